@@ -18,6 +18,7 @@
 package v2
 
 import (
+	"context"
 	"io"
 	"net"
 	"sync"
@@ -34,6 +35,9 @@ type AsyncClient struct {
 	inflight int
 	ch       chan ackMessage
 	wg       sync.WaitGroup
+
+	// batches sent, callback not yet called
+	tracker batchTracker
 }
 
 type ackMessage struct {
@@ -51,6 +55,13 @@ type ackMessage struct {
 // Send.
 type AsyncSendCallback func(seq uint32, err error)
 
+// Future reports completion of a batch published via SendFuture.
+type Future struct {
+	done chan struct{}
+	seq  uint32
+	err  error
+}
+
 // NewAsyncClientWith creates a new AsyncClient from low-level lumberjack v2 Client.
 // The inflight argument sets number of active publish requests.
 func NewAsyncClientWith(cl *Client, inflight int) (*AsyncClient, error) {
@@ -82,6 +93,16 @@ func AsyncDial(address string, inflight int, opts ...Option) (*AsyncClient, erro
 	return NewAsyncClientWith(cl, inflight)
 }
 
+// AsyncDialContext connects to lumberjack server like AsyncDial. Cancelling ctx
+// aborts connecting.
+func AsyncDialContext(ctx context.Context, address string, inflight int, opts ...Option) (*AsyncClient, error) {
+	cl, err := DialContext(ctx, address, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewAsyncClientWith(cl, inflight)
+}
+
 // AsyncDialWith uses provided dialer to connect to lumberjack server. On error
 // no AsyncClient is being returned.
 func AsyncDialWith(
@@ -116,7 +137,75 @@ func (c *AsyncClient) Close() error {
 // Send blocks if maximum number of allowed asynchrounous calls is still active.
 // Upon completion cb will be called with last ACKed index into active batch.
 // Returns error if communication or serialization to JSON failed.
+//
+// If MaxBatchEvents is configured, the batch is sent in multiple windows in
+// order, each window taking one in-flight slot. The callback is called once,
+// after all windows have been ACKed or with the number of events ACKed so far
+// on error.
 func (c *AsyncClient) Send(cb AsyncSendCallback, data []interface{}) error {
+	c.tracker.add(1)
+	cb = c.track(cb)
+
+	window := c.cl.opts.maxBatchEvents
+	if window <= 0 || len(data) <= window {
+		return c.sendWindow(cb, data)
+	}
+
+	split := &splitCallback{cb: cb, total: len(data)}
+	for off := 0; off < len(data); off += window {
+		end := off + window
+		if end > len(data) {
+			end = len(data)
+		}
+
+		if err := c.sendWindow(split.window(off), data[off:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// track wraps cb, marking the batch as complete once cb returns.
+func (c *AsyncClient) track(cb AsyncSendCallback) AsyncSendCallback {
+	return func(seq uint32, err error) {
+		cb(seq, err)
+		c.tracker.done(err)
+	}
+}
+
+// Flush blocks until all batches passed to Send before have been ACKed and
+// their callbacks have returned, or ctx is done. Flush returns a *FlushError
+// with the number of batches not ACKed, if ctx is done first, or if batches
+// failed since the previous call to Flush. Flush must not be called from a
+// callback.
+func (c *AsyncClient) Flush(ctx context.Context) error {
+	return c.tracker.wait(ctx, nil, nil)
+}
+
+// splitCallback combines the ACKs of the windows a batch has been split into,
+// calling cb once.
+type splitCallback struct {
+	cb    AsyncSendCallback
+	total int
+	done  bool // accessed by ackLoop only
+}
+
+// window returns the callback for the window starting at event off.
+func (s *splitCallback) window(off int) AsyncSendCallback {
+	return func(seq uint32, err error) {
+		if s.done {
+			return
+		}
+
+		acked := uint32(off) + seq
+		if err != nil || int(acked) == s.total {
+			s.done = true
+			s.cb(acked, err)
+		}
+	}
+}
+
+func (c *AsyncClient) sendWindow(cb AsyncSendCallback, data []interface{}) error {
 	if err := c.cl.Send(data); err != nil {
 		c.ch <- ackMessage{
 			seq: 0,
@@ -134,6 +223,29 @@ func (c *AsyncClient) Send(cb AsyncSendCallback, data []interface{}) error {
 	return nil
 }
 
+// SendFuture publishes a new batch of events like Send, returning a Future
+// being completed once the batch has been ACKed or publishing failed.
+func (c *AsyncClient) SendFuture(data []interface{}) (*Future, error) {
+	f := &Future{done: make(chan struct{})}
+	err := c.Send(func(seq uint32, err error) {
+		f.seq, f.err = seq, err
+		close(f.done)
+	}, data)
+	return f, err
+}
+
+// Done returns a channel being closed once the batch is complete.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait blocks until the batch is complete. It returns the last ACKed event's
+// index and the error encountered, as passed to AsyncSendCallback.
+func (f *Future) Wait() (uint32, error) {
+	<-f.done
+	return f.seq, f.err
+}
+
 func (c *AsyncClient) startACK() {
 	c.ch = make(chan ackMessage, c.inflight)
 	c.wg.Add(1)
@@ -149,6 +261,10 @@ func (c *AsyncClient) ackLoop() {
 	var seq uint32
 	var err error
 
+	// events ACKed by merged ACKs beyond the current window, if CumulativeACK
+	// is enabled
+	var carry uint32
+
 	// drain ack queue on error/exit
 	defer func() {
 		if err == nil {
@@ -170,7 +286,11 @@ func (c *AsyncClient) ackLoop() {
 			return
 		}
 
-		seq, err = c.cl.AwaitACK(msg.seq)
+		if c.cl.opts.cumulativeACK {
+			seq, err = c.awaitCumulativeACK(msg.seq, &carry)
+		} else {
+			seq, err = c.cl.AwaitACK(msg.seq)
+		}
 		msg.cb(seq, err)
 		if err != nil {
 			c.cl.Close()
@@ -178,3 +298,21 @@ func (c *AsyncClient) ackLoop() {
 		}
 	}
 }
+
+// awaitCumulativeACK waits for count events being ACKed, with every ACK
+// counting the events ACKed since the previous ACK. Events ACKed in excess of
+// count are carried over to the next window.
+func (c *AsyncClient) awaitCumulativeACK(count uint32, carry *uint32) (uint32, error) {
+	for *carry < count {
+		seq, err := c.cl.ReceiveACK()
+		if err != nil {
+			acked := *carry
+			*carry = 0
+			return acked, err
+		}
+		*carry += seq
+	}
+
+	*carry -= count
+	return count, nil
+}
@@ -0,0 +1,356 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v2
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	server "github.com/elastic/go-lumber/server/v2"
+)
+
+// fakeServer reads uncompressed windows from a client connection, passing the
+// window size to the test for replying with custom ACKs.
+type fakeServer struct {
+	conn    net.Conn
+	windows chan int
+}
+
+func newFakeServer(t *testing.T) (*fakeServer, net.Conn) {
+	srv, cl := net.Pipe()
+	t.Cleanup(func() { srv.Close(); cl.Close() })
+
+	s := &fakeServer{conn: srv, windows: make(chan int, 16)}
+	go s.run()
+	return s, cl
+}
+
+func (s *fakeServer) run() {
+	defer close(s.windows)
+	for {
+		count, err := readWindow(s.conn)
+		if err != nil {
+			return
+		}
+		s.windows <- count
+	}
+}
+
+func (s *fakeServer) ack(t *testing.T, seq uint32) {
+	if err := writeACK(s.conn, seq); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readWindow reads an uncompressed window, returning the number of events.
+func readWindow(r io.Reader) (int, error) {
+	var hdr [6]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, err
+	}
+	count := int(binary.BigEndian.Uint32(hdr[2:]))
+	for i := 0; i < count; i++ {
+		var frame [10]byte
+		if _, err := io.ReadFull(r, frame[:]); err != nil {
+			return 0, err
+		}
+		payload := int64(binary.BigEndian.Uint32(frame[6:]))
+		if _, err := io.CopyN(io.Discard, r, payload); err != nil {
+			return 0, err
+		}
+	}
+	return count, nil
+}
+
+func writeACK(w io.Writer, seq uint32) error {
+	msg := []byte{'2', 'A', 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(msg[2:], seq)
+	_, err := w.Write(msg)
+	return err
+}
+
+func (s *fakeServer) window(t *testing.T) int {
+	select {
+	case n := <-s.windows:
+		return n
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for window")
+		return 0
+	}
+}
+
+func waitFuture(t *testing.T, f *Future) (uint32, error) {
+	select {
+	case <-f.Done():
+		return f.Wait()
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for future")
+		return 0, nil
+	}
+}
+
+func TestAsyncClientPipeline(t *testing.T) {
+	const depth = 4
+
+	s, conn := newFakeServer(t)
+	c, err := NewAsyncClientWithConn(conn, depth, Timeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// all windows are sent before the first ACK is received
+	futures := make([]*Future, depth)
+	for i := range futures {
+		if futures[i], err = c.SendFuture([]interface{}{i, i}); err != nil {
+			t.Fatal(err)
+		}
+		if n := s.window(t); n != 2 {
+			t.Fatalf("unexpected window size %v", n)
+		}
+	}
+	for _, f := range futures {
+		select {
+		case <-f.Done():
+			t.Fatal("future completed before ACK")
+		default:
+		}
+	}
+
+	// partial ACKs are combined, completing futures in order
+	for i, f := range futures {
+		s.ack(t, 1)
+		s.ack(t, 2)
+		if seq, err := waitFuture(t, f); err != nil || seq != 2 {
+			t.Errorf("future %v: seq=%v, err=%v", i, seq, err)
+		}
+	}
+}
+
+func TestAsyncClientInvalidACK(t *testing.T) {
+	s, conn := newFakeServer(t)
+	c, err := NewAsyncClientWithConn(conn, 3, Timeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	first, _ := c.SendFuture([]interface{}{1})
+	second, _ := c.SendFuture([]interface{}{2})
+	s.window(t)
+	s.window(t)
+
+	// sequence number of the second window ACKing the first
+	s.ack(t, 2)
+	if _, err := waitFuture(t, first); err == nil {
+		t.Error("expected error for ACK exceeding window size")
+	}
+	if _, err := waitFuture(t, second); err == nil {
+		t.Error("expected outstanding future to fail after protocol error")
+	}
+}
+
+func TestAsyncClientConnectionLoss(t *testing.T) {
+	s, conn := newFakeServer(t)
+	c, err := NewAsyncClientWithConn(conn, 3, Timeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var futures []*Future
+	for i := 0; i < 3; i++ {
+		f, err := c.SendFuture([]interface{}{i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.window(t)
+		futures = append(futures, f)
+	}
+
+	s.ack(t, 1)
+	s.conn.Close()
+
+	if seq, err := waitFuture(t, futures[0]); err != nil || seq != 1 {
+		t.Errorf("expected first batch to be ACKed, got seq=%v, err=%v", seq, err)
+	}
+	for _, f := range futures[1:] {
+		if _, err := waitFuture(t, f); err == nil {
+			t.Error("expected outstanding future to fail on connection loss")
+		}
+	}
+}
+
+func TestAsyncClientMaxBatchEvents(t *testing.T) {
+	s, conn := newFakeServer(t)
+	c, err := NewAsyncClientWithConn(conn, 4, Timeout(5*time.Second), MaxBatchEvents(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	f, err := c.SendFuture([]interface{}{1, 2, 3, 4, 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []int{2, 2, 1} {
+		if n := s.window(t); n != want {
+			t.Fatalf("expected window of %v events, got %v", want, n)
+		}
+	}
+
+	s.ack(t, 2)
+	s.ack(t, 2)
+	select {
+	case <-f.Done():
+		t.Fatal("future completed before all windows have been ACKed")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	s.ack(t, 1)
+	if seq, err := waitFuture(t, f); err != nil || seq != 5 {
+		t.Errorf("expected all events to be ACKed, got seq=%v, err=%v", seq, err)
+	}
+}
+
+func TestAsyncClientMaxBatchEventsPartial(t *testing.T) {
+	s, conn := newFakeServer(t)
+	c, err := NewAsyncClientWithConn(conn, 4, Timeout(5*time.Second), MaxBatchEvents(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	f, _ := c.SendFuture([]interface{}{1, 2, 3, 4, 5})
+	for i := 0; i < 3; i++ {
+		s.window(t)
+	}
+
+	s.ack(t, 2)
+	s.ack(t, 1)
+	s.conn.Close()
+	if seq, err := waitFuture(t, f); err == nil || seq != 3 {
+		t.Errorf("expected 3 events ACKed with error, got seq=%v, err=%v", seq, err)
+	}
+}
+
+func TestAsyncClientServer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := server.NewWithListener(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	c, err := AsyncDial(l.Addr().String(), 2, MaxBatchEvents(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	f, err := c.SendFuture([]interface{}{1, 2, 3, 4, 5, 6, 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var events []interface{}
+	for len(events) < 7 {
+		b := s.Receive()
+		events = append(events, b.Events...)
+		b.ACK()
+	}
+	if seq, err := waitFuture(t, f); err != nil || seq != 7 {
+		t.Errorf("seq=%v, err=%v", seq, err)
+	}
+	for i, e := range events {
+		if e != float64(i+1) {
+			t.Fatalf("events out of order: %v", events)
+		}
+	}
+}
+
+func TestAsyncClientFlush(t *testing.T) {
+	s, conn := newFakeServer(t)
+	c, err := NewAsyncClientWithConn(conn, 3, Timeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Flush(context.Background()); err != nil {
+		t.Fatalf("expected flush without batches to succeed, got %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := c.Send(func(uint32, error) {}, []interface{}{i}); err != nil {
+			t.Fatal(err)
+		}
+		s.window(t)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	var flushErr *FlushError
+	if err := c.Flush(ctx); !errors.As(err, &flushErr) || flushErr.Unacked != 2 ||
+		!errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected flush to time out with 2 batches not ACKed, got %v", err)
+	}
+
+	s.ack(t, 1)
+	s.ack(t, 1)
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Flush(ctx); err != nil {
+		t.Errorf("expected flush to succeed after ACK, got %v", err)
+	}
+}
+
+func TestAsyncClientFlushFailed(t *testing.T) {
+	s, conn := newFakeServer(t)
+	c, err := NewAsyncClientWithConn(conn, 3, Timeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := c.Send(func(uint32, error) {}, []interface{}{i}); err != nil {
+			t.Fatal(err)
+		}
+		s.window(t)
+	}
+	s.conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var flushErr *FlushError
+	if err := c.Flush(ctx); !errors.As(err, &flushErr) || flushErr.Unacked != 2 {
+		t.Fatalf("expected flush to report 2 failed batches, got %v", err)
+	}
+	if err := c.Flush(ctx); err != nil {
+		t.Errorf("expected failures to be reported once, got %v", err)
+	}
+}
@@ -18,43 +18,33 @@
 package v2
 
 import (
-	"encoding/binary"
-	"net"
+	"context"
+	"math/rand"
 	"time"
-
-	protocol "github.com/elastic/go-lumber/protocol/v2"
 )
 
-type writer struct {
-	c  net.Conn
-	to time.Duration
-}
-
-func newWriter(c net.Conn, to time.Duration) *writer {
-	return &writer{c: c, to: to}
-}
-
-func (w *writer) ACK(n int) error {
-	var buf [6]byte
-	buf[0] = protocol.CodeVersion
-	buf[1] = protocol.CodeACK
-	binary.BigEndian.PutUint32(buf[2:], uint32(n))
-
-	if err := w.c.SetWriteDeadline(time.Now().Add(w.to)); err != nil {
-		return err
+// backoff returns a random duration between 0 and the exponential backoff
+// duration for the given retry, starting at init up to max.
+func backoff(init, max time.Duration, retry int) time.Duration {
+	d := init
+	for i := 0; i < retry && d < max; i++ {
+		d *= 2
 	}
-
-	tmp := buf[:]
-	for len(tmp) > 0 {
-		n, err := w.c.Write(tmp)
-		if err != nil {
-			return err
-		}
-		tmp = tmp[n:]
+	if d > max {
+		d = max
 	}
-	return nil
+	return time.Duration(rand.Int63n(int64(d) + 1))
 }
 
-func (w *writer) Keepalive(n int) error {
-	return w.ACK(n)
+// sleepContext sleeps for d or until ctx is cancelled.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
 }
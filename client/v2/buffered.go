@@ -0,0 +1,413 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// BufferedClient publishes batches in the background, buffering batches until
+// they have been ACKed. Send queues a batch without waiting for the server, so
+// publishing proceeds while the server is briefly unreachable. Batches are
+// buffered in memory up to BufferLimit events. If SpillDir is configured,
+// batches exceeding the limit are written to the spill directory and sent
+// from there once the connection recovers. Spilled batches left by a previous
+// process, e.g. after a crash, are sent first.
+//
+// Delivery is at-least-once. Batches are removed from the buffer only after
+// being ACKed. Events of a batch not yet ACKed are resent after reconnecting,
+// and spilled batches are resent in full after a restart, so the server might
+// receive events more than once. Batches only buffered in memory are lost if
+// the process crashes; Close spills them if SpillDir is configured.
+//
+// Batches are sent one at a time, in the order Send has been called, with
+// spilled batches of previous processes first. Batches spilled by Close keep
+// their position, such that the next client sends them before batches it
+// spills itself. Ordering only holds for events delivered once: events resent
+// after a failure follow events of the same batch received already. A spill
+// directory must not be used by more than one client at a time.
+//
+// Events are encoded by the JSONEncoder when passed to Send, and sent as
+// json.RawMessage. Custom encoders must encode json.RawMessage as is, like
+// json.Marshal does.
+//
+// BufferedClient always reconnects, with the backoff configured via Backoff,
+// or between 100ms and 10s by default. MaxRetries is ignored. The client is
+// thread-safe.
+type BufferedClient struct {
+	opts options
+	dial func(ctx context.Context) (*Client, error)
+
+	mu        sync.Mutex
+	mem       []*bufferedBatch // batches buffered in memory, in send order
+	memEvents int
+	spill     *spillDir      // nil if spilling is disabled
+	spillHead *bufferedBatch // oldest spilled batch, once loaded
+	nextID    uint64
+	conn      *SyncClient // nil if not connected
+	closed    bool
+
+	// batches buffered, including spilled batches
+	tracker batchTracker
+
+	wake   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// bufferedBatch is a batch not yet ACKed. Batches are sent in id order.
+type bufferedBatch struct {
+	id      uint64
+	events  []interface{}
+	acked   int  // number of events ACKed, if the batch has been sent partially
+	spilled bool // batch is stored in the spill directory
+}
+
+var (
+	// ErrBufferFull is returned by BufferedClient.Send if the batch exceeds the
+	// BufferLimit and no SpillDir is configured.
+	ErrBufferFull = errors.New("client buffer full")
+
+	// ErrClientClosed is returned by BufferedClient.Send after Close.
+	ErrClientClosed = errors.New("client closed")
+)
+
+// BufferedDial creates a BufferedClient publishing to the lumberjack server at
+// address. The connection is established in the background, such that
+// BufferedDial does not fail if the server is unreachable.
+func BufferedDial(address string, opts ...Option) (*BufferedClient, error) {
+	return newBufferedClient(opts, func(ctx context.Context) (*Client, error) {
+		return DialContext(ctx, address, opts...)
+	})
+}
+
+// BufferedDialWith creates a BufferedClient like BufferedDial, using dial to
+// connect to the lumberjack server.
+func BufferedDialWith(
+	dial func(network, address string) (net.Conn, error),
+	address string,
+	opts ...Option,
+) (*BufferedClient, error) {
+	return newBufferedClient(opts, func(context.Context) (*Client, error) {
+		return DialWith(dial, address, opts...)
+	})
+}
+
+func newBufferedClient(
+	opts []Option,
+	dial func(ctx context.Context) (*Client, error),
+) (*BufferedClient, error) {
+	o, err := applyOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if o.backoffInit <= 0 {
+		o.backoffInit, o.backoffMax = 100*time.Millisecond, 10*time.Second
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &BufferedClient{
+		opts:   o,
+		dial:   dial,
+		wake:   make(chan struct{}, 1),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	if o.spillDir != "" {
+		spill, err := openSpillDir(o.spillDir)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		c.spill = spill
+		c.nextID = spill.nextID()
+		c.tracker.add(len(spill.ids))
+		c.wake <- struct{}{} // send batches of previous clients
+	}
+
+	c.wg.Add(1)
+	go c.sendLoop()
+	return c, nil
+}
+
+// Close stops publishing and closes the connection. Batches still buffered in
+// memory are written to the spill directory, if configured, to be sent by the
+// next client using the directory. Without spill directory, batches not yet
+// ACKed are dropped. Calling Close more than once is a no-op.
+func (c *BufferedClient) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	conn := c.conn
+	c.mu.Unlock()
+
+	// interrupt waiting for an ACK
+	c.cancel()
+	if conn != nil {
+		_ = conn.Close()
+	}
+	c.wg.Wait()
+
+	var err error
+	if c.spill != nil {
+		for _, b := range c.mem {
+			if e := c.spill.write(b.id, b.events[b.acked:], c.opts.encoder); e != nil {
+				err = e
+			}
+		}
+	}
+	c.mem, c.memEvents = nil, 0
+	return err
+}
+
+// Send queues a batch of events for publishing. Send does not wait for the
+// batch to be ACKed, but returns encoding errors right away. Events of
+// key-value data frames must not be modified after Send returns. If the batch
+// exceeds BufferLimit, it is spilled to disk if SpillDir is configured, or
+// rejected with ErrBufferFull.
+func (c *BufferedClient) Send(data []interface{}) error {
+	if len(data) == 0 {
+		return nil
+	}
+	data, err := c.encode(data)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClientClosed
+	}
+
+	id := c.nextID
+	switch {
+	case c.memEvents+len(data) <= c.opts.bufferLimit:
+		c.mem = append(c.mem, &bufferedBatch{id: id, events: data})
+		c.memEvents += len(data)
+	case c.spill != nil:
+		if err := c.spill.write(id, data, c.opts.encoder); err != nil {
+			return err
+		}
+	default:
+		return ErrBufferFull
+	}
+	c.nextID++
+	c.tracker.add(1)
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Flush blocks until all batches buffered have been ACKed, including batches
+// spilled by previous clients, or ctx is done. Flush returns a *FlushError with
+// the number of batches not ACKed, if ctx is done or the client is closed
+// first, or if spilled batches have been discarded for being corrupt since the
+// previous call to Flush. Call Flush before Close for sending all batches
+// before shutting down.
+func (c *BufferedClient) Flush(ctx context.Context) error {
+	return c.tracker.wait(ctx, c.ctx.Done(), ErrClientClosed)
+}
+
+// encode prepares events for buffering. JSON events are encoded right away,
+// such that encoding errors do not fail sending the batch in the background.
+func (c *BufferedClient) encode(data []interface{}) ([]interface{}, error) {
+	events := make([]interface{}, len(data))
+	for i, d := range data {
+		if c.opts.dataFrames == KeyValue {
+			if _, ok := d.(map[string]string); !ok {
+				return nil, fmt.Errorf("%w (event %v is %T)", ErrNotKeyValue, i, d)
+			}
+			events[i] = d
+			continue
+		}
+
+		raw, err := c.opts.encoder(d)
+		if err != nil {
+			return nil, err
+		}
+		events[i] = json.RawMessage(raw)
+	}
+	return events, nil
+}
+
+// Buffered returns the number of batches not yet ACKed, including spilled
+// batches.
+func (c *BufferedClient) Buffered() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(c.mem)
+	if c.spill != nil {
+		n += len(c.spill.ids)
+	}
+	return n
+}
+
+func (c *BufferedClient) sendLoop() {
+	defer c.wg.Done()
+
+	retry := 0
+	for {
+		b := c.next()
+		if b == nil {
+			return // client closed
+		}
+
+		if err := c.send(b); err != nil {
+			d := backoff(c.opts.backoffInit, c.opts.backoffMax, retry)
+			retry++
+			if err := sleepContext(c.ctx, d); err != nil {
+				return
+			}
+			continue
+		}
+		retry = 0
+		c.remove(b)
+	}
+}
+
+// next waits for the oldest batch not yet ACKed. Returns nil once the client
+// is closed.
+func (c *BufferedClient) next() *bufferedBatch {
+	for {
+		c.mu.Lock()
+		b := c.peek()
+		c.mu.Unlock()
+		if b != nil {
+			return b
+		}
+
+		select {
+		case <-c.wake:
+		case <-c.ctx.Done():
+			return nil
+		}
+	}
+}
+
+// peek returns the oldest batch, comparing the oldest batch buffered in memory
+// with the oldest spilled batch. Spilled batches failing to load are
+// discarded.
+func (c *BufferedClient) peek() *bufferedBatch {
+	var mem *bufferedBatch
+	if len(c.mem) > 0 {
+		mem = c.mem[0]
+	}
+	if c.spill == nil {
+		return mem
+	}
+
+	for len(c.spill.ids) > 0 {
+		id := c.spill.ids[0]
+		if mem != nil && mem.id < id {
+			return mem
+		}
+		if c.spillHead != nil && c.spillHead.id == id {
+			return c.spillHead
+		}
+
+		events, err := c.spill.read(id, c.opts.dataFrames == KeyValue)
+		if err != nil {
+			_ = c.spill.discard()
+			c.tracker.done(err)
+			continue
+		}
+		c.spillHead = &bufferedBatch{id: id, events: events, spilled: true}
+		return c.spillHead
+	}
+	return mem
+}
+
+// remove drops batch b from the buffer, once it has been ACKed.
+func (c *BufferedClient) remove(b *bufferedBatch) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.tracker.done(nil)
+	if b.spilled {
+		_ = c.spill.remove()
+		c.spillHead = nil
+		return
+	}
+	c.mem[0] = nil
+	c.mem = c.mem[1:]
+	c.memEvents -= len(b.events)
+}
+
+// send publishes the events of b not yet ACKed, connecting first if required.
+func (c *BufferedClient) send(b *bufferedBatch) error {
+	conn, err := c.connect()
+	if err != nil {
+		return err
+	}
+
+	n, err := conn.SendContext(c.ctx, b.events[b.acked:])
+	b.acked += n
+	if err != nil {
+		c.disconnect()
+		return err
+	}
+	return nil
+}
+
+func (c *BufferedClient) connect() (*SyncClient, error) {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+
+	cl, err := c.dial(c.ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, _ = NewSyncClientWith(cl)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		_ = conn.Close()
+		return nil, ErrClientClosed
+	}
+	c.conn = conn
+	return conn, nil
+}
+
+func (c *BufferedClient) disconnect() {
+	c.mu.Lock()
+	conn := c.conn
+	c.conn = nil
+	c.mu.Unlock()
+	if conn != nil {
+		_ = conn.Close()
+	}
+}
@@ -0,0 +1,246 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gatedDialer fails dialing until opened.
+type gatedDialer struct {
+	mu   sync.Mutex
+	open bool
+}
+
+func (d *gatedDialer) dial(network, address string) (net.Conn, error) {
+	d.mu.Lock()
+	open := d.open
+	d.mu.Unlock()
+	if !open {
+		return nil, errors.New("server unreachable")
+	}
+	return net.Dial(network, address)
+}
+
+func (d *gatedDialer) setOpen() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.open = true
+}
+
+func spillFiles(t *testing.T, dir, suffix string) int {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+suffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(files)
+}
+
+func waitFlushed(t *testing.T, c *BufferedClient) {
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Buffered() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %v batches to be ACKed", c.Buffered())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestBufferedClientSpillReplay(t *testing.T) {
+	s, recv := startACKServer(t)
+	dir := t.TempDir()
+
+	d := &gatedDialer{}
+	c, err := BufferedDialWith(d.dial, s.addr,
+		BufferLimit(1), SpillDir(dir), Backoff(time.Millisecond, 10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := c.Send([]interface{}{i, i}); err != nil {
+			t.Fatalf("send %v failed: %v", i, err)
+		}
+	}
+	if err := c.Send([]interface{}{"mem"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := spillFiles(t, dir, spillSuffix); n != 3 {
+		t.Fatalf("expected 3 spill files, got %v", n)
+	}
+	if n := c.Buffered(); n != 4 {
+		t.Fatalf("expected 4 batches buffered, got %v", n)
+	}
+
+	d.setOpen()
+	waitFlushed(t, c)
+	if n := countReceived(recv); n != 7 {
+		t.Errorf("expected 7 events, got %v", n)
+	}
+	if n := spillFiles(t, dir, spillSuffix); n != 0 {
+		t.Errorf("expected spill files to be removed, got %v", n)
+	}
+}
+
+func TestBufferedClientRecovery(t *testing.T) {
+	s, recv := startACKServer(t)
+	dir := t.TempDir()
+
+	// first client never connects, spilling its batches on Close
+	d := &gatedDialer{}
+	c, err := BufferedDialWith(d.dial, s.addr, BufferLimit(2), SpillDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, batch := range [][]interface{}{{1}, {2, 3}, {4}} {
+		if err := c.Send(batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := spillFiles(t, dir, spillSuffix); n != 3 {
+		t.Fatalf("expected 3 spill files after close, got %v", n)
+	}
+	if err := c.Send([]interface{}{5}); err != ErrClientClosed {
+		t.Errorf("expected ErrClientClosed, got %v", err)
+	}
+
+	// simulate a crash while writing a spill file
+	if err := os.WriteFile(filepath.Join(dir, "x"+tmpSuffix), []byte("LJ"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = BufferedDial(s.addr, SpillDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Send([]interface{}{5}); err != nil {
+		t.Fatal(err)
+	}
+	waitFlushed(t, c)
+	if n := countReceived(recv); n != 5 {
+		t.Errorf("expected 5 events, got %v", n)
+	}
+	if n := spillFiles(t, dir, ""); n != 0 {
+		t.Errorf("expected spill directory to be empty, got %v files", n)
+	}
+}
+
+func TestBufferedClientCorruptSpill(t *testing.T) {
+	s, recv := startACKServer(t)
+	dir := t.TempDir()
+
+	spill, err := openSpillDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := spill.write(0, []interface{}{1, 2}, json.Marshal); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(spill.file(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(spill.file(0), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := BufferedDial(s.addr, SpillDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Send([]interface{}{3}); err != nil {
+		t.Fatal(err)
+	}
+	waitFlushed(t, c)
+	if n := countReceived(recv); n != 1 {
+		t.Errorf("expected 1 event, got %v", n)
+	}
+	if n := spillFiles(t, dir, corruptSuffix); n != 1 {
+		t.Errorf("expected corrupt spill file to be kept, got %v", n)
+	}
+}
+
+func TestBufferedClientBufferFull(t *testing.T) {
+	d := &gatedDialer{}
+	c, err := BufferedDialWith(d.dial, "127.0.0.1:1", BufferLimit(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Send([]interface{}{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Send([]interface{}{3}); err != ErrBufferFull {
+		t.Errorf("expected ErrBufferFull, got %v", err)
+	}
+	if err := c.Send([]interface{}{make(chan int)}); err == nil {
+		t.Error("expected encoding error")
+	}
+	if n := c.Buffered(); n != 1 {
+		t.Errorf("expected 1 batch buffered, got %v", n)
+	}
+}
+
+func TestBufferedClientFlush(t *testing.T) {
+	s, recv := startACKServer(t)
+
+	d := &gatedDialer{}
+	c, err := BufferedDialWith(d.dial, s.addr, Backoff(time.Millisecond, 10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := c.Send([]interface{}{i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	var flushErr *FlushError
+	if err := c.Flush(ctx); !errors.As(err, &flushErr) || flushErr.Unacked != 2 {
+		t.Fatalf("expected flush to time out with 2 batches buffered, got %v", err)
+	}
+
+	d.setOpen()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Flush(ctx); err != nil {
+		t.Fatalf("expected flush to succeed, got %v", err)
+	}
+	if n := countReceived(recv); n != 2 {
+		t.Errorf("expected 2 events, got %v", n)
+	}
+}
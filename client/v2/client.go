@@ -19,6 +19,8 @@ package v2
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -36,6 +38,13 @@ import (
 type Client struct {
 	conn net.Conn
 	wb   *bytes.Buffer
+	cb   *bytes.Buffer // compression buffer used with compression threshold
+
+	// stream compressor if stream compression has been negotiated
+	zw *zlib.Writer
+
+	// encoder of key-value data frames
+	enc protocol.Encoder
 
 	opts options
 }
@@ -44,6 +53,7 @@ var (
 	codeWindowSize    = []byte{protocol.CodeVersion, protocol.CodeWindowSize}
 	codeCompressed    = []byte{protocol.CodeVersion, protocol.CodeCompressed}
 	codeJSONDataFrame = []byte{protocol.CodeVersion, protocol.CodeJSONDataFrame}
+	codeStream        = []byte{protocol.CodeVersion, protocol.CodeCompressStream}
 
 	empty4 = []byte{0, 0, 0, 0}
 )
@@ -52,32 +62,93 @@ var (
 	// ErrProtocolError is returned if an protocol error was detected in the
 	// conversation with lumberjack server.
 	ErrProtocolError = errors.New("lumberjack protocol error")
+
+	// ErrTooManyRetries is returned by SyncClient if reconnecting failed
+	// MaxRetries times in a row.
+	ErrTooManyRetries = errors.New("too many failed reconnect attempts")
+
+	// ErrNotKeyValue is returned by Send if key-value data frames are
+	// configured and an event is not of type map[string]string.
+	ErrNotKeyValue = errors.New("event not of type map[string]string")
+
+	errNotConnected = errors.New("client not connected")
 )
 
+// OpError is returned if connecting or writing to the lumberjack server
+// fails. Op names the failing phase, one of "dial", "handshake" or "write".
+type OpError struct {
+	Op  string
+	Err error
+}
+
+func (e *OpError) Error() string {
+	return "lumberjack " + e.Op + ": " + e.Err.Error()
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout returns true if the operation failed due to a timeout.
+func (e *OpError) Timeout() bool {
+	if errors.Is(e.Err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(e.Err, &netErr) && netErr.Timeout()
+}
+
 // NewWithConn create a new lumberjack client with an existing and active
-// connection.
+// connection. If c is a TLS connection not yet having completed the handshake,
+// the handshake is run bound by DialTimeout.
 func NewWithConn(c net.Conn, opts ...Option) (*Client, error) {
 	o, err := applyOptions(opts)
 	if err != nil {
 		return nil, err
 	}
-	return &Client{
+	return newClient(context.Background(), c, o)
+}
+
+func newClient(ctx context.Context, c net.Conn, o options) (*Client, error) {
+	if tc, ok := c.(*tls.Conn); ok && !tc.ConnectionState().HandshakeComplete {
+		ctx, cancel := context.WithTimeout(ctx, o.dialTimeout)
+		defer cancel()
+		if err := tc.HandshakeContext(ctx); err != nil {
+			return nil, &OpError{Op: "handshake", Err: err}
+		}
+	}
+
+	client := &Client{
 		conn: c,
 		wb:   bytes.NewBuffer(nil),
 		opts: o,
-	}, nil
+	}
+	if o.streamCompressLvl != zlib.NoCompression {
+		if err := client.startStreamCompression(); err != nil {
+			return nil, err
+		}
+	}
+	return client, nil
 }
 
 // Dial connects to the lumberjack server and returns new Client.
 // Returns an error if connection attempt fails.
 func Dial(address string, opts ...Option) (*Client, error) {
+	return DialContext(context.Background(), address, opts...)
+}
+
+// DialContext connects to the lumberjack server like Dial. Cancelling ctx
+// aborts connecting and the TLS handshake.
+func DialContext(ctx context.Context, address string, opts ...Option) (*Client, error) {
 	o, err := applyOptions(opts)
 	if err != nil {
 		return nil, err
 	}
 
-	dialer := net.Dialer{Timeout: o.timeout}
-	return DialWith(dialer.Dial, address, opts...)
+	dialer := net.Dialer{Timeout: o.dialTimeout}
+	return dialClient(ctx, func(network, address string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, address)
+	}, address, o)
 }
 
 // DialWith uses provided dialer to connect to lumberjack server returning a
@@ -87,12 +158,45 @@ func DialWith(
 	address string,
 	opts ...Option,
 ) (*Client, error) {
-	c, err := dial("tcp", address)
+	o, err := applyOptions(opts)
 	if err != nil {
 		return nil, err
 	}
+	return dialClient(context.Background(), dial, address, o)
+}
+
+func dialClient(
+	ctx context.Context,
+	dial func(network, address string) (net.Conn, error),
+	address string,
+	o options,
+) (*Client, error) {
+	c, err := dial("tcp", address)
+	if err != nil {
+		return nil, &OpError{Op: "dial", Err: err}
+	}
 
-	client, err := NewWithConn(c, opts...)
+	if o.tls != nil {
+		config := o.tls
+		if config.ServerName == "" || len(o.certPins) > 0 {
+			config = config.Clone()
+		}
+		if config.ServerName == "" {
+			if host, _, err := net.SplitHostPort(address); err == nil {
+				config.ServerName = host
+			} else {
+				config.ServerName = address
+			}
+		}
+		if len(o.certPins) > 0 {
+			// VerifyConnection is run on resumed sessions too, unlike
+			// VerifyPeerCertificate
+			config.VerifyConnection = verifyPins(o.certPins, config.VerifyConnection)
+		}
+		c = tls.Client(c, config)
+	}
+
+	client, err := newClient(ctx, c, o)
 	if err != nil {
 		_ = c.Close() // ignore error
 		return nil, err
@@ -118,47 +222,95 @@ func (c *Client) Send(data []interface{}) error {
 	writeUint32(c.wb, uint32(len(data)))
 
 	// 2. serialize data (payload)
-	if c.opts.compressLvl > 0 {
-		// Compressed Data Frame:
-		// version: uint8 = '2'
-		// code: uint8 = 'C'
-		// payloadSz: uint32
-		// payload: compressed payload
-
-		_, _ = c.wb.Write(codeCompressed) // write compressed header
-
-		offSz := c.wb.Len()
-		_, _ = c.wb.Write(empty4)
-		offPayload := c.wb.Len()
-
-		// compress payload
-		w, err := zlib.NewWriterLevel(c.wb, c.opts.compressLvl)
+	if c.opts.compressLvl != zlib.NoCompression && c.opts.compressThreshold == 0 {
+		err := c.compress(c.wb, func(w io.Writer) error {
+			return c.serialize(w, data)
+		})
 		if err != nil {
 			return err
 		}
-
-		if err := c.serialize(w, data); err != nil {
+	} else {
+		offData := c.wb.Len()
+		if err := c.serialize(c.wb, data); err != nil {
 			return err
 		}
 
-		if err := w.Close(); err != nil {
-			return err
+		// compress serialized data frames if threshold is exceeded
+		dataSz := c.wb.Len() - offData
+		if c.opts.compressLvl != zlib.NoCompression && dataSz >= c.opts.compressThreshold {
+			if c.cb == nil {
+				c.cb = bytes.NewBuffer(nil)
+			}
+			c.cb.Reset()
+			err := c.compress(c.cb, func(w io.Writer) error {
+				_, err := w.Write(c.wb.Bytes()[offData:])
+				return err
+			})
+			if err != nil {
+				return err
+			}
+
+			c.wb.Truncate(offData)
+			_, _ = c.wb.Write(c.cb.Bytes())
 		}
+	}
 
-		// write compress header
-		payloadSz := c.wb.Len() - offPayload
-		binary.BigEndian.PutUint32(c.wb.Bytes()[offSz:], uint32(payloadSz))
-	} else {
-		if err := c.serialize(c.wb, data); err != nil {
+	// 3. send buffer
+	if err := c.send(c.wb.Bytes()); err != nil {
+		return &OpError{Op: "write", Err: err}
+	}
+	return nil
+}
+
+func (c *Client) send(payload []byte) error {
+	if err := c.setWriteDeadline(); err != nil {
+		return err
+	}
+	if c.zw != nil {
+		if _, err := c.zw.Write(payload); err != nil {
 			return err
 		}
+		return c.zw.Flush()
 	}
+	return c.write(payload)
+}
 
-	// 3. send buffer
-	if err := c.setWriteDeadline(); err != nil {
+// compress writes a compressed frame to out, with the frame payload being
+// written by serialize.
+func (c *Client) compress(out *bytes.Buffer, serialize func(io.Writer) error) error {
+	// Compressed Data Frame:
+	// version: uint8 = '2'
+	// code: uint8 = 'C'
+	// payloadSz: uint32
+	// payload: compressed payload
+
+	_, _ = out.Write(codeCompressed) // write compressed header
+
+	offSz := out.Len()
+	_, _ = out.Write(empty4)
+	offPayload := out.Len()
+
+	// compress payload
+	w, err := zlib.NewWriterLevel(out, c.opts.compressLvl)
+	if err != nil {
 		return err
 	}
-	payload := c.wb.Bytes()
+
+	if err := serialize(w); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	// write compress header
+	payloadSz := out.Len() - offPayload
+	binary.BigEndian.PutUint32(out.Bytes()[offSz:], uint32(payloadSz))
+	return nil
+}
+
+func (c *Client) write(payload []byte) error {
 	for len(payload) > 0 {
 		n, err := c.conn.Write(payload)
 		if err != nil {
@@ -167,7 +319,42 @@ func (c *Client) Send(data []interface{}) error {
 
 		payload = payload[n:]
 	}
+	return nil
+}
+
+// startStreamCompression negotiates compression of all data sent to the
+// server. The server must confirm the request by returning the request frame.
+func (c *Client) startStreamCompression() error {
+	// Stream compression request:
+	// version: uint8 = '2'
+	// code: uint8 = 'S'
+	// reserved: uint32 = 0
+
+	var msg [6]byte
+	copy(msg[:], codeStream)
 
+	if err := c.setWriteDeadline(); err != nil {
+		return err
+	}
+	if err := c.write(msg[:]); err != nil {
+		return err
+	}
+
+	if err := c.setReadDeadline(); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(c.conn, msg[:]); err != nil {
+		return err
+	}
+	if !bytes.Equal(msg[:2], codeStream) {
+		return ErrProtocolError
+	}
+
+	zw, err := zlib.NewWriterLevel(c.conn, c.opts.streamCompressLvl)
+	if err != nil {
+		return err
+	}
+	c.zw = zw
 	return nil
 }
 
@@ -206,10 +393,12 @@ func (c *Client) AwaitACK(count uint32) (uint32, error) {
 
 	// read until all acks
 	for ackSeq < count {
-		ackSeq, err = c.ReceiveACK()
+		var seq uint32
+		seq, err = c.ReceiveACK()
 		if err != nil {
 			return ackSeq, err
 		}
+		ackSeq = seq
 	}
 
 	if ackSeq > count {
@@ -220,6 +409,10 @@ func (c *Client) AwaitACK(count uint32) (uint32, error) {
 }
 
 func (c *Client) serialize(out io.Writer, data []interface{}) error {
+	if c.opts.dataFrames == KeyValue {
+		return c.serializeKV(out, data)
+	}
+
 	for i, d := range data {
 		b, err := c.opts.encoder(d)
 		if err != nil {
@@ -241,6 +434,19 @@ func (c *Client) serialize(out io.Writer, data []interface{}) error {
 	return nil
 }
 
+func (c *Client) serializeKV(out io.Writer, data []interface{}) error {
+	for i, d := range data {
+		fields, ok := d.(map[string]string)
+		if !ok {
+			return fmt.Errorf("%w (event %v is %T)", ErrNotKeyValue, i, d)
+		}
+		if err := c.enc.WriteKVEvent(out, uint32(i)+1, fields); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (c *Client) setWriteDeadline() error {
 	return c.conn.SetWriteDeadline(time.Now().Add(c.opts.timeout))
 }
@@ -0,0 +1,314 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v2
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zlib"
+)
+
+// discardConn counts and discards all bytes written.
+type discardConn struct {
+	net.Conn
+	written int64
+}
+
+func (c *discardConn) Write(p []byte) (int, error) {
+	c.written += int64(len(p))
+	return len(p), nil
+}
+
+func (c *discardConn) SetWriteDeadline(time.Time) error { return nil }
+
+func benchEvents(n int) []interface{} {
+	events := make([]interface{}, n)
+	for i := range events {
+		events[i] = map[string]interface{}{
+			"@timestamp": time.Date(2017, 1, 1, 0, 0, i, 0, time.UTC),
+			"message":    fmt.Sprintf("GET /index.html?id=%v HTTP/1.1 200 %v", i, 512+i%100),
+			"host":       "web-01",
+			"source":     "/var/log/nginx/access.log",
+		}
+	}
+	return events
+}
+
+// BenchmarkCompressionLevel reports encoding throughput and the ratio of
+// compressed to uncompressed bytes per compression level.
+func BenchmarkCompressionLevel(b *testing.B) {
+	events := benchEvents(1000)
+
+	plain := &discardConn{}
+	cl, err := NewWithConn(plain)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := cl.Send(events); err != nil {
+		b.Fatal(err)
+	}
+	uncompressed := plain.written
+
+	levels := []int{
+		zlib.NoCompression,
+		zlib.HuffmanOnly,
+		zlib.BestSpeed,
+		zlib.DefaultCompression,
+		zlib.BestCompression,
+	}
+	for _, lvl := range levels {
+		b.Run(fmt.Sprintf("level=%v", lvl), func(b *testing.B) {
+			conn := &discardConn{}
+			cl, err := NewWithConn(conn, CompressionLevel(lvl))
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.SetBytes(uncompressed)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := cl.Send(events); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+
+			ratio := float64(conn.written) / float64(int64(b.N)*uncompressed)
+			b.ReportMetric(ratio, "ratio")
+		})
+	}
+}
+
+// silentListener accepts connections without ever responding.
+func silentListener(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, c := range conns {
+				c.Close()
+			}
+		}()
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, c)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func expectOpError(t *testing.T, err error, op string) *OpError {
+	var opErr *OpError
+	if !errors.As(err, &opErr) {
+		t.Fatalf("expected OpError, got %v", err)
+	}
+	if opErr.Op != op {
+		t.Errorf("expected %v error, got %v", op, opErr)
+	}
+	return opErr
+}
+
+func TestDialError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	_, err = Dial(addr)
+	expectOpError(t, err, "dial")
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	addr := silentListener(t)
+
+	start := time.Now()
+	_, err := Dial(addr,
+		TLS(&tls.Config{InsecureSkipVerify: true}),
+		DialTimeout(50*time.Millisecond))
+	if opErr := expectOpError(t, err, "handshake"); !opErr.Timeout() {
+		t.Errorf("expected timeout error, got %v", opErr)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("handshake not bound by dial timeout")
+	}
+}
+
+func TestDialContextCancel(t *testing.T) {
+	addr := silentListener(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	_, err := DialContext(ctx, addr,
+		TLS(&tls.Config{InsecureSkipVerify: true}),
+		DialTimeout(time.Hour))
+	expectOpError(t, err, "handshake")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+// tlsServer starts a TLS listener presenting a self-signed certificate for
+// localhost. Returns the listener address and the certificate.
+func tlsServer(t *testing.T) (string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_ = c.(*tls.Conn).Handshake()
+				_, _ = io.Copy(io.Discard, c)
+			}()
+		}
+	}()
+	return l.Addr().String(), cert
+}
+
+func TestServerCertPin(t *testing.T) {
+	addr, cert := tlsServer(t)
+	_, port, _ := net.SplitHostPort(addr)
+	match := sha256.Sum256(cert.Raw)
+	other := sha256.Sum256([]byte("rotated certificate"))
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	tests := []struct {
+		name   string
+		config *tls.Config
+		pins   [][]byte
+		ok     bool
+	}{
+		{"pin only", &tls.Config{InsecureSkipVerify: true}, [][]byte{match[:]}, true},
+		{"pin only mismatch", &tls.Config{InsecureSkipVerify: true}, [][]byte{other[:]}, false},
+		{"rotation", &tls.Config{InsecureSkipVerify: true}, [][]byte{other[:], match[:]}, true},
+		{"pin and CA", &tls.Config{RootCAs: roots}, [][]byte{match[:]}, true},
+		{"pin mismatch and CA", &tls.Config{RootCAs: roots}, [][]byte{other[:]}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := Dial(net.JoinHostPort("localhost", port),
+				TLS(test.config), ServerCertPin(test.pins...))
+			if test.ok {
+				if err != nil {
+					t.Fatal(err)
+				}
+				c.Close()
+				return
+			}
+
+			expectOpError(t, err, "handshake")
+			if !errors.Is(err, ErrCertPinMismatch) {
+				t.Errorf("expected ErrCertPinMismatch, got %v", err)
+			}
+		})
+	}
+}
+
+func TestServerCertPinOptions(t *testing.T) {
+	if _, err := Dial("localhost:0", TLS(&tls.Config{}), ServerCertPin([]byte("short"))); err == nil {
+		t.Error("expected pin not being a SHA-256 fingerprint to fail")
+	}
+	var pin [sha256.Size]byte
+	if _, err := Dial("localhost:0", ServerCertPin(pin[:])); err == nil {
+		t.Error("expected pin without TLS to fail")
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	server, conn := net.Pipe()
+	server.Close()
+
+	c, err := NewWithConn(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectOpError(t, c.Send([]interface{}{1}), "write")
+}
+
+func TestKeyValueNotKeyValue(t *testing.T) {
+	conn := &discardConn{}
+	c, err := NewWithConn(conn, DataFrameEncoding(KeyValue))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Send([]interface{}{map[string]string{"a": "1"}, map[string]interface{}{"a": 1}})
+	if !errors.Is(err, ErrNotKeyValue) {
+		t.Errorf("expected ErrNotKeyValue, got %v", err)
+	}
+	if conn.written != 0 {
+		t.Errorf("expected no bytes to be written, got %v", conn.written)
+	}
+}
@@ -20,4 +20,7 @@
 // This package provides the low level `Client` handling the wire-format only,
 // plus `SyncClient` and AsyncClient. SyncClient and AsyncClient do provide
 // protocol compliant communication and error handling with lumberjack server.
+// PoolClient balances batches between multiple lumberjack servers.
+// BufferedClient queues batches in the background, spilling them to disk if
+// the server is unreachable.
 package v2
@@ -0,0 +1,113 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v2
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// FlushError is returned by Flush if batches sent before Flush have not been
+// ACKed, either because ctx is done before, or because publishing failed.
+type FlushError struct {
+	// Unacked is the number of batches not ACKed, including batches still
+	// waiting for an ACK and batches failed since the previous Flush.
+	Unacked int
+
+	// Err is ctx.Err() if ctx is done, the error of the batch failed last
+	// otherwise.
+	Err error
+}
+
+func (e *FlushError) Error() string {
+	return fmt.Sprintf("lumberjack flush: %v batches not ACKed: %v", e.Unacked, e.Err)
+}
+
+func (e *FlushError) Unwrap() error {
+	return e.Err
+}
+
+// batchTracker counts the batches of a client waiting for ACK, for Flush to
+// wait on.
+type batchTracker struct {
+	mu      sync.Mutex
+	pending int
+	failed  int           // batches failed since the last wait
+	err     error         // error of the batch failed last
+	idle    chan struct{} // closed once pending drops to 0, nil if not waited on
+}
+
+// add counts n batches waiting for ACK.
+func (t *batchTracker) add(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending += n
+}
+
+// done marks a batch as ACKed, or as failed if err is set.
+func (t *batchTracker) done(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending--
+	if err != nil {
+		t.failed++
+		t.err = err
+	}
+	if t.pending == 0 && t.idle != nil {
+		close(t.idle)
+		t.idle = nil
+	}
+}
+
+// wait blocks until no batch is waiting for ACK, ctx is done, or stop is
+// closed. Failed batches are reported once.
+func (t *batchTracker) wait(ctx context.Context, stop <-chan struct{}, stopErr error) error {
+	t.mu.Lock()
+	idle := t.idle
+	if t.pending > 0 && idle == nil {
+		idle = make(chan struct{})
+		t.idle = idle
+	}
+	t.mu.Unlock()
+
+	var err error
+	if idle != nil {
+		select {
+		case <-idle:
+		case <-stop:
+			err = stopErr
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	unacked := t.failed
+	if err != nil {
+		unacked += t.pending
+	} else {
+		err = t.err
+	}
+	t.failed, t.err = 0, nil
+	if unacked == 0 {
+		return nil
+	}
+	return &FlushError{Unacked: unacked, Err: err}
+}
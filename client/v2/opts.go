@@ -18,22 +18,64 @@
 package v2
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"time"
+
+	"github.com/klauspost/compress/zlib"
 )
 
 // Option type to be passed to New/Dial functions.
 type Option func(*options) error
 
 type options struct {
-	timeout     time.Duration
-	encoder     jsonEncoder
-	compressLvl int
+	timeout           time.Duration
+	dialTimeout       time.Duration
+	tls               *tls.Config
+	certPins          [][]byte
+	encoder           jsonEncoder
+	compressLvl       int
+	compressThreshold int
+
+	streamCompressLvl int
+
+	maxBatchEvents int
+
+	// adaptive window, disabled if windowInit is 0
+	windowInit    int
+	windowMax     int
+	windowGrowth  float64
+	windowBackoff float64
+
+	backoffInit time.Duration
+	backoffMax  time.Duration
+	maxRetries  int
+
+	cumulativeACK bool
+	dataFrames    Encoding
+
+	bufferLimit int
+	spillDir    string
 }
 
 type jsonEncoder func(interface{}) ([]byte, error)
 
+// Encoding selects the data frames events are sent in.
+type Encoding uint8
+
+const (
+	// JSON sends events in JSON data frames, encoded by JSONEncoder.
+	JSON Encoding = iota
+
+	// KeyValue sends events in key-value data frames, as defined by
+	// lumberjack protocol version 1. Events must be of type
+	// map[string]string.
+	KeyValue
+)
+
 // JSONEncoder client option configuring the encoder used to convert events
 // to json. The default is `json.Marshal`.
 func JSONEncoder(encoder func(interface{}) ([]byte, error)) Option {
@@ -43,6 +85,20 @@ func JSONEncoder(encoder func(interface{}) ([]byte, error)) Option {
 	}
 }
 
+// DataFrameEncoding client option selecting the data frames events are sent
+// in. KeyValue is supported by Logstash and go-lumber servers, for sending flat
+// string key-value events. Sending events not being of type map[string]string
+// fails with ErrNotKeyValue if KeyValue is configured. The default is JSON.
+func DataFrameEncoding(e Encoding) Option {
+	return func(opt *options) error {
+		if e > KeyValue {
+			return errors.New("invalid data frame encoding")
+		}
+		opt.dataFrames = e
+		return nil
+	}
+}
+
 // Timeout client option configuring read/write timeout.
 func Timeout(to time.Duration) Option {
 	return func(opt *options) error {
@@ -54,21 +110,244 @@ func Timeout(to time.Duration) Option {
 	}
 }
 
-// CompressionLevel client option setting the gzip compression level (0 to 9).
+// DialTimeout client option configuring the timeout for establishing a
+// connection. The timeout applies to connecting and, with TLS enabled, to the
+// TLS handshake each. The default is the Timeout.
+func DialTimeout(to time.Duration) Option {
+	return func(opt *options) error {
+		if to < 0 {
+			return errors.New("timeouts must not be negative")
+		}
+		opt.dialTimeout = to
+		return nil
+	}
+}
+
+// TLS client option enabling TLS when connecting via Dial, DialContext or
+// DialWith. If config.ServerName is not set, the host of the address dialed is
+// used. The TLS handshake is bound by DialTimeout.
+func TLS(config *tls.Config) Option {
+	return func(opt *options) error {
+		opt.tls = config
+		return nil
+	}
+}
+
+// ServerCertPin client option pinning the server certificate by the SHA-256
+// fingerprint of its DER encoding. Connections to servers presenting a leaf
+// certificate matching none of the pinned fingerprints fail the TLS handshake
+// with ErrCertPinMismatch. Pass multiple fingerprints, or use the option
+// repeatedly, to accept old and new certificates while rotating them.
+//
+// Pins are checked in addition to the verification configured via TLS. Set
+// InsecureSkipVerify in the TLS config to rely on pins only, e.g. for
+// self-signed server certificates. Pins apply to connections established by
+// Dial, DialContext and DialWith, and require TLS to be enabled.
+func ServerCertPin(fingerprints ...[]byte) Option {
+	return func(opt *options) error {
+		for _, fp := range fingerprints {
+			if len(fp) != sha256.Size {
+				return fmt.Errorf("certificate pin must be a %v byte SHA-256 fingerprint, got %v bytes",
+					sha256.Size, len(fp))
+			}
+			opt.certPins = append(opt.certPins, append([]byte(nil), fp...))
+		}
+		return nil
+	}
+}
+
+// CompressionLevel client option setting the zlib compression level. Valid
+// levels are zlib.NoCompression (0) through zlib.BestCompression (9), plus
+// zlib.DefaultCompression and zlib.HuffmanOnly. Batches are sent as plain JSON
+// data frames with zlib.NoCompression (the default).
 func CompressionLevel(l int) Option {
 	return func(opt *options) error {
-		if !(0 <= l && l <= 9) {
-			return errors.New("compression level must be within 0 and 9")
+		if err := checkCompressionLevel(l); err != nil {
+			return err
 		}
 		opt.compressLvl = l
 		return nil
 	}
 }
 
+// CompressionThreshold client option configuring the minimum size in bytes of
+// the serialized data frames of a batch to be compressed. Smaller batches are
+// sent as plain JSON data frames, avoiding compression overhead on tiny
+// batches. The threshold only applies if CompressionLevel enables compression.
+// The default of 0 compresses all batches.
+func CompressionThreshold(bytes int) Option {
+	return func(opt *options) error {
+		if bytes < 0 {
+			return errors.New("compression threshold must not be negative")
+		}
+		opt.compressThreshold = bytes
+		return nil
+	}
+}
+
+// StreamCompression client option enabling compression of the complete stream
+// sent to the server at the given zlib compression level. Stream
+// compression is a go-lumber extension, which must be enabled in the server.
+// Connecting to servers not supporting stream compression fails. The default
+// of zlib.NoCompression disables stream compression.
+//
+// When using stream compression, frame compression (CompressionLevel) should be
+// disabled.
+func StreamCompression(l int) Option {
+	return func(opt *options) error {
+		if err := checkCompressionLevel(l); err != nil {
+			return err
+		}
+		opt.streamCompressLvl = l
+		return nil
+	}
+}
+
+// MaxBatchEvents client option configuring the maximum number of events sent
+// in one window. Bigger batches are split into multiple windows. SyncClient
+// waits for each window being ACKed before sending the next window, while
+// AsyncClient pipelines the windows. The default of 0 sends all events passed
+// to Send in one window.
+func MaxBatchEvents(n int) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("max batch events must not be negative")
+		}
+		opt.maxBatchEvents = n
+		return nil
+	}
+}
+
+// AdaptiveWindow client option enabling SyncClient to tune the number of
+// events sent per window. Sending starts with windows of init events. The
+// window grows by WindowGrowth after each fully ACKed window, up to max
+// events, and shrinks by WindowBackoff if sending a window fails or times out.
+// The window size is kept between calls to Send and can be read via
+// SyncClient.WindowSize. MaxBatchEvents, if configured, caps the window. By
+// default batches are not split.
+func AdaptiveWindow(init, max int) Option {
+	return func(opt *options) error {
+		if init <= 0 || max < init {
+			return errors.New("window must be positive and init must not exceed max")
+		}
+		opt.windowInit = init
+		opt.windowMax = max
+		return nil
+	}
+}
+
+// WindowGrowth client option configuring the factor the adaptive window grows
+// by after a window has been ACKed. The factor must be greater than 1. The
+// default is 2.
+func WindowGrowth(factor float64) Option {
+	return func(opt *options) error {
+		if factor <= 1 {
+			return errors.New("window growth factor must be greater than 1")
+		}
+		opt.windowGrowth = factor
+		return nil
+	}
+}
+
+// WindowBackoff client option configuring the factor the adaptive window is
+// multiplied with if sending a window fails. The factor must be between 0 and
+// 1. The default is 0.5.
+func WindowBackoff(factor float64) Option {
+	return func(opt *options) error {
+		if factor <= 0 || factor >= 1 {
+			return errors.New("window backoff factor must be between 0 and 1")
+		}
+		opt.windowBackoff = factor
+		return nil
+	}
+}
+
+// Backoff client option enabling SyncClient to reconnect if publishing fails.
+// Between reconnect attempts Send sleeps with exponential backoff and full
+// jitter, starting at init up to max. The backoff is reset once a window has
+// been ACKed. Backoff requires the client to be created via SyncDial,
+// SyncDialContext or SyncDialWith. By default SyncClient does not reconnect.
+// AsyncClient does not reconnect, and PoolClient is configured via
+// PoolBackoff. BufferedClient always reconnects, using Backoff if configured.
+func Backoff(init, max time.Duration) Option {
+	return func(opt *options) error {
+		if init <= 0 || max < init {
+			return errors.New("backoff must be positive and init must not exceed max")
+		}
+		opt.backoffInit = init
+		opt.backoffMax = max
+		return nil
+	}
+}
+
+// MaxRetries client option configuring the number of consecutive failed
+// reconnect attempts after which Send gives up and returns an error. A value
+// of 0 retries until the context passed to SendContext is cancelled. The
+// option only applies if Backoff is configured. The default is 3.
+func MaxRetries(n int) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("max retries must not be negative")
+		}
+		opt.maxRetries = n
+		return nil
+	}
+}
+
+// CumulativeACK client option configuring the AsyncClient to interpret the
+// sequence number of an ACK as the number of events ACKed since the previous
+// ACK, possibly spanning multiple windows. Enable CumulativeACK if the server
+// merges the ACKs of multiple windows, like go-lumber servers configured with
+// the ACKEvery option. Lumberjack servers ACK windows individually and must not
+// be used with CumulativeACK enabled.
+func CumulativeACK(b bool) Option {
+	return func(opt *options) error {
+		opt.cumulativeACK = b
+		return nil
+	}
+}
+
+// BufferLimit client option configuring the number of events BufferedClient
+// buffers in memory. Batches exceeding the limit are spilled to disk if
+// SpillDir is configured, or rejected by Send with ErrBufferFull. A limit of 0
+// spills all batches. The default is 4096.
+func BufferLimit(n int) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("buffer limit must not be negative")
+		}
+		opt.bufferLimit = n
+		return nil
+	}
+}
+
+// SpillDir client option configuring the directory BufferedClient writes
+// batches to if BufferLimit is exceeded, and when closing the client. The
+// directory is created if missing. Batches left in the directory by previous
+// clients are sent first. The directory must not be shared by clients running
+// concurrently. By default batches are not spilled.
+func SpillDir(dir string) Option {
+	return func(opt *options) error {
+		opt.spillDir = dir
+		return nil
+	}
+}
+
+func checkCompressionLevel(l int) error {
+	if !(zlib.HuffmanOnly <= l && l <= zlib.BestCompression) {
+		return errors.New("invalid compression level")
+	}
+	return nil
+}
+
 func applyOptions(opts []Option) (options, error) {
 	o := options{
-		encoder: json.Marshal,
-		timeout: 30 * time.Second,
+		encoder:       json.Marshal,
+		timeout:       30 * time.Second,
+		maxRetries:    3,
+		windowGrowth:  2,
+		windowBackoff: 0.5,
+		bufferLimit:   4096,
 	}
 
 	for _, opt := range opts {
@@ -76,5 +355,11 @@ func applyOptions(opts []Option) (options, error) {
 			return o, err
 		}
 	}
+	if o.dialTimeout == 0 {
+		o.dialTimeout = o.timeout
+	}
+	if len(o.certPins) > 0 && o.tls == nil {
+		return o, errors.New("certificate pins require TLS to be enabled")
+	}
 	return o, nil
 }
@@ -0,0 +1,57 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v2
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+)
+
+// ErrCertPinMismatch is returned by the TLS handshake if ServerCertPin is
+// configured and the server certificate matches none of the pinned
+// fingerprints.
+var ErrCertPinMismatch = errors.New("server certificate does not match pinned fingerprints")
+
+// verifyPins returns a TLS connection verifier rejecting servers whose leaf
+// certificate has a SHA-256 fingerprint other than pins. The verifier next, if
+// set, is run first.
+func verifyPins(pins [][]byte, next func(tls.ConnectionState) error) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if next != nil {
+			if err := next(cs); err != nil {
+				return err
+			}
+		}
+		if len(cs.PeerCertificates) == 0 {
+			return fmt.Errorf("%w: no server certificate", ErrCertPinMismatch)
+		}
+
+		leaf := cs.PeerCertificates[0]
+		sum := sha256.Sum256(leaf.Raw)
+		for _, pin := range pins {
+			if bytes.Equal(pin, sum[:]) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: certificate of %q has fingerprint %x",
+			ErrCertPinMismatch, leaf.Subject.CommonName, sum)
+	}
+}
@@ -0,0 +1,441 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v2
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PoolClient publishes batches to multiple lumberjack endpoints. Each Send
+// selects a healthy host using the configured Balancer, retrying on another
+// host if sending fails. Hosts failing repeatedly are ejected from the pool
+// and periodically re-probed, until a new connection can be established.
+//
+// Batches failing mid-send are resent to another host in full, so events might
+// be published more than once. If backoff is configured, Send retries
+// publishing after all hosts failed, waiting with exponential backoff between
+// retries. A PoolClient with one address only can be used as reconnecting
+// client. The client is thread-safe.
+type PoolClient struct {
+	opts  poolOptions
+	hosts []*poolHost
+
+	mu        sync.Mutex // guards host health
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// HostState describes a healthy host a Balancer can select.
+type HostState struct {
+	Address  string
+	InFlight int
+}
+
+// Balancer selects the host to publish the next batch to. The index of the
+// selected host in hosts must be returned. Hosts is never empty.
+type Balancer func(hosts []HostState) int
+
+// PoolOption type to be passed to PoolDial.
+type PoolOption func(*poolOptions) error
+
+type poolOptions struct {
+	balancer      Balancer
+	maxFailures   int
+	probeInterval time.Duration
+	dial          func(network, address string) (net.Conn, error)
+	clientOpts    []Option
+
+	backoffInit time.Duration
+	backoffMax  time.Duration
+	maxRetries  int
+}
+
+type poolHost struct {
+	address  string
+	inflight int32
+
+	// serializes publish requests on connection
+	mu     sync.Mutex
+	client *SyncClient
+
+	// health, guarded by PoolClient.mu
+	failures int
+	ejected  bool
+}
+
+var (
+	// ErrNoHealthyHost is returned by PoolClient if no host is available for
+	// publishing events.
+	ErrNoHealthyHost = errors.New("no healthy host available")
+
+	// ErrPoolClosed is returned by PoolClient if Send is called after Close.
+	ErrPoolClosed = errors.New("pool client closed")
+)
+
+// RoundRobin balancer selects hosts in turn.
+func RoundRobin() Balancer {
+	var next uint32
+	return func(hosts []HostState) int {
+		return int((atomic.AddUint32(&next, 1) - 1) % uint32(len(hosts)))
+	}
+}
+
+// LeastInFlight balancer selects the host with the least number of active
+// publish requests.
+func LeastInFlight() Balancer {
+	return func(hosts []HostState) int {
+		idx := 0
+		for i, h := range hosts {
+			if h.InFlight < hosts[idx].InFlight {
+				idx = i
+			}
+		}
+		return idx
+	}
+}
+
+// PoolBalancer pool option configuring the host selection strategy. The
+// default is RoundRobin.
+func PoolBalancer(b Balancer) PoolOption {
+	return func(opt *poolOptions) error {
+		if b == nil {
+			return errors.New("balancer must not be nil")
+		}
+		opt.balancer = b
+		return nil
+	}
+}
+
+// PoolMaxFailures pool option configuring the number of consecutive failures
+// after which a host is ejected from the pool. The default is 3.
+func PoolMaxFailures(n int) PoolOption {
+	return func(opt *poolOptions) error {
+		if n <= 0 {
+			return errors.New("max failures must be positive")
+		}
+		opt.maxFailures = n
+		return nil
+	}
+}
+
+// PoolProbeInterval pool option configuring the interval ejected hosts are
+// re-probed at. The default is 10 seconds.
+func PoolProbeInterval(d time.Duration) PoolOption {
+	return func(opt *poolOptions) error {
+		if d <= 0 {
+			return errors.New("probe interval must be positive")
+		}
+		opt.probeInterval = d
+		return nil
+	}
+}
+
+// PoolBackoff pool option enabling retries if publishing to all hosts failed.
+// Between retries Send sleeps with exponential backoff and full jitter,
+// starting at init up to max. By default Send does not retry.
+func PoolBackoff(init, max time.Duration) PoolOption {
+	return func(opt *poolOptions) error {
+		if init <= 0 || max < init {
+			return errors.New("backoff must be positive and init must not exceed max")
+		}
+		opt.backoffInit = init
+		opt.backoffMax = max
+		return nil
+	}
+}
+
+// PoolMaxRetries pool option configuring the number of consecutive retries
+// with backoff, before Send gives up and returns an error. A value of 0 retries
+// until the context passed to SendContext is cancelled. The default is 3.
+func PoolMaxRetries(n int) PoolOption {
+	return func(opt *poolOptions) error {
+		if n < 0 {
+			return errors.New("max retries must not be negative")
+		}
+		opt.maxRetries = n
+		return nil
+	}
+}
+
+// PoolDialer pool option configuring the dialer used to connect to hosts.
+func PoolDialer(dial func(network, address string) (net.Conn, error)) PoolOption {
+	return func(opt *poolOptions) error {
+		opt.dial = dial
+		return nil
+	}
+}
+
+// PoolClientOptions pool option configuring the options passed to the
+// clients connecting to each host.
+func PoolClientOptions(opts ...Option) PoolOption {
+	return func(opt *poolOptions) error {
+		opt.clientOpts = opts
+		return nil
+	}
+}
+
+// PoolDial creates a new PoolClient publishing to the lumberjack servers in
+// addresses. Connections are established on first use.
+func PoolDial(addresses []string, opts ...PoolOption) (*PoolClient, error) {
+	if len(addresses) == 0 {
+		return nil, errors.New("no host configured")
+	}
+
+	o := poolOptions{
+		balancer:      RoundRobin(),
+		maxFailures:   3,
+		probeInterval: 10 * time.Second,
+		maxRetries:    3,
+	}
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
+			return nil, err
+		}
+	}
+
+	clientOpts, err := applyOptions(o.clientOpts)
+	if err != nil {
+		return nil, err
+	}
+	if o.dial == nil {
+		dialer := net.Dialer{Timeout: clientOpts.dialTimeout}
+		o.dial = dialer.Dial
+	}
+
+	p := &PoolClient{
+		opts:  o,
+		hosts: make([]*poolHost, len(addresses)),
+		done:  make(chan struct{}),
+	}
+	for i, address := range addresses {
+		p.hosts[i] = &poolHost{address: address}
+	}
+
+	p.wg.Add(1)
+	go p.probeLoop()
+	return p, nil
+}
+
+// Close closes all connections and stops probing ejected hosts. Calling Close
+// more than once is a no-op. Sending after Close fails with ErrPoolClosed.
+func (p *PoolClient) Close() error {
+	p.closeOnce.Do(func() { close(p.done) })
+	p.wg.Wait()
+
+	var err error
+	for _, h := range p.hosts {
+		h.mu.Lock()
+		if h.client != nil {
+			if e := h.client.Close(); e != nil {
+				err = e
+			}
+			h.client = nil
+		}
+		h.mu.Unlock()
+	}
+	return err
+}
+
+// Send publishes a new batch of events by JSON-encoding given batch to one of
+// the healthy hosts. If sending fails, the batch is retried on another host.
+// Send blocks until the complete batch has been ACKed or all hosts failed.
+func (p *PoolClient) Send(data []interface{}) (int, error) {
+	return p.SendContext(context.Background(), data)
+}
+
+// SendContext publishes a new batch of events like Send. Cancelling ctx stops
+// retrying, interrupting the backoff sleep.
+func (p *PoolClient) SendContext(ctx context.Context, data []interface{}) (int, error) {
+	for retry := 0; ; retry++ {
+		if p.isClosed() {
+			return 0, ErrPoolClosed
+		}
+
+		n, err := p.sendAny(data)
+		if err == nil {
+			return n, nil
+		}
+
+		if p.opts.backoffInit <= 0 || (p.opts.maxRetries > 0 && retry >= p.opts.maxRetries) {
+			return 0, err
+		}
+
+		timer := time.NewTimer(backoff(p.opts.backoffInit, p.opts.backoffMax, retry))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, ctx.Err()
+		case <-p.done:
+			timer.Stop()
+			return 0, ErrPoolClosed
+		case <-timer.C:
+		}
+
+		// give ejected hosts another chance before retrying
+		p.probe()
+	}
+}
+
+func (p *PoolClient) isClosed() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// sendAny tries to publish data to each healthy host once.
+func (p *PoolClient) sendAny(data []interface{}) (int, error) {
+	tried := make([]bool, len(p.hosts))
+	err := ErrNoHealthyHost
+	for {
+		h := p.selectHost(tried)
+		if h == nil {
+			return 0, err
+		}
+
+		var n int
+		n, err = p.send(h, data)
+		if err == nil || err == ErrPoolClosed {
+			return n, err
+		}
+	}
+}
+
+func (p *PoolClient) selectHost(tried []bool) *poolHost {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var candidates []int
+	var states []HostState
+	for i, h := range p.hosts {
+		if h.ejected || tried[i] {
+			continue
+		}
+		candidates = append(candidates, i)
+		states = append(states, HostState{
+			Address:  h.address,
+			InFlight: int(atomic.LoadInt32(&h.inflight)),
+		})
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	i := candidates[p.opts.balancer(states)]
+	tried[i] = true
+	return p.hosts[i]
+}
+
+func (p *PoolClient) send(h *poolHost, data []interface{}) (int, error) {
+	atomic.AddInt32(&h.inflight, 1)
+	defer atomic.AddInt32(&h.inflight, -1)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.client == nil {
+		if p.isClosed() {
+			return 0, ErrPoolClosed // do not reconnect after Close
+		}
+		if err := h.connect(p.opts); err != nil {
+			p.onFailure(h)
+			return 0, err
+		}
+	}
+
+	n, err := h.client.Send(data)
+	if err != nil {
+		_ = h.client.Close()
+		h.client = nil
+		p.onFailure(h)
+		return n, err
+	}
+
+	p.onSuccess(h)
+	return n, nil
+}
+
+func (p *PoolClient) onFailure(h *poolHost) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	h.failures++
+	if h.failures >= p.opts.maxFailures {
+		h.ejected = true
+	}
+}
+
+func (p *PoolClient) onSuccess(h *poolHost) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	h.failures = 0
+	h.ejected = false
+}
+
+func (p *PoolClient) probeLoop() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.opts.probeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.probe()
+		}
+	}
+}
+
+// probe tries to reconnect to all ejected hosts, adding a host back to the
+// pool if a connection can be established.
+func (p *PoolClient) probe() {
+	for _, h := range p.hosts {
+		p.mu.Lock()
+		ejected := h.ejected
+		p.mu.Unlock()
+		if !ejected {
+			continue
+		}
+
+		h.mu.Lock()
+		if h.client == nil && !p.isClosed() && h.connect(p.opts) == nil {
+			p.onSuccess(h)
+		}
+		h.mu.Unlock()
+	}
+}
+
+func (h *poolHost) connect(opts poolOptions) error {
+	cl, err := SyncDialWith(opts.dial, h.address, opts.clientOpts...)
+	if err != nil {
+		return err
+	}
+	h.client = cl
+	return nil
+}
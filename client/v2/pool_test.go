@@ -0,0 +1,157 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v2
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	server "github.com/elastic/go-lumber/server/v2"
+)
+
+// ackServer is a lumberjack server ACKing all batches.
+type ackServer struct {
+	s    *server.Server
+	addr string
+	once sync.Once
+}
+
+// Close stops the server. Close can be called more than once.
+func (s *ackServer) Close() {
+	s.once.Do(func() { s.s.Close() })
+}
+
+// startACKServer starts a lumberjack server ACKing all batches. The number of
+// events received is reported on the returned channel.
+func startACKServer(t *testing.T) (*ackServer, <-chan int) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := server.NewWithListener(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	as := &ackServer{s: s, addr: l.Addr().String()}
+	t.Cleanup(as.Close)
+
+	received := make(chan int, 100)
+	go func() {
+		for b := range s.ReceiveChan() {
+			received <- len(b.Events)
+			b.ACK()
+		}
+	}()
+	return as, received
+}
+
+func countReceived(ch <-chan int) int {
+	n := 0
+	for {
+		select {
+		case c := <-ch:
+			n += c
+		default:
+			return n
+		}
+	}
+}
+
+func TestPoolFailover(t *testing.T) {
+	s1, recv1 := startACKServer(t)
+	s2, recv2 := startACKServer(t)
+
+	p, err := PoolDial([]string{s1.addr, s2.addr},
+		PoolMaxFailures(1),
+		PoolProbeInterval(time.Hour),
+		PoolClientOptions(Timeout(time.Second)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	for i := 0; i < 4; i++ {
+		if _, err := p.Send([]interface{}{i}); err != nil {
+			t.Fatalf("send %v failed: %v", i, err)
+		}
+	}
+	if n1, n2 := countReceived(recv1), countReceived(recv2); n1 != 2 || n2 != 2 {
+		t.Fatalf("expected batches to be balanced, got %v and %v", n1, n2)
+	}
+
+	s1.Close()
+	for i := 0; i < 4; i++ {
+		if _, err := p.Send([]interface{}{i}); err != nil {
+			t.Fatalf("send %v after host failure failed: %v", i, err)
+		}
+	}
+	if n := countReceived(recv2); n != 4 {
+		t.Errorf("expected all events to fail over to remaining host, got %v", n)
+	}
+
+	p.mu.Lock()
+	ejected := p.hosts[0].ejected
+	p.mu.Unlock()
+	if !ejected {
+		t.Error("expected failed host to be ejected")
+	}
+}
+
+func TestPoolAllHostsDown(t *testing.T) {
+	s, _ := startACKServer(t)
+	addr := s.addr
+	s.Close()
+
+	p, err := PoolDial([]string{addr}, PoolClientOptions(Timeout(time.Second)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if _, err := p.Send([]interface{}{1}); err == nil {
+		t.Error("expected send to fail with all hosts down")
+	}
+}
+
+func TestPoolClose(t *testing.T) {
+	s, recv := startACKServer(t)
+
+	p, err := PoolDial([]string{s.addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Send([]interface{}{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Errorf("second close failed: %v", err)
+	}
+
+	if _, err := p.Send([]interface{}{2}); err != ErrPoolClosed {
+		t.Errorf("expected ErrPoolClosed, got %v", err)
+	}
+	if n := countReceived(recv); n != 1 {
+		t.Errorf("expected no events after close, got %v", n)
+	}
+}
@@ -0,0 +1,227 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Spill files hold the events of one batch each, named by the zero padded
+// batch id, such that file names sort in send order. Files are written to a
+// temporary file first and renamed once synced to disk, such that a crash
+// never leaves a partially written spill file behind. The file format is:
+//
+//	magic "LJSP", version (1 byte), number of events (uint32)
+//	per event: length (uint32), CRC-32 (IEEE) of the event (uint32), event
+//
+// Integers are big endian. Events are stored JSON encoded.
+const (
+	spillMagic   = "LJSP"
+	spillVersion = 1
+
+	spillSuffix   = ".spill"
+	tmpSuffix     = ".tmp"
+	corruptSuffix = ".corrupt"
+)
+
+var errCorruptSpill = errors.New("corrupt spill file")
+
+// spillDir manages the spill files of a BufferedClient.
+type spillDir struct {
+	path string
+	ids  []uint64 // batches spilled, not yet ACKed, in send order
+}
+
+// openSpillDir creates the spill directory if missing, and loads the batches
+// spilled by previous clients. Temporary files of incomplete writes are
+// removed.
+func openSpillDir(path string) (*spillDir, error) {
+	if err := os.MkdirAll(path, 0o700); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &spillDir{path: path}
+	for _, e := range entries {
+		name := e.Name()
+		switch {
+		case strings.HasSuffix(name, tmpSuffix):
+			_ = os.Remove(filepath.Join(path, name))
+		case strings.HasSuffix(name, spillSuffix):
+			id, err := strconv.ParseUint(strings.TrimSuffix(name, spillSuffix), 10, 64)
+			if err == nil {
+				d.ids = append(d.ids, id)
+			}
+		}
+	}
+	sort.Slice(d.ids, func(i, j int) bool { return d.ids[i] < d.ids[j] })
+	return d, nil
+}
+
+// nextID returns the id following the last batch spilled.
+func (d *spillDir) nextID() uint64 {
+	if len(d.ids) == 0 {
+		return 0
+	}
+	return d.ids[len(d.ids)-1] + 1
+}
+
+func (d *spillDir) file(id uint64) string {
+	return filepath.Join(d.path, fmt.Sprintf("%020d%s", id, spillSuffix))
+}
+
+// write durably stores events as batch id.
+func (d *spillDir) write(id uint64, events []interface{}, encode jsonEncoder) error {
+	var buf bytes.Buffer
+	buf.WriteString(spillMagic)
+	buf.WriteByte(spillVersion)
+	writeUint32(&buf, uint32(len(events)))
+	for _, event := range events {
+		raw, ok := event.(json.RawMessage)
+		if !ok {
+			var err error
+			if raw, err = encode(event); err != nil {
+				return err
+			}
+		}
+		writeUint32(&buf, uint32(len(raw)))
+		writeUint32(&buf, crc32.ChecksumIEEE(raw))
+		buf.Write(raw)
+	}
+
+	path := d.file(id)
+	tmp := path + tmpSuffix
+	if err := writeSynced(tmp, buf.Bytes()); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	syncDir(d.path)
+
+	// batches spilled by Close precede batches spilled before
+	i := sort.Search(len(d.ids), func(i int) bool { return d.ids[i] > id })
+	d.ids = append(d.ids, 0)
+	copy(d.ids[i+1:], d.ids[i:])
+	d.ids[i] = id
+	return nil
+}
+
+// read loads the events of batch id. Events are returned as json.RawMessage,
+// or as map[string]string if kv is set.
+func (d *spillDir) read(id uint64, kv bool) ([]interface{}, error) {
+	data, err := os.ReadFile(d.file(id))
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := len(spillMagic) + 5
+	if len(data) < hdr || string(data[:len(spillMagic)]) != spillMagic ||
+		data[len(spillMagic)] != spillVersion {
+		return nil, errCorruptSpill
+	}
+	count := binary.BigEndian.Uint32(data[hdr-4:])
+	data = data[hdr:]
+	if uint64(count)*8 > uint64(len(data)) {
+		return nil, errCorruptSpill
+	}
+
+	events := make([]interface{}, 0, count)
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, errCorruptSpill
+		}
+		sz := binary.BigEndian.Uint32(data)
+		sum := binary.BigEndian.Uint32(data[4:])
+		data = data[8:]
+		if uint32(len(data)) < sz || crc32.ChecksumIEEE(data[:sz]) != sum {
+			return nil, errCorruptSpill
+		}
+		raw := data[:sz:sz]
+		data = data[sz:]
+
+		if !kv {
+			events = append(events, json.RawMessage(raw))
+			continue
+		}
+		var event map[string]string
+		if err := json.Unmarshal(raw, &event); err != nil {
+			return nil, errCorruptSpill
+		}
+		events = append(events, event)
+	}
+	if uint32(len(events)) != count {
+		return nil, errCorruptSpill
+	}
+	return events, nil
+}
+
+// remove deletes the oldest spilled batch, once it has been ACKed.
+func (d *spillDir) remove() error {
+	id := d.ids[0]
+	d.ids = d.ids[1:]
+	return os.Remove(d.file(id))
+}
+
+// discard renames the oldest spilled batch, if it can not be read. Corrupt
+// files are kept for inspection.
+func (d *spillDir) discard() error {
+	id := d.ids[0]
+	d.ids = d.ids[1:]
+	return os.Rename(d.file(id), d.file(id)+corruptSuffix)
+}
+
+// writeSynced writes data to a new file at path, syncing it to disk.
+func writeSynced(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// syncDir syncs the directory at path, persisting renames. Errors are
+// ignored, as syncing directories is not supported on all platforms.
+func syncDir(path string) {
+	if f, err := os.Open(path); err == nil {
+		_ = f.Sync()
+		_ = f.Close()
+	}
+}
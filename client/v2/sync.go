@@ -17,17 +17,32 @@
 
 package v2
 
-import "net"
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net"
+)
 
 // SyncClient synchronously publishes events to lumberjack endpoint waiting for
-// ACK before allowing another send request. The client is not thread-safe.
+// ACK before allowing another send request. If Backoff is configured, a client
+// created via SyncDial, SyncDialContext or SyncDialWith reconnects if
+// publishing fails. The client is not thread-safe.
 type SyncClient struct {
-	cl *Client
+	cl   *Client
+	opts options
+
+	// current adaptive window size, 0 if disabled
+	window int
+
+	// dial reconnects the client, nil if the client can not reconnect
+	dial func(ctx context.Context) (*Client, error)
 }
 
 // NewSyncClientWith creates a new SyncClient from low-level lumberjack v2 Client.
 func NewSyncClientWith(c *Client) (*SyncClient, error) {
-	return &SyncClient{c}, nil
+	return &SyncClient{cl: c, opts: c.opts, window: c.opts.windowInit}, nil
 }
 
 // NewSyncClientWithConn creates a new SyncClient from an active connection.
@@ -42,11 +57,26 @@ func NewSyncClientWithConn(c net.Conn, opts ...Option) (*SyncClient, error) {
 // SyncDial connects to lumberjack server and returns new SyncClient. On error
 // no SyncClient is being created.
 func SyncDial(address string, opts ...Option) (*SyncClient, error) {
-	cl, err := Dial(address, opts...)
+	return SyncDialContext(context.Background(), address, opts...)
+}
+
+// SyncDialContext connects to lumberjack server like SyncDial. Cancelling ctx
+// aborts connecting. Reconnects are bound by the context passed to
+// SendContext.
+func SyncDialContext(ctx context.Context, address string, opts ...Option) (*SyncClient, error) {
+	cl, err := DialContext(ctx, address, opts...)
 	if err != nil {
 		return nil, err
 	}
-	return NewSyncClientWith(cl)
+
+	c, err := NewSyncClientWith(cl)
+	if err != nil {
+		return nil, err
+	}
+	c.dial = func(ctx context.Context) (*Client, error) {
+		return DialContext(ctx, address, opts...)
+	}
+	return c, nil
 }
 
 // SyncDialWith uses provided dialer to connect to lumberjack server. On error
@@ -60,20 +90,154 @@ func SyncDialWith(
 	if err != nil {
 		return nil, err
 	}
-	return NewSyncClientWith(cl)
+
+	c, err := NewSyncClientWith(cl)
+	if err != nil {
+		return nil, err
+	}
+	c.dial = func(context.Context) (*Client, error) {
+		return DialWith(dial, address, opts...)
+	}
+	return c, nil
 }
 
 // Close closes the client, so no new events can be published anymore. The
 // underlying network connection will be closed too. Returns an error if
 // underlying net.Conn errors on Close.
 func (c *SyncClient) Close() error {
+	if c.cl == nil {
+		return nil // failed to reconnect
+	}
 	return c.cl.Close()
 }
 
 // Send publishes a new batch of events by JSON-encoding given batch.
 // Send blocks until the complete batch has been ACKed by lumberjack server or
-// some error happened.
+// some error happened. If MaxBatchEvents or AdaptiveWindow is configured, the
+// batch is sent in multiple windows in order. On error, the number of events
+// ACKed so far is returned.
 func (c *SyncClient) Send(data []interface{}) (int, error) {
+	return c.SendContext(context.Background(), data)
+}
+
+// SendContext publishes a new batch of events like Send. If Backoff is
+// configured, events not yet ACKed are resent after reconnecting if the
+// connection fails. Encoding errors, e.g. ErrNotKeyValue, are returned right
+// away. Cancelling ctx interrupts the backoff sleep.
+func (c *SyncClient) SendContext(ctx context.Context, data []interface{}) (int, error) {
+	acked, retry := 0, 0
+	for acked < len(data) {
+		window := c.windowSize(len(data) - acked)
+		n, err := c.sendWindow(data[acked : acked+window])
+		acked += n
+		if err == nil {
+			retry = 0
+			c.growWindow(window)
+			continue
+		}
+
+		if !isConnError(err) {
+			return acked, err // encoding errors are not resolved by resending
+		}
+
+		c.shrinkWindow()
+		if c.dial == nil || c.opts.backoffInit <= 0 {
+			return acked, err
+		}
+		if err := c.reconnect(ctx, &retry); err != nil {
+			return acked, err
+		}
+	}
+	return acked, nil
+}
+
+// isConnError returns true if err has been caused by the connection to the
+// server, such that events not yet ACKed can be resent after reconnecting.
+func isConnError(err error) bool {
+	switch err {
+	case errNotConnected, ErrProtocolError, io.EOF, io.ErrUnexpectedEOF:
+		return true
+	}
+
+	var opErr *OpError
+	var netErr net.Error
+	return errors.As(err, &opErr) || errors.As(err, &netErr)
+}
+
+// WindowSize returns the current number of events sent per window if
+// AdaptiveWindow is configured. Returns 0 otherwise.
+func (c *SyncClient) WindowSize() int {
+	return c.window
+}
+
+// windowSize returns the number of events to send in the next window.
+func (c *SyncClient) windowSize(remaining int) int {
+	n := remaining
+	if c.window > 0 && c.window < n {
+		n = c.window
+	}
+	if max := c.opts.maxBatchEvents; max > 0 && max < n {
+		n = max
+	}
+	return n
+}
+
+// growWindow grows the adaptive window after sent events have been ACKed, if
+// the window has been filled.
+func (c *SyncClient) growWindow(sent int) {
+	if c.window == 0 || sent < c.window {
+		return
+	}
+
+	c.window = int(math.Ceil(float64(c.window) * c.opts.windowGrowth))
+	if c.window > c.opts.windowMax {
+		c.window = c.opts.windowMax
+	}
+}
+
+// shrinkWindow shrinks the adaptive window after sending failed.
+func (c *SyncClient) shrinkWindow() {
+	if c.window == 0 {
+		return
+	}
+
+	c.window = int(float64(c.window) * c.opts.windowBackoff)
+	if c.window < 1 {
+		c.window = 1
+	}
+}
+
+// reconnect closes the current connection and dials the server until a new
+// connection has been established, sleeping with backoff before each attempt.
+func (c *SyncClient) reconnect(ctx context.Context, retry *int) error {
+	if c.cl != nil {
+		_ = c.cl.Close()
+		c.cl = nil
+	}
+
+	for {
+		if c.opts.maxRetries > 0 && *retry >= c.opts.maxRetries {
+			return ErrTooManyRetries
+		}
+
+		d := backoff(c.opts.backoffInit, c.opts.backoffMax, *retry)
+		*retry++
+		if err := sleepContext(ctx, d); err != nil {
+			return err
+		}
+
+		cl, err := c.dial(ctx)
+		if err == nil {
+			c.cl = cl
+			return nil
+		}
+	}
+}
+
+func (c *SyncClient) sendWindow(data []interface{}) (int, error) {
+	if c.cl == nil {
+		return 0, errNotConnected
+	}
 	if err := c.cl.Send(data); err != nil {
 		return 0, err
 	}
@@ -0,0 +1,287 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// trackingDialer dials TCP connections, remembering the last connection.
+type trackingDialer struct {
+	mu    sync.Mutex
+	dials int
+	conn  net.Conn
+}
+
+func (d *trackingDialer) dial(network, address string) (net.Conn, error) {
+	c, err := net.Dial(network, address)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dials++
+	d.conn = c
+	return c, err
+}
+
+func (d *trackingDialer) dropConn() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.conn.Close()
+}
+
+func TestSyncClientReconnect(t *testing.T) {
+	s, recv := startACKServer(t)
+
+	var d trackingDialer
+	c, err := SyncDialWith(d.dial, s.addr, Backoff(time.Millisecond, 10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.Send([]interface{}{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	d.dropConn()
+	if n, err := c.Send([]interface{}{2, 3}); err != nil || n != 2 {
+		t.Fatalf("expected send to succeed after reconnect, got n=%v, err=%v", n, err)
+	}
+	if d.dials != 2 {
+		t.Errorf("expected 2 dials, got %v", d.dials)
+	}
+	if n := countReceived(recv); n != 3 {
+		t.Errorf("expected 3 events, got %v", n)
+	}
+}
+
+func TestSyncClientNoBackoff(t *testing.T) {
+	s, _ := startACKServer(t)
+
+	var d trackingDialer
+	c, err := SyncDialWith(d.dial, s.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	d.dropConn()
+	if _, err := c.Send([]interface{}{1}); err == nil {
+		t.Error("expected send to fail without backoff")
+	}
+	if d.dials != 1 {
+		t.Errorf("expected client not to reconnect, got %v dials", d.dials)
+	}
+}
+
+func TestSyncClientEncodeError(t *testing.T) {
+	s, recv := startACKServer(t)
+
+	var d trackingDialer
+	c, err := SyncDialWith(d.dial, s.addr, Backoff(time.Millisecond, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var jsonErr *json.UnsupportedTypeError
+	if n, err := c.Send([]interface{}{1, make(chan int)}); !errors.As(err, &jsonErr) || n != 0 {
+		t.Errorf("expected encoding error, got n=%v, err=%v", n, err)
+	}
+	if n, err := c.Send([]interface{}{2}); err != nil || n != 1 {
+		t.Fatalf("expected send to succeed, got n=%v, err=%v", n, err)
+	}
+	if d.dials != 1 {
+		t.Errorf("expected client not to reconnect, got %v dials", d.dials)
+	}
+	if n := countReceived(recv); n != 1 {
+		t.Errorf("expected 1 event, got %v", n)
+	}
+}
+
+func TestSyncClientMaxRetries(t *testing.T) {
+	s, _ := startACKServer(t)
+
+	var d trackingDialer
+	c, err := SyncDialWith(d.dial, s.addr,
+		Backoff(time.Millisecond, time.Millisecond), MaxRetries(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	s.Close()
+	d.dropConn()
+	if _, err := c.Send([]interface{}{1}); err != ErrTooManyRetries {
+		t.Errorf("expected ErrTooManyRetries, got %v", err)
+	}
+	if d.dials != 3 {
+		t.Errorf("expected 2 reconnect attempts, got %v dials", d.dials)
+	}
+}
+
+func TestSyncClientBackoffCancel(t *testing.T) {
+	s, _ := startACKServer(t)
+
+	var d trackingDialer
+	c, err := SyncDialWith(d.dial, s.addr, Backoff(time.Hour, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	d.dropConn()
+	start := time.Now()
+	if _, err := c.SendContext(ctx, []interface{}{1}); err != context.DeadlineExceeded {
+		t.Errorf("expected context error, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("cancelling context did not interrupt backoff")
+	}
+}
+
+// startLimitServer starts a server ACKing windows of up to limit events. Bigger
+// windows are never ACKed, simulating a server too slow to process them before
+// the client times out. Window sizes received are reported on the returned
+// channel.
+func startLimitServer(t *testing.T, limit int) (string, <-chan int) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	windows := make(chan int, 100)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					count, err := readWindow(conn)
+					if err != nil {
+						return
+					}
+					windows <- count
+					if count <= limit {
+						writeACK(conn, uint32(count))
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), windows
+}
+
+func receivedWindows(ch <-chan int) []int {
+	var windows []int
+	for {
+		select {
+		case n := <-ch:
+			windows = append(windows, n)
+		default:
+			return windows
+		}
+	}
+}
+
+func TestSyncClientAdaptiveWindowGrowth(t *testing.T) {
+	addr, windows := startLimitServer(t, 1000)
+
+	c, err := SyncDial(addr, AdaptiveWindow(2, 16), Timeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	data := make([]interface{}, 50)
+	if n, err := c.Send(data); err != nil || n != len(data) {
+		t.Fatalf("send failed: n=%v, err=%v", n, err)
+	}
+
+	got := receivedWindows(windows)
+	expected := []int{2, 4, 8, 16, 16, 4}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected windows %v, got %v", expected, got)
+	}
+	if w := c.WindowSize(); w != 16 {
+		t.Errorf("expected window to stay at max, got %v", w)
+	}
+}
+
+func TestSyncClientAdaptiveWindowBackoff(t *testing.T) {
+	addr, windows := startLimitServer(t, 4)
+
+	c, err := SyncDial(addr,
+		AdaptiveWindow(16, 16),
+		WindowBackoff(0.25),
+		Timeout(50*time.Millisecond),
+		Backoff(time.Millisecond, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	data := make([]interface{}, 8)
+	if n, err := c.Send(data); err != nil || n != len(data) {
+		t.Fatalf("send failed: n=%v, err=%v", n, err)
+	}
+
+	// window of 8 times out, shrinking the window to 4, growing it to 8 again
+	// after the window has been ACKed
+	got := receivedWindows(windows)
+	expected := []int{8, 4, 4}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected windows %v, got %v", expected, got)
+	}
+	if w := c.WindowSize(); w != 8 {
+		t.Errorf("expected window of 8, got %v", w)
+	}
+}
+
+func TestSyncClientWindowDisabled(t *testing.T) {
+	addr, windows := startLimitServer(t, 1000)
+
+	c, err := SyncDial(addr, Timeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.Send(make([]interface{}, 50)); err != nil {
+		t.Fatal(err)
+	}
+	if got := receivedWindows(windows); !reflect.DeepEqual(got, []int{50}) {
+		t.Errorf("expected batch to be sent in one window, got %v", got)
+	}
+	if w := c.WindowSize(); w != 0 {
+		t.Errorf("expected window size 0, got %v", w)
+	}
+}
@@ -0,0 +1,116 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package lj
+
+import (
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ConnEventKind identifies the connection lifecycle moment reported by a
+// ConnEvent.
+type ConnEventKind uint8
+
+const (
+	// ConnAccepted is reported once a connection has been accepted. For TLS
+	// connections the event is reported after the TLS handshake.
+	ConnAccepted ConnEventKind = iota
+
+	// ConnFirstWindow is reported once the first window has been read.
+	ConnFirstWindow
+
+	// ConnReadError is reported if reading a batch failed, right before the
+	// connection is closed. Clients closing the connection between batches
+	// are not reported.
+	ConnReadError
+
+	// ConnClosed is reported after the connection has been closed.
+	ConnClosed
+)
+
+var connEventKindNames = [...]string{
+	ConnAccepted:    "accepted",
+	ConnFirstWindow: "first window",
+	ConnReadError:   "read error",
+	ConnClosed:      "closed",
+}
+
+func (k ConnEventKind) String() string {
+	if int(k) < len(connEventKindNames) {
+		return connEventKindNames[k]
+	}
+	return "unknown"
+}
+
+// ConnEvent describes a moment in the lifecycle of a client connection. Which
+// fields are set depends on Kind.
+type ConnEvent struct {
+	Kind       ConnEventKind
+	Time       time.Time
+	RemoteAddr net.Addr
+
+	// TLS holds the connection state of TLS connections after the handshake
+	// completed. Set for ConnAccepted. Nil for plain connections or if the
+	// handshake failed, which is reported by ConnReadError.
+	TLS *tls.ConnectionState
+
+	// Events is the number of events in the first window. Set for
+	// ConnFirstWindow.
+	Events int
+
+	// Err is the error reading a batch for ConnReadError. For ConnClosed, Err
+	// is the error the read loop stopped with: io.EOF if the client closed the
+	// connection between batches, the read error, or the error caused by the
+	// server closing the connection, e.g. on shutdown or resend requests.
+	Err error
+
+	// Duration is the time the connection has been open. Set for ConnClosed.
+	Duration time.Duration
+}
+
+// ConnCounters counts the bytes read from and written to a client connection.
+// For TLS connections application bytes are counted, excluding the TLS
+// handshake and record overhead. Counters are totals since the connection has
+// been accepted. ConnCounters is safe for concurrent use. Servers count bytes
+// via AddRead and AddWritten.
+type ConnCounters struct {
+	read    uint64
+	written uint64
+}
+
+// BytesRead returns the number of bytes read from the connection.
+func (c *ConnCounters) BytesRead() uint64 {
+	return atomic.LoadUint64(&c.read)
+}
+
+// BytesWritten returns the number of bytes written to the connection.
+func (c *ConnCounters) BytesWritten() uint64 {
+	return atomic.LoadUint64(&c.written)
+}
+
+// AddRead adds n bytes read from the connection.
+func (c *ConnCounters) AddRead(n int) {
+	atomic.AddUint64(&c.read, uint64(n))
+}
+
+// AddWritten adds n bytes written to the connection.
+func (c *ConnCounters) AddWritten(n int) {
+	atomic.AddUint64(&c.written, uint64(n))
+}
@@ -0,0 +1,101 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package lj
+
+// EventCursor iterates the events of a batch one at a time, decoding events of
+// lazy batches on access. Iteration stops at the first event failing to
+// decode.
+//
+//	c := batch.Cursor()
+//	for c.Next() {
+//		process(c.Event())
+//	}
+//	if err := c.Err(); err != nil {
+//		...
+//	}
+//
+// An EventCursor is not safe for concurrent use.
+type EventCursor struct {
+	batch *Batch
+	idx   int
+	event interface{}
+	err   error
+}
+
+// Cursor returns a new EventCursor positioned before the first event.
+func (b *Batch) Cursor() *EventCursor {
+	return &EventCursor{batch: b, idx: -1}
+}
+
+// Next advances the cursor to the next event. Returns false if all events have
+// been read or an event failed to decode.
+func (c *EventCursor) Next() bool {
+	if c.err != nil || c.idx >= len(c.batch.Events) {
+		return false
+	}
+
+	c.idx++
+	if c.idx >= len(c.batch.Events) {
+		c.event = nil
+		return false
+	}
+
+	c.event, c.err = c.batch.Event(c.idx)
+	return c.err == nil
+}
+
+// Event returns the current event.
+func (c *EventCursor) Event() interface{} {
+	return c.event
+}
+
+// Index returns the index of the current event in the batch.
+func (c *EventCursor) Index() int {
+	return c.idx
+}
+
+// Err returns the error decoding the current event, if any.
+func (c *EventCursor) Err() error {
+	return c.err
+}
+
+// All returns an iterator over all events in the batch, decoding events of
+// lazy batches on access. Iteration stops after yielding the first decoding
+// error. With Go 1.23 or newer, All is used with range-over-func:
+//
+//	for event, err := range batch.All() {
+//		if err != nil {
+//			...
+//		}
+//		process(event)
+//	}
+func (b *Batch) All() func(yield func(interface{}, error) bool) {
+	return func(yield func(interface{}, error) bool) {
+		for c := b.Cursor(); ; {
+			if !c.Next() {
+				if err := c.Err(); err != nil {
+					yield(nil, err)
+				}
+				return
+			}
+			if !yield(c.Event(), nil) {
+				return
+			}
+		}
+	}
+}
@@ -15,47 +15,29 @@
 // specific language governing permissions and limitations
 // under the License.
 
-package v1
+//go:build go1.23
+
+package lj_test
 
 import (
-	"encoding/binary"
-	"net"
-	"time"
+	"encoding/json"
+	"fmt"
 
-	protocol "github.com/elastic/go-lumber/protocol/v1"
+	"github.com/elastic/go-lumber/lj"
 )
 
-type writer struct {
-	c  net.Conn
-	to time.Duration
-}
-
-func newWriter(c net.Conn, to time.Duration) *writer {
-	return &writer{c: c, to: to}
-}
-
-func (w *writer) ACK(n int) error {
-	var buf [6]byte
-	buf[0] = protocol.CodeVersion
-	buf[1] = protocol.CodeACK
-	binary.BigEndian.PutUint32(buf[2:], uint32(n))
+func ExampleBatch_All() {
+	raw := [][]byte{[]byte(`{"message":"hello"}`), []byte(`42`)}
+	batch := lj.NewLazyBatch(raw, json.Unmarshal)
 
-	if err := w.c.SetWriteDeadline(time.Now().Add(w.to)); err != nil {
-		return err
-	}
-
-	tmp := buf[:]
-	for len(tmp) > 0 {
-		n, err := w.c.Write(tmp)
+	for event, err := range batch.All() {
 		if err != nil {
-			return err
+			fmt.Println("error:", err)
+			break
 		}
-		tmp = tmp[n:]
+		fmt.Println(event)
 	}
-	return nil
-}
-
-func (w *writer) Keepalive(n int) error {
-	// keepalive not supported by v1
-	return nil
+	// Output:
+	// map[message:hello]
+	// 42
 }
@@ -0,0 +1,41 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package lj_test
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/elastic/go-lumber/lj"
+)
+
+func ExampleBatch_Cursor() {
+	raw := [][]byte{[]byte(`{"message":"hello"}`), []byte(`{bad`), []byte(`3`)}
+	batch := lj.NewLazyBatch(raw, json.Unmarshal)
+
+	c := batch.Cursor()
+	for c.Next() {
+		fmt.Println(c.Index(), c.Event())
+	}
+	if err := c.Err(); err != nil {
+		fmt.Println("event", c.Index(), "failed to decode")
+	}
+	// Output:
+	// 0 map[message:hello]
+	// event 1 failed to decode
+}
@@ -0,0 +1,81 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package lj
+
+import (
+	"context"
+	"sync"
+)
+
+// EventLimiter limits the number of events in flight, that is events read from
+// clients and not yet ACKed. Implementations must be safe for concurrent use.
+type EventLimiter interface {
+	// Acquire blocks until n more events can be accepted, or ctx is
+	// cancelled. Events acquired are returned via Release.
+	Acquire(ctx context.Context, n int) error
+
+	// Release returns n events acquired before.
+	Release(n int)
+}
+
+type eventLimiter struct {
+	max int
+
+	mu       sync.Mutex
+	inflight int
+	released chan struct{} // closed and replaced on Release
+}
+
+// NewEventLimiter creates an EventLimiter accepting up to max events in flight.
+// A batch of more than max events is accepted once no other events are in
+// flight, such that oversized batches can not block a server forever. max must
+// be positive.
+func NewEventLimiter(max int) EventLimiter {
+	return &eventLimiter{max: max, released: make(chan struct{})}
+}
+
+func (l *eventLimiter) Acquire(ctx context.Context, n int) error {
+	for {
+		l.mu.Lock()
+		if l.inflight == 0 || l.inflight+n <= l.max {
+			l.inflight += n
+			l.mu.Unlock()
+			return nil
+		}
+		released := l.released
+		l.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (l *eventLimiter) Release(n int) {
+	if n == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	l.inflight -= n
+	close(l.released)
+	l.released = make(chan struct{})
+	l.mu.Unlock()
+}
@@ -18,25 +18,509 @@
 // Package lj implements common lumberjack types and functions.
 package lj
 
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
 // Batch is an ACK-able batch of events as has been received by lumberjack
 // server implemenentations. Batches must be ACKed, for the server
 // implementations returning an ACK to it's clients.
 type Batch struct {
+	// Events holds the events of the batch. Entries of lazy batches are nil
+	// until decoded. Prefer reading events via Cursor or All, which decode
+	// events on access.
 	Events []interface{}
-	ack    chan struct{}
+
+	// RawEvents holds the event payloads of raw batches (see NewRawBatch),
+	// which are never decoded. Events is nil for raw batches. Use Len for the
+	// number of events of any batch.
+	RawEvents [][]byte
+
+	// Sequences holds the sequence numbers the client assigned to the events
+	// of the batch, in the order of Events or RawEvents, if enabled via the
+	// server option EventSequences. Sequence numbers of dropped events are not
+	// included. It is nil for batches not read by a server, and is not
+	// updated by middleware replacing or filtering events.
+	Sequences []uint32
+
+	// ProtocolVersion is the lumberjack protocol version code ('1' or '2') the
+	// batch has been received with. It is 0 if the batch has not been created
+	// by a server reader.
+	ProtocolVersion byte
+
+	// Dropped is the number of events received in the window, but not
+	// included in Events, e.g. due to decoding errors. The ACK returned to the
+	// client covers dropped events as well.
+	Dropped int
+
+	// Partial is set if the connection failed before the complete window has
+	// been received (see server option PartialBatches). Partial batches are
+	// never ACKed to the client, which resends the complete window.
+	Partial bool
+
+	// PossibleDuplicate is set if the window is likely resent by the client,
+	// e.g. after an ACK timeout. Detection is best effort. If the previous
+	// connection of the client, identified by IP address, has been closed
+	// with windows not ACKed to the client, as many windows read first from
+	// its next connection are flagged. Additionally, for lumberjack v2 clients
+	// numbering events across windows with increasing sequence numbers,
+	// windows overlapping sequence numbers ACKed before on the same connection
+	// are flagged.
+	PossibleDuplicate bool
+
+	// WireBytes is the number of lumberjack protocol bytes read for the batch,
+	// including frame headers and compressed frames. With stream compression,
+	// WireBytes is the number of compressed bytes read from the connection.
+	// DecodedBytes is the number of event payload bytes after decompression.
+	WireBytes    int
+	DecodedBytes int
+
+	// ReceivedAt is the time the server finished reading the batch.
+	ReceivedAt time.Time
+
+	// ClientX509Cert is the leaf certificate presented by the client for TLS
+	// connections, or nil. The certificate has only been verified if the
+	// server TLS configuration requires client certificate verification.
+	ClientX509Cert *x509.Certificate
+
+	// TLS holds the connection state of the TLS connection the batch has been
+	// read from, if enabled via the server option TLSConnectionState. It is
+	// nil for plain TCP connections. The state is shared by all batches of
+	// the connection and must not be modified. ClientX509Cert is the first
+	// of TLS.PeerCertificates.
+	TLS *tls.ConnectionState
+
+	// Conn holds the byte counters of the connection the batch has been read
+	// from, shared by all batches of the connection. Use for attributing bytes
+	// to clients, e.g. by ClientX509Cert. Nil if the batch has not been read by
+	// a server.
+	Conn *ConnCounters
+
+	// ConflictPolicy configures how calls to ACK and RequestResend are resolved
+	// if a batch is completed more than once. The default is FirstCallWins.
+	ConflictPolicy ConflictPolicy
+
+	mu       sync.Mutex
+	ack      chan struct{}
+	done     bool
+	doneTime time.Time
+	resend   bool
+	size     int         // size + 1 cached by Size, 0 if not yet computed
+	meta     []metaEntry // metadata set via SetMeta
+
+	// raw event payloads not yet decoded for lazy batches
+	raw     [][]byte
+	decoder func([]byte, interface{}) error
+}
+
+type metaEntry struct {
+	key   string
+	value interface{}
 }
 
+// ConflictPolicy defines the outcome of a batch being completed multiple
+// times via ACK or RequestResend.
+type ConflictPolicy uint8
+
+const (
+	// FirstCallWins ignores all but the first call to ACK or RequestResend.
+	FirstCallWins ConflictPolicy = iota
+
+	// LastCallWins lets the last call to ACK or RequestResend define the
+	// outcome. The server acts on the outcome once the batch has been
+	// completed first, later calls have no effect after the server did ACK to
+	// or close the connection.
+	LastCallWins
+
+	// PanicOnConflict panics if a batch is completed by ACK and RequestResend
+	// each. Use for detecting racing consumers during development.
+	PanicOnConflict
+)
+
+// FullChannelPolicy configures server behavior if the channel received batches
+// are forwarded to is full.
+type FullChannelPolicy uint8
+
+const (
+	// FullChannelBlock blocks reading from the connection until the batch can
+	// be forwarded. The client's TCP window fills up, applying backpressure to
+	// the client.
+	FullChannelBlock FullChannelPolicy = iota
+
+	// FullChannelDropOldest evicts the oldest batch not yet consumed from the
+	// channel. Resend is requested for the evicted batch, closing the
+	// connection it has been received from. Events are not lost, as the client
+	// must resend the batch.
+	//
+	// The channel is shared by all connections and a connection never has more
+	// than one batch queued, so the evicted batch always belongs to another
+	// client. A single fast client can force slower clients to reconnect and
+	// resend repeatedly. Use one channel per client (see server.SNIRouter) or
+	// FullChannelReject to keep the impact of a full channel on the client
+	// causing it.
+	FullChannelDropOldest
+
+	// FullChannelReject closes the connection the new batch has been received
+	// from without ACKing the batch, forcing the client to back off and resend
+	// the batch.
+	FullChannelReject
+)
+
+// IPStack selects the IP versions a server listener accepts connections on.
+type IPStack uint8
+
+const (
+	// DefaultStack binds the listen address as net.Listen does. Whether a
+	// wildcard address accepts IPv4, IPv6 or both depends on the address
+	// and the platform. E.g. "0.0.0.0:5044" accepts IPv6 connections on
+	// Linux too.
+	DefaultStack IPStack = iota
+
+	// DualStack binds a single IPv6 socket with IPV6_V6ONLY disabled,
+	// accepting IPv4 connections as IPv4-mapped IPv6 addresses. The listen
+	// address must be empty or "::". Listening fails on platforms without
+	// IPv4-mapped address support (e.g. OpenBSD) or with IPv6 disabled.
+	DualStack
+
+	// IPv4Only binds an IPv4 socket. An empty host binds "0.0.0.0".
+	IPv4Only
+
+	// IPv6Only binds an IPv6 socket with IPV6_V6ONLY enabled. An empty host
+	// binds "::". Windows and some BSDs enable IPV6_V6ONLY by default, Linux
+	// depends on the net.ipv6.bindv6only sysctl; the option is always set
+	// explicitly.
+	IPv6Only
+)
+
 // NewBatch creates a new ACK-able batch.
 func NewBatch(evts []interface{}) *Batch {
-	return &Batch{evts, make(chan struct{})}
+	return &Batch{Events: evts, ack: make(chan struct{})}
+}
+
+// NewLazyBatch creates a new ACK-able batch of encoded events. Events are
+// decoded using decoder on first access via Event. Until then the
+// corresponding entry in Events is nil.
+//
+// The raw payloads are referenced by the batch until decoded and must not be
+// modified by the caller.
+func NewLazyBatch(raw [][]byte, decoder func([]byte, interface{}) error) *Batch {
+	return &Batch{
+		Events:  make([]interface{}, len(raw)),
+		ack:     make(chan struct{}),
+		raw:     raw,
+		decoder: decoder,
+	}
+}
+
+// NewRawBatch creates a new ACK-able batch of event payloads, which are passed
+// to consumers in RawEvents without being decoded.
+func NewRawBatch(raw [][]byte) *Batch {
+	return &Batch{RawEvents: raw, ack: make(chan struct{})}
+}
+
+// ResetLazy reinitializes b as a batch of encoded events, as created by
+// NewLazyBatch, such that readers can reuse a batch across reads. The storage
+// of Events is reused if large enough. All other fields are reset. A batch
+// still pending ACK keeps its ACK channel, a new channel is created if the
+// batch has already been completed.
+//
+// The batch must not be in use by a server or consumer while being reset.
+func (b *Batch) ResetLazy(raw [][]byte, decoder func([]byte, interface{}) error) {
+	events := b.Events[:0]
+	if cap(events) < len(raw) {
+		events = make([]interface{}, len(raw))
+	} else {
+		events = events[:len(raw)]
+		for i := range events {
+			events[i] = nil
+		}
+	}
+
+	b.reset()
+	b.Events = events
+	b.raw = raw
+	b.decoder = decoder
+}
+
+// ResetRaw reinitializes b as a raw batch of the payloads raw, as created by
+// NewRawBatch. See ResetLazy.
+func (b *Batch) ResetRaw(raw [][]byte) {
+	b.reset()
+	b.RawEvents = raw
+}
+
+func (b *Batch) reset() {
+	b.Events = nil
+	b.RawEvents = nil
+	b.Sequences = nil
+	b.ProtocolVersion = 0
+	b.Dropped = 0
+	b.Partial = false
+	b.PossibleDuplicate = false
+	b.WireBytes = 0
+	b.DecodedBytes = 0
+	b.ReceivedAt = time.Time{}
+	b.ClientX509Cert = nil
+	b.TLS = nil
+	b.Conn = nil
+	b.ConflictPolicy = FirstCallWins
+	b.raw = nil
+	b.decoder = nil
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.ack == nil || b.done {
+		b.ack = make(chan struct{})
+	}
+	b.done = false
+	b.doneTime = time.Time{}
+	b.resend = false
+	b.size = 0
+	b.meta = nil
+}
+
+// Size returns the total size of the event payloads in bytes. For batches read
+// by a server, Size is the number of payload bytes received (see
+// DecodedBytes). Otherwise Size sums the lengths of the raw payloads, and the
+// length of the JSON encoding of decoded events. The size is computed on first
+// call only, as events must not be modified after the batch has been created.
+func (b *Batch) Size() int {
+	if b.DecodedBytes > 0 {
+		return b.DecodedBytes
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.size > 0 {
+		return b.size - 1
+	}
+
+	size := 0
+	for _, raw := range b.RawEvents {
+		size += len(raw)
+	}
+	for i, event := range b.Events {
+		if b.raw != nil && b.raw[i] != nil {
+			size += len(b.raw[i])
+			continue
+		}
+		if enc, err := json.Marshal(event); err == nil {
+			size += len(enc)
+		}
+	}
+	b.size = size + 1
+	return size
+}
+
+// Len returns the number of events in the batch, excluding dropped events.
+func (b *Batch) Len() int {
+	if b.RawEvents != nil {
+		return len(b.RawEvents)
+	}
+	return len(b.Events)
+}
+
+// Event returns the i-th event in the batch. Events of batches created with
+// NewLazyBatch are decoded on first access. Event is not safe for concurrent
+// use.
+func (b *Batch) Event(i int) (interface{}, error) {
+	if b.raw != nil && b.raw[i] != nil {
+		var event interface{}
+		if err := b.decoder(b.raw[i], &event); err != nil {
+			return nil, err
+		}
+		b.Events[i] = event
+		b.raw[i] = nil
+	}
+	return b.Events[i], nil
+}
+
+// WriteNDJSON writes all events in the batch as newline delimited JSON to w.
+// Payloads of raw batches and events not yet decoded are compacted before
+// being written, such that raw payloads containing newlines (e.g. pretty
+// printed JSON) produce one line per event. Returns the number of events
+// written.
+func (b *Batch) WriteNDJSON(w io.Writer) (int, error) {
+	var buf bytes.Buffer
+	if b.RawEvents != nil {
+		for i, raw := range b.RawEvents {
+			if err := writeCompactLine(w, &buf, raw); err != nil {
+				return i, err
+			}
+		}
+		return len(b.RawEvents), nil
+	}
+
+	enc := json.NewEncoder(w)
+	for i, event := range b.Events {
+		if b.raw != nil && b.raw[i] != nil {
+			if err := writeCompactLine(w, &buf, b.raw[i]); err != nil {
+				return i, err
+			}
+			continue
+		}
+
+		if err := enc.Encode(event); err != nil {
+			return i, err
+		}
+	}
+	return len(b.Events), nil
+}
+
+// writeCompactLine writes the JSON document raw compacted into a single line
+// to w, using buf as scratch space.
+func writeCompactLine(w io.Writer, buf *bytes.Buffer, raw []byte) error {
+	buf.Reset()
+	if err := json.Compact(buf, raw); err != nil {
+		return err
+	}
+	buf.WriteByte('\n')
+	_, err := w.Write(buf.Bytes())
+	return err
 }
 
 // ACK acknowledges a batch initiating propagation of ACK to clients.
 func (b *Batch) ACK() {
-	close(b.ack)
+	b.complete(false)
+}
+
+// RequestResend completes the batch without ACKing it. Instead of returning an
+// ACK, the server closes the connection the batch has been received from,
+// forcing the client to resend all events not yet ACKed. If combined with ACK,
+// the outcome is determined by the batch's ConflictPolicy.
+func (b *Batch) RequestResend() {
+	b.complete(true)
+}
+
+// ResendRequested reports whether RequestResend has been called for this
+// batch. It must only be called after the channel returned by Await has been
+// closed.
+func (b *Batch) ResendRequested() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.resend
+}
+
+func (b *Batch) complete(resend bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.done {
+		b.done = true
+		b.doneTime = time.Now()
+		b.resend = resend
+		close(b.ack)
+		return
+	}
+
+	switch b.ConflictPolicy {
+	case LastCallWins:
+		b.resend = resend
+	case PanicOnConflict:
+		if b.resend != resend {
+			panic("lj: batch has been ACKed and resend requested")
+		}
+	}
+}
+
+// CompletedAt returns the time the batch has been ACKed or resend has been
+// requested first. Returns the zero time if the batch is still pending.
+func (b *Batch) CompletedAt() time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.doneTime
 }
 
 // Await returns a channel for waiting for a batch to be ACKed.
 func (b *Batch) Await() <-chan struct{} {
 	return b.ack
 }
+
+// AwaitContext waits for the batch to be ACKed or ctx being cancelled. Returns
+// nil if the batch has been ACKed (or resend has been requested), ctx.Err()
+// otherwise.
+func (b *Batch) AwaitContext(ctx context.Context) error {
+	select {
+	case <-b.ack:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SetMeta attaches the metadata value v to the batch under key, replacing the
+// value set before. Metadata is not interpreted by lumberjack, but passes
+// derived information like tenant IDs or trace context from the code reading
+// a batch to its consumers. Batches without metadata do not allocate.
+func (b *Batch) SetMeta(key string, v interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := range b.meta {
+		if b.meta[i].key == key {
+			b.meta[i].value = v
+			return
+		}
+	}
+	b.meta = append(b.meta, metaEntry{key: key, value: v})
+}
+
+// Meta returns the metadata value set for key via SetMeta. Returns false if no
+// value has been set.
+func (b *Batch) Meta(key string) (interface{}, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, e := range b.meta {
+		if e.key == key {
+			return e.value, true
+		}
+	}
+	return nil, false
+}
+
+// ClientCommonName returns the subject common name of the client certificate.
+// Returns false if the batch has no client certificate.
+func (b *Batch) ClientCommonName() (string, bool) {
+	if b.ClientX509Cert == nil {
+		return "", false
+	}
+	return b.ClientX509Cert.Subject.CommonName, true
+}
+
+// ClientDNSNames returns the DNS subject alternative names of the client
+// certificate. Returns nil if the batch has no client certificate.
+func (b *Batch) ClientDNSNames() []string {
+	if b.ClientX509Cert == nil {
+		return nil
+	}
+	return b.ClientX509Cert.DNSNames
+}
+
+// ClientEmailAddresses returns the email subject alternative names of the
+// client certificate. Returns nil if the batch has no client certificate.
+func (b *Batch) ClientEmailAddresses() []string {
+	if b.ClientX509Cert == nil {
+		return nil
+	}
+	return b.ClientX509Cert.EmailAddresses
+}
+
+// ClientURIs returns the URI subject alternative names of the client
+// certificate. Returns nil if the batch has no client certificate.
+func (b *Batch) ClientURIs() []string {
+	if b.ClientX509Cert == nil {
+		return nil
+	}
+
+	var uris []string
+	for _, u := range b.ClientX509Cert.URIs {
+		uris = append(uris, u.String())
+	}
+	return uris
+}
@@ -0,0 +1,281 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package lj
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConflictPolicy(t *testing.T) {
+	ack := func(b *Batch) { b.ACK() }
+	resend := func(b *Batch) { b.RequestResend() }
+
+	tests := []struct {
+		name       string
+		policy     ConflictPolicy
+		calls      []func(*Batch)
+		wantResend bool
+		wantPanic  bool
+	}{
+		{"first wins, ACK then resend", FirstCallWins, []func(*Batch){ack, resend}, false, false},
+		{"first wins, resend then ACK", FirstCallWins, []func(*Batch){resend, ack}, true, false},
+		{"last wins, ACK then resend", LastCallWins, []func(*Batch){ack, resend}, true, false},
+		{"last wins, resend then ACK", LastCallWins, []func(*Batch){resend, ack}, false, false},
+		{"panic, ACK then resend", PanicOnConflict, []func(*Batch){ack, resend}, false, true},
+		{"panic, resend then ACK", PanicOnConflict, []func(*Batch){resend, ack}, true, true},
+		{"panic, ACK twice", PanicOnConflict, []func(*Batch){ack, ack}, false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := NewBatch([]interface{}{1})
+			b.ConflictPolicy = test.policy
+
+			panicked := func() (panicked bool) {
+				defer func() { panicked = recover() != nil }()
+				for _, call := range test.calls {
+					call(b)
+				}
+				return false
+			}()
+
+			if panicked != test.wantPanic {
+				t.Errorf("panic=%v, want %v", panicked, test.wantPanic)
+			}
+			if got := b.ResendRequested(); got != test.wantResend {
+				t.Errorf("ResendRequested()=%v, want %v", got, test.wantResend)
+			}
+			select {
+			case <-b.Await():
+			default:
+				t.Error("batch not completed")
+			}
+		})
+	}
+}
+
+func TestWriteNDJSON(t *testing.T) {
+	raw := [][]byte{
+		[]byte(`{"message":"compact"}`),
+		[]byte("{\n  \"message\": \"pretty\",\n  \"tags\": [\n    \"a\"\n  ]\n}\n"),
+		[]byte(`"decoded"`),
+		[]byte(`42`),
+	}
+	b := NewLazyBatch(raw, json.Unmarshal)
+	if _, err := b.Event(2); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	n, err := b.WriteNDJSON(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Errorf("expected 4 events written, got %v", n)
+	}
+
+	expected := `{"message":"compact"}
+{"message":"pretty","tags":["a"]}
+"decoded"
+42
+`
+	if got := buf.String(); got != expected {
+		t.Errorf("unexpected NDJSON output:\n%s\nwant:\n%s", got, expected)
+	}
+}
+
+func TestWriteNDJSONRawBatch(t *testing.T) {
+	b := NewRawBatch([][]byte{
+		[]byte(`{"message":"compact"}`),
+		[]byte("{\n  \"message\": \"pretty\"\n}\n"),
+	})
+
+	var buf bytes.Buffer
+	n, err := b.WriteNDJSON(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "{\"message\":\"compact\"}\n{\"message\":\"pretty\"}\n"
+	if n != 2 || buf.String() != expected {
+		t.Errorf("expected 2 events written as %q, got n=%v, %q", expected, n, buf.String())
+	}
+}
+
+func TestWriteNDJSONInvalidRaw(t *testing.T) {
+	b := NewLazyBatch([][]byte{[]byte(`1`), []byte(`{bad`)}, json.Unmarshal)
+
+	var buf bytes.Buffer
+	n, err := b.WriteNDJSON(&buf)
+	if err == nil {
+		t.Fatal("expected error for invalid raw event")
+	}
+	if n != 1 || buf.String() != "1\n" {
+		t.Errorf("expected first event only to be written, got n=%v, %q", n, buf.String())
+	}
+}
+
+func TestClientCertNames(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri, _ := url.Parse("spiffe://example.org/tenant/a")
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(1),
+		Subject:        pkix.Name{CommonName: "tenant-a"},
+		DNSNames:       []string{"a.example.org", "b.example.org"},
+		EmailAddresses: []string{"ops@example.org"},
+		URIs:           []*url.URL{uri},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Batch{ClientX509Cert: cert}
+	if cn, ok := b.ClientCommonName(); !ok || cn != "tenant-a" {
+		t.Errorf("unexpected common name: %q, %v", cn, ok)
+	}
+	if got := b.ClientDNSNames(); !reflect.DeepEqual(got, tmpl.DNSNames) {
+		t.Errorf("unexpected DNS names: %v", got)
+	}
+	if got := b.ClientEmailAddresses(); !reflect.DeepEqual(got, tmpl.EmailAddresses) {
+		t.Errorf("unexpected email addresses: %v", got)
+	}
+	if got := b.ClientURIs(); !reflect.DeepEqual(got, []string{uri.String()}) {
+		t.Errorf("unexpected URIs: %v", got)
+	}
+
+	b = &Batch{}
+	if cn, ok := b.ClientCommonName(); ok || cn != "" {
+		t.Errorf("expected no common name without certificate, got %q", cn)
+	}
+	if b.ClientDNSNames() != nil || b.ClientEmailAddresses() != nil || b.ClientURIs() != nil {
+		t.Error("expected no names without certificate")
+	}
+}
+
+func TestSize(t *testing.T) {
+	b := NewBatch([]interface{}{"abc", map[string]interface{}{"a": 1}})
+	if size := b.Size(); size != len(`"abc"`)+len(`{"a":1}`) {
+		t.Errorf("unexpected size %v", size)
+	}
+
+	// size is cached
+	b.Events[0] = "abcdef"
+	if size := b.Size(); size != 12 {
+		t.Errorf("expected cached size, got %v", size)
+	}
+
+	lazy := NewLazyBatch([][]byte{[]byte(`{"a": 1}`), []byte(`2`)}, json.Unmarshal)
+	if _, err := lazy.Event(1); err != nil {
+		t.Fatal(err)
+	}
+	if size := lazy.Size(); size != 9 {
+		t.Errorf("unexpected lazy batch size %v", size)
+	}
+
+	if size := NewRawBatch([][]byte{[]byte(`abc`), []byte(`de`)}).Size(); size != 5 {
+		t.Errorf("unexpected raw batch size %v", size)
+	}
+
+	read := NewBatch([]interface{}{1})
+	read.DecodedBytes = 100
+	if size := read.Size(); size != 100 {
+		t.Errorf("expected DecodedBytes, got %v", size)
+	}
+}
+
+func TestMeta(t *testing.T) {
+	b := NewBatch([]interface{}{1})
+	if allocs := testing.AllocsPerRun(10, func() { b.Meta("tenant") }); allocs != 0 {
+		t.Errorf("expected Meta not to allocate, got %v allocations", allocs)
+	}
+	if _, ok := b.Meta("tenant"); ok {
+		t.Error("expected no metadata")
+	}
+
+	b.SetMeta("tenant", "a")
+	b.SetMeta("trace", 42)
+	b.SetMeta("tenant", "b")
+	if v, ok := b.Meta("tenant"); !ok || v != "b" {
+		t.Errorf("expected replaced tenant, got %v, %v", v, ok)
+	}
+	if v, ok := b.Meta("trace"); !ok || v != 42 {
+		t.Errorf("unexpected trace %v, %v", v, ok)
+	}
+
+	b.ResetRaw(nil)
+	if _, ok := b.Meta("tenant"); ok {
+		t.Error("expected reset to clear metadata")
+	}
+}
+
+func TestEventLimiter(t *testing.T) {
+	l := NewEventLimiter(3)
+	ctx := context.Background()
+
+	if err := l.Acquire(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan error, 1)
+	go func() { acquired <- l.Acquire(ctx, 2) }()
+	select {
+	case err := <-acquired:
+		t.Fatalf("expected Acquire to block, got %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	l.Release(2)
+	if err := <-acquired; err != nil {
+		t.Fatal(err)
+	}
+
+	cancelled, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := l.Acquire(cancelled, 2); err != context.DeadlineExceeded {
+		t.Errorf("expected Acquire to be cancelled, got %v", err)
+	}
+
+	// oversized batches are accepted once no events are in flight
+	l.Release(2)
+	if err := l.Acquire(ctx, 10); err != nil {
+		t.Fatal(err)
+	}
+	l.Release(10)
+}
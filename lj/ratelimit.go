@@ -0,0 +1,125 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package lj
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter limits the rate of events accepted per client IP address.
+// Implementations must be safe for concurrent use.
+type RateLimiter interface {
+	// Wait blocks until n more events from the client with IP address ip can be
+	// accepted, or ctx is cancelled.
+	Wait(ctx context.Context, ip string, n int) error
+}
+
+type tokenBucketLimiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+const rateLimiterSweepInterval = 10 * time.Second
+
+// NewRateLimiter creates a RateLimiter using a token bucket per IP address,
+// accepting eventsPerSecond events on average, with bursts of up to burst
+// events. Buckets of inactive IP addresses are evicted once refilled.
+// eventsPerSecond and burst must be positive.
+func NewRateLimiter(eventsPerSecond float64, burst int) RateLimiter {
+	return &tokenBucketLimiter{
+		rate:      eventsPerSecond,
+		burst:     float64(burst),
+		buckets:   map[string]*tokenBucket{},
+		lastSweep: time.Now(),
+	}
+}
+
+// Wait consumes n tokens from the bucket of ip, blocking until the bucket is
+// not in debt anymore. Batches larger than burst are accepted, delaying
+// following batches accordingly.
+func (l *tokenBucketLimiter) Wait(ctx context.Context, ip string, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.sweep(now)
+
+	b := l.buckets[ip]
+	if b == nil {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[ip] = b
+	} else {
+		b.tokens = l.refill(b, now)
+		b.last = now
+	}
+
+	b.tokens -= float64(n)
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// return tokens not used
+		l.mu.Lock()
+		b.tokens += float64(n)
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (l *tokenBucketLimiter) refill(b *tokenBucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Seconds()*l.rate
+	if tokens > l.burst {
+		tokens = l.burst
+	}
+	return tokens
+}
+
+// sweep removes buckets being full. A full bucket behaves like a new one.
+func (l *tokenBucketLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimiterSweepInterval {
+		return
+	}
+
+	l.lastSweep = now
+	for ip, b := range l.buckets {
+		if l.refill(b, now) >= l.burst {
+			delete(l.buckets, ip)
+		}
+	}
+}
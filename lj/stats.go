@@ -0,0 +1,73 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package lj
+
+import "time"
+
+// Stats is a snapshot of server statistics. Counters are totals since the
+// server has been started.
+type Stats struct {
+	// ActiveConnections is the number of client connections currently being
+	// served.
+	ActiveConnections int
+
+	// Connections is the total number of client connections accepted.
+	Connections uint64
+
+	// Rejected is the number of connections closed right after accept, as the
+	// client address is not permitted or the client did not present a
+	// verified certificate.
+	Rejected uint64
+
+	// Batches and Events count the batches and events read from clients,
+	// including batches not yet ACKed.
+	Batches uint64
+	Events  uint64
+
+	// Bytes is the number of bytes read from the network for all batches. See
+	// Batch.WireBytes.
+	Bytes uint64
+
+	// ReadErrors counts connections closed due to a protocol or network error
+	// while reading a batch. Clients disconnecting between batches are not
+	// counted.
+	ReadErrors uint64
+
+	// PartialBatches counts incomplete batches passed to consumers after a
+	// read error. See Batch.Partial.
+	PartialBatches uint64
+
+	// DroppedEvents counts events received, but dropped from their batch due
+	// to failing to decode. See Batch.Dropped.
+	DroppedEvents uint64
+
+	// Uptime is the time passed since the server has been started.
+	Uptime time.Duration
+}
+
+// CloseResult reports the outcome of closing a server with a drain timeout.
+type CloseResult struct {
+	// ForcedConns is the number of connections still open after the drain
+	// timeout, which have been closed forcibly.
+	ForcedConns int
+
+	// Dropped is true if batches of forcibly closed connections have not been
+	// ACKed. Clients resend batches not ACKed, such that these events might be
+	// received again after a restart.
+	Dropped bool
+}
@@ -0,0 +1,108 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package lumbertest_test
+
+import (
+	"fmt"
+	"time"
+
+	client "github.com/elastic/go-lumber/client/v2"
+	"github.com/elastic/go-lumber/lumbertest"
+	server "github.com/elastic/go-lumber/server/v2"
+)
+
+func Example() {
+	s, err := lumbertest.NewServer()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	c, err := s.SyncClient(client.Timeout(5 * time.Second))
+	if err != nil {
+		panic(err)
+	}
+	defer c.Close()
+
+	go func() {
+		b := s.Receive()
+		fmt.Println(b.Events)
+		b.ACK()
+	}()
+
+	n, err := c.Send([]interface{}{"hello", "world"})
+	fmt.Println(n, err)
+
+	// Output:
+	// [hello world]
+	// 2 <nil>
+}
+
+func ExampleServer_Replay() {
+	s, err := lumbertest.NewServer()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	var frames lumbertest.Frames
+	frames.Window(2).
+		JSON(1, `{"message":"plain"}`).
+		Compressed(new(lumbertest.Frames).JSON(2, `{"message":"compressed"}`))
+
+	conn, err := s.Replay(frames.Bytes())
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+
+	b := s.Receive()
+	fmt.Println(b.Events)
+	b.ACK()
+	fmt.Println(lumbertest.ReadACK(conn))
+
+	// Output:
+	// [map[message:plain] map[message:compressed]]
+	// 2 <nil>
+}
+
+func ExampleFrames_Truncate() {
+	s, err := lumbertest.NewServer(server.Timeout(50 * time.Millisecond))
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	// the header of the second event is cut short
+	var frames lumbertest.Frames
+	frames.Window(2).JSON(1, `1`).JSON(2, `2`)
+	frames.Truncate(frames.Len() - 5)
+
+	conn, err := s.Replay(frames.Bytes())
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+
+	// the server times out waiting for the event and closes the connection
+	_, err = lumbertest.ReadACK(conn)
+	fmt.Println(err)
+
+	// Output:
+	// EOF
+}
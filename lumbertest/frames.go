@@ -0,0 +1,108 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package lumbertest
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/klauspost/compress/zlib"
+
+	protocol "github.com/elastic/go-lumber/protocol/v2"
+)
+
+// Frames builds raw lumberjack protocol version 2 byte streams. Frames are
+// appended in the order the methods are called, without checking the stream
+// for being valid, such that malformed streams (e.g. windows announcing more
+// events than being sent, unknown frame codes or truncated headers) can be
+// built. The zero value is ready to use.
+type Frames struct {
+	buf bytes.Buffer
+	enc protocol.Encoder
+}
+
+// Window appends a window frame announcing count events.
+func (f *Frames) Window(count uint32) *Frames {
+	_ = f.enc.WriteWindow(&f.buf, count)
+	return f
+}
+
+// JSON appends a JSON data frame with sequence number seq.
+func (f *Frames) JSON(seq uint32, payload string) *Frames {
+	_ = f.enc.WriteJSONEvent(&f.buf, seq, []byte(payload))
+	return f
+}
+
+// KeyValue appends a key-value data frame with sequence number seq.
+func (f *Frames) KeyValue(seq uint32, fields map[string]string) *Frames {
+	_ = f.enc.WriteKVEvent(&f.buf, seq, fields)
+	return f
+}
+
+// Compressed appends a compressed frame holding the zlib compressed frames of
+// inner.
+func (f *Frames) Compressed(inner *Frames) *Frames {
+	var payload bytes.Buffer
+	zw := zlib.NewWriter(&payload)
+	_, _ = zw.Write(inner.Bytes())
+	_ = zw.Close()
+
+	f.header(protocol.CodeCompressed, uint32(payload.Len()))
+	f.buf.Write(payload.Bytes())
+	return f
+}
+
+// Frame appends a frame with the given code and length prefixed payload, the
+// layout of compressed and custom frames.
+func (f *Frames) Frame(code byte, payload []byte) *Frames {
+	f.header(code, uint32(len(payload)))
+	f.buf.Write(payload)
+	return f
+}
+
+// Raw appends b as is.
+func (f *Frames) Raw(b ...byte) *Frames {
+	f.buf.Write(b)
+	return f
+}
+
+// Truncate discards all but the first n bytes appended. It panics if n is
+// negative or greater than Len.
+func (f *Frames) Truncate(n int) *Frames {
+	f.buf.Truncate(n)
+	return f
+}
+
+// Len returns the number of bytes appended.
+func (f *Frames) Len() int {
+	return f.buf.Len()
+}
+
+// Bytes returns the byte stream. The slice is valid until the next
+// modification of f.
+func (f *Frames) Bytes() []byte {
+	return f.buf.Bytes()
+}
+
+func (f *Frames) header(code byte, sz uint32) {
+	var hdr [6]byte
+	hdr[0] = protocol.CodeVersion
+	hdr[1] = code
+	binary.BigEndian.PutUint32(hdr[2:], sz)
+	f.buf.Write(hdr[:])
+}
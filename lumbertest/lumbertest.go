@@ -0,0 +1,166 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package lumbertest provides utilities for testing lumberjack clients and
+// servers without the network stack of the operating system.
+//
+// Listener accepts in-memory connections created by its Dial method. Server
+// runs a lumberjack protocol version 2 server on a Listener, connecting clients
+// via in-memory connections. Frames builds raw protocol byte streams, valid and
+// malformed, for testing protocol edge cases.
+package lumbertest
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+
+	client "github.com/elastic/go-lumber/client/v2"
+	protocol "github.com/elastic/go-lumber/protocol/v2"
+	server "github.com/elastic/go-lumber/server/v2"
+)
+
+// Listener is a net.Listener accepting in-memory connections created by Dial.
+// Connections are created by net.Pipe and do not buffer: a write blocks until
+// the peer has read the data. Consume batches while clients pipelining batches
+// are sending, as the server stops reading until the batch waiting for ACK has
+// been ACKed.
+type Listener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// NewListener creates a new Listener.
+func NewListener() *Listener {
+	return &Listener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// Accept waits for the next connection created by Dial. net.ErrClosed is
+// returned once the listener is closed.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the listener. Connections accepted already are not closed.
+func (l *Listener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+// Addr returns the listener address, named "pipe".
+func (l *Listener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// Dial creates a new in-memory connection, blocking until the connection is
+// accepted. network and address are ignored, such that Dial can be passed as
+// dialer to clients (e.g. client.SyncDialWith).
+func (l *Listener) Dial(network, address string) (net.Conn, error) {
+	c, s := net.Pipe()
+	select {
+	case l.conns <- s:
+		return c, nil
+	case <-l.done:
+		c.Close()
+		s.Close()
+		return nil, net.ErrClosed
+	}
+}
+
+// Server is a lumberjack protocol version 2 server serving in-memory
+// connections.
+type Server struct {
+	*server.Server
+	Listener *Listener
+}
+
+// NewServer starts a new server configured by opts. The server must be closed
+// by calling Close.
+func NewServer(opts ...server.Option) (*Server, error) {
+	l := NewListener()
+	s, err := server.NewWithListener(l, opts...)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &Server{Server: s, Listener: l}, nil
+}
+
+// Close stops the server and its listener, closing all connections.
+func (s *Server) Close() error {
+	err := s.Server.Close()
+	s.Listener.Close()
+	return err
+}
+
+// Dial creates a new in-memory connection to the server.
+func (s *Server) Dial(network, address string) (net.Conn, error) {
+	return s.Listener.Dial(network, address)
+}
+
+// SyncClient connects a new SyncClient to the server.
+func (s *Server) SyncClient(opts ...client.Option) (*client.SyncClient, error) {
+	return client.SyncDialWith(s.Dial, "pipe", opts...)
+}
+
+// AsyncClient connects a new AsyncClient to the server.
+func (s *Server) AsyncClient(inflight int, opts ...client.Option) (*client.AsyncClient, error) {
+	return client.AsyncDialWith(s.Dial, "pipe", inflight, opts...)
+}
+
+// Replay connects to the server, writing data in the background. The returned
+// connection is used for reading ACKs (see ReadACK) and must be closed by the
+// caller. Writing stops once all data has been written or the server closes the
+// connection.
+func (s *Server) Replay(data []byte) (net.Conn, error) {
+	conn, err := s.Dial("pipe", "pipe")
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		_, _ = conn.Write(data)
+	}()
+	return conn, nil
+}
+
+// ReadACK reads the next ACK frame from conn, returning its sequence number.
+// Returns client.ErrProtocolError if the frame is no ACK frame.
+func ReadACK(conn net.Conn) (uint32, error) {
+	var msg [6]byte
+	if _, err := io.ReadFull(conn, msg[:]); err != nil {
+		return 0, err
+	}
+	if msg[0] != protocol.CodeVersion || msg[1] != protocol.CodeACK {
+		return 0, client.ErrProtocolError
+	}
+	return binary.BigEndian.Uint32(msg[2:]), nil
+}
@@ -0,0 +1,112 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package lumbertest
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	client "github.com/elastic/go-lumber/client/v2"
+	server "github.com/elastic/go-lumber/server/v2"
+)
+
+func startServer(t *testing.T, opts ...server.Option) *Server {
+	s, err := NewServer(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestAsyncClient(t *testing.T) {
+	const batches = 20
+
+	s := startServer(t)
+	c, err := s.AsyncClient(batches, client.Timeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(batches)
+	// in-memory connections do not buffer, batches must be consumed while the
+	// client is sending
+	go func() {
+		for i := 0; i < batches; i++ {
+			s.Receive().ACK()
+		}
+	}()
+
+	for i := 0; i < batches; i++ {
+		err := c.Send(func(seq uint32, err error) {
+			defer wg.Done()
+			if seq != 1 || err != nil {
+				t.Errorf("unexpected ACK: seq=%v, err=%v", seq, err)
+			}
+		}, []interface{}{i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+}
+
+func TestMalformedFrames(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames *Frames
+	}{
+		{"unknown frame", new(Frames).Window(1).Frame('X', nil)},
+		{"invalid version", new(Frames).Raw('1', 'W', 0, 0, 0, 1)},
+		{"invalid compressed payload", new(Frames).Window(1).Frame('C', []byte("no zlib"))},
+		{"truncated event header", new(Frames).Window(1).JSON(1, `1`).Truncate(10)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := startServer(t, server.Timeout(50*time.Millisecond))
+			conn, err := s.Replay(test.frames.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if seq, err := ReadACK(conn); err == nil {
+				t.Fatalf("expected connection to be closed, got ACK %v", seq)
+			}
+			if stats := s.Stats(); stats.Batches != 0 {
+				t.Errorf("expected no batches to be read, got %v", stats.Batches)
+			}
+		})
+	}
+}
+
+func TestListenerClosed(t *testing.T) {
+	l := NewListener()
+	l.Close()
+	if _, err := l.Dial("pipe", "pipe"); err != net.ErrClosed {
+		t.Errorf("expected net.ErrClosed from Dial, got %v", err)
+	}
+	if _, err := l.Accept(); err != net.ErrClosed {
+		t.Errorf("expected net.ErrClosed from Accept, got %v", err)
+	}
+}
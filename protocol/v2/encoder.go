@@ -0,0 +1,144 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sort"
+
+	"github.com/klauspost/compress/zlib"
+)
+
+// Encoder writes lumberjack protocol version 2 frames, for implementing
+// custom senders. A batch is sent by writing a window frame with the number of
+// events, followed by the events in JSON data frames or compressed frames.
+// Sequence numbers start at 1 for the first event in a window.
+//
+// The zero value is ready to use. An Encoder is not safe for concurrent use.
+type Encoder struct {
+	hdr [10]byte
+	buf bytes.Buffer
+}
+
+// WriteWindow writes a window frame announcing count events to w.
+func (e *Encoder) WriteWindow(w io.Writer, count uint32) error {
+	// Window Frame:
+	// version: uint8 = '2'
+	// code: uint8 = 'W'
+	// count: uint32
+
+	e.hdr[0] = CodeVersion
+	e.hdr[1] = CodeWindowSize
+	binary.BigEndian.PutUint32(e.hdr[2:], count)
+	_, err := w.Write(e.hdr[:6])
+	return err
+}
+
+// WriteJSONEvent writes the JSON encoded event payload in a JSON data frame
+// with sequence number seq to w.
+func (e *Encoder) WriteJSONEvent(w io.Writer, seq uint32, payload []byte) error {
+	// JSON Data Frame:
+	// version: uint8 = '2'
+	// code: uint8 = 'J'
+	// seq: uint32
+	// payloadLen (bytes): uint32
+	// payload: JSON document
+
+	e.hdr[0] = CodeVersion
+	e.hdr[1] = CodeJSONDataFrame
+	binary.BigEndian.PutUint32(e.hdr[2:], seq)
+	binary.BigEndian.PutUint32(e.hdr[6:], uint32(len(payload)))
+	if _, err := w.Write(e.hdr[:10]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// WriteKVEvent writes the event fields in a key-value data frame with sequence
+// number seq to w. Fields are written in key order.
+func (e *Encoder) WriteKVEvent(w io.Writer, seq uint32, fields map[string]string) error {
+	// Key-Value Data Frame:
+	// version: uint8 = '2'
+	// code: uint8 = 'D'
+	// seq: uint32
+	// pairs: uint32
+	// pairs times: keyLen uint32, key, valueLen uint32, value
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	e.buf.Reset()
+	e.hdr[0] = CodeVersion
+	e.hdr[1] = CodeDataFrame
+	binary.BigEndian.PutUint32(e.hdr[2:], seq)
+	binary.BigEndian.PutUint32(e.hdr[6:], uint32(len(keys)))
+	e.buf.Write(e.hdr[:10])
+
+	writeString := func(s string) {
+		binary.BigEndian.PutUint32(e.hdr[:4], uint32(len(s)))
+		e.buf.Write(e.hdr[:4])
+		e.buf.WriteString(s)
+	}
+	for _, k := range keys {
+		writeString(k)
+		writeString(fields[k])
+	}
+
+	_, err := w.Write(e.buf.Bytes())
+	return err
+}
+
+// WriteCompressed writes the JSON encoded events as JSON data frames into a
+// compressed frame to w. The events are numbered starting at sequence number 1.
+// level is the zlib compression level.
+func (e *Encoder) WriteCompressed(w io.Writer, events [][]byte, level int) error {
+	// Compressed Data Frame:
+	// version: uint8 = '2'
+	// code: uint8 = 'C'
+	// payloadSz: uint32
+	// payload: compressed payload
+
+	e.buf.Reset()
+	zw, err := zlib.NewWriterLevel(&e.buf, level)
+	if err != nil {
+		return err
+	}
+	for i, event := range events {
+		if err := e.WriteJSONEvent(zw, uint32(i)+1, event); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	e.hdr[0] = CodeVersion
+	e.hdr[1] = CodeCompressed
+	binary.BigEndian.PutUint32(e.hdr[2:], uint32(e.buf.Len()))
+	if _, err := w.Write(e.hdr[:6]); err != nil {
+		return err
+	}
+	_, err = w.Write(e.buf.Bytes())
+	return err
+}
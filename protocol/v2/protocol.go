@@ -30,3 +30,17 @@ const (
 	CodeCompressed    byte = 'C'
 	CodeACK           byte = 'A'
 )
+
+// CodeDataFrame is the key-value data frame of protocol version 1, carrying an
+// event of string keys and values. Logstash accepts key-value data frames in
+// version 2 windows too.
+const CodeDataFrame byte = 'D'
+
+// CodeCompressStream is sent by clients to negotiate compression of the
+// complete client to server stream. The frame has the size of a window frame,
+// with the last 4 bytes being reserved. If the server returns the frame, all
+// following bytes sent by the client are zlib compressed.
+//
+// Stream compression is a go-lumber extension, not supported by other
+// lumberjack implementations.
+const CodeCompressStream byte = 'S'
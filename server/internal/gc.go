@@ -0,0 +1,82 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import (
+	"runtime/debug"
+	"sync"
+)
+
+var gcPercent struct {
+	sync.Mutex
+	active []int // percentages requested by running servers
+	old    int
+}
+
+// SetGCPercent installs the GC target percentage p for the runtime, returning a
+// function restoring the previous setting. Calls can be nested, with the
+// highest percentage of all active calls being in effect. The original setting
+// is restored once the last restore function has been called.
+// If p is 0, the runtime setting is not changed.
+func SetGCPercent(p int) (restore func()) {
+	if p == 0 {
+		return func() {}
+	}
+
+	gcPercent.Lock()
+	defer gcPercent.Unlock()
+
+	if len(gcPercent.active) == 0 {
+		gcPercent.old = debug.SetGCPercent(p)
+	}
+	gcPercent.active = append(gcPercent.active, p)
+	applyGCPercent()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			gcPercent.Lock()
+			defer gcPercent.Unlock()
+
+			for i, active := range gcPercent.active {
+				if active == p {
+					gcPercent.active = append(gcPercent.active[:i], gcPercent.active[i+1:]...)
+					break
+				}
+			}
+
+			if len(gcPercent.active) == 0 {
+				debug.SetGCPercent(gcPercent.old)
+			} else {
+				applyGCPercent()
+			}
+		})
+	}
+}
+
+// applyGCPercent installs the highest active percentage. Must be called with
+// gcPercent being locked.
+func applyGCPercent() {
+	p := gcPercent.active[0]
+	for _, active := range gcPercent.active[1:] {
+		if active > p {
+			p = active
+		}
+	}
+	debug.SetGCPercent(p)
+}
@@ -0,0 +1,54 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import (
+	"runtime/debug"
+	"testing"
+)
+
+func TestSetGCPercentNested(t *testing.T) {
+	orig := debug.SetGCPercent(100)
+	defer debug.SetGCPercent(orig)
+
+	current := func() int {
+		p := debug.SetGCPercent(-1)
+		debug.SetGCPercent(p)
+		return p
+	}
+
+	restoreLow := SetGCPercent(200)
+	restoreHigh := SetGCPercent(400)
+	if p := current(); p != 400 {
+		t.Errorf("expected highest percentage 400 in effect, got %v", p)
+	}
+
+	restoreHigh()
+	if p := current(); p != 200 {
+		t.Errorf("expected 200 in effect after restore, got %v", p)
+	}
+	restoreHigh() // restore is idempotent
+	if p := current(); p != 200 {
+		t.Errorf("expected 200 in effect after second restore, got %v", p)
+	}
+
+	restoreLow()
+	if p := current(); p != 100 {
+		t.Errorf("expected original percentage 100, got %v", p)
+	}
+}
@@ -18,6 +18,12 @@
 package internal
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"sync"
 	"time"
@@ -27,18 +33,130 @@ import (
 )
 
 type defaultHandler struct {
-	cb        Eventer
-	client    net.Conn
-	reader    BatchReader
-	writer    ACKWriter
-	keepalive time.Duration
+	cb     Eventer
+	client net.Conn
+	reader BatchReader
+	writer ACKWriter
+	cfg    HandlerConfig
 
-	signal chan struct{}
-	ch     chan *lj.Batch
+	signal  chan struct{}
+	ch      chan pendingBatch
+	ackDone chan struct{}
+
+	// cancels rate limiter waits on Stop
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// pending ACK flush, if ACKs are coalesced
+	flushTimer *time.Timer
+	flushC     <-chan time.Time
+
+	// windows and events ACKed by the consumer, but not yet ACKed to the
+	// client, if ACKs are merged
+	mergedWindows int
+	mergedEvents  int
+
+	// windows read next, which the client is expected to resend as they have
+	// not been ACKed on its previous connection
+	resent int
+
+	// TLS connection state and client certificate, looked up on first batch
+	tlsState  *tls.ConnectionState
+	cert      *x509.Certificate
+	tlsLoaded bool
+
+	// connection open time and first window, for ConnListener
+	accepted    time.Time
+	firstWindow bool
+
+	// batches not yet ACKed and drain state, the highest sequence number of
+	// the window ACKed last, and the number of windows queued for ACK and
+	// ACKed to the client, guarded by mu
+	mu        sync.Mutex
+	pending   int
+	draining  bool
+	drain     chan struct{}
+	ackedSeq  uint32
+	queued    int
+	ackedWins int
 
 	stopGuard sync.Once
 }
 
+// pendingBatch is a batch waiting for ACK, with the trace span to end after
+// the ACK has been send and the events to return to the EventLimiter.
+type pendingBatch struct {
+	batch *lj.Batch
+	end   func(error)
+
+	limiter lj.EventLimiter
+	events  int
+
+	// number of events ACKed to the client, covering the window read
+	window int
+
+	// sequence numbers of the window read
+	seq SeqRange
+}
+
+var (
+	// ErrKeepAlive is returned by BatchReader.ReadBatch if the client did send
+	// an empty window, keeping the connection alive.
+	ErrKeepAlive = errors.New("keepalive window received")
+
+	// ErrWriteTimeout is returned if writing an ACK to the client did not
+	// complete within the configured write timeout.
+	ErrWriteTimeout = errors.New("ACK write timeout")
+
+	// ErrNoClientCert is returned if RequireClientCert is set and the client
+	// did not present a verified certificate.
+	ErrNoClientCert = errors.New("no verified client certificate")
+
+	errResendRequested = errors.New("batch resend requested by consumer")
+	errBatchRejected   = errors.New("batch rejected by middleware")
+	errHandlerStopped  = errors.New("client handler stopped")
+)
+
+// PartialBatchError is returned by BatchReader.ReadBatch if reading a window
+// failed after some of its events have been read. Batch holds the events read
+// so far, with Batch.Partial set.
+type PartialBatchError struct {
+	Batch *lj.Batch
+	Err   error
+}
+
+func (e *PartialBatchError) Error() string {
+	return fmt.Sprintf("partial batch of %v events: %v", e.Batch.Len(), e.Err)
+}
+
+func (e *PartialBatchError) Unwrap() error {
+	return e.Err
+}
+
+// InvalidBatchError is returned by BatchReader.ReadBatch if the event with
+// index Index of a window failed validation with Err. If Window is > 0, the
+// window of Window events has been read completely and is ACKed without
+// forwarding its events. Otherwise the connection is closed once the batches
+// read before have been ACKed.
+type InvalidBatchError struct {
+	Index  int
+	Err    error
+	Window int
+}
+
+func (e *InvalidBatchError) Error() string {
+	return fmt.Sprintf("event %v in batch failed validation: %v", e.Index, e.Err)
+}
+
+func (e *InvalidBatchError) Unwrap() error {
+	return e.Err
+}
+
+// BatchReader reads batches from a client connection. ReadBatch returns a
+// non-nil batch or an error. ErrKeepAlive is returned for empty windows.
+// Readers implementing Release are released when the connection handler stops
+// reading. Readers implementing SeqRange report the sequence numbers of the
+// window read last, for detecting windows resent by the client.
 type BatchReader interface {
 	ReadBatch() (*lj.Batch, error)
 }
@@ -46,137 +164,789 @@ type BatchReader interface {
 type ACKWriter interface {
 	Keepalive(int) error
 	ACK(int) error
+
+	// Flush writes buffered ACKs, if the writer buffers ACKs. Flush must be
+	// safe to call concurrently with ACK and Keepalive.
+	Flush() error
 }
 
 type ProtocolFactory func(conn net.Conn) (BatchReader, ACKWriter, error)
 
+// HandlerConfig configures the connection handler created by DefaultHandler.
+type HandlerConfig struct {
+	// Keepalive sets the interval for sending keepalive ACKs while waiting for
+	// a batch to be ACKed. Keepalives are disabled if 0.
+	Keepalive time.Duration
+
+	// ACKLatency, if set, is called with the time it took to write an ACK to
+	// the client, measured from the consumer ACKing the batch.
+	ACKLatency func(net.Addr, time.Duration)
+
+	// ConflictPolicy is installed in every batch read.
+	ConflictPolicy lj.ConflictPolicy
+
+	// ResendRequested, if set, is called with the number of events in the
+	// batch, if the connection is closed due to a resend request.
+	ResendRequested func(net.Addr, int)
+
+	// Trace, if set, is called for every batch read. The returned function is
+	// called with the error sending the ACK, once the batch has been ACKed or
+	// the connection has been closed.
+	Trace func(*lj.Batch, net.Addr) func(error)
+
+	// RateLimiter, if set, delays reading the next batch until the events of
+	// the current batch are accepted by the limiter.
+	RateLimiter lj.RateLimiter
+
+	// EventLimiter, if set, delays forwarding a batch until its events are
+	// acquired from the limiter. The events are released once the batch has
+	// been ACKed, or dropped on the connection being closed.
+	EventLimiter lj.EventLimiter
+
+	// ACKCoalesce, if set, is the maximum time ACKs are buffered, before
+	// writing the buffered ACKs as a single ACK frame counting the events of
+	// all buffered windows. Buffered ACKs are flushed early if no more batches
+	// are waiting for ACK, and when the handler is stopped.
+	ACKCoalesce time.Duration
+
+	// ACKEvery, if > 1, merges the ACKs of up to ACKEvery windows into a single
+	// ACK frame, counting the events of all merged windows. Merged ACKs are
+	// written early if no more batches are waiting for ACK, when ACKs are
+	// flushed due to ACKCoalesce, and when the handler stops.
+	ACKEvery int
+
+	// ConnListener, if set, is called with the lifecycle events of the
+	// connection. It is called by the goroutine serving the connection.
+	ConnListener func(lj.ConnEvent)
+
+	// HandshakeTimeout bounds the TLS handshake completed before reporting
+	// ConnAccepted to ConnListener or checking the client certificate. No
+	// timeout is applied if 0.
+	HandshakeTimeout time.Duration
+
+	// TLSState attaches the TLS connection state to every batch read.
+	TLSState bool
+
+	// RequireClientCert closes connections with ErrNoClientCert before reading
+	// the first batch, if the client did not present a verified certificate.
+	RequireClientCert bool
+
+	// Middleware is applied to every batch read, in order, before forwarding
+	// the batch. A middleware returning nil drops the batch, which is ACKed
+	// right away. A middleware returning an error rejects the batch, which is
+	// not ACKed. The connection is closed once the batches read before have
+	// been ACKed. Later middleware is not called for dropped or rejected
+	// batches.
+	Middleware []func(*lj.Batch) (*lj.Batch, error)
+
+	// Stats, if set, counts batches read and read errors.
+	Stats *Stats
+
+	// Resends, if set, records clients closing the connection with windows not
+	// ACKed, flagging as many windows read after the client reconnects as
+	// PossibleDuplicate.
+	Resends *ResendTracker
+}
+
 func DefaultHandler(
-	keepalive time.Duration,
+	cfg HandlerConfig,
 	mk ProtocolFactory,
 ) HandlerFactory {
 	return func(cb Eventer, client net.Conn) (Handler, error) {
+		client = &countingConn{Conn: client}
 		r, w, err := mk(client)
 		if err != nil {
 			return nil, err
 		}
 
+		ctx, cancel := context.WithCancel(context.Background())
 		return &defaultHandler{
-			cb:        cb,
-			client:    client,
-			reader:    r,
-			writer:    w,
-			keepalive: keepalive,
-			signal:    make(chan struct{}),
-			ch:        make(chan *lj.Batch),
+			cb:      cb,
+			client:  client,
+			reader:  r,
+			writer:  w,
+			cfg:     cfg,
+			signal:  make(chan struct{}),
+			ch:      make(chan pendingBatch),
+			ackDone: make(chan struct{}),
+			drain:   make(chan struct{}),
+			ctx:     ctx,
+			cancel:  cancel,
 		}, nil
 	}
 }
 
 func (h *defaultHandler) Run() {
-	defer close(h.ch)
+	h.accepted = time.Now()
+	var state *tls.ConnectionState
+	if h.cfg.ConnListener != nil || h.cfg.RequireClientCert {
+		state = h.handshake()
+	}
+	h.emit(lj.ConnEvent{Kind: lj.ConnAccepted, TLS: state})
 
 	// start async routine for returning ACKs to client.
 	// Sends ACK of 0 every 'keepalive' seconds to signal
 	// client the batch still being in pipeline
 	go h.ackLoop()
-	if err := h.handle(); err != nil {
+	err := h.handle(state)
+	close(h.ch)
+
+	// ACKs written after the client closed the connection are likely not
+	// received, such that the client resends these windows
+	var unacked int
+	if err == io.EOF {
+		unacked = h.unacked()
+	}
+
+	if r, ok := h.reader.(interface{ Release() }); ok {
+		r.Release()
+	}
+
+	switch {
+	case err == io.EOF:
+		// Client closed its side of the connection between batches. Keep the
+		// connection open until the batches read have been ACKed, such that
+		// clients half-closing the connection receive all ACKs.
+		log.Printf("Client %v closed connection", h.client.RemoteAddr())
+		<-h.ackDone
+	case err == io.ErrUnexpectedEOF:
+		log.Printf("Client %v closed connection mid batch", h.client.RemoteAddr())
+	case errors.Is(err, errBatchRejected), isInvalidBatch(err):
+		// ACK batches read before, closing the connection on the rejected batch
+		log.Println(err)
+		<-h.ackDone
+	case err != nil:
 		log.Println(err)
 	}
+	h.Stop()
+	<-h.ackDone
+	if err != io.EOF {
+		unacked = h.unacked()
+	}
+	h.cfg.Resends.closed(clientIP(h.client), unacked)
+
+	if h.cfg.ConnListener != nil {
+		h.emit(lj.ConnEvent{Kind: lj.ConnClosed, Err: err, Duration: time.Since(h.accepted)})
+	}
+}
+
+// emit reports a connection lifecycle event to ConnListener.
+func (h *defaultHandler) emit(evt lj.ConnEvent) {
+	if h.cfg.ConnListener == nil {
+		return
+	}
+	evt.Time = time.Now()
+	evt.RemoteAddr = h.client.RemoteAddr()
+	h.cfg.ConnListener(evt)
+}
+
+// handshake completes the TLS handshake of TLS connections and returns the
+// connection state. Handshake errors are returned by the first read.
+func (h *defaultHandler) handshake() *tls.ConnectionState {
+	c := tlsConn(h.client)
+	if c == nil {
+		return nil
+	}
+
+	ctx := h.ctx
+	if h.cfg.HandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.cfg.HandshakeTimeout)
+		defer cancel()
+	}
+	if err := c.HandshakeContext(ctx); err != nil {
+		return nil
+	}
+	state := c.ConnectionState()
+	return &state
 }
 
 func (h *defaultHandler) Stop() {
 	h.stopGuard.Do(func() {
 		close(h.signal)
+		h.cancel()
+		if h.cfg.ACKCoalesce > 0 {
+			// best effort, write ACKs coalesced so far before closing
+			_ = h.writer.Flush()
+		}
 		_ = h.client.Close()
 	})
 }
 
-func (h *defaultHandler) handle() error {
+// Drain stops reading new batches. The handler stops once all batches read
+// have been ACKed.
+func (h *defaultHandler) Drain() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.draining {
+		h.draining = true
+		close(h.drain)
+	}
+}
+
+// Pending returns the number of batches read, but not yet ACKed.
+func (h *defaultHandler) Pending() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.pending
+}
+
+// track counts a batch waiting for ACK. Returns false if the handler is
+// draining and the batch must not be forwarded.
+func (h *defaultHandler) track() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.draining {
+		return false
+	}
+	h.pending++
+	return true
+}
+
+// untrack removes a batch from the pending count. Returns true if the handler
+// is draining and no more batches are waiting for ACK.
+func (h *defaultHandler) untrack() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pending--
+	return h.draining && h.pending == 0
+}
+
+// drained returns true if the handler is draining and no more batches are
+// waiting for ACK.
+func (h *defaultHandler) drained() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.draining && h.pending == 0
+}
+
+// stopped returns true if Stop has been called.
+func (h *defaultHandler) stopped() bool {
+	select {
+	case <-h.signal:
+		return true
+	default:
+		return false
+	}
+}
+
+func (h *defaultHandler) handle(state *tls.ConnectionState) error {
 	log.Printf("Start client handler")
 	defer log.Printf("client handler stopped")
-	defer h.Stop()
+
+	if h.cfg.RequireClientCert && (state == nil || len(state.VerifiedChains) == 0) {
+		log.Printf("Rejected client %v: %v", h.client.RemoteAddr(), ErrNoClientCert)
+		h.cfg.Stats.connRejected()
+		return ErrNoClientCert
+	}
 
 	for {
 		// 1. read data into batch
 		b, err := h.reader.ReadBatch()
+		if err == ErrKeepAlive {
+			continue
+		}
+		if pe, ok := err.(*PartialBatchError); ok {
+			h.deliverPartial(pe.Batch)
+			err = pe.Err
+		}
+		if ie, ok := err.(*InvalidBatchError); ok {
+			if ie.Window == 0 {
+				return fmt.Errorf("batch from %v rejected: %w", h.client.RemoteAddr(), ie)
+			}
+			log.Printf("Dropped batch from %v: %v", h.client.RemoteAddr(), ie)
+			if !h.dropInvalid(ie.Window) {
+				return nil
+			}
+			continue
+		}
 		if err != nil {
+			if err != io.EOF && !h.stopped() {
+				h.cfg.Stats.readError()
+				h.emit(lj.ConnEvent{Kind: lj.ConnReadError, Err: err})
+			}
 			return err
 		}
+		h.cfg.Stats.batchRead(b)
+		if !h.firstWindow {
+			h.firstWindow = true
+			h.resent = h.cfg.Resends.take(clientIP(h.client))
+			h.emit(lj.ConnEvent{Kind: lj.ConnFirstWindow, Events: b.Len()})
+		}
+		b.ConflictPolicy = h.cfg.ConflictPolicy
+		h.setTLS(b)
+		b.Conn = h.counters()
+		seq := h.seqRange()
+		b.PossibleDuplicate = h.possibleDuplicate(seq)
+		if h.resent > 0 {
+			h.resent--
+			b.PossibleDuplicate = true
+		}
 
-		// read next batch if empty batch has been received
-		if b == nil {
+		// 2. apply middleware. Dropped and rejected batches still pass the ACK
+		// queue, for ACKs to be returned in order.
+		window := b.Len() + b.Dropped
+		out, err := h.applyMiddleware(b)
+		if err != nil || out == nil {
+			if err != nil {
+				b.RequestResend()
+			} else {
+				b.ACK()
+			}
+			if !h.queue(pendingBatch{batch: b, window: window, seq: seq}) {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("%w from %v: %v", errBatchRejected, h.client.RemoteAddr(), err)
+			}
 			continue
 		}
+		b = out
 
-		// 2. push batch to ACK queue
-		select {
-		case <-h.signal:
+		// 3. block reading the next batch while too many events are in flight
+		p := pendingBatch{batch: b, window: window, seq: seq}
+		if h.cfg.EventLimiter != nil {
+			if err := h.cfg.EventLimiter.Acquire(h.ctx, b.Len()); err != nil {
+				return nil // handler stopped
+			}
+			p.limiter, p.events = h.cfg.EventLimiter, b.Len()
+		}
+		if h.cfg.Trace != nil {
+			p.end = h.cfg.Trace(b, h.client.RemoteAddr())
+		}
+
+		// 4. push batch to ACK queue
+		if !h.queue(p) {
 			return nil
-		case h.ch <- b:
 		}
 
-		// 3. push batch to server receive queue:
+		// 5. push batch to server receive queue:
 		if err := h.cb.OnEvents(b); err != nil {
-			return nil
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		// 6. block reading the next batch if client exceeds its rate limit
+		if h.cfg.RateLimiter != nil {
+			err := h.cfg.RateLimiter.Wait(h.ctx, clientIP(h.client), b.Len())
+			if err != nil {
+				return nil // handler stopped
+			}
+		}
+	}
+}
+
+// seqRange returns the sequence numbers of the window read last, if reported
+// by the reader.
+func (h *defaultHandler) seqRange() SeqRange {
+	if r, ok := h.reader.(interface{ SeqRange() SeqRange }); ok {
+		return r.SeqRange()
+	}
+	return SeqRange{}
+}
+
+// possibleDuplicate reports whether the window of sequence numbers seq overlaps
+// the sequence numbers ACKed before. This only detects resends of clients
+// numbering events across windows with increasing sequence numbers. Windows
+// starting at sequence number 1 are never reported, as most clients number the
+// events of every window starting at 1. Resends of these clients are detected
+// via Resends instead.
+func (h *defaultHandler) possibleDuplicate(seq SeqRange) bool {
+	if !seq.Valid || seq.Low <= 1 {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return seq.Low <= h.ackedSeq
+}
+
+// acked records the sequence numbers of a window ACKed.
+func (h *defaultHandler) acked(seq SeqRange) {
+	if !seq.Valid {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ackedSeq = seq.High
+}
+
+// ackedWindows records n windows ACKed to the client.
+func (h *defaultHandler) ackedWindows(n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ackedWins += n
+}
+
+// unacked returns the number of windows queued for ACK, but not yet ACKed to
+// the client.
+func (h *defaultHandler) unacked() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.queued - h.ackedWins
+}
+
+// dropInvalid ACKs a window of n events failing validation, without forwarding
+// any events. Returns false if the handler stops.
+func (h *defaultHandler) dropInvalid(n int) bool {
+	b := lj.NewBatch(nil)
+	b.ACK()
+	return h.queue(pendingBatch{batch: b, window: n, seq: h.seqRange()})
+}
+
+// isInvalidBatch reports whether err has been caused by a batch failing
+// validation.
+func isInvalidBatch(err error) bool {
+	var ie *InvalidBatchError
+	return errors.As(err, &ie)
+}
+
+// applyMiddleware passes b through the configured middleware. Returns nil if
+// the batch has been dropped.
+func (h *defaultHandler) applyMiddleware(b *lj.Batch) (*lj.Batch, error) {
+	for _, fn := range h.cfg.Middleware {
+		var err error
+		if b, err = fn(b); err != nil || b == nil {
+			return nil, err
 		}
 	}
+	return b, nil
+}
+
+// queue pushes p to the ACK queue. Batches read while draining are dropped
+// without ACK, for the client to resend them. Returns false if the handler
+// stops.
+func (h *defaultHandler) queue(p pendingBatch) bool {
+	if !h.track() {
+		p.finish(errHandlerStopped)
+		return false
+	}
+	select {
+	case <-h.signal:
+		p.finish(errHandlerStopped)
+		return false
+	case h.ch <- p:
+		h.mu.Lock()
+		h.queued++
+		h.mu.Unlock()
+		return true
+	}
 }
 
 func (h *defaultHandler) ackLoop() {
 	log.Println("start client ack loop")
 	defer log.Println("client ack loop stopped")
+	defer close(h.ackDone)
 
 	// drain queue on shutdown.
 	// Stop ACKing batches in case of error, forcing client to reconnect
 	defer func() {
 		log.Println("drain ack loop")
-		for range h.ch {
+		for p := range h.ch {
+			p.finish(errHandlerStopped)
 		}
 	}()
 
+	// write merged ACKs before the connection is closed
+	defer func() {
+		if h.mergedWindows > 0 {
+			_ = h.flush()
+		}
+	}()
+
+	drain := h.drain
 	for {
+		if h.flushC != nil || h.mergedWindows > 0 {
+			select {
+			case p, open := <-h.ch:
+				if !h.ackBatch(p, open) {
+					return
+				}
+				continue
+			default:
+				// no more batches waiting for ACK, do not delay coalesced ACKs
+				if err := h.flush(); err != nil {
+					log.Println(err)
+					h.Stop()
+					return
+				}
+			}
+		}
+
 		select {
 		case <-h.signal: // return on client/server shutdown
 			log.Println("receive client connection close signal")
 			return
-		case b, open := <-h.ch:
-			if !open {
+		case <-drain:
+			drain = nil
+			if h.drained() {
+				h.stopDrained()
 				return
 			}
-			if err := h.waitACK(b); err != nil {
+		case p, open := <-h.ch:
+			if !h.ackBatch(p, open) {
 				return
 			}
 		}
 	}
 }
 
-func (h *defaultHandler) waitACK(batch *lj.Batch) error {
-	n := len(batch.Events)
+// stopDrained writes outstanding ACKs and stops the handler after draining.
+func (h *defaultHandler) stopDrained() {
+	log.Printf("Client %v drained", h.client.RemoteAddr())
+	if err := h.flush(); err != nil {
+		log.Println(err)
+	}
+	h.Stop()
+}
+
+// deliverPartial forwards an incomplete batch to the consumer. The batch is not
+// ACKed, as the connection is closed right after.
+func (h *defaultHandler) deliverPartial(b *lj.Batch) {
+	if h.stopped() {
+		return
+	}
+	h.cfg.Stats.partialBatch()
+	b.ConflictPolicy = h.cfg.ConflictPolicy
+	h.setTLS(b)
+	b.Conn = h.counters()
+	b, err := h.applyMiddleware(b)
+	if err != nil || b == nil {
+		return
+	}
+	if err := h.cb.OnEvents(b); err != nil && err != io.EOF {
+		log.Printf("Failed to forward partial batch: %v", err)
+	}
+}
+
+// ackBatch waits for p to be ACKed and sends the ACK. Returns false if the ACK
+// loop must stop.
+func (h *defaultHandler) ackBatch(p pendingBatch, open bool) bool {
+	if !open {
+		return false
+	}
+
+	err := h.waitACK(p.batch, p.window)
+	p.finish(err)
+	if err == nil {
+		h.acked(p.seq)
+	}
+	drained := h.untrack()
+	if err == errHandlerStopped {
+		return false
+	}
+	if err != nil {
+		log.Println(err)
+		if err == errResendRequested && h.mergedWindows > 0 {
+			// client must not resend windows ACKed already
+			_ = h.flush()
+		}
+		h.Stop()
+		return false
+	}
+	if drained {
+		h.stopDrained()
+		return false
+	}
+	return true
+}
 
-	if h.keepalive <= 0 {
+func (h *defaultHandler) waitACK(batch *lj.Batch, window int) error {
+	if h.cfg.Keepalive <= 0 {
 		for {
 			select {
 			case <-h.signal:
-				return nil
+				return errHandlerStopped
 			case <-batch.Await():
-				// send ack
-				return h.writer.ACK(n)
+				return h.sendACK(batch, window)
+			case <-h.flushC:
+				if err := h.flush(); err != nil {
+					return err
+				}
 			}
 		}
 	} else {
 		for {
 			select {
 			case <-h.signal:
-				return nil
+				return errHandlerStopped
 			case <-batch.Await():
-				// send ack
-				return h.writer.ACK(n)
-			case <-time.After(h.keepalive):
+				return h.sendACK(batch, window)
+			case <-h.flushC:
+				if err := h.flush(); err != nil {
+					return err
+				}
+			case <-time.After(h.cfg.Keepalive):
 				if err := h.writer.Keepalive(0); err != nil {
 					return err
 				}
 			}
 		}
 	}
+}
+
+func (h *defaultHandler) sendACK(batch *lj.Batch, n int) error {
+	if batch.ResendRequested() {
+		if h.cfg.ResendRequested != nil {
+			h.cfg.ResendRequested(h.client.RemoteAddr(), batch.Len())
+		}
+		return errResendRequested
+	}
+
+	windows := 1
+	if h.cfg.ACKEvery > 1 || h.cfg.ACKCoalesce > 0 {
+		h.mergedWindows++
+		h.mergedEvents += n
+		if h.cfg.ACKEvery <= 1 || h.mergedWindows < h.cfg.ACKEvery {
+			if h.cfg.ACKCoalesce > 0 {
+				h.reportLatency(batch) // buffering is not included
+			}
+			h.startFlushTimer()
+			return nil
+		}
+		windows, n = h.takeMerged()
+	}
+	if err := h.writer.ACK(n); err != nil {
+		return err
+	}
+	h.ackedWindows(windows)
+	h.reportLatency(batch)
+	h.startFlushTimer()
+	return nil
+}
+
+// reportLatency reports the time since batch has been ACKed by the consumer to
+// ACKLatency.
+func (h *defaultHandler) reportLatency(batch *lj.Batch) {
+	if h.cfg.ACKLatency == nil {
+		return
+	}
+	h.cfg.ACKLatency(h.client.RemoteAddr(), time.Since(batch.CompletedAt()))
+}
+
+// startFlushTimer schedules flushing buffered ACKs, if ACKs are coalesced.
+func (h *defaultHandler) startFlushTimer() {
+	if h.cfg.ACKCoalesce > 0 && h.flushTimer == nil {
+		h.flushTimer = time.NewTimer(h.cfg.ACKCoalesce)
+		h.flushC = h.flushTimer.C
+	}
+}
+
+// takeMerged returns the number of windows and events ACKed by merged ACKs not
+// yet written.
+func (h *defaultHandler) takeMerged() (int, int) {
+	windows, n := h.mergedWindows, h.mergedEvents
+	h.mergedWindows, h.mergedEvents = 0, 0
+	return windows, n
+}
+
+// flush writes coalesced ACKs.
+func (h *defaultHandler) flush() error {
+	if h.mergedWindows > 0 {
+		windows, n := h.takeMerged()
+		if err := h.writer.ACK(n); err != nil {
+			return err
+		}
+		h.ackedWindows(windows)
+	}
+	if h.flushTimer != nil {
+		h.flushTimer.Stop()
+		h.flushTimer = nil
+		h.flushC = nil
+	}
+	return h.writer.Flush()
+}
+
+func clientIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+func (p pendingBatch) finish(err error) {
+	if p.limiter != nil {
+		p.limiter.Release(p.events)
+	}
+	if p.end != nil {
+		p.end(err)
+	}
+}
+
+// counters returns the byte counters of the client connection.
+func (h *defaultHandler) counters() *lj.ConnCounters {
+	if c, ok := h.client.(*countingConn); ok {
+		return &c.counters
+	}
+	return nil
+}
+
+// setTLS sets the client certificate of b and, if configured, the TLS
+// connection state. Both are derived from the connection state captured once
+// per connection.
+func (h *defaultHandler) setTLS(b *lj.Batch) {
+	if !h.tlsLoaded {
+		h.tlsLoaded = true
+		h.tlsState = ConnectionState(h.client)
+		if h.tlsState != nil && len(h.tlsState.PeerCertificates) > 0 {
+			h.cert = h.tlsState.PeerCertificates[0]
+		}
+	}
+	b.ClientX509Cert = h.cert
+	if h.cfg.TLSState {
+		b.TLS = h.tlsState
+	}
+}
+
+// ConnectionState returns the TLS connection state of conn, or nil if conn is
+// no TLS connection. Connections wrapping another connection must provide a
+// NetConn method returning the wrapped connection.
+func ConnectionState(conn net.Conn) *tls.ConnectionState {
+	c := tlsConn(conn)
+	if c == nil {
+		return nil
+	}
+	state := c.ConnectionState()
+	return &state
+}
+
+// tlsConn returns the TLS connection conn wraps, or nil.
+func tlsConn(conn net.Conn) *tls.Conn {
+	for {
+		switch c := conn.(type) {
+		case *tls.Conn:
+			return c
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+// countingConn counts the bytes read from and written to the wrapped
+// connection. NetConn returns the wrapped connection, such that TLS
+// connections are still found by ConnectionState.
+type countingConn struct {
+	net.Conn
+	counters lj.ConnCounters
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.counters.AddRead(n)
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.counters.AddWritten(n)
+	return n, err
+}
 
+func (c *countingConn) NetConn() net.Conn {
+	return c.Conn
 }
@@ -0,0 +1,81 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import "net"
+
+// IPFilter permits or rejects clients by their remote IP address. A client is
+// rejected if its address is contained in any of the Denied networks, even if
+// it is also contained in an Allowed network. If Allowed is not empty, only
+// clients from the Allowed networks are permitted.
+type IPFilter struct {
+	Allowed []net.IPNet
+	Denied  []net.IPNet
+}
+
+// Active reports whether any networks are configured.
+func (f IPFilter) Active() bool {
+	return len(f.Allowed) > 0 || len(f.Denied) > 0
+}
+
+// Permits reports whether a client connecting from addr is permitted.
+// Addresses without IP are rejected if any networks are configured.
+func (f IPFilter) Permits(addr net.Addr) bool {
+	if !f.Active() {
+		return true
+	}
+
+	ip := remoteIP(addr)
+	if ip == nil {
+		return false
+	}
+	// match IPv4-mapped IPv6 addresses (dual-stack listeners) against IPv4
+	// networks
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	if containsIP(f.Denied, ip) {
+		return false
+	}
+	return len(f.Allowed) == 0 || containsIP(f.Allowed, ip)
+}
+
+func remoteIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case nil:
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+func containsIP(nets []net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import (
+	"net"
+	"testing"
+)
+
+func mustCIDRs(t *testing.T, cidrs ...string) []net.IPNet {
+	var nets []net.IPNet
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nets = append(nets, *n)
+	}
+	return nets
+}
+
+func TestIPFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter IPFilter
+		addr   string
+		permit bool
+	}{
+		{"no filter", IPFilter{}, "192.0.2.1", true},
+		{"allowed", IPFilter{Allowed: mustCIDRs(t, "192.0.2.0/24")}, "192.0.2.1", true},
+		{"not allowed", IPFilter{Allowed: mustCIDRs(t, "192.0.2.0/24")}, "198.51.100.1", false},
+		{"denied", IPFilter{Denied: mustCIDRs(t, "192.0.2.0/24")}, "192.0.2.1", false},
+		{"not denied", IPFilter{Denied: mustCIDRs(t, "192.0.2.0/24")}, "198.51.100.1", true},
+		{"deny precedence", IPFilter{
+			Allowed: mustCIDRs(t, "192.0.2.0/24"),
+			Denied:  mustCIDRs(t, "192.0.2.128/25"),
+		}, "192.0.2.200", false},
+		{"allowed, not denied", IPFilter{
+			Allowed: mustCIDRs(t, "192.0.2.0/24"),
+			Denied:  mustCIDRs(t, "192.0.2.128/25"),
+		}, "192.0.2.1", true},
+		{"IPv4-mapped allowed", IPFilter{Allowed: mustCIDRs(t, "192.0.2.0/24")}, "::ffff:192.0.2.1", true},
+		{"IPv4-mapped denied", IPFilter{Denied: mustCIDRs(t, "192.0.2.0/24")}, "::ffff:192.0.2.1", false},
+		{"IPv6 allowed", IPFilter{Allowed: mustCIDRs(t, "2001:db8::/32")}, "2001:db8::1", true},
+		{"IPv6 not allowed", IPFilter{Allowed: mustCIDRs(t, "2001:db8::/32")}, "2001:db9::1", false},
+	}
+
+	for _, test := range tests {
+		addr := &net.TCPAddr{IP: net.ParseIP(test.addr), Port: 5044}
+		if permit := test.filter.Permits(addr); permit != test.permit {
+			t.Errorf("%v: expected permit=%v for %v", test.name, test.permit, test.addr)
+		}
+	}
+}
+
+func TestIPFilterNonTCPAddr(t *testing.T) {
+	f := IPFilter{Allowed: mustCIDRs(t, "127.0.0.0/8")}
+	if !f.Permits(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}) {
+		t.Error("expected address to be parsed from string")
+	}
+	if f.Permits(&net.UnixAddr{Name: "/tmp/sock", Net: "unix"}) {
+		t.Error("expected address without IP to be rejected")
+	}
+}
@@ -0,0 +1,195 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/elastic/go-lumber/lj"
+	"github.com/elastic/go-lumber/log"
+)
+
+// Delays between retrying Accept after temporary errors, doubling while
+// errors persist.
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// Binder returns a binder creating TCP listeners for the IP versions selected
+// by stack, with a listen backlog of backlog connections if > 0. Listeners are
+// wrapped with TLS, if tlsConfig is set.
+func Binder(stack lj.IPStack, backlog int, tlsConfig *tls.Config) func(network, addr string) (net.Listener, error) {
+	if stack == lj.DefaultStack && backlog == 0 {
+		if tlsConfig != nil {
+			return func(network, addr string) (net.Listener, error) {
+				return tls.Listen(network, addr, tlsConfig)
+			}
+		}
+		return net.Listen
+	}
+
+	return func(network, addr string) (net.Listener, error) {
+		var l net.Listener
+		var err error
+		if stack == lj.DefaultStack {
+			l, err = net.Listen(network, addr)
+		} else {
+			l, err = listenStack(stack, addr)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if backlog > 0 {
+			if err := setBacklog(l, backlog); err != nil {
+				l.Close()
+				return nil, err
+			}
+		}
+		if tlsConfig != nil {
+			l = tls.NewListener(l, tlsConfig)
+		}
+		return l, nil
+	}
+}
+
+// setBacklog changes the listen backlog of a listening socket, by calling
+// listen again. net.ListenConfig always uses the system default.
+func setBacklog(l net.Listener, backlog int) error {
+	sc, ok := l.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("setting listen backlog: unsupported listener %T", l)
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		serr = listenBacklog(fd, backlog)
+	})
+	if err != nil {
+		return err
+	}
+	if serr != nil {
+		return fmt.Errorf("setting listen backlog %v: %w", backlog, serr)
+	}
+	return nil
+}
+
+// Accept returns the next connection accepted by l. Accept is retried after
+// temporary errors, e.g. the process running out of file descriptors, backing
+// off from minAcceptDelay up to maxAcceptDelay. Errors are passed to onError,
+// if set, unless done has been closed, as the listener is being closed.
+// Returns the first permanent error, or the last error once done is closed.
+func Accept(l net.Listener, done <-chan struct{}, onError func(error, bool)) (net.Conn, error) {
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err == nil {
+			return conn, nil
+		}
+		select {
+		case <-done:
+			return nil, err
+		default:
+		}
+
+		temporary := isTemporary(err)
+		if onError != nil {
+			onError(err, temporary)
+		}
+		if !temporary {
+			log.Printf("Stop accepting connections: %v", err)
+			return nil, err
+		}
+
+		delay *= 2
+		if delay == 0 {
+			delay = minAcceptDelay
+		}
+		if delay > maxAcceptDelay {
+			delay = maxAcceptDelay
+		}
+		log.Printf("Accept error: %v; retrying in %v", err, delay)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-done:
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+	}
+}
+
+func isTemporary(err error) bool {
+	var te interface{ Temporary() bool }
+	return errors.As(err, &te) && te.Temporary()
+}
+
+func listenStack(stack lj.IPStack, addr string) (net.Listener, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	network := "tcp6"
+	v6only := true
+	switch stack {
+	case lj.DualStack:
+		if host != "" && !net.IPv6unspecified.Equal(net.ParseIP(host)) {
+			return nil, fmt.Errorf("dual-stack listener requires address :: or no host, got %q", host)
+		}
+		host = "::"
+		v6only = false
+	case lj.IPv4Only:
+		network = "tcp4"
+	case lj.IPv6Only:
+	default:
+		return nil, fmt.Errorf("unknown IP stack %v", stack)
+	}
+
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			if network != "tcp6" {
+				return nil
+			}
+
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = setIPv6Only(fd, v6only)
+			})
+			if err != nil {
+				return err
+			}
+			if serr != nil {
+				return fmt.Errorf("setting IPV6_V6ONLY=%v: %w", v6only, serr)
+			}
+			return nil
+		},
+	}
+	return lc.Listen(context.Background(), network, net.JoinHostPort(host, port))
+}
@@ -0,0 +1,200 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import (
+	"errors"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/elastic/go-lumber/lj"
+)
+
+func TestListenIPStack(t *testing.T) {
+	tests := []struct {
+		name     string
+		stack    lj.IPStack
+		addr     string
+		ipv4, v6 bool
+	}{
+		{"dual-stack", lj.DualStack, "[::]:0", true, true},
+		{"dual-stack no host", lj.DualStack, ":0", true, true},
+		{"IPv4 only", lj.IPv4Only, ":0", true, false},
+		{"IPv6 only", lj.IPv6Only, "[::]:0", false, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l, err := Binder(test.stack, 0, nil)("tcp", test.addr)
+			if err != nil {
+				t.Skipf("stack not available: %v", err)
+			}
+			defer l.Close()
+			go func() {
+				for {
+					c, err := l.Accept()
+					if err != nil {
+						return
+					}
+					c.Close()
+				}
+			}()
+
+			port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+			check := func(network, host string, ok bool) {
+				c, err := net.Dial(network, net.JoinHostPort(host, port))
+				if err == nil {
+					c.Close()
+				}
+				if ok && err != nil {
+					t.Errorf("failed to connect via %v: %v", host, err)
+				}
+				if !ok && err == nil {
+					t.Errorf("unexpected connection via %v", host)
+				}
+			}
+			check("tcp4", "127.0.0.1", test.ipv4)
+			if hasIPv6Loopback() {
+				check("tcp6", "::1", test.v6)
+			}
+		})
+	}
+}
+
+func TestListenDualStackAddress(t *testing.T) {
+	if _, err := Binder(lj.DualStack, 0, nil)("tcp", "127.0.0.1:0"); err == nil {
+		t.Fatal("expected dual-stack listener on IPv4 address to fail")
+	}
+}
+
+func hasIPv6Loopback() bool {
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
+
+func TestListenBacklog(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("listen backlog not supported")
+	}
+
+	l, err := Binder(lj.DefaultStack, 16, nil)("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c, err = l.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+// errListener returns err from Accept, recording the time of every call.
+type errListener struct {
+	net.Listener
+	err error
+
+	mu    sync.Mutex
+	calls []time.Time
+}
+
+func (l *errListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.calls = append(l.calls, time.Now())
+	return nil, l.err
+}
+
+func (l *errListener) callTimes() []time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]time.Time(nil), l.calls...)
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	emfile := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	l := &errListener{err: emfile}
+
+	var reported int
+	done := make(chan struct{})
+	returned := make(chan error)
+	go func() {
+		_, err := Accept(l, done, func(err error, temporary bool) {
+			if !temporary {
+				t.Errorf("expected temporary error, got %v", err)
+			}
+			reported++
+		})
+		returned <- err
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	close(done)
+	select {
+	case err := <-returned:
+		if err != emfile {
+			t.Errorf("expected last accept error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Accept did not return after done has been closed")
+	}
+
+	// delays of 5, 10, 20, 40 and 80ms fit into 200ms
+	calls := l.callTimes()
+	if len(calls) < 3 || len(calls) > 7 {
+		t.Fatalf("expected accept to be retried with backoff, got %v calls", len(calls))
+	}
+	if reported != len(calls) {
+		t.Errorf("expected %v errors to be reported, got %v", len(calls), reported)
+	}
+	for i := 2; i < len(calls); i++ {
+		prev, cur := calls[i-1].Sub(calls[i-2]), calls[i].Sub(calls[i-1])
+		if prev < minAcceptDelay || cur < prev {
+			t.Errorf("expected growing retry delays, got %v after %v", cur, prev)
+		}
+	}
+}
+
+func TestAcceptPermanentError(t *testing.T) {
+	l := &errListener{err: errors.New("listener failed")}
+
+	var temporary []bool
+	_, err := Accept(l, nil, func(err error, tmp bool) { temporary = append(temporary, tmp) })
+	if err != l.err {
+		t.Errorf("expected permanent error to be returned, got %v", err)
+	}
+	if len(l.callTimes()) != 1 || len(temporary) != 1 || temporary[0] {
+		t.Errorf("expected single permanent error, got calls=%v reported=%v",
+			len(l.callTimes()), temporary)
+	}
+}
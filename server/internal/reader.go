@@ -0,0 +1,295 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// ErrProtocolError is returned by readers of all protocol versions if a
+// protocol error was detected in the conversation with a client.
+var ErrProtocolError = errors.New("lumberjack protocol error")
+
+// ProtocolError describes a protocol violation detected reading from a
+// client. ProtocolError wraps ErrProtocolError, such that errors.Is(err,
+// ErrProtocolError) holds for all protocol errors.
+type ProtocolError struct {
+	// Code is the code of the offending frame, or 0 if the violation is not
+	// specific to a frame.
+	Code byte
+
+	// Offset is the number of bytes of the current window read from the
+	// connection when the violation was detected. For frames nested in
+	// compressed frames, Offset points into the enclosing compressed frame.
+	Offset int
+
+	// RemoteAddr is the address of the client. Nil if unknown.
+	RemoteAddr net.Addr
+
+	// Reason describes the violation.
+	Reason string
+}
+
+// NewProtocolError returns a ProtocolError for the frame with code, with the
+// reason formatted from format and args. Offset and RemoteAddr are added by
+// the reader via WithContext.
+func NewProtocolError(code byte, format string, args ...interface{}) *ProtocolError {
+	return &ProtocolError{Code: code, Reason: fmt.Sprintf(format, args...)}
+}
+
+func (e *ProtocolError) Error() string {
+	var b strings.Builder
+	b.WriteString(ErrProtocolError.Error())
+	b.WriteString(": ")
+	b.WriteString(e.Reason)
+	if e.Code != 0 {
+		fmt.Fprintf(&b, " (frame %q at offset %v", e.Code, e.Offset)
+	} else {
+		fmt.Fprintf(&b, " (offset %v", e.Offset)
+	}
+	if e.RemoteAddr != nil {
+		fmt.Fprintf(&b, " from %v", e.RemoteAddr)
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return ErrProtocolError
+}
+
+// WithContext sets Offset and the RemoteAddr of conn in the ProtocolError in
+// the chain of err, if any, returning err.
+func WithContext(err error, offset int, conn net.Conn) error {
+	var pe *ProtocolError
+	if errors.As(err, &pe) {
+		pe.Offset, pe.RemoteAddr = offset, conn.RemoteAddr()
+	}
+	return err
+}
+
+// DecompressorError converts err of a decompressor failing to initialize, e.g.
+// due to an invalid header of the compressed payload, into a ProtocolError for
+// the frame with code. EOF and network errors are returned as is.
+func DecompressorError(code byte, err error) error {
+	var netErr net.Error
+	if err == io.EOF || err == io.ErrUnexpectedEOF || errors.As(err, &netErr) {
+		return err
+	}
+	return NewProtocolError(code, "failed to initialize decompressor: %v", err)
+}
+
+// ErrBatchTooLarge is returned by readers of all protocol versions if the
+// event payloads of a window exceed the configured maximum batch size.
+var ErrBatchTooLarge = errors.New("batch exceeds maximum size")
+
+// Sizes declared by clients are trusted for allocations up to these limits
+// only. Larger buffers grow with the bytes actually received, such that
+// clients can not force large allocations by declaring sizes they never send.
+const (
+	// MaxPreallocEvents is the maximum capacity preallocated for the events of
+	// a window.
+	MaxPreallocEvents = 4096
+
+	// MaxPreallocPayload is the maximum payload size read into a preallocated
+	// buffer.
+	MaxPreallocPayload = 64 << 10
+)
+
+// PreallocEvents returns the capacity to preallocate for a window of count
+// events.
+func PreallocEvents(count int) int {
+	if count > MaxPreallocEvents {
+		return MaxPreallocEvents
+	}
+	return count
+}
+
+// ReadFull reads exactly len(buf) bytes from in. io.EOF is returned if no
+// bytes have been read, and io.ErrUnexpectedEOF if in ends early.
+func ReadFull(in io.Reader, buf []byte) error {
+	_, err := io.ReadFull(in, buf)
+	return err
+}
+
+// ReadSized reads n bytes into a new buffer, growing with the bytes actually
+// received. Like ReadFull, io.EOF is returned if no bytes have been read, and
+// io.ErrUnexpectedEOF if fewer than n bytes have been read.
+func ReadSized(in io.Reader, n int) ([]byte, error) {
+	buf, err := io.ReadAll(io.LimitReader(in, int64(n)))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case len(buf) == 0 && n > 0:
+		return nil, io.EOF
+	case len(buf) < n:
+		return nil, io.ErrUnexpectedEOF
+	}
+	return buf, nil
+}
+
+// ReadWindowHeader reads the window header hdr from in. Waiting for the first
+// byte of the header is bounded by idle, if > 0, or waits forever. Once the
+// first byte has been received, the remaining bytes must follow within
+// timeout, such that clients stalling in the middle of the header are
+// disconnected. Deadlines are set on conn.
+func ReadWindowHeader(
+	conn interface{ SetReadDeadline(time.Time) error },
+	in io.Reader,
+	hdr []byte,
+	idle, timeout time.Duration,
+) error {
+	var deadline time.Time
+	if idle > 0 {
+		deadline = time.Now().Add(idle)
+	}
+	_ = conn.SetReadDeadline(deadline)
+	if err := ReadFull(in, hdr[:1]); err != nil {
+		return err
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	err := ReadFull(in, hdr[1:])
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// DiscardRemaining discards the bytes left in in, e.g. padding trailing the
+// compressed data of a compressed frame. Returns io.ErrUnexpectedEOF if the
+// underlying reader ends first.
+func DiscardRemaining(in *io.LimitedReader) error {
+	if _, err := io.Copy(io.Discard, in); err != nil {
+		return err
+	}
+	if in.N > 0 {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// CountingReader counts the number of bytes read from R.
+type CountingReader struct {
+	R io.Reader
+	N int
+}
+
+func (c *CountingReader) Read(buf []byte) (int, error) {
+	n, err := c.R.Read(buf)
+	c.N += n
+	return n, err
+}
+
+// codeDataFrame is the code of key-value data frames of all protocol versions.
+const codeDataFrame = 'D'
+
+// FieldReader reads key-value data frames, which share their layout between
+// protocol versions 1 and 2:
+//
+//	version: uint8, code: uint8 = 'D'
+//	seq: uint32
+//	pairs: uint32
+//	per pair: keyLen: uint32, key, valueLen: uint32, value
+//
+// Sizes and pair counts exceeding the limits passed are rejected with
+// a ProtocolError before allocating any buffer. Limits of 0 disable checks.
+// The zero value is ready to use.
+type FieldReader struct {
+	hdr [8]byte
+	buf []byte
+}
+
+// ReadHeader reads the header following the frame code and returns the
+// sequence number of the event and the number of pairs in the frame.
+func (r *FieldReader) ReadHeader(in io.Reader, maxPairs int) (uint32, int, error) {
+	if err := ReadFull(in, r.hdr[:8]); err != nil {
+		return 0, 0, err
+	}
+
+	seq := binary.BigEndian.Uint32(r.hdr[:4])
+	pairs := int(binary.BigEndian.Uint32(r.hdr[4:8]))
+	if maxPairs > 0 && pairs > maxPairs {
+		return 0, 0, NewProtocolError(codeDataFrame,
+			"key-value frame of %v pairs exceeds limit of %v pairs", pairs, maxPairs)
+	}
+	return seq, pairs, nil
+}
+
+// ReadString reads a length prefixed key or value.
+func (r *FieldReader) ReadString(in io.Reader, maxSize int) (string, error) {
+	sz := r.hdr[:4]
+	if err := ReadFull(in, sz); err != nil {
+		return "", err
+	}
+
+	n := int(binary.BigEndian.Uint32(sz))
+	if maxSize > 0 && n > maxSize {
+		return "", NewProtocolError(codeDataFrame,
+			"key-value frame field of %v bytes exceeds limit of %v bytes", n, maxSize)
+	}
+
+	if n > MaxPreallocPayload {
+		buf, err := ReadSized(in, n)
+		return string(buf), err
+	}
+	if n > len(r.buf) {
+		r.buf = make([]byte, n)
+	}
+	buf := r.buf[:n]
+	if err := ReadFull(in, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// SeqRange is the range of sequence numbers of the events of a window. The
+// zero value is the empty range.
+type SeqRange struct {
+	Low, High uint32
+	Valid     bool
+}
+
+// Add extends the range by seq.
+func (s *SeqRange) Add(seq uint32) {
+	switch {
+	case !s.Valid:
+		*s = SeqRange{Low: seq, High: seq, Valid: true}
+	case seq < s.Low:
+		s.Low = seq
+	case seq > s.High:
+		s.High = seq
+	}
+}
+
+// Merge extends the range by all sequence numbers of o.
+func (s *SeqRange) Merge(o SeqRange) {
+	if o.Valid {
+		s.Add(o.Low)
+		s.Add(o.High)
+	}
+}
@@ -0,0 +1,67 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import "sync"
+
+// maxResendClients bounds the number of clients tracked by ResendTracker.
+// Clients closing their connection with windows not yet ACKed are not tracked
+// once the limit is reached.
+const maxResendClients = 4096
+
+// ResendTracker remembers clients whose connection has been closed while
+// windows read from the client had not been ACKed. Clients resend windows not
+// ACKed after reconnecting, such that as many windows read from the next
+// connection of the same client are possible duplicates. Clients are
+// identified by IP address. All methods are safe to be called on a nil
+// ResendTracker.
+type ResendTracker struct {
+	mu      sync.Mutex
+	clients map[string]int
+}
+
+func NewResendTracker() *ResendTracker {
+	return &ResendTracker{clients: map[string]int{}}
+}
+
+// closed records the connection of client being closed with windows not ACKed
+// to the client.
+func (t *ResendTracker) closed(client string, windows int) {
+	if t == nil || windows <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.clients[client]; !ok && len(t.clients) >= maxResendClients {
+		return
+	}
+	t.clients[client] += windows
+}
+
+// take returns the number of windows the client is expected to resend on a
+// new connection, and forgets the client.
+func (t *ResendTracker) take(client string) int {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := t.clients[client]
+	delete(t.clients, client)
+	return n
+}
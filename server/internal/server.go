@@ -18,10 +18,14 @@
 package internal
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/elastic/go-lumber/lj"
 	"github.com/elastic/go-lumber/log"
@@ -33,12 +37,68 @@ type Server struct {
 	ch       chan *lj.Batch
 	ownCH    bool
 	sig      closeSignaler
+	drain    chan struct{}
+	done     chan struct{} // closed before closing listener
+
+	closeOnce sync.Once
+	closeErr  error
+	closed    lj.CloseResult
+	forced    int64
+	dropped   int32
+
+	restoreGC func()
 }
 
+// DefaultCloseTimeout is the grace period connections are given to drain on
+// Close.
+const DefaultCloseTimeout = 5 * time.Second
+
 type Config struct {
 	TLS     *tls.Config
 	Handler HandlerFactory
 	Channel chan *lj.Batch
+
+	// IPStack selects the IP versions bound by ListenAndServe.
+	IPStack lj.IPStack
+
+	// Backlog, if > 0, sets the listen backlog of the listener created by
+	// ListenAndServe.
+	Backlog int
+
+	// AcceptError, if set, is called with the errors accepting connections.
+	// See Accept.
+	AcceptError func(err error, temporary bool)
+
+	// IPFilter rejects clients right after accepting the connection.
+	IPFilter IPFilter
+
+	// GCPercent, if not 0, is installed via SetGCPercent while the server is
+	// running.
+	GCPercent int
+
+	// FullChannelPolicy handles batches with Channel being full.
+	FullChannelPolicy lj.FullChannelPolicy
+
+	// Backpressure, if set, is called every time a batch can not be forwarded
+	// to Channel right away.
+	Backpressure func()
+
+	// Router, if set, selects the channel to forward batches to per TLS
+	// connection.
+	Router SNIRouter
+
+	// PerConnection, if set, forwards the batches of every connection to a
+	// dedicated, unbuffered channel instead of Channel or the channel selected
+	// by Router. PerConnection is called with the remote address and the
+	// channel once the connection has been accepted, before reading the first
+	// batch. The channel is closed once the connection handler has returned.
+	// Connections block on their channel being full, independent of
+	// FullChannelPolicy.
+	PerConnection func(remote net.Addr, ch <-chan *lj.Batch)
+
+	// Stats, if set, counts connections. The handler created by Handler
+	// should count batches using the same Stats.
+	Stats *Stats
 }
 
 type Handler interface {
@@ -46,6 +106,14 @@ type Handler interface {
 	Stop()
 }
 
+// Drainer is implemented by handlers supporting graceful shutdown. Drain asks
+// the handler to stop reading new batches and to stop once all batches read
+// have been ACKed. Pending returns the number of batches not yet ACKed.
+type Drainer interface {
+	Drain()
+	Pending() int
+}
+
 type HandlerFactory func(Eventer, net.Conn) (Handler, error)
 
 type Eventer interface {
@@ -53,15 +121,69 @@ type Eventer interface {
 }
 
 type chanCallback struct {
-	done <-chan struct{}
-	ch   chan *lj.Batch
+	done         <-chan struct{}
+	ch           chan *lj.Batch
+	policy       lj.FullChannelPolicy
+	backpressure func()
+
+	// route, if set, is called on first batch to select the channel.
+	route func() chan *lj.Batch
 }
 
-func newChanCallback(done <-chan struct{}, ch chan *lj.Batch) *chanCallback {
-	return &chanCallback{done, ch}
+var errChannelFull = errors.New("batch rejected due to receive channel being full")
+
+func newChanCallback(
+	done <-chan struct{},
+	ch chan *lj.Batch,
+	policy lj.FullChannelPolicy,
+	backpressure func(),
+) *chanCallback {
+	return &chanCallback{done: done, ch: ch, policy: policy, backpressure: backpressure}
 }
 
 func (c *chanCallback) OnEvents(b *lj.Batch) error {
+	if c.route != nil {
+		if ch := c.route(); ch != nil {
+			c.ch = ch
+		}
+		c.route = nil
+	}
+
+	select {
+	case <-c.done:
+		return io.EOF
+	case c.ch <- b:
+		return nil
+	default:
+	}
+
+	if c.backpressure != nil {
+		c.backpressure()
+	}
+
+	switch c.policy {
+	case lj.FullChannelReject:
+		return errChannelFull
+
+	case lj.FullChannelDropOldest:
+		if cap(c.ch) == 0 {
+			break // no batches to drop from unbuffered channel
+		}
+
+		for {
+			select {
+			case <-c.done:
+				return io.EOF
+			case c.ch <- b:
+				return nil
+			case old := <-c.ch:
+				// old was received from another connection, as a handler only
+				// forwards its next batch after the previous one has been ACKed.
+				old.RequestResend()
+			}
+		}
+	}
+
 	select {
 	case <-c.done:
 		return io.EOF
@@ -74,6 +196,8 @@ func NewWithListener(l net.Listener, opts Config) (*Server, error) {
 	s := &Server{
 		listener: l,
 		sig:      makeCloseSignaler(),
+		drain:    make(chan struct{}),
+		done:     make(chan struct{}),
 		ch:       opts.Channel,
 		opts:     opts,
 	}
@@ -83,6 +207,8 @@ func NewWithListener(l net.Listener, opts Config) (*Server, error) {
 		s.ch = make(chan *lj.Batch, 128)
 	}
 
+	s.restoreGC = SetGCPercent(opts.GCPercent)
+
 	s.sig.Add(1)
 	go s.run()
 
@@ -102,25 +228,39 @@ func ListenAndServeWith(
 }
 
 func ListenAndServe(addr string, opts Config) (*Server, error) {
-	binder := net.Listen
-	if opts.TLS != nil {
-		binder = func(network, addr string) (net.Listener, error) {
-			return tls.Listen(network, addr, opts.TLS)
-		}
-	}
-
-	return ListenAndServeWith(binder, addr, opts)
+	return ListenAndServeWith(Binder(opts.IPStack, opts.Backlog, opts.TLS), addr, opts)
 }
 
 func (s *Server) Close() error {
-	err := s.listener.Close()
-	s.sig.Close()
-	if s.ownCH {
-		close(s.ch)
-	}
+	_, err := s.CloseWithTimeout(DefaultCloseTimeout)
 	return err
 }
 
+// CloseWithTimeout stops the listener and waits up to d for active connections
+// to drain, before closing the remaining connections forcibly. Connections
+// drain by ACKing all batches read, without reading new batches. Repeated
+// calls return the result of the first call.
+func (s *Server) CloseWithTimeout(d time.Duration) (lj.CloseResult, error) {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.closeErr = s.listener.Close()
+		if d > 0 {
+			close(s.drain)
+			s.sig.Wait(d)
+		}
+		s.sig.Close()
+		s.restoreGC()
+		if s.ownCH {
+			close(s.ch)
+		}
+		s.closed = lj.CloseResult{
+			ForcedConns: int(atomic.LoadInt64(&s.forced)),
+			Dropped:     atomic.LoadInt32(&s.dropped) != 0,
+		}
+	})
+	return s.closed, s.closeErr
+}
+
 func (s *Server) Receive() *lj.Batch {
 	select {
 	case <-s.sig.Sig():
@@ -134,49 +274,164 @@ func (s *Server) ReceiveChan() <-chan *lj.Batch {
 	return s.ch
 }
 
+func (s *Server) Stats() lj.Stats {
+	return s.opts.Stats.Snapshot()
+}
+
 func (s *Server) run() {
 	defer s.sig.Done()
 
 	for {
-		client, err := s.listener.Accept()
+		client, err := Accept(s.listener, s.done, s.opts.AcceptError)
 		if err != nil {
 			break
 		}
 
+		if !s.opts.IPFilter.Permits(client.RemoteAddr()) {
+			log.Printf("Rejected connection from %v: address not permitted", client.RemoteAddr())
+			s.opts.Stats.connRejected()
+			client.Close()
+			continue
+		}
+
 		log.Printf("New connection from %v", client.RemoteAddr())
 		s.startConnHandler(client)
 	}
 }
 
 func (s *Server) startConnHandler(client net.Conn) {
-	var wgStart sync.WaitGroup
+	if s.opts.PerConnection != nil {
+		s.startConnChannel(client)
+		return
+	}
 
-	h, err := s.opts.Handler(newChanCallback(s.sig.Sig(), s.ch), client)
-	if err != nil {
-		log.Printf("Failed to initialize client handler: %v", h)
+	cb := newChanCallback(s.sig.Sig(), s.ch,
+		s.opts.FullChannelPolicy, s.opts.Backpressure)
+	if router := s.opts.Router; router != nil {
+		cb.route = func() chan *lj.Batch { return routeChannel(router, client) }
+	}
+	h := s.newHandler(cb, client)
+	if h == nil {
+		return
+	}
+
+	s.sig.Add(1)
+	runHandler(h, s.opts.Stats, s.drain, s.sig.Sig(), s.forceClose, s.sig.Done)
+}
+
+// startConnChannel runs the handler for client, forwarding batches to a
+// dedicated channel passed to PerConnection. Using one channel per connection,
+// a slow consumer only blocks the connection it is processing.
+func (s *Server) startConnChannel(client net.Conn) {
+	ch := make(chan *lj.Batch)
+	cb := newChanCallback(s.sig.Sig(), ch, lj.FullChannelBlock, s.opts.Backpressure)
+	h := s.newHandler(cb, client)
+	if h == nil {
 		return
 	}
 
+	s.opts.PerConnection(client.RemoteAddr(), ch)
 	s.sig.Add(1)
-	wgStart.Add(1)
+	runHandler(h, s.opts.Stats, s.drain, s.sig.Sig(), s.forceClose, func() {
+		close(ch)
+		s.sig.Done()
+	})
+}
+
+// newHandler creates the handler for client, forwarding batches to cb. Returns
+// nil and closes client if the handler can not be initialized.
+func (s *Server) newHandler(cb Eventer, client net.Conn) Handler {
+	h, err := s.opts.Handler(cb, client)
+	if err != nil {
+		log.Printf("Failed to initialize client handler: %v", err)
+		client.Close()
+		return nil
+	}
+	return h
+}
+
+// forceClose records a connection closed forcibly on shutdown.
+func (s *Server) forceClose(h Handler) {
+	atomic.AddInt64(&s.forced, 1)
+	if d, ok := h.(Drainer); ok && d.Pending() > 0 {
+		atomic.StoreInt32(&s.dropped, 1)
+	}
+}
+
+// ServeConn runs the handler configured in opts on an already established
+// connection, independent of any listener. Batches are forwarded to the
+// returned channel, which is closed once the connection handler has
+// returned. Cancelling ctx stops the handler and closes conn.
+//
+// Listener related settings (TLS, IPStack, IPFilter, Router, Channel,
+// PerConnection, FullChannelPolicy, GCPercent) are ignored. The caller is
+// responsible for the TLS handshake, e.g. by passing a *tls.Conn.
+func ServeConn(ctx context.Context, conn net.Conn, opts Config) (<-chan *lj.Batch, error) {
+	if opts.Stats == nil {
+		opts.Stats = NewStats()
+	}
+
+	ch := make(chan *lj.Batch)
+	cb := newChanCallback(ctx.Done(), ch, lj.FullChannelBlock, opts.Backpressure)
+	h, err := opts.Handler(cb, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	runHandler(h, opts.Stats, nil, ctx.Done(), nil, func() { close(ch) })
+	return ch, nil
+}
+
+// runHandler runs h in a new go-routine. Handlers implementing Drainer are
+// asked to drain once drain is closed, others are stopped right away. The
+// handler is stopped if done is closed, calling onForce first if the handler
+// is still running. onExit is called after the handler loop returned.
+func runHandler(
+	h Handler,
+	stats *Stats,
+	drain, done <-chan struct{},
+	onForce func(Handler),
+	onExit func(),
+) {
 	stopped := make(chan struct{}, 1)
+	stats.connOpened()
 	go func() {
-		defer s.sig.Done()
+		defer onExit()
 		defer close(stopped) // signal handler loop stopped
+		defer stats.connClosed()
 
-		wgStart.Done()
 		h.Run()
 	}()
 
-	wgStart.Wait()
 	go func() {
-		select {
-		case <-s.sig.Sig():
-			// server shutdown
-			h.Stop()
+		for {
+			select {
+			case <-drain:
+				// server shutdown, grace period
+				drain = nil
+				if d, ok := h.(Drainer); ok {
+					d.Drain()
+				} else {
+					h.Stop()
+				}
+
+			case <-done:
+				// server shutdown
+				select {
+				case <-stopped:
+					return
+				default:
+				}
+				if onForce != nil {
+					onForce(h)
+				}
+				h.Stop()
+				return
 
-		case <-stopped:
-			// handler loop stopped
+			case <-stopped:
+				// handler loop stopped
+				return
+			}
 		}
 	}()
 }
@@ -17,7 +17,10 @@
 
 package internal
 
-import "sync"
+import (
+	"sync"
+	"time"
+)
 
 type closeSignaler struct {
 	done chan struct{}
@@ -46,3 +49,22 @@ func (s *closeSignaler) Close() {
 	close(s.done)
 	s.wg.Wait()
 }
+
+// Wait waits up to d for all go-routines to return, without signaling them to
+// stop. Returns false on timeout.
+func (s *closeSignaler) Wait(d time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
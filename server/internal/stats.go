@@ -0,0 +1,105 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/elastic/go-lumber/lj"
+)
+
+// Stats collects server statistics using atomic counters, such that taking a
+// snapshot is cheap and safe while serving clients. All methods are safe to
+// be called on a nil Stats.
+type Stats struct {
+	activeConns int64
+	connections uint64
+	batches     uint64
+	events      uint64
+	bytes       uint64
+	readErrors  uint64
+	partials    uint64
+	rejected    uint64
+	dropped     uint64
+
+	started time.Time
+}
+
+func NewStats() *Stats {
+	return &Stats{started: time.Now()}
+}
+
+// Snapshot returns the current statistics.
+func (s *Stats) Snapshot() lj.Stats {
+	if s == nil {
+		return lj.Stats{}
+	}
+	return lj.Stats{
+		ActiveConnections: int(atomic.LoadInt64(&s.activeConns)),
+		Connections:       atomic.LoadUint64(&s.connections),
+		Batches:           atomic.LoadUint64(&s.batches),
+		Events:            atomic.LoadUint64(&s.events),
+		Bytes:             atomic.LoadUint64(&s.bytes),
+		ReadErrors:        atomic.LoadUint64(&s.readErrors),
+		PartialBatches:    atomic.LoadUint64(&s.partials),
+		Rejected:          atomic.LoadUint64(&s.rejected),
+		DroppedEvents:     atomic.LoadUint64(&s.dropped),
+		Uptime:            time.Since(s.started),
+	}
+}
+
+func (s *Stats) connOpened() {
+	if s != nil {
+		atomic.AddInt64(&s.activeConns, 1)
+		atomic.AddUint64(&s.connections, 1)
+	}
+}
+
+func (s *Stats) connRejected() {
+	if s != nil {
+		atomic.AddUint64(&s.rejected, 1)
+	}
+}
+
+func (s *Stats) connClosed() {
+	if s != nil {
+		atomic.AddInt64(&s.activeConns, -1)
+	}
+}
+
+func (s *Stats) batchRead(b *lj.Batch) {
+	if s != nil {
+		atomic.AddUint64(&s.batches, 1)
+		atomic.AddUint64(&s.events, uint64(b.Len()))
+		atomic.AddUint64(&s.bytes, uint64(b.WireBytes))
+		atomic.AddUint64(&s.dropped, uint64(b.Dropped))
+	}
+}
+
+func (s *Stats) readError() {
+	if s != nil {
+		atomic.AddUint64(&s.readErrors, 1)
+	}
+}
+
+func (s *Stats) partialBatch() {
+	if s != nil {
+		atomic.AddUint64(&s.partials, 1)
+	}
+}
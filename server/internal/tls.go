@@ -0,0 +1,127 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/elastic/go-lumber/lj"
+)
+
+// TLSSettings holds TLS settings to be applied on top of a user provided TLS
+// configuration.
+type TLSSettings struct {
+	MinVersion   uint16
+	CipherSuites []uint16
+
+	// Secure rejects TLS configurations allowing TLS versions older than 1.2.
+	Secure bool
+
+	// Router selects the TLS configuration by the server name requested by
+	// the client (SNI).
+	Router SNIRouter
+}
+
+// SNIRouter selects the TLS configuration and channel to forward batches to
+// by the server name requested by the client. A nil configuration rejects the
+// client. A nil channel forwards batches to the servers default channel.
+type SNIRouter func(serverName string) (*tls.Config, chan *lj.Batch)
+
+var (
+	errNoTLSConfig   = errors.New("TLS settings require a TLS configuration")
+	errInsecureTLS   = errors.New("TLS configuration allows TLS versions older than 1.2")
+	errNoCipherSuite = errors.New("no TLS cipher suite configured")
+)
+
+// ConfigureTLS applies s to a copy of base. Settings in s take precedence over
+// base. Returns base if no settings are configured.
+//
+// If a Router is configured, the remaining settings are applied to the
+// configurations returned by the router as well. base is optional in this
+// case.
+func ConfigureTLS(base *tls.Config, s TLSSettings) (*tls.Config, error) {
+	if s.Router != nil {
+		return configureSNIRouter(base, s)
+	}
+
+	if s.MinVersion == 0 && s.CipherSuites == nil && !s.Secure {
+		return base, nil
+	}
+	if base == nil {
+		return nil, errNoTLSConfig
+	}
+
+	cfg := base.Clone()
+	if s.MinVersion != 0 {
+		cfg.MinVersion = s.MinVersion
+	}
+	if s.CipherSuites != nil {
+		if len(s.CipherSuites) == 0 {
+			return nil, errNoCipherSuite
+		}
+		cfg.CipherSuites = s.CipherSuites
+	}
+
+	if s.Secure {
+		if cfg.MinVersion == 0 {
+			cfg.MinVersion = tls.VersionTLS12
+		}
+		if cfg.MinVersion < tls.VersionTLS12 {
+			return nil, errInsecureTLS
+		}
+	}
+	return cfg, nil
+}
+
+func configureSNIRouter(base *tls.Config, s TLSSettings) (*tls.Config, error) {
+	router := s.Router
+	s.Router = nil
+
+	var cfg *tls.Config
+	if base == nil {
+		cfg = &tls.Config{}
+	} else {
+		var err error
+		if cfg, err = ConfigureTLS(base, s); err != nil {
+			return nil, err
+		}
+		cfg = cfg.Clone()
+	}
+
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		routed, _ := router(hello.ServerName)
+		if routed == nil {
+			return nil, fmt.Errorf("unknown TLS server name '%v'", hello.ServerName)
+		}
+		return ConfigureTLS(routed, s)
+	}
+	return cfg, nil
+}
+
+// routeChannel returns the channel the SNI router selects for conn, or nil.
+func routeChannel(router SNIRouter, conn net.Conn) chan *lj.Batch {
+	state := ConnectionState(conn)
+	if state == nil {
+		return nil
+	}
+	_, ch := router(state.ServerName)
+	return ch
+}
@@ -0,0 +1,131 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// codeACK is the code of ACK frames of all protocol versions.
+const codeACK = 'A'
+
+// FrameWriter writes the ACK frames of a protocol version to a client,
+// implementing ACKWriter for all protocol versions.
+type FrameWriter struct {
+	c  net.Conn
+	to time.Duration
+
+	// protocol version written in every frame, and whether the version
+	// supports keepalive frames
+	version   byte
+	keepalive bool
+
+	// buffer ACKs until Flush, and the ACK frames buffered, excluding
+	// keepalives
+	buffered bool
+	mu       sync.Mutex
+	buf      []byte
+	acks     []ackFrame
+
+	// OnACK, if set, is called with the sequence number and the number of
+	// events acknowledged of every ACK frame written, once the frame has been
+	// written
+	OnACK func(seq uint32, events int)
+}
+
+// ackFrame is an ACK frame written to the client.
+type ackFrame struct {
+	seq    uint32
+	events int
+}
+
+// NewFrameWriter creates a FrameWriter writing frames of the given protocol
+// version to c, bounding every write by to. Keepalives are not written if
+// keepalive is not set. ACKs are buffered until Flush if buffered is set.
+func NewFrameWriter(
+	c net.Conn,
+	version byte,
+	keepalive bool,
+	to time.Duration,
+	buffered bool,
+) *FrameWriter {
+	return &FrameWriter{c: c, to: to, version: version, keepalive: keepalive, buffered: buffered}
+}
+
+func (w *FrameWriter) ACK(n int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, w.version, codeACK, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(w.buf[len(w.buf)-4:], uint32(n))
+	if w.OnACK != nil && n > 0 {
+		w.acks = append(w.acks, ackFrame{seq: uint32(n), events: n})
+	}
+	if w.buffered {
+		return nil
+	}
+	return w.flush()
+}
+
+func (w *FrameWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.flush()
+}
+
+func (w *FrameWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+
+	if err := w.c.SetWriteDeadline(time.Now().Add(w.to)); err != nil {
+		return err
+	}
+	// clear deadline, such that it does not apply to later writes
+	defer w.c.SetWriteDeadline(time.Time{})
+
+	tmp := w.buf
+	for len(tmp) > 0 {
+		n, err := w.c.Write(tmp)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return ErrWriteTimeout
+			}
+			return err
+		}
+		tmp = tmp[n:]
+	}
+	for _, ack := range w.acks {
+		w.OnACK(ack.seq, ack.events)
+	}
+	w.buf, w.acks = w.buf[:0], w.acks[:0]
+	return nil
+}
+
+func (w *FrameWriter) Keepalive(n int) error {
+	if !w.keepalive {
+		return nil
+	}
+	if err := w.ACK(n); err != nil {
+		return err
+	}
+	return w.Flush()
+}
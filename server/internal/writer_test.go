@@ -0,0 +1,73 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWriteTimeout(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	// client not reading ACKs stalls the write
+	w := NewFrameWriter(server, '2', true, 20*time.Millisecond, false)
+	if err := w.ACK(1); err != ErrWriteTimeout {
+		t.Fatalf("expected ErrWriteTimeout, got %v", err)
+	}
+
+	// deadline must not apply to later writes
+	time.Sleep(30 * time.Millisecond)
+	go io.Copy(io.Discard, client)
+	if _, err := server.Write([]byte{1}); err != nil {
+		t.Fatalf("write deadline not cleared: %v", err)
+	}
+}
+
+func TestFrameWriterOnACK(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go io.Copy(io.Discard, client)
+
+	var acks [][2]int
+	w := NewFrameWriter(server, '2', true, time.Second, true)
+	w.OnACK = func(seq uint32, events int) { acks = append(acks, [2]int{int(seq), events}) }
+
+	// buffered ACKs are reported once flushed, keepalives are not reported
+	if err := w.ACK(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.ACK(3); err != nil {
+		t.Fatal(err)
+	}
+	if len(acks) != 0 {
+		t.Fatalf("buffered ACKs reported before written: %v", acks)
+	}
+	if err := w.Keepalive(0); err != nil {
+		t.Fatal(err)
+	}
+	if expected := [][2]int{{2, 2}, {3, 3}}; !reflect.DeepEqual(acks, expected) {
+		t.Errorf("expected ACKs %v, got %v", expected, acks)
+	}
+}
@@ -20,11 +20,14 @@ package server
 import (
 	"errors"
 	"net"
+	"sync"
 )
 
 type muxListener struct {
 	net.Listener
-	ch chan net.Conn
+	ch   chan net.Conn
+	done chan struct{}
+	once sync.Once
 }
 
 type muxConn struct {
@@ -43,22 +46,37 @@ var (
 )
 
 func newMuxListener(l net.Listener) *muxListener {
-	return &muxListener{l, make(chan net.Conn, 1)}
+	return &muxListener{
+		Listener: l,
+		ch:       make(chan net.Conn, 1),
+		done:     make(chan struct{}),
+	}
 }
 
 // Accept waits for and returns the next connection to the listener.
 func (l *muxListener) Accept() (net.Conn, error) {
-	conn, ok := <-l.ch
-	if !ok {
+	select {
+	case conn := <-l.ch:
+		return conn, nil
+	case <-l.done:
 		return nil, ErrListenerClosed
 	}
-	return conn, nil
+}
+
+// deliver passes conn to Accept. The connection is closed if the listener has
+// been closed.
+func (l *muxListener) deliver(conn net.Conn) {
+	select {
+	case l.ch <- conn:
+	case <-l.done:
+		conn.Close()
+	}
 }
 
 // Close closes the listener.
 // Any blocked Accept operations will be unblocked and return errors.
 func (l *muxListener) Close() error {
-	close(l.ch)
+	l.once.Do(func() { close(l.done) })
 	return nil
 }
 
@@ -69,6 +87,16 @@ func newMuxConn(v byte, c net.Conn) *muxConn {
 	return mc
 }
 
+// NetConn returns the wrapped connection.
+func (mc *muxConn) NetConn() net.Conn {
+	return mc.Conn
+}
+
+// NetConn returns the wrapped connection.
+func (vc *versionConn) NetConn() net.Conn {
+	return vc.Conn
+}
+
 func (vc *versionConn) Read(buf []byte) (int, error) {
 	if len(buf) == 0 {
 		return 0, nil
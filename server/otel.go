@@ -0,0 +1,100 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+//go:build otel
+
+package server
+
+import (
+	"context"
+	"net"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/elastic/go-lumber/lj"
+)
+
+// TraceParentField is the top-level event field the W3C trace context of a
+// batch is extracted from. The field of the first event in a batch is used,
+// together with the optional tracestate field.
+const TraceParentField = "traceparent"
+
+// TracerProvider creates an OpenTelemetry span for every batch received. The
+// span is a child of the trace context found in TraceParentField of the
+// first event, and ends once the batch has been ACKed. TracerProvider is
+// only available when building with the otel build tag. It configures Tracer,
+// such that the last of both options wins.
+func TracerProvider(tp trace.TracerProvider) Option {
+	tracer := tp.Tracer("github.com/elastic/go-lumber/server")
+	propagator := propagation.TraceContext{}
+
+	return Tracer(func(b *lj.Batch, remote net.Addr) func(error) {
+		ctx := propagator.Extract(context.Background(), traceCarrier(firstEventFields(b)))
+		_, span := tracer.Start(ctx, "lumberjack.batch",
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.Int("lumberjack.batch.events", b.Len()),
+				attribute.Int("lumberjack.batch.wire_bytes", b.WireBytes),
+				attribute.String("lumberjack.protocol.version", string(b.ProtocolVersion)),
+				attribute.String("net.peer.address", remote.String()),
+			))
+
+		return func(err error) {
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+			}
+			span.End()
+		}
+	})
+}
+
+// firstEventFields returns the first event of b if it is a JSON object.
+// Returns nil if the event can not be decoded.
+func firstEventFields(b *lj.Batch) map[string]interface{} {
+	if len(b.Events) == 0 {
+		return nil
+	}
+
+	event, err := b.Event(0)
+	if err != nil {
+		return nil
+	}
+	fields, _ := event.(map[string]interface{})
+	return fields
+}
+
+// traceCarrier reads trace context from the string fields of an event.
+type traceCarrier map[string]interface{}
+
+func (c traceCarrier) Get(key string) string {
+	s, _ := c[key].(string)
+	return s
+}
+
+func (c traceCarrier) Set(key, value string) {}
+
+func (c traceCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
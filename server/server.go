@@ -18,14 +18,16 @@
 package server
 
 import (
-	"crypto/tls"
 	"errors"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/elastic/go-lumber/lj"
 	"github.com/elastic/go-lumber/log"
+	"github.com/elastic/go-lumber/server/internal"
 	"github.com/elastic/go-lumber/server/v1"
 	"github.com/elastic/go-lumber/server/v2"
 )
@@ -40,17 +42,39 @@ type Server interface {
 	// Batches returned by Receive must be ACKed.
 	Receive() *lj.Batch
 
+	// Stats returns a snapshot of the server statistics. Stats is cheap and
+	// safe to call while serving clients.
+	Stats() lj.Stats
+
 	// Close stops the listener, closes all active connections and closes the
-	// receiver channel returned from ReceiveChan().
+	// receiver channel returned from ReceiveChan(). Connections are given 5
+	// seconds to drain, see CloseWithTimeout.
 	Close() error
+
+	// CloseWithTimeout stops the listener and waits up to d for active
+	// connections to drain, before closing the remaining connections forcibly
+	// and closing the receiver channel. Draining connections stop reading new
+	// batches, but keep ACKing batches already received. Repeated and
+	// concurrent calls return the result of the first call.
+	CloseWithTimeout(d time.Duration) (lj.CloseResult, error)
 }
 
 type server struct {
-	ch    chan *lj.Batch
-	ownCH bool
+	ch       chan *lj.Batch
+	ownCH    bool
+	timeout  time.Duration
+	ipFilter internal.IPFilter
+	rejected uint64
+
+	acceptError func(error, bool)
 
-	done chan struct{}
-	wg   sync.WaitGroup
+	done    chan struct{}
+	stopped chan struct{}
+	wg      sync.WaitGroup
+
+	closeOnce sync.Once
+	closeErr  error
+	closed    lj.CloseResult
 
 	netListener net.Listener
 	mux         []muxServer
@@ -66,8 +90,36 @@ var (
 	// ErrNoVersionEnabled indicates no lumberjack protocol version being enabled
 	// when instantiating a server.
 	ErrNoVersionEnabled = errors.New("No protocol version enabled")
+
+	// ErrProtocolError is returned if an protocol error was detected in the
+	// conversation with lumberjack server. The error is shared by all protocol
+	// versions.
+	ErrProtocolError = v2.ErrProtocolError
+
+	// ErrWriteTimeout is returned if writing an ACK to the client did not
+	// complete within the configured write timeout. The connection is closed.
+	ErrWriteTimeout = v2.ErrWriteTimeout
+
+	// ErrNoClientCert is returned if RequireClientCert is set and a client did
+	// not present a verified certificate.
+	ErrNoClientCert = v2.ErrNoClientCert
+
+	// ErrBatchTooLarge is returned if the event payloads of a batch exceed the
+	// size configured by MaxBatchBytes. The connection is closed.
+	ErrBatchTooLarge = v2.ErrBatchTooLarge
 )
 
+// ProtocolError describes a protocol violation of a client. It wraps
+// ErrProtocolError. See v2.ProtocolError.
+type ProtocolError = v2.ProtocolError
+
+// RegisterCompressionCodec registers a decompressor for the payloads of
+// compressed frames of protocol version 2 starting with magic. See
+// v2.RegisterCompressionCodec.
+func RegisterCompressionCodec(magic []byte, factory func(io.Reader) (io.ReadCloser, error)) {
+	v2.RegisterCompressionCodec(magic, factory)
+}
+
 // NewWithListener creates a new Server using an existing net.Listener. Use
 // options V1 and V2 to enable wanted protocol versions.
 func NewWithListener(l net.Listener, opts ...Option) (Server, error) {
@@ -102,31 +154,49 @@ func ListenAndServe(addr string, opts ...Option) (Server, error) {
 		return nil, err
 	}
 
-	binder := net.Listen
-	if o.tls != nil {
-		binder = func(network, addr string) (net.Listener, error) {
-			return tls.Listen(network, addr, o.tls)
-		}
-	}
-
+	binder := internal.Binder(o.ipStack, o.backlog, o.tls)
 	return ListenAndServeWith(binder, addr, opts...)
 }
 
 // Close stops the listener, closes all active connections and closes the
 // receiver channel returned from ReceiveChan()
 func (s *server) Close() error {
-	close(s.done)
-	for _, m := range s.mux {
-		m.server.Close()
-	}
-	err := s.netListener.Close()
-	s.wg.Wait()
-	if s.ownCH {
-		close(s.ch)
-	}
+	_, err := s.CloseWithTimeout(internal.DefaultCloseTimeout)
 	return err
 }
 
+// CloseWithTimeout stops the listener and drains the connections of all
+// protocol versions concurrently, combining the results.
+func (s *server) CloseWithTimeout(d time.Duration) (lj.CloseResult, error) {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.closeErr = s.netListener.Close()
+
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for _, m := range s.mux {
+			wg.Add(1)
+			go func(srv Server) {
+				defer wg.Done()
+				res, _ := srv.CloseWithTimeout(d)
+
+				mu.Lock()
+				defer mu.Unlock()
+				s.closed.ForcedConns += res.ForcedConns
+				s.closed.Dropped = s.closed.Dropped || res.Dropped
+			}(m.server)
+		}
+		wg.Wait()
+
+		s.wg.Wait()
+		close(s.stopped)
+		if s.ownCH {
+			close(s.ch)
+		}
+	})
+	return s.closed, s.closeErr
+}
+
 // ReceiveChan returns a channel all received batch requests will be made
 // available on. Batches read from channel must be ACKed.
 func (s *server) ReceiveChan() <-chan *lj.Batch {
@@ -137,13 +207,34 @@ func (s *server) ReceiveChan() <-chan *lj.Batch {
 // Batches returned by Receive must be ACKed.
 func (s *server) Receive() *lj.Batch {
 	select {
-	case <-s.done:
+	case <-s.stopped:
 		return nil
 	case b := <-s.ch:
 		return b
 	}
 }
 
+// Stats returns the statistics of all protocol versions combined.
+func (s *server) Stats() lj.Stats {
+	stats := lj.Stats{Rejected: atomic.LoadUint64(&s.rejected)}
+	for _, m := range s.mux {
+		st := m.server.Stats()
+		stats.ActiveConnections += st.ActiveConnections
+		stats.Connections += st.Connections
+		stats.Rejected += st.Rejected
+		stats.Batches += st.Batches
+		stats.Events += st.Events
+		stats.Bytes += st.Bytes
+		stats.ReadErrors += st.ReadErrors
+		stats.PartialBatches += st.PartialBatches
+		stats.DroppedEvents += st.DroppedEvents
+		if st.Uptime > stats.Uptime {
+			stats.Uptime = st.Uptime
+		}
+	}
+	return stats
+}
+
 func newServer(l net.Listener, opts ...Option) (Server, error) {
 	cfg, err := applyOptions(opts)
 	if err != nil {
@@ -156,21 +247,99 @@ func newServer(l net.Listener, opts ...Option) (Server, error) {
 
 	if cfg.v1 {
 		servers = append(servers, func(l net.Listener) (Server, byte, error) {
-			s, err := v1.NewWithListener(l,
+			opts := []v1.Option{
 				v1.Timeout(cfg.timeout),
+				v1.IdleTimeout(cfg.idleTimeout),
+				v1.WriteTimeout(cfg.writeTimeout),
 				v1.Channel(cfg.ch),
-				v1.TLS(cfg.tls))
+				v1.TLS(cfg.tls),
+				v1.GCPercent(cfg.gcPercent),
+				v1.ACKLatency(cfg.ackLatency),
+				v1.OnACK(cfg.onACK),
+				v1.ConflictPolicy(cfg.conflictPolicy),
+				v1.FullChannelPolicy(cfg.fullChannelPolicy),
+				v1.Backpressure(cfg.backpressure),
+				v1.PerConnectionChannels(cfg.perConnection),
+				v1.MaxCompressedDepth(cfg.maxCompressedDepth),
+				v1.MaxCompressedEvents(cfg.maxCompressedEvents),
+				v1.MaxFieldSize(cfg.maxFieldSize),
+				v1.MaxFieldPairs(cfg.maxFieldPairs),
+				v1.MaxBatchBytes(cfg.maxBatchBytes),
+				v1.SNIRouter(cfg.tlsSettings.Router),
+				v1.RequireClientCert(cfg.requireClientCert),
+				v1.TLSConnectionState(cfg.tlsState),
+				v1.Clock(cfg.clock),
+				v1.Tracer(cfg.trace),
+				v1.ConnectionListener(cfg.connListener),
+				v1.RateLimiter(cfg.rateLimiter),
+				v1.EventLimiter(cfg.eventLimiter),
+				v1.ACKCoalesce(cfg.ackCoalesce),
+				v1.ACKEvery(cfg.ackEvery),
+				v1.ResendRequested(cfg.resendRequested),
+				v1.AcceptError(cfg.acceptError),
+			}
+			for _, fn := range cfg.middleware {
+				opts = append(opts, v1.Middleware(fn))
+			}
+
+			s, err := v1.NewWithListener(l, opts...)
 			return s, '1', err
 		})
 	}
 	if cfg.v2 {
 		servers = append(servers, func(l net.Listener) (Server, byte, error) {
-			s, err := v2.NewWithListener(l,
+			opts := []v2.Option{
 				v2.Keepalive(cfg.keepalive),
 				v2.Timeout(cfg.timeout),
+				v2.IdleTimeout(cfg.idleTimeout),
+				v2.WriteTimeout(cfg.writeTimeout),
 				v2.Channel(cfg.ch),
 				v2.TLS(cfg.tls),
-				v2.JSONDecoder(cfg.decoder))
+				v2.JSONDecoder(cfg.decoder),
+				v2.GCPercent(cfg.gcPercent),
+				v2.ACKLatency(cfg.ackLatency),
+				v2.OnACK(cfg.onACK),
+				v2.ConflictPolicy(cfg.conflictPolicy),
+				v2.FullChannelPolicy(cfg.fullChannelPolicy),
+				v2.Backpressure(cfg.backpressure),
+				v2.PerConnectionChannels(cfg.perConnection),
+				v2.MaxCompressedDepth(cfg.maxCompressedDepth),
+				v2.MaxCompressedEvents(cfg.maxCompressedEvents),
+				v2.MaxCompressedPadding(cfg.compressedPadding),
+				v2.MaxFieldSize(cfg.maxFieldSize),
+				v2.MaxFieldPairs(cfg.maxFieldPairs),
+				v2.MaxBatchBytes(cfg.maxBatchBytes),
+				v2.LazyDecoding(cfg.lazy),
+				v2.RawPayloads(cfg.rawPayloads),
+				v2.LenientDecoding(cfg.lenient),
+				v2.ValidateJSON(cfg.validate),
+				v2.EventValidator(cfg.validator),
+				v2.DropInvalidBatches(cfg.dropInvalid),
+				v2.StreamCompression(cfg.streamCompression),
+				v2.PartialBatches(cfg.partialBatches),
+				v2.EventSequences(cfg.sequences),
+				v2.ParallelDecompression(cfg.inflateWorkers, cfg.inflateMinSize),
+				v2.SNIRouter(cfg.tlsSettings.Router),
+				v2.RequireClientCert(cfg.requireClientCert),
+				v2.TLSConnectionState(cfg.tlsState),
+				v2.Clock(cfg.clock),
+				v2.Tracer(cfg.trace),
+				v2.ConnectionListener(cfg.connListener),
+				v2.RateLimiter(cfg.rateLimiter),
+				v2.EventLimiter(cfg.eventLimiter),
+				v2.ACKCoalesce(cfg.ackCoalesce),
+				v2.ACKEvery(cfg.ackEvery),
+				v2.ResendRequested(cfg.resendRequested),
+				v2.AcceptError(cfg.acceptError),
+			}
+			for code, fn := range cfg.frameHandlers {
+				opts = append(opts, v2.FrameHandler(code, fn))
+			}
+			for _, fn := range cfg.middleware {
+				opts = append(opts, v2.Middleware(fn))
+			}
+
+			s, err := v2.NewWithListener(l, opts...)
 			return s, '2', err
 		})
 	}
@@ -208,9 +377,13 @@ func newServer(l net.Listener, opts ...Option) (Server, error) {
 	s := &server{
 		ch:          cfg.ch,
 		ownCH:       ownCH,
+		timeout:     cfg.timeout,
+		ipFilter:    cfg.ipFilter,
+		acceptError: cfg.acceptError,
 		netListener: l,
 		mux:         mux,
 		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
 	}
 	s.wg.Add(1)
 	go s.run()
@@ -221,11 +394,18 @@ func newServer(l net.Listener, opts ...Option) (Server, error) {
 func (s *server) run() {
 	defer s.wg.Done()
 	for {
-		client, err := s.netListener.Accept()
+		client, err := internal.Accept(s.netListener, s.done, s.acceptError)
 		if err != nil {
 			break
 		}
 
+		if !s.ipFilter.Permits(client.RemoteAddr()) {
+			log.Printf("Rejected connection from %v: address not permitted", client.RemoteAddr())
+			atomic.AddUint64(&s.rejected, 1)
+			client.Close()
+			continue
+		}
+
 		s.handle(client)
 	}
 }
@@ -237,9 +417,18 @@ func (s *server) handle(client net.Conn) {
 
 	go func() {
 		var buf [1]byte
+
+		// protocol version is read with timeout, so clients not sending any
+		// data do not block the connection forever.
+		if s.timeout > 0 {
+			_ = client.SetReadDeadline(time.Now().Add(s.timeout))
+		}
 		if _, err := io.ReadFull(client, buf[:]); err != nil {
+			client.Close()
+			close(sig)
 			return
 		}
+		_ = client.SetReadDeadline(time.Time{})
 		close(sig)
 
 		for _, m := range s.mux {
@@ -247,10 +436,12 @@ func (s *server) handle(client net.Conn) {
 				continue
 			}
 
-			conn := newMuxConn(buf[0], client)
-			m.l.ch <- conn
+			m.l.deliver(newMuxConn(buf[0], client))
 			return
 		}
+
+		log.Printf("Unknown protocol version %v from %v: %v",
+			buf[0], client.RemoteAddr(), ErrProtocolError)
 		client.Close()
 	}()
 
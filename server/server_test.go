@@ -0,0 +1,349 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	client "github.com/elastic/go-lumber/client/v2"
+	"github.com/elastic/go-lumber/lj"
+	"github.com/elastic/go-lumber/server/v2"
+)
+
+func TestConnectionListenerTLS(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	events := make(chan lj.ConnEvent, 10)
+
+	addr := freeAddr(t)
+	s, err := ListenAndServe(addr, V2(true),
+		TLS(ca.serverConfig(t, "server.example.org")),
+		ConnectionListener(func(evt lj.ConnEvent) { events <- evt }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	c, err := client.SyncDialWith(func(network, address string) (net.Conn, error) {
+		return tls.Dial(network, address, &tls.Config{
+			ServerName:   "server.example.org",
+			RootCAs:      ca.pool,
+			Certificates: []tls.Certificate{ca.issue(t, "client")},
+			MinVersion:   tls.VersionTLS13,
+		})
+	}, addr, client.Timeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() { s.Receive().ACK() }()
+	if _, err := c.Send([]interface{}{"event"}); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	var kinds []lj.ConnEventKind
+	for len(kinds) < 3 {
+		select {
+		case evt := <-events:
+			kinds = append(kinds, evt.Kind)
+			if evt.Kind != lj.ConnAccepted {
+				continue
+			}
+			if evt.TLS == nil || !evt.TLS.HandshakeComplete {
+				t.Fatal("expected TLS state of completed handshake")
+			}
+			if evt.TLS.Version != tls.VersionTLS13 || evt.TLS.CipherSuite == 0 {
+				t.Errorf("unexpected TLS state: version=%x, cipher=%x",
+					evt.TLS.Version, evt.TLS.CipherSuite)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for events, got %v", kinds)
+		}
+	}
+
+	expected := []lj.ConnEventKind{lj.ConnAccepted, lj.ConnFirstWindow, lj.ConnClosed}
+	for i := range expected {
+		if kinds[i] != expected[i] {
+			t.Errorf("expected events %v, got %v", expected, kinds)
+			break
+		}
+	}
+}
+
+func TestConnCountersTLS(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	addr := freeAddr(t)
+	s, err := ListenAndServe(addr, V2(true), TLS(ca.serverConfig(t, "server.example.org")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	c, err := client.SyncDialWith(func(network, address string) (net.Conn, error) {
+		return tls.Dial(network, address, &tls.Config{
+			ServerName:   "server.example.org",
+			RootCAs:      ca.pool,
+			Certificates: []tls.Certificate{ca.issue(t, "client")},
+		})
+	}, addr, client.Timeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	received := make(chan *lj.Batch, 1)
+	go func() {
+		b := s.Receive()
+		b.ACK()
+		received <- b
+	}()
+	if _, err := c.Send([]interface{}{"event"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// counting bytes must not hide the TLS connection
+	b := <-received
+	if cn, _ := b.ClientCommonName(); cn != "client" {
+		t.Errorf("expected client certificate, got %q", cn)
+	}
+	if n := b.Conn.BytesRead(); n != uint64(b.WireBytes) {
+		t.Errorf("expected %v application bytes read, got %v", b.WireBytes, n)
+	}
+}
+
+func TestRequireClientCert(t *testing.T) {
+	ca := newTestCA(t, "ca")
+
+	tests := []struct {
+		name       string
+		clientAuth tls.ClientAuthType
+		cert       bool
+		ok         bool
+	}{
+		{"no cert requested", tls.NoClientCert, true, false},
+		{"cert not verified", tls.RequestClientCert, true, false},
+		{"no cert given", tls.VerifyClientCertIfGiven, false, false},
+		{"verified cert", tls.VerifyClientCertIfGiven, true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// permissive server configuration, not requiring client certificates
+			tlsConfig := ca.serverConfig(t, "server.example.org")
+			tlsConfig.ClientAuth = test.clientAuth
+
+			addr := freeAddr(t)
+			s, err := ListenAndServe(addr, V2(true), TLS(tlsConfig), RequireClientCert(true))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			go func() {
+				for b := range s.ReceiveChan() {
+					b.ACK()
+				}
+			}()
+
+			clientConfig := &tls.Config{ServerName: "server.example.org", RootCAs: ca.pool}
+			if test.cert {
+				clientConfig.Certificates = []tls.Certificate{ca.issue(t, "client")}
+			}
+			c, err := client.SyncDialWith(func(network, address string) (net.Conn, error) {
+				return tls.Dial(network, address, clientConfig)
+			}, addr, client.Timeout(5*time.Second))
+			if err == nil {
+				_, err = c.Send([]interface{}{"event"})
+				c.Close()
+			}
+
+			if test.ok && err != nil {
+				t.Fatalf("expected client to be accepted, got %v", err)
+			}
+			if !test.ok {
+				if err == nil {
+					t.Fatal("expected client to be rejected")
+				}
+				if n := s.Stats().Rejected; n != 1 {
+					t.Errorf("expected 1 rejected connection, got %v", n)
+				}
+			}
+		})
+	}
+}
+
+func TestTLSConnectionState(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	tlsConfig := ca.serverConfig(t, "server.example.org")
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	tlsConfig.NextProtos = []string{"lumberjack"}
+
+	addr := freeAddr(t)
+	s, err := ListenAndServe(addr, V2(true), TLS(tlsConfig), TLSConnectionState(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	c, err := client.SyncDialWith(func(network, address string) (net.Conn, error) {
+		return tls.Dial(network, address, &tls.Config{
+			ServerName:   "server.example.org",
+			RootCAs:      ca.pool,
+			Certificates: []tls.Certificate{ca.issue(t, "client")},
+			NextProtos:   []string{"lumberjack"},
+		})
+	}, addr, client.Timeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var batches []*lj.Batch
+	for i := 0; i < 2; i++ {
+		go c.Send([]interface{}{"event"})
+		b := s.Receive()
+		b.ACK()
+		batches = append(batches, b)
+	}
+
+	state := batches[0].TLS
+	if state == nil {
+		t.Fatal("expected TLS connection state")
+	}
+	if state.ServerName != "server.example.org" || state.NegotiatedProtocol != "lumberjack" ||
+		state.Version < tls.VersionTLS12 {
+		t.Errorf("unexpected connection state: SNI %q, ALPN %q, version %x",
+			state.ServerName, state.NegotiatedProtocol, state.Version)
+	}
+	if batches[0].ClientX509Cert != state.PeerCertificates[0] {
+		t.Error("expected client certificate to be derived from the connection state")
+	}
+	if batches[1].TLS != state {
+		t.Error("expected connection state to be shared by batches of a connection")
+	}
+}
+
+func TestTLSConnectionStatePlain(t *testing.T) {
+	addr := freeAddr(t)
+	s, err := ListenAndServe(addr, V2(true), TLSConnectionState(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	c, err := client.SyncDial(addr, client.Timeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	go c.Send([]interface{}{"event"})
+	b := s.Receive()
+	b.ACK()
+	if b.TLS != nil || b.ClientX509Cert != nil {
+		t.Errorf("expected no TLS state for plain connection, got %v", b.TLS)
+	}
+}
+
+func TestRequireClientCertPlain(t *testing.T) {
+	addr := freeAddr(t)
+	s, err := ListenAndServe(addr, V2(true), RequireClientCert(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	c, err := client.SyncDial(addr, client.Timeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Send([]interface{}{"event"}); err == nil {
+		t.Fatal("expected plain connection to be rejected")
+	}
+}
+
+func TestHandleConnTLS(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+
+	conn := tls.Server(serverConn, ca.serverConfig(t, "server.example.org"))
+	batches, err := v2.HandleConn(context.Background(), conn, v2.RequireClientCert(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := client.NewSyncClientWithConn(tls.Client(clientConn, &tls.Config{
+		ServerName:   "server.example.org",
+		RootCAs:      ca.pool,
+		Certificates: []tls.Certificate{ca.issue(t, "client")},
+	}), client.Timeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan *lj.Batch, 1)
+	go func() {
+		b := <-batches
+		b.ACK()
+		received <- b
+	}()
+	if _, err := c.Send([]interface{}{"event"}); err != nil {
+		t.Fatal(err)
+	}
+
+	b := <-received
+	if cn, ok := b.ClientCommonName(); !ok || cn != "client" {
+		t.Errorf("expected client certificate CN 'client', got %q (ok=%v)", cn, ok)
+	}
+}
+
+func TestCloseWithTimeout(t *testing.T) {
+	addr := freeAddr(t)
+	s, err := ListenAndServe(addr, V2(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	c, err := client.SyncDial(addr, client.Timeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	go c.Send([]interface{}{"event"})
+	if b := s.Receive(); b == nil {
+		t.Fatal("server closed")
+	}
+
+	// batch never ACKed
+	res, err := s.CloseWithTimeout(50 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (lj.CloseResult{ForcedConns: 1, Dropped: true}); res != expected {
+		t.Errorf("expected close result %+v, got %+v", expected, res)
+	}
+	if b := s.Receive(); b != nil {
+		t.Errorf("unexpected batch after close: %v", b)
+	}
+}
@@ -0,0 +1,190 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	client "github.com/elastic/go-lumber/client/v2"
+	"github.com/elastic/go-lumber/lj"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue creates a certificate for name usable by servers and clients.
+func (ca *testCA) issue(t *testing.T, name string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// serverConfig returns a TLS configuration presenting a certificate for name,
+// requiring client certificates issued by ca.
+func (ca *testCA) serverConfig(t *testing.T, name string) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, name)},
+		ClientCAs:    ca.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+}
+
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestSNIRouter(t *testing.T) {
+	tenants := []struct {
+		name string
+		ca   *testCA
+		ch   chan *lj.Batch
+	}{
+		{"a.example.org", newTestCA(t, "ca-a"), make(chan *lj.Batch, 1)},
+		{"b.example.org", newTestCA(t, "ca-b"), make(chan *lj.Batch, 1)},
+	}
+
+	configs := map[string]*tls.Config{}
+	channels := map[string]chan *lj.Batch{}
+	for _, tenant := range tenants {
+		configs[tenant.name] = tenant.ca.serverConfig(t, tenant.name)
+		channels[tenant.name] = tenant.ch
+	}
+	router := func(name string) (*tls.Config, chan *lj.Batch) {
+		return configs[name], channels[name]
+	}
+
+	addr := freeAddr(t)
+	s, err := ListenAndServe(addr, V2(true), SNIRouter(router))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	dial := func(name string, roots *x509.CertPool, cert tls.Certificate) (*client.SyncClient, error) {
+		return client.SyncDialWith(func(network, address string) (net.Conn, error) {
+			return tls.Dial(network, address, &tls.Config{
+				ServerName:   name,
+				RootCAs:      roots,
+				Certificates: []tls.Certificate{cert},
+			})
+		}, addr, client.Timeout(5*time.Second))
+	}
+
+	for _, tenant := range tenants {
+		clientName := "client." + tenant.name
+		c, err := dial(tenant.name, tenant.ca.pool, tenant.ca.issue(t, clientName))
+		if err != nil {
+			t.Fatalf("%v: dial failed: %v", tenant.name, err)
+		}
+
+		done := make(chan struct{})
+		go func(ch chan *lj.Batch) {
+			defer close(done)
+			b := <-ch
+			if cn, _ := b.ClientCommonName(); cn != clientName {
+				t.Errorf("batch routed to wrong tenant, client %q", cn)
+			}
+			b.ACK()
+		}(tenant.ch)
+
+		if n, err := c.Send([]interface{}{tenant.name}); err != nil || n != 1 {
+			t.Errorf("%v: send failed: n=%v, err=%v", tenant.name, n, err)
+		}
+		<-done
+		c.Close()
+	}
+
+	// client certificate issued by the other tenant's CA
+	c, err := dial(tenants[0].name, tenants[0].ca.pool, tenants[1].ca.issue(t, "client"))
+	if err == nil {
+		_, err = c.Send([]interface{}{"rejected"})
+		c.Close()
+	}
+	if err == nil {
+		t.Error("expected client certificate of other CA to be rejected")
+	}
+
+	// unknown server name
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		ServerName:         "unknown.example.org",
+		InsecureSkipVerify: true,
+	})
+	if err == nil {
+		conn.Close()
+		t.Error("expected handshake with unknown server name to fail")
+	}
+}
@@ -22,112 +22,215 @@ import (
 	"encoding/binary"
 	"io"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/klauspost/compress/zlib"
 
 	"github.com/elastic/go-lumber/lj"
-	"github.com/elastic/go-lumber/log"
 	protocol "github.com/elastic/go-lumber/protocol/v1"
+	"github.com/elastic/go-lumber/server/internal"
 )
 
 type reader struct {
-	in      *bufio.Reader
-	conn    net.Conn
+	readerConfig
+	in   *bufio.Reader
+	conn net.Conn
+
+	// byte counters of current batch
+	wire    internal.CountingReader
+	decoded int
+
+	// reads key-value data frames
+	fields internal.FieldReader
+
+	// pool to return the reader to on Release
+	pool *readerPool
+}
+
+// readerPool pools readers of closed connections, for reuse by new
+// connections.
+type readerPool struct {
+	cfg  readerConfig
+	pool sync.Pool
+}
+
+type readerConfig struct {
 	timeout time.Duration
-	buf     []byte
+
+	// maximum time to wait for the next window. Unlimited if 0.
+	idleTimeout time.Duration
+
+	// maximum nesting level of compressed frames
+	maxCompressedDepth int
+
+	// maximum number of events per compressed frame. Unlimited if 0.
+	maxCompressedEvents int
+
+	// maximum size of keys and values, and maximum number of pairs of data
+	// frames. Unlimited if 0.
+	maxFieldSize  int
+	maxFieldPairs int
+
+	// maximum number of event payload bytes per window. Unlimited if 0.
+	maxBatchBytes int
+
+	// time source for stamping received batches
+	clock func() time.Time
 }
 
-func newReader(c net.Conn, to time.Duration) *reader {
+func newReader(c net.Conn, cfg readerConfig) *reader {
 	r := &reader{
-		in:      bufio.NewReader(c),
-		conn:    c,
-		timeout: to,
-		buf:     make([]byte, 0, 64),
+		readerConfig: cfg,
+		in:           bufio.NewReader(c),
+		conn:         c,
 	}
 	return r
 }
 
+// Reset rebinds the reader to a new connection, such that readers can be
+// reused across connections. Bytes still buffered from the previous connection
+// are discarded. The scratch buffer is kept.
+func (r *reader) Reset(c net.Conn, to time.Duration) {
+	r.in.Reset(c)
+	r.conn = c
+	r.timeout = to
+}
+
+func newReaderPool(cfg readerConfig) *readerPool {
+	return &readerPool{cfg: cfg}
+}
+
+// get returns a pooled reader reset to c, or a new reader if the pool is
+// empty.
+func (p *readerPool) get(c net.Conn) *reader {
+	if r, ok := p.pool.Get().(*reader); ok {
+		r.Reset(c, p.cfg.timeout)
+		return r
+	}
+
+	r := newReader(c, p.cfg)
+	r.pool = p
+	return r
+}
+
+// Release returns the reader to its pool, once the connection handler has
+// stopped reading. The reader must not be used afterwards.
+func (r *reader) Release() {
+	if r.pool == nil {
+		return
+	}
+
+	r.Reset(nil, r.timeout)
+	r.pool.pool.Put(r)
+}
+
 func (r *reader) ReadBatch() (*lj.Batch, error) {
 	// 1. read window size
 	var win [6]byte
-	_ = r.conn.SetReadDeadline(time.Time{}) // wait for next batch without timeout
-	if err := readFull(r.in, win[:]); err != nil {
+	r.wire = internal.CountingReader{R: r.in}
+	r.decoded = 0
+	if err := internal.ReadWindowHeader(r.conn, &r.wire, win[:], r.idleTimeout, r.timeout); err != nil {
 		return nil, err
 	}
 
-	if win[0] != protocol.CodeVersion && win[1] != protocol.CodeWindowSize {
-		log.Printf("Expected window from. Received %v", win[0:1])
-		return nil, ErrProtocolError
+	if win[0] != protocol.CodeVersion || win[1] != protocol.CodeWindowSize {
+		err := internal.NewProtocolError(win[1], "expected window frame, got version %q frame", win[0])
+		return nil, internal.WithContext(err, r.wire.N, r.conn)
 	}
 
 	count := int(binary.BigEndian.Uint32(win[2:]))
 	if count == 0 {
-		return nil, nil
+		return nil, ErrKeepAlive
 	}
 
 	if err := r.conn.SetReadDeadline(time.Now().Add(r.timeout)); err != nil {
 		return nil, err
 	}
 
-	events, err := r.readEvents(r.in, make([]interface{}, 0, count))
+	events := make([]interface{}, 0, internal.PreallocEvents(count))
+	events, err := r.readEvents(&r.wire, events, count, 0)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF // connection closed mid window
+	}
 	if events == nil || err != nil {
-		log.Printf("readEvents failed with: %v", err)
-		return nil, err
+		return nil, internal.WithContext(err, r.wire.N, r.conn)
 	}
 
-	return lj.NewBatch(events), nil
+	batch := lj.NewBatch(events)
+	batch.ProtocolVersion = protocol.CodeVersion
+	batch.WireBytes = r.wire.N
+	batch.DecodedBytes = r.decoded
+	batch.ReceivedAt = r.clock()
+	return batch, nil
 }
 
-func (r *reader) readEvents(in io.Reader, events []interface{}) ([]interface{}, error) {
-	for len(events) < cap(events) {
+// readEvents appends events read from in to events, until the window of count
+// events is complete.
+func (r *reader) readEvents(
+	in io.Reader,
+	events []interface{},
+	count, depth int,
+) ([]interface{}, error) {
+	for len(events) < count {
 		var hdr [2]byte
-		if err := readFull(in, hdr[:]); err != nil {
+		if err := internal.ReadFull(in, hdr[:]); err != nil {
 			return nil, err
 		}
 
 		if hdr[0] != protocol.CodeVersion {
-			log.Println("Event protocol version error")
-			return nil, ErrProtocolError
+			return nil, internal.NewProtocolError(hdr[1], "unsupported protocol version %q", hdr[0])
 		}
 
 		switch hdr[1] {
 		case protocol.CodeDataFrame:
 			event, err := r.readEvent(in)
 			if err != nil {
-				log.Printf("failed to read json event with: %v\n", err)
 				return nil, err
 			}
 			events = append(events, event)
 		case protocol.CodeCompressed:
-			readEvents, err := r.readCompressed(in, events)
+			if depth >= r.maxCompressedDepth {
+				return nil, internal.NewProtocolError(hdr[1],
+					"compressed frames nested too deep (max depth %v)", r.maxCompressedDepth)
+			}
+
+			readEvents, err := r.readCompressed(in, events, count, depth+1)
 			if err != nil {
 				return nil, err
 			}
 			events = readEvents
 		default:
-			log.Printf("Unknown frame type: %v", hdr[1])
-			return nil, ErrProtocolError
+			return nil, internal.NewProtocolError(hdr[1], "unknown frame type")
 		}
 	}
 	return events, nil
 }
 
-func (r *reader) readCompressed(in io.Reader, events []interface{}) ([]interface{}, error) {
+func (r *reader) readCompressed(
+	in io.Reader,
+	events []interface{},
+	count, depth int,
+) ([]interface{}, error) {
 	var hdr [4]byte
-	if err := readFull(in, hdr[:]); err != nil {
+	if err := internal.ReadFull(in, hdr[:]); err != nil {
 		return nil, err
 	}
 
+	// The compressed frame must provide all remaining events of the window.
+	if n := count - len(events); r.maxCompressedEvents > 0 && n > r.maxCompressedEvents {
+		return nil, internal.NewProtocolError(protocol.CodeCompressed,
+			"too many events in compressed frame (%v > %v)", n, r.maxCompressedEvents)
+	}
+
 	payloadSz := binary.BigEndian.Uint32(hdr[:])
-	limit := io.LimitReader(in, int64(payloadSz))
+	limit := &io.LimitedReader{R: in, N: int64(payloadSz)}
 	reader, err := zlib.NewReader(limit)
 	if err != nil {
-		log.Printf("Failed to initialized zlib reader %v\n", err)
-		return nil, err
+		return nil, internal.DecompressorError(protocol.CodeCompressed, err)
 	}
 
-	events, err = r.readEvents(reader, events)
+	events, err = r.readEvents(reader, events, count, depth)
 	if err != nil {
 		_ = reader.Close()
 		return nil, err
@@ -136,63 +239,46 @@ func (r *reader) readCompressed(in io.Reader, events []interface{}) ([]interface
 		return nil, err
 	}
 
-	// consume final bytes from limit reader
-	for {
-		var tmp [16]byte
-		if _, err := limit.Read(tmp[:]); err != nil {
-			if err != io.EOF {
-				return nil, err
-			}
-			break
-		}
+	// consume final bytes from limit reader, bounded by the frame size
+	if err := internal.DiscardRemaining(limit); err != nil {
+		return nil, err
 	}
 	return events, nil
 }
 
+// readEvent reads a data frame. Events are returned as map[string]string.
 func (r *reader) readEvent(in io.Reader) (interface{}, error) {
-	var hdr [8]byte
-	if err := readFull(in, hdr[:]); err != nil {
+	_, pairs, err := r.fields.ReadHeader(in, r.maxFieldPairs)
+	if err != nil {
 		return nil, err
 	}
 
-	readString := func() (string, error) {
-		var bufBytes [4]byte
-		if err := readFull(in, bufBytes[:]); err != nil {
-			return "", err
-		}
-
-		bytes := int(binary.BigEndian.Uint32(bufBytes[:]))
-		if bytes > len(r.buf) {
-			r.buf = make([]byte, bytes)
-		}
-
-		buf := r.buf[:bytes]
-		if err := readFull(in, buf); err != nil {
-			return "", err
-		}
-
-		return string(buf[:]), nil
-	}
-
 	event := map[string]string{}
-	pairs := int(binary.BigEndian.Uint32(hdr[4:]))
 	for i := 0; i < pairs; i++ {
-		k, err := readString()
+		k, err := r.fields.ReadString(in, r.maxFieldSize)
 		if err != nil {
 			return nil, err
 		}
 
-		v, err := readString()
+		v, err := r.fields.ReadString(in, r.maxFieldSize)
 		if err != nil {
 			return nil, err
 		}
 
+		if err := r.addDecoded(len(k) + len(v)); err != nil {
+			return nil, err
+		}
 		event[k] = v
 	}
 	return event, nil
 }
 
-func readFull(in io.Reader, buf []byte) error {
-	_, err := io.ReadFull(in, buf)
-	return err
+// addDecoded counts n event payload bytes of the current window, failing with
+// ErrBatchTooLarge once the window exceeds maxBatchBytes.
+func (r *reader) addDecoded(n int) error {
+	r.decoded += n
+	if r.maxBatchBytes > 0 && r.decoded > r.maxBatchBytes {
+		return ErrBatchTooLarge
+	}
+	return nil
 }
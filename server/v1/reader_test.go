@@ -0,0 +1,268 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v1
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zlib"
+)
+
+var testReaderConfig = readerConfig{
+	timeout:            time.Second,
+	maxCompressedDepth: 1,
+	clock:              time.Now,
+}
+
+func windowFrame(count uint32) []byte {
+	b := []byte{'1', 'W', 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[2:], count)
+	return b
+}
+
+// dataFrame builds a data frame of the key-value pairs in fields.
+func dataFrame(seq uint32, fields ...string) []byte {
+	b := []byte{'1', 'D', 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[2:], seq)
+	binary.BigEndian.PutUint32(b[6:], uint32(len(fields)/2))
+	for _, f := range fields {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(f)))
+		b = append(b, f...)
+	}
+	return b
+}
+
+func compressedFrame(frames ...[]byte) []byte {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	for _, f := range frames {
+		w.Write(f)
+	}
+	w.Close()
+
+	b := []byte{'1', 'C', 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[2:], uint32(buf.Len()))
+	return append(b, buf.Bytes()...)
+}
+
+// pipeConn returns a connection frames are read from. The peer connection is
+// closed after writing all frames.
+func pipeConn(t *testing.T, frames ...[]byte) net.Conn {
+	server, client := net.Pipe()
+	go func() {
+		defer client.Close()
+		for _, f := range frames {
+			if _, err := client.Write(f); err != nil {
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+func testReader(t *testing.T, cfg readerConfig, frames ...[]byte) *reader {
+	return newReader(pipeConn(t, frames...), cfg)
+}
+
+func TestReadDataFrames(t *testing.T) {
+	first := dataFrame(1, "line", "hello", "host", "a")
+	compressed := compressedFrame(dataFrame(2, "line", "b"), dataFrame(3))
+	r := testReader(t, testReaderConfig, windowFrame(3), first, compressed)
+
+	b, err := r.ReadBatch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []interface{}{
+		map[string]string{"line": "hello", "host": "a"},
+		map[string]string{"line": "b"},
+		map[string]string{},
+	}
+	if !reflect.DeepEqual(b.Events, expected) {
+		t.Errorf("expected events %v, got %v", expected, b.Events)
+	}
+	if b.ProtocolVersion != '1' {
+		t.Errorf("unexpected protocol version %q", b.ProtocolVersion)
+	}
+	if wire := 6 + len(first) + len(compressed); b.WireBytes != wire {
+		t.Errorf("expected %v wire bytes, got %v", wire, b.WireBytes)
+	}
+	if b.DecodedBytes != 19 {
+		t.Errorf("expected 19 decoded bytes, got %v", b.DecodedBytes)
+	}
+}
+
+func TestReadKeepAlive(t *testing.T) {
+	r := testReader(t, testReaderConfig, windowFrame(0), windowFrame(1), dataFrame(1, "a", "b"))
+	if _, err := r.ReadBatch(); err != ErrKeepAlive {
+		t.Fatalf("expected ErrKeepAlive, got %v", err)
+	}
+	if b, err := r.ReadBatch(); err != nil || len(b.Events) != 1 {
+		t.Fatalf("failed to read batch after keepalive: %v", err)
+	}
+}
+
+func TestReadWindowHeader(t *testing.T) {
+	for name, hdr := range map[string][]byte{
+		"code":    {'1', 'X', 0, 0, 0, 1},
+		"version": {'2', 'W', 0, 0, 0, 1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := testReader(t, testReaderConfig, hdr, dataFrame(1))
+			if _, err := r.ReadBatch(); !errors.Is(err, ErrProtocolError) {
+				t.Errorf("expected ErrProtocolError, got %v", err)
+			}
+		})
+	}
+}
+
+func TestReadWindowHeaderStalled(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go client.Write(windowFrame(1)[:2])
+
+	cfg := testReaderConfig
+	cfg.timeout = 50 * time.Millisecond
+	r := newReader(server, cfg)
+
+	start := time.Now()
+	_, err := r.ReadBatch()
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("expected timeout reading partial window header, got %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("stalled client disconnected after %v", d)
+	}
+}
+
+func TestReadCompressedLimits(t *testing.T) {
+	nested := compressedFrame(compressedFrame(dataFrame(1)))
+	r := testReader(t, testReaderConfig, windowFrame(1), nested)
+	if _, err := r.ReadBatch(); !errors.Is(err, ErrProtocolError) {
+		t.Errorf("expected nested compressed frame to fail, got %v", err)
+	}
+
+	cfg := testReaderConfig
+	cfg.maxCompressedEvents = 1
+	r = testReader(t, cfg, windowFrame(2), compressedFrame(dataFrame(1), dataFrame(2)))
+	if _, err := r.ReadBatch(); !errors.Is(err, ErrProtocolError) {
+		t.Errorf("expected too many compressed events to fail, got %v", err)
+	}
+}
+
+// padCompressed returns compressed frame f declaring a payload size of
+// padding bytes more than its compressed data, followed by n bytes of padding.
+func padCompressed(f []byte, padding, n int) []byte {
+	f = append([]byte(nil), f...)
+	sz := int(binary.BigEndian.Uint32(f[2:])) + padding
+	binary.BigEndian.PutUint32(f[2:], uint32(sz))
+	return append(f, make([]byte, n)...)
+}
+
+func TestReadCompressedPadding(t *testing.T) {
+	frame := compressedFrame(dataFrame(1, "a", "b"))
+	r := testReader(t, testReaderConfig,
+		windowFrame(1), padCompressed(frame, 5000, 5000), windowFrame(1), dataFrame(1))
+	for i := 0; i < 2; i++ {
+		if b, err := r.ReadBatch(); err != nil || len(b.Events) != 1 {
+			t.Fatalf("failed to read batch %v: %v", i, err)
+		}
+	}
+
+	// connection closed before the declared payload has been received
+	r = testReader(t, testReaderConfig, windowFrame(1), padCompressed(frame, 5000, 10))
+	if _, err := r.ReadBatch(); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestReadFieldLimits(t *testing.T) {
+	cfg := testReaderConfig
+	cfg.maxFieldSize = 4
+	cfg.maxFieldPairs = 1
+
+	r := testReader(t, cfg, windowFrame(1), dataFrame(1, "key", "value"))
+	if _, err := r.ReadBatch(); !errors.Is(err, ErrProtocolError) {
+		t.Errorf("expected oversized field to fail, got %v", err)
+	}
+	r = testReader(t, cfg, windowFrame(1), dataFrame(1, "a", "b", "c", "d"))
+	if _, err := r.ReadBatch(); !errors.Is(err, ErrProtocolError) {
+		t.Errorf("expected too many pairs to fail, got %v", err)
+	}
+}
+
+func TestReadProtocolError(t *testing.T) {
+	r := testReader(t, testReaderConfig, windowFrame(1), []byte{'1', 'X'})
+	_, err := r.ReadBatch()
+	var pe *ProtocolError
+	if !errors.Is(err, ErrProtocolError) || !errors.As(err, &pe) {
+		t.Fatalf("expected ProtocolError, got %v", err)
+	}
+	if pe.Code != 'X' || pe.Offset != 8 || pe.RemoteAddr == nil {
+		t.Errorf("expected frame 'X' at offset 8, got %+v", pe)
+	}
+}
+
+func TestReadMaxBatchBytes(t *testing.T) {
+	cfg := testReaderConfig
+	cfg.maxBatchBytes = 20
+
+	event := dataFrame(1, "key", "value")
+	r := testReader(t, cfg, windowFrame(2), event, event)
+	if b, err := r.ReadBatch(); err != nil || b.DecodedBytes != 16 {
+		t.Fatalf("expected batch within limit to be read, got %v", err)
+	}
+
+	// the third event exceeds the limit, the fourth one is never sent
+	r = testReader(t, cfg, windowFrame(4), event, event, compressedFrame(event))
+	if _, err := r.ReadBatch(); err != ErrBatchTooLarge {
+		t.Errorf("expected ErrBatchTooLarge, got %v", err)
+	}
+}
+
+func TestReadHostileSizes(t *testing.T) {
+	// sizes declared by the client must not be allocated before being received
+	field := []byte{'1', 'D', 0, 0, 0, 1, 0, 0, 0, 1, 0x7f, 0xff, 0xff, 0xff}
+	for name, frames := range map[string][][]byte{
+		"window": {windowFrame(1 << 31), dataFrame(1)},
+		"field":  {windowFrame(1), field},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			r := testReader(t, readerConfig{timeout: time.Second, clock: time.Now}, frames...)
+			if _, err := r.ReadBatch(); err != io.ErrUnexpectedEOF {
+				t.Errorf("expected io.ErrUnexpectedEOF, got %v", err)
+			}
+			runtime.ReadMemStats(&after)
+			if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 16<<20 {
+				t.Errorf("reading allocated %v bytes", allocated)
+			}
+		})
+	}
+}
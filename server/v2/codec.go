@@ -0,0 +1,108 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v2
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zlib"
+
+	protocol "github.com/elastic/go-lumber/protocol/v2"
+	"github.com/elastic/go-lumber/server/internal"
+)
+
+// maxCodecMagic is the maximum length of the magic bytes identifying a
+// compression codec.
+const maxCodecMagic = 16
+
+type codecFactory func(io.Reader) (io.ReadCloser, error)
+
+type codec struct {
+	magic   []byte
+	factory codecFactory
+}
+
+// codecs registered, guarded by codecsMu
+var (
+	codecsMu sync.RWMutex
+	codecs   []codec
+)
+
+func init() {
+	// The first byte of a zlib stream holds the compression method (8) and
+	// the window size, the second byte is a checksum of the header.
+	zlibReader := func(in io.Reader) (io.ReadCloser, error) { return zlib.NewReader(in) }
+	for window := 0; window < 8; window++ {
+		RegisterCompressionCodec([]byte{byte(window<<4 | 8)}, zlibReader)
+	}
+}
+
+// RegisterCompressionCodec registers a decompressor for the payloads of
+// compressed frames starting with magic. Readers sniff the leading bytes of
+// every compressed payload and pass the complete payload, including magic, to
+// the reader created by factory. If magic bytes of multiple codecs match, the
+// codec with the longest magic is used. Registering a codec for magic bytes
+// registered already replaces the codec. Compressed frames matching no
+// registered codec fail with ErrProtocolError.
+//
+// zlib, as sent by lumberjack clients, is registered by default. Stream
+// compression always uses zlib. RegisterCompressionCodec is typically called
+// from an init function, but is safe to call while servers are running.
+// Magic must be 1 to 16 bytes.
+func RegisterCompressionCodec(magic []byte, factory func(io.Reader) (io.ReadCloser, error)) {
+	if len(magic) == 0 || len(magic) > maxCodecMagic {
+		panic(fmt.Sprintf("lumberjack: compression codec magic of %v bytes", len(magic)))
+	}
+	if factory == nil {
+		panic("lumberjack: nil compression codec factory")
+	}
+
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	c := codec{magic: append([]byte(nil), magic...), factory: factory}
+	for i := range codecs {
+		if bytes.Equal(codecs[i].magic, magic) {
+			codecs[i] = c
+			return
+		}
+	}
+	codecs = append(codecs, c)
+}
+
+// lookupCodec returns the decompressor for the compressed payload starting
+// with hdr. ErrProtocolError is returned if no codec matches.
+func lookupCodec(hdr []byte) (codecFactory, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	var match *codec
+	for i := range codecs {
+		c := &codecs[i]
+		if bytes.HasPrefix(hdr, c.magic) && (match == nil || len(c.magic) > len(match.magic)) {
+			match = c
+		}
+	}
+	if match == nil {
+		return nil, internal.NewProtocolError(protocol.CodeCompressed,
+			"no compression codec for payload starting with %x", hdr)
+	}
+	return match.factory, nil
+}
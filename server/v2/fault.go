@@ -0,0 +1,41 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v2
+
+// faultStage identifies a stage of reading a window at which tests can inject
+// faults, e.g. truncating the input after the window header, corrupting the
+// compressed data of a frame or delaying a read. Faults are only injected in
+// builds with the lumberfault tag:
+//
+//	go test -tags lumberfault ./server/v2
+//
+// Other builds replace injectFault with a no-op.
+type faultStage uint8
+
+const (
+	// faultWindow wraps the connection input a window is read from, starting
+	// with the window header.
+	faultWindow faultStage = iota
+
+	// faultCompressed wraps the payload of a compressed frame, before it is
+	// decompressed.
+	faultCompressed
+
+	// faultInflated wraps the decompressed payload of a compressed frame.
+	faultInflated
+)
@@ -0,0 +1,51 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+//go:build lumberfault
+
+package v2
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// faultFunc wraps the input of a read stage, returning the reader the stage
+// reads from.
+type faultFunc func(stage faultStage, in io.Reader) io.Reader
+
+// faultHook holds the faultFunc installed by setFaultHook. Readers of all
+// connections and inflate pool workers share the hook.
+var faultHook atomic.Value
+
+func init() {
+	faultHook.Store(faultFunc(nil))
+}
+
+// setFaultHook installs fn for all readers. A nil fn removes the hook.
+func setFaultHook(fn faultFunc) {
+	faultHook.Store(fn)
+}
+
+// injectFault returns the input the reader reads stage from, as wrapped by
+// the installed hook.
+func injectFault(stage faultStage, in io.Reader) io.Reader {
+	if fn := faultHook.Load().(faultFunc); fn != nil {
+		return fn(stage, in)
+	}
+	return in
+}
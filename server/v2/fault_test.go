@@ -0,0 +1,239 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+//go:build lumberfault
+
+package v2
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// injectFaults wraps the input of stage with fault for the duration of the
+// test.
+func injectFaults(t testing.TB, stage faultStage, fault func(io.Reader) io.Reader) {
+	setFaultHook(func(s faultStage, in io.Reader) io.Reader {
+		if s != stage {
+			return in
+		}
+		return fault(in)
+	})
+	t.Cleanup(func() { setFaultHook(nil) })
+}
+
+// truncatedReader ends the input with io.EOF after n bytes.
+type truncatedReader struct {
+	in io.Reader
+	n  int
+}
+
+func truncate(n int) func(io.Reader) io.Reader {
+	return func(in io.Reader) io.Reader { return &truncatedReader{in: in, n: n} }
+}
+
+func (r *truncatedReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, io.EOF
+	}
+	if len(p) > r.n {
+		p = p[:r.n]
+	}
+	n, err := r.in.Read(p)
+	r.n -= n
+	return n, err
+}
+
+// corruptReader flips the bits of the byte at offset off.
+type corruptReader struct {
+	in  io.Reader
+	off int
+}
+
+func corrupt(off int) func(io.Reader) io.Reader {
+	return func(in io.Reader) io.Reader { return &corruptReader{in: in, off: off} }
+}
+
+func (r *corruptReader) Read(p []byte) (int, error) {
+	n, err := r.in.Read(p)
+	if r.off >= 0 && r.off < n {
+		p[r.off] ^= 0xff
+	}
+	r.off -= n
+	return n, err
+}
+
+// delayedReader sleeps for d once, before reading past the first n bytes.
+type delayedReader struct {
+	in io.Reader
+	n  int
+	d  time.Duration
+}
+
+func delay(n int, d time.Duration) func(io.Reader) io.Reader {
+	return func(in io.Reader) io.Reader { return &delayedReader{in: in, n: n, d: d} }
+}
+
+func (r *delayedReader) Read(p []byte) (int, error) {
+	if r.n <= 0 && r.d > 0 {
+		time.Sleep(r.d)
+		r.d = 0
+	}
+	if r.n > 0 && len(p) > r.n {
+		p = p[:r.n]
+	}
+	n, err := r.in.Read(p)
+	r.n -= n
+	return n, err
+}
+
+func TestFaultTruncatedWindow(t *testing.T) {
+	event := jsonFrame(1, `"a"`)
+	tests := []struct {
+		name string
+		n    int
+		err  error
+	}{
+		{"before window", 0, io.EOF},
+		{"mid header", 3, io.ErrUnexpectedEOF},
+		{"after header", 6, io.ErrUnexpectedEOF},
+		{"mid event", 6 + len(event) - 1, io.ErrUnexpectedEOF},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			injectFaults(t, faultWindow, truncate(test.n))
+			_, err := testReader(t, testReaderConfig, windowFrame(2), event, event).ReadBatch()
+			if err != test.err {
+				t.Errorf("expected %v, got %v", test.err, err)
+			}
+		})
+	}
+
+	// events read before the truncation are passed on as partial batch
+	injectFaults(t, faultWindow, truncate(6+len(event)))
+	cfg := testReaderConfig
+	cfg.partialBatches = true
+	_, err := testReader(t, cfg, windowFrame(2), event, event).ReadBatch()
+	var pe *PartialBatchError
+	if !errors.As(err, &pe) || pe.Batch.Len() != 1 || pe.Err != io.ErrUnexpectedEOF {
+		t.Errorf("expected partial batch of 1 event, got %v", err)
+	}
+}
+
+func TestFaultCompressed(t *testing.T) {
+	frame := compressedFrame(jsonFrame(1, `"a"`), jsonFrame(2, `"b"`))
+	tests := []struct {
+		name  string
+		stage faultStage
+		fault func(io.Reader) io.Reader
+		err   error
+	}{
+		{"unknown codec", faultCompressed, corrupt(0), ErrProtocolError},
+		{"corrupt header", faultCompressed, corrupt(1), ErrProtocolError},
+		{"truncated payload", faultCompressed, truncate(4), io.ErrUnexpectedEOF},
+		{"truncated events", faultInflated, truncate(12), io.ErrUnexpectedEOF},
+	}
+	for _, test := range tests {
+		for _, workers := range []int{0, 2} {
+			t.Run(fmt.Sprintf("%v/workers=%v", test.name, workers), func(t *testing.T) {
+				injectFaults(t, test.stage, test.fault)
+				cfg := testReaderConfig
+				cfg.inflater = newInflatePool(workers, 0)
+
+				_, err := testReader(t, cfg, windowFrame(2), frame).ReadBatch()
+				if !errors.Is(err, test.err) {
+					t.Errorf("expected %v, got %v", test.err, err)
+				}
+			})
+		}
+	}
+}
+
+func TestFaultDelayedRead(t *testing.T) {
+	event := jsonFrame(1, `"a"`)
+	injectFaults(t, faultWindow, delay(6+len(event), 200*time.Millisecond))
+	cfg := testReaderConfig
+	cfg.timeout = 50 * time.Millisecond
+	cfg.partialBatches = true
+
+	// the stalled read exceeds the read deadline set after the window header
+	_, err := testReader(t, cfg, windowFrame(2), event, event).ReadBatch()
+	var pe *PartialBatchError
+	if !errors.As(err, &pe) || pe.Batch.Len() != 1 {
+		t.Fatalf("expected partial batch of 1 event, got %v", err)
+	}
+	if ne, ok := pe.Err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("expected timeout, got %v", pe.Err)
+	}
+}
+
+// FuzzReadBatchFaults reads batches from valid input with a truncation or
+// corruption injected at an arbitrary offset and stage. Run the fuzzer with:
+//
+//	go test -tags lumberfault -run '^$' -fuzz FuzzReadBatchFaults ./server/v2
+func FuzzReadBatchFaults(f *testing.F) {
+	var window bytes.Buffer
+	window.Write(windowFrame(4))
+	window.Write(jsonFrame(1, `{"a":1}`))
+	window.Write(compressedFrame(jsonFrame(2, `"b"`), kvFrame(3, "k", "v")))
+	window.Write(compressedFrame(jsonFrame(4, `[1,2]`)))
+	data := window.Bytes()
+
+	for _, stage := range []faultStage{faultWindow, faultCompressed, faultInflated} {
+		for _, off := range []uint16{0, 1, 5, 6, 12, 20, 40} {
+			f.Add(byte(stage), off, false, false)
+			f.Add(byte(stage), off, true, true)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, stage byte, off uint16, truncated, parallel bool) {
+		fault := corrupt(int(off))
+		if truncated {
+			fault = truncate(int(off))
+		}
+		injectFaults(t, faultStage(stage%3), fault)
+
+		cfg := testReaderConfig
+		cfg.partialBatches = true
+		if parallel {
+			cfg.inflater = newInflatePool(2, 0)
+		}
+		r := newReader(&fuzzConn{in: bytes.NewReader(data)}, cfg)
+		for steps := 0; ; steps++ {
+			if steps > 2 {
+				t.Fatalf("reader did not fail after %v batches", steps)
+			}
+
+			b, err := r.ReadBatch()
+			if err != nil {
+				var pe *PartialBatchError
+				if errors.As(err, &pe) && pe.Batch.Len() > 4 {
+					t.Fatalf("partial batch of %v events exceeds window", pe.Batch.Len())
+				}
+				return
+			}
+			if b.Len() != 4 {
+				t.Fatalf("expected batch of 4 events, got %v", b.Len())
+			}
+		}
+	})
+}
@@ -0,0 +1,150 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v2
+
+import (
+	"bytes"
+	"io"
+
+	protocol "github.com/elastic/go-lumber/protocol/v2"
+	"github.com/elastic/go-lumber/server/internal"
+)
+
+// inflatePool bounds the number of compressed frames inflated concurrently by
+// all readers sharing the pool.
+type inflatePool struct {
+	sem chan struct{}
+
+	// compressed payload size from which frames are inflated by the pool
+	minSize uint32
+}
+
+// inflateJob inflates a single compressed frame using a reader of its own.
+type inflateJob struct {
+	r     *reader
+	codec codecFactory
+	done  chan struct{}
+	err   error
+}
+
+func newInflatePool(workers, minSize int) *inflatePool {
+	if workers <= 0 {
+		return nil
+	}
+	return &inflatePool{sem: make(chan struct{}, workers), minSize: uint32(minSize)}
+}
+
+// run inflates payload on a pool worker, once a worker is available.
+func (p *inflatePool) run(job *inflateJob, payload []byte) {
+	p.sem <- struct{}{}
+	go func() {
+		defer func() { <-p.sem }()
+		defer close(job.done)
+		in := bytes.NewReader(payload)
+		err := job.r.inflate(in, 1, job.codec)
+		job.err = job.r.compressedFrameEnd(err, uint32(len(payload)), int64(in.Len()))
+	}()
+}
+
+// readCompressedAsync reads the compressed payload of payloadSz bytes and
+// passes it to the inflate pool. Events are added to the batch by awaitPending.
+func (r *reader) readCompressedAsync(in io.Reader, payloadSz uint32) error {
+	// buffer grows with the bytes actually received
+	payload, err := io.ReadAll(injectFault(faultCompressed, io.LimitReader(in, int64(payloadSz))))
+	if err != nil {
+		return err
+	}
+	if len(payload) < int(payloadSz) {
+		return io.ErrUnexpectedEOF
+	}
+	magic := payload
+	if len(magic) > maxCodecMagic {
+		magic = magic[:maxCodecMagic]
+	}
+	codec, err := lookupCodec(magic)
+	if err != nil {
+		return err
+	}
+
+	job := &inflateJob{
+		r: &reader{
+			readerConfig: r.readerConfig,
+			window:       r.window,
+			keepRaw:      r.keepRaw,
+			offset:       r.received(),
+			batchBytes:   r.batchBytes,
+		},
+		codec: codec,
+		done:  make(chan struct{}),
+	}
+	r.pending = append(r.pending, job)
+	r.inflater.run(job, payload)
+	return nil
+}
+
+// awaitPending waits for all pending frames to be inflated, adding their events
+// to the batch in frame order.
+func (r *reader) awaitPending() error {
+	var err error
+	for _, job := range r.pending {
+		<-job.done
+		if err != nil {
+			continue
+		}
+
+		// events of frames still pending on start of the job are not counted
+		// by the job's offset
+		shift := r.received() - job.r.offset
+		if ie, ok := job.err.(*internal.InvalidBatchError); ok {
+			ie.Index += shift
+		}
+		if job.err != nil {
+			err = job.err
+			continue
+		}
+
+		r.events = append(r.events, job.r.events...)
+		r.raw = append(r.raw, job.r.raw...)
+		r.seqs = append(r.seqs, job.r.seqs...)
+		r.dropped += job.r.dropped
+		r.seq.Merge(job.r.seq)
+		if r.invalid == nil && job.r.invalid != nil {
+			r.invalid = job.r.invalid
+			r.invalid.Index += shift
+		}
+		r.decoded += job.r.decoded
+	}
+	r.pending = r.pending[:0]
+
+	if err == nil && r.received() > r.window {
+		err = internal.NewProtocolError(protocol.CodeCompressed,
+			"compressed frames exceed window size %v", r.window)
+	}
+	return err
+}
+
+// nextCompressed reports whether the connection input holds the header of
+// another compressed frame. Only buffered bytes are checked, such that reading
+// does not block on frames the client might not send.
+func (r *reader) nextCompressed() bool {
+	if r.in.Buffered() < 2 {
+		return false
+	}
+	hdr, err := r.in.Peek(2)
+	return err == nil && hdr[0] == protocol.CodeVersion && hdr[1] == protocol.CodeCompressed
+}
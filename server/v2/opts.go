@@ -21,20 +21,70 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"net"
 	"time"
 
 	"github.com/elastic/go-lumber/lj"
+	protocol "github.com/elastic/go-lumber/protocol/v2"
+	"github.com/elastic/go-lumber/server/internal"
 )
 
 // Option type for configuring server run options.
 type Option func(*options) error
 
 type options struct {
-	timeout   time.Duration
-	keepalive time.Duration
-	decoder   jsonDecoder
-	tls       *tls.Config
-	ch        chan *lj.Batch
+	timeout    time.Duration
+	keepalive  time.Duration
+	decoder    jsonDecoder
+	tls        *tls.Config
+	ch         chan *lj.Batch
+	gcPercent  int
+	ackLatency func(net.Addr, time.Duration)
+	onACK      func(net.Addr, uint32, int)
+	clock      func() time.Time
+	trace      func(*lj.Batch, net.Addr) func(error)
+	middleware []func(*lj.Batch) (*lj.Batch, error)
+
+	conflictPolicy    lj.ConflictPolicy
+	fullChannelPolicy lj.FullChannelPolicy
+	backpressure      func()
+	perConnection     func(net.Addr, <-chan *lj.Batch)
+	resendRequested   func(net.Addr, int)
+	rateLimiter       lj.RateLimiter
+	eventLimiter      lj.EventLimiter
+	ackCoalesce       time.Duration
+	ackEvery          int
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	ipStack           lj.IPStack
+	backlog           int
+	acceptError       func(error, bool)
+	connListener      func(lj.ConnEvent)
+	requireClientCert bool
+	tlsState          bool
+
+	maxCompressedDepth  int
+	maxCompressedEvents int
+	compressedPadding   int
+	maxFieldSize        int
+	maxFieldPairs       int
+	maxBatchBytes       int
+	lazy                bool
+	rawPayloads         bool
+	lenient             bool
+	validate            bool
+	validator           func(json.RawMessage) error
+	dropInvalid         bool
+	streamCompression   bool
+	partialBatches      bool
+	sequences           bool
+	inflateWorkers      int
+	inflateMinSize      int
+	frameHandlers       map[byte]func([]byte) error
+
+	tlsSettings internal.TLSSettings
+	ipFilter    internal.IPFilter
 }
 
 // Keepalive configures the keepalive interval returning an ACK of length 0 to
@@ -60,8 +110,84 @@ func Timeout(to time.Duration) Option {
 	}
 }
 
+// WriteTimeout configures the deadline for writing ACKs to the client. Once
+// exceeded, e.g. because a stalled client stopped reading and its receive
+// window is full, the connection is closed with ErrWriteTimeout. The default
+// of 0 uses the network timeout configured by Timeout.
+func WriteTimeout(to time.Duration) Option {
+	return func(opt *options) error {
+		if to < 0 {
+			return errors.New("write timeout must not be negative")
+		}
+		opt.writeTimeout = to
+		return nil
+	}
+}
+
+// IdleTimeout closes connections not starting the next window within d after
+// the previous window has been read. Clients waiting for ACKs do not send, so
+// d must exceed the time consumers take to ACK a batch. Independent of
+// IdleTimeout, a window header must be completed within Timeout once its
+// first byte has been received. The default of 0 waits for the next window
+// forever.
+func IdleTimeout(d time.Duration) Option {
+	return func(opt *options) error {
+		if d < 0 {
+			return errors.New("idle timeout must not be negative")
+		}
+		opt.idleTimeout = d
+		return nil
+	}
+}
+
+// IPStack selects the IP versions the listener created by ListenAndServe
+// accepts connections on. See lj.IPStack for the platform differences. The
+// option has no effect on listeners passed to NewWithListener or created by
+// the binder passed to ListenAndServeWith.
+func IPStack(stack lj.IPStack) Option {
+	return func(opt *options) error {
+		if stack > lj.IPv6Only {
+			return errors.New("unknown IP stack")
+		}
+		opt.ipStack = stack
+		return nil
+	}
+}
+
+// ListenBacklog sets the maximum number of connections queued by the operating
+// system before being accepted by the listener created by ListenAndServe,
+// e.g. for absorbing connection floods. The operating system caps the backlog,
+// e.g. at net.core.somaxconn on Linux. Setting the backlog is supported on unix
+// platforms only, ListenAndServe fails elsewhere. The default of 0 keeps the
+// system default. The option has no effect on listeners passed to
+// NewWithListener or created by the binder passed to ListenAndServeWith.
+func ListenBacklog(n int) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("listen backlog must not be negative")
+		}
+		opt.backlog = n
+		return nil
+	}
+}
+
+// AcceptError, if set, is called with the errors returned by the listener
+// accepting connections. Accepting is retried after temporary errors, like
+// running out of file descriptors, with the delay growing from 5ms up to 1s
+// while errors persist. Other errors stop the server from accepting new
+// connections, while connections accepted already are still served. Errors
+// caused by closing the server are not reported.
+func AcceptError(cb func(err error, temporary bool)) Option {
+	return func(opt *options) error {
+		opt.acceptError = cb
+		return nil
+	}
+}
+
 // Channel option is used to register custom channel received batches will be
-// forwarded to.
+// forwarded to. Batches of a connection are forwarded in the order the
+// client sent them, also with ParallelDecompression enabled. Batches of
+// different connections interleave.
 func Channel(c chan *lj.Batch) Option {
 	return func(opt *options) error {
 		opt.ch = c
@@ -69,6 +195,24 @@ func Channel(c chan *lj.Batch) Option {
 	}
 }
 
+// PerConnectionChannels forwards the batches of every connection to a
+// dedicated channel, instead of the channel configured by Channel. cb is called
+// with the remote address and channel of every new connection, before the
+// first batch is read. The channel is closed once the connection has been
+// closed. Consuming every channel in its own goroutine, connections are
+// processed independently, without a slow batch delaying other connections.
+//
+// cb is called by the goroutine accepting connections and must not block. A
+// connection is not read from while its channel is full, independent of
+// FullChannelPolicy. No batches are forwarded to ReceiveChan or the channels
+// selected by SNIRouter.
+func PerConnectionChannels(cb func(remote net.Addr, ch <-chan *lj.Batch)) Option {
+	return func(opt *options) error {
+		opt.perConnection = cb
+		return nil
+	}
+}
+
 // TLS enables and configures TLS support in lumberjack server.
 func TLS(tls *tls.Config) Option {
 	return func(opt *options) error {
@@ -77,8 +221,11 @@ func TLS(tls *tls.Config) Option {
 	}
 }
 
-// JSONDecoder sets an alternative json decoder for parsing events.
-// The default is json.Unmarshal.
+// JSONDecoder sets an alternative json decoder for parsing events, e.g. a
+// faster JSON implementation or a schema aware decoder. With ValidateJSON and
+// LazyDecoding, payloads are validated by decoding them with decoder instead
+// of json.Valid, such that validation matches the decoding by consumers. The
+// default of nil decodes events with json.Unmarshal.
 func JSONDecoder(decoder func([]byte, interface{}) error) Option {
 	return func(opt *options) error {
 		opt.decoder = decoder
@@ -86,12 +233,628 @@ func JSONDecoder(decoder func([]byte, interface{}) error) Option {
 	}
 }
 
+// GCPercent sets the garbage collection target percentage (see
+// runtime/debug.SetGCPercent) used while the server is running. Higher values
+// reduce GC frequency under heavy batch churn, trading memory for less time
+// spent in garbage collection. Decoded events are short-lived, such that a
+// higher heap target mostly delays collection of garbage, instead of growing
+// the live heap.
+//
+// The setting is process wide, as the Go runtime offers no per package GC
+// tuning. It affects all code in the process while the server is running and
+// is restored on Close. If multiple servers set GCPercent, the highest value
+// is in effect. Use runtime/debug.SetMemoryLimit to bound the heap size. The
+// default of 0 keeps the runtime settings.
+func GCPercent(p int) Option {
+	return func(opt *options) error {
+		if p < 0 {
+			return errors.New("gc percent must not be negative")
+		}
+		opt.gcPercent = p
+		return nil
+	}
+}
+
+// ACKLatency registers a callback reporting the time it took to write an ACK
+// to the client after the batch has been ACKed, measured from the consumer
+// ACKing the batch. High latencies indicate clients not reading ACKs promptly,
+// e.g. due to full receive buffers, or batches waiting for earlier batches of
+// the same connection to be ACKed. The callback is run by the connection
+// handler and must not block.
+func ACKLatency(cb func(addr net.Addr, d time.Duration)) Option {
+	return func(opt *options) error {
+		opt.ackLatency = cb
+		return nil
+	}
+}
+
+// OnACK registers a callback reporting every ACK written to a client, e.g. for
+// auditing which events have been acknowledged to which agent. seq is the
+// sequence number sent in the ACK frame, and events the number of events the
+// frame acknowledges, including events dropped from their batch. For ACKs of
+// a single window, seq is the number of events of the window, which is the
+// sequence number of its last event as lumberjack clients number events per
+// window. For ACKs merged by ACKCoalesce or ACKEvery, seq is the sum of the
+// events of all merged windows, to be interpreted cumulatively by the client.
+// The callback is run once the frame has been written, such that merged ACKs
+// are reported once per merged frame. Keepalives are not reported. The
+// callback is run by the connection handler and must not block.
+func OnACK(cb func(addr net.Addr, seq uint32, events int)) Option {
+	return func(opt *options) error {
+		opt.onACK = cb
+		return nil
+	}
+}
+
+// MaxCompressedDepth configures the maximum nesting level of compressed frames.
+// Frames nested deeper are rejected with ErrProtocolError. The default is 1,
+// as clients never nest compressed frames. A value of 0 rejects all compressed
+// frames.
+func MaxCompressedDepth(d int) Option {
+	return func(opt *options) error {
+		if d < 0 {
+			return errors.New("compressed frame depth must not be negative")
+		}
+		opt.maxCompressedDepth = d
+		return nil
+	}
+}
+
+// MaxCompressedEvents limits the number of events a single compressed frame
+// can contribute to a batch. Frames exceeding the limit are rejected with
+// ErrProtocolError. The default of 0 only limits events by the window size.
+func MaxCompressedEvents(n int) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("compressed frame events must not be negative")
+		}
+		opt.maxCompressedEvents = n
+		return nil
+	}
+}
+
+// MaxCompressedPadding tolerates up to n bytes trailing the compressed data of
+// a compressed frame, within the payload size declared by the frame. Trailing
+// bytes are discarded. Frames with more trailing bytes are rejected with
+// ErrProtocolError right away, instead of waiting for bytes a client declaring
+// a wrong payload size might never send. Frames declaring a payload size
+// smaller than its compressed data are rejected with ErrProtocolError too. The
+// default of 0 rejects all trailing bytes.
+func MaxCompressedPadding(n int) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("compressed frame padding must not be negative")
+		}
+		opt.compressedPadding = n
+		return nil
+	}
+}
+
+// MaxFieldSize limits the size of keys and values in key-value data frames to
+// n bytes. Frames declaring a larger key or value are rejected with
+// ErrProtocolError before the field is read. Defaults to 1MiB. Field sizes are
+// unlimited if 0.
+func MaxFieldSize(n int) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("max field size must not be negative")
+		}
+		opt.maxFieldSize = n
+		return nil
+	}
+}
+
+// MaxFieldPairs limits the number of key-value pairs per key-value data frame.
+// Frames declaring more pairs are rejected with ErrProtocolError before any
+// pair is read. Defaults to 1024. The number of pairs is unlimited if 0.
+func MaxFieldPairs(n int) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("max field pairs must not be negative")
+		}
+		opt.maxFieldPairs = n
+		return nil
+	}
+}
+
+// MaxBatchBytes limits the total size of the event payloads of a window to n
+// bytes, counting JSON payloads and the keys and values of key-value data
+// frames, including events of compressed frames after decompression. Reading
+// fails with ErrBatchTooLarge as soon as the events read exceed the limit,
+// without reading the rest of the window, and the connection is closed. JSON
+// payloads exceeding the limit are rejected before being read. Unlike
+// MaxFieldSize and MaxCompressedEvents, the limit bounds the memory of a batch
+// independent of the number and size of its events, also across frames
+// inflated concurrently with ParallelDecompression. Batch sizes are unlimited
+// if 0, the default.
+func MaxBatchBytes(n int) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("max batch bytes must not be negative")
+		}
+		opt.maxBatchBytes = n
+		return nil
+	}
+}
+
+// LazyDecoding defers decoding of events until first accessed via
+// (*lj.Batch).Event. Raw events are buffered per batch until decoded, which
+// saves decoding costs for consumers inspecting a fraction of events only.
+// Entries in Batch.Events are nil until decoded.
+func LazyDecoding(b bool) Option {
+	return func(opt *options) error {
+		opt.lazy = b
+		return nil
+	}
+}
+
+// RawPayloads passes event payloads to consumers in Batch.RawEvents, without
+// decoding or validating them as JSON. Use for consumers forwarding events
+// as is. Events of compressed frames are passed decompressed. JSONDecoder,
+// LazyDecoding, LenientDecoding and ValidateJSON have no effect on raw
+// batches. The default is false.
+func RawPayloads(b bool) Option {
+	return func(opt *options) error {
+		opt.rawPayloads = b
+		return nil
+	}
+}
+
+// ConflictPolicy configures the default lj.ConflictPolicy of received batches,
+// deciding the outcome if a batch is ACKed and resend is requested. The default
+// is lj.FirstCallWins.
+func ConflictPolicy(p lj.ConflictPolicy) Option {
+	return func(opt *options) error {
+		opt.conflictPolicy = p
+		return nil
+	}
+}
+
+// LenientDecoding drops events failing to decode from a batch, instead of
+// closing the connection. Dropped events are ACKed to the client, such that a
+// single corrupt event does not fail the complete batch, and are counted in
+// Batch.Dropped and Stats.DroppedEvents. By default the connection is closed
+// on decoding errors.
+func LenientDecoding(b bool) Option {
+	return func(opt *options) error {
+		opt.lenient = b
+		return nil
+	}
+}
+
+// PartialBatches passes the events read so far to the consumer, if the
+// connection times out or is closed in the middle of a window. The batch is
+// marked via Batch.Partial and is not ACKed, as the connection is closed
+// afterwards, such that the client resends the complete window. Consumers
+// must expect partial windows to be received again. Protocol errors still
+// discard the events read. The default is false.
+func PartialBatches(b bool) Option {
+	return func(opt *options) error {
+		opt.partialBatches = b
+		return nil
+	}
+}
+
+// EventSequences collects the sequence numbers of the data frames read into
+// Batch.Sequences, for consumers deduplicating or ordering events. Events
+// read from compressed frames report the sequence numbers of the frames
+// within the compressed payload. The default is false.
+func EventSequences(b bool) Option {
+	return func(opt *options) error {
+		opt.sequences = b
+		return nil
+	}
+}
+
+// ValidateJSON enables validation of event payloads when reading batches with
+// LazyDecoding enabled. Batches with invalid events fail with ErrInvalidJSON,
+// or drop the invalid events if LenientDecoding is set. Without LazyDecoding,
+// events are validated by decoding them. The default is false.
+func ValidateJSON(b bool) Option {
+	return func(opt *options) error {
+		opt.validate = b
+		return nil
+	}
+}
+
+// EventValidator installs fn validating the payload of every event while a
+// window is read. If fn fails for any event, the complete batch is rejected
+// with an *InvalidBatchError reporting the index of the failing event. The
+// rejected batch is not ACKed and the connection is closed once the batches
+// read before have been ACKed, such that the client resends the window. Set
+// DropInvalidBatches to ACK and discard rejected batches instead. Unlike
+// LenientDecoding, which drops single events, validation is all-or-nothing.
+// Key-value events are passed JSON encoded. fn must not retain the payload.
+//
+// fn is called on the goroutine reading the connection. Its run time adds to
+// the latency of every batch and delays reading the next window, so costly
+// checks are better left to the consumer.
+func EventValidator(fn func(json.RawMessage) error) Option {
+	return func(opt *options) error {
+		opt.validator = fn
+		return nil
+	}
+}
+
+// DropInvalidBatches ACKs batches rejected by EventValidator without
+// forwarding them, keeping the connection open. The client does not resend
+// the window, such that its events are lost. The default is false.
+func DropInvalidBatches(b bool) Option {
+	return func(opt *options) error {
+		opt.dropInvalid = b
+		return nil
+	}
+}
+
+// StreamCompression allows clients to request compression of the complete
+// stream, so repeated content compresses across windows. Stream compression
+// is a go-lumber extension and must be enabled in the client as well. The
+// default is false.
+func StreamCompression(b bool) Option {
+	return func(opt *options) error {
+		opt.streamCompression = b
+		return nil
+	}
+}
+
+// ParallelDecompression inflates compressed frames with a compressed size of
+// at least minFrameSize bytes on a pool of workers goroutines shared by all
+// connections, bounding the CPU used for decompression. Once a frame has been
+// passed to the pool, the connection continues reading further compressed
+// frames of the window already received, such that multiple frames of a
+// window are inflated in parallel. Events are added to the batch in frame
+// order. Handlers registered via FrameHandler are run by the workers for
+// custom frames contained in frames inflated by the pool.
+//
+// Payloads of frames inflated by the pool are buffered in full. The default
+// of 0 workers inflates all frames on the connection goroutine.
+func ParallelDecompression(workers, minFrameSize int) Option {
+	return func(opt *options) error {
+		if workers < 0 || minFrameSize < 0 {
+			return errors.New("decompression workers and frame size must not be negative")
+		}
+		opt.inflateWorkers = workers
+		opt.inflateMinSize = minFrameSize
+		return nil
+	}
+}
+
+// FullChannelPolicy configures the handling of received batches if the channel
+// batches are forwarded to is full. See lj.FullChannelPolicy for the delivery
+// guarantees of each policy. The default is lj.FullChannelBlock.
+func FullChannelPolicy(p lj.FullChannelPolicy) Option {
+	return func(opt *options) error {
+		opt.fullChannelPolicy = p
+		return nil
+	}
+}
+
+// Backpressure registers a callback being called every time a received batch
+// can not be forwarded right away, due to the channel being full. The callback
+// must not block.
+func Backpressure(cb func()) Option {
+	return func(opt *options) error {
+		opt.backpressure = cb
+		return nil
+	}
+}
+
+// TLSMinVersion configures the minimum TLS version accepted, overwriting
+// MinVersion of the configuration passed to TLS. Requires TLS to be set.
+func TLSMinVersion(v uint16) Option {
+	return func(opt *options) error {
+		opt.tlsSettings.MinVersion = v
+		return nil
+	}
+}
+
+// TLSCipherSuites configures the TLS cipher suites accepted, overwriting
+// CipherSuites of the configuration passed to TLS. Requires TLS to be set.
+func TLSCipherSuites(suites []uint16) Option {
+	return func(opt *options) error {
+		opt.tlsSettings.CipherSuites = suites
+		return nil
+	}
+}
+
+// TLSSecureProfile enforces TLS 1.2 or newer. Server creation fails if the
+// effective TLS configuration allows older TLS versions. If no minimum version
+// is configured, TLS 1.2 is used.
+//
+// TLSMinVersion and TLSCipherSuites are applied to a copy of the configuration
+// passed to TLS, independent of option order. The secure profile is validated
+// after applying all settings.
+func TLSSecureProfile(b bool) Option {
+	return func(opt *options) error {
+		opt.tlsSettings.Secure = b
+		return nil
+	}
+}
+
+// RequireClientCert rejects connections not presenting a client certificate
+// verified by the TLS configuration, independent of the ClientAuth setting of
+// the TLS configuration. Connections are closed with ErrNoClientCert before
+// reading any batch, such that a misconfigured ClientAuth setting does not
+// accept anonymous clients. Plain TCP connections are rejected too. Rejected
+// connections are counted by Stats.Rejected.
+func RequireClientCert(b bool) Option {
+	return func(opt *options) error {
+		opt.requireClientCert = b
+		return nil
+	}
+}
+
+// TLSConnectionState attaches the TLS connection state negotiated with the
+// client to every batch read, for auditing the protocol version, cipher suite,
+// server name (SNI) or ALPN protocol of a batch's connection (see
+// lj.Batch.TLS). The state is captured once per connection. Batches read from
+// plain TCP connections carry no state. Disabled by default.
+func TLSConnectionState(b bool) Option {
+	return func(opt *options) error {
+		opt.tlsState = b
+		return nil
+	}
+}
+
+// SNIRouter selects the TLS configuration and the channel to forward batches
+// to by the server name requested by TLS clients (SNI). This allows serving
+// multiple tenants with different certificates, trust roots and consumers.
+// Clients requesting an unknown server name, for which router returns a nil
+// configuration, are rejected during the TLS handshake. If router returns a
+// nil channel, batches are forwarded to the default channel.
+//
+// Clients not sending a server name are routed by the empty name. The TLS
+// option is not required with SNIRouter. TLSMinVersion, TLSCipherSuites and
+// TLSSecureProfile are applied to the routed configurations. Routed channels
+// are not closed on Close.
+func SNIRouter(router func(serverName string) (*tls.Config, chan *lj.Batch)) Option {
+	return func(opt *options) error {
+		opt.tlsSettings.Router = router
+		return nil
+	}
+}
+
+// AllowedCIDRs restricts clients to connect from the networks nets only.
+// Connections from other addresses are closed right after being accepted,
+// before reading any data. IPv4-mapped IPv6 addresses are matched against
+// IPv4 networks. DeniedCIDRs takes precedence. Rejected connections are
+// counted by Stats.
+func AllowedCIDRs(nets []net.IPNet) Option {
+	return func(opt *options) error {
+		opt.ipFilter.Allowed = nets
+		return nil
+	}
+}
+
+// DeniedCIDRs rejects clients connecting from the networks nets, even if
+// permitted by AllowedCIDRs. See AllowedCIDRs.
+func DeniedCIDRs(nets []net.IPNet) Option {
+	return func(opt *options) error {
+		opt.ipFilter.Denied = nets
+		return nil
+	}
+}
+
+// Clock configures the time source used to stamp lj.Batch.ReceivedAt. The
+// default is time.Now.
+func Clock(now func() time.Time) Option {
+	return func(opt *options) error {
+		if now == nil {
+			now = time.Now
+		}
+		opt.clock = now
+		return nil
+	}
+}
+
+// Tracer registers a callback starting a trace span for every batch received.
+// The batch provides the span attributes, e.g. the number of events, wire
+// bytes and protocol version, and its events can be inspected for trace
+// context propagated by clients. The returned function ends the span. It is
+// called with the error sending the ACK once the batch has been ACKed, or with
+// an error if the connection is closed before.
+//
+// Tracer does not depend on a tracing library. It is used to integrate with
+// OpenTelemetry by starting and ending spans of a trace.Tracer.
+func Tracer(start func(b *lj.Batch, remote net.Addr) (end func(error))) Option {
+	return func(opt *options) error {
+		opt.trace = start
+		return nil
+	}
+}
+
+// Middleware appends fn to the chain of functions applied to every batch read,
+// before the batch is forwarded. Middleware is called in the order registered,
+// each receiving the batch returned by the previous one, and runs on the
+// goroutine serving the connection, delaying reading the next batch. Use
+// middleware for filtering, enriching or replacing batches, e.g. dropping
+// health checks or attaching metadata via Batch.SetMeta.
+//
+// Returning nil drops the batch, which is ACKed to the client without being
+// forwarded. Returning an error rejects the batch: it is not ACKed, and the
+// connection is closed once the batches read before have been ACKed, such
+// that the client resends the batch. A returned batch replacing the batch read
+// is forwarded as is, and ACKing it ACKs the complete window to the client.
+// Later middleware is not called for dropped or rejected batches. Partial
+// batches (see PartialBatches) are passed through the middleware too.
+func Middleware(fn func(b *lj.Batch) (*lj.Batch, error)) Option {
+	return func(opt *options) error {
+		if fn == nil {
+			return errors.New("middleware must not be nil")
+		}
+		opt.middleware = append(opt.middleware, fn)
+		return nil
+	}
+}
+
+// ConnectionListener configures a callback receiving structured lifecycle
+// events of every client connection: the connection being accepted, including
+// the TLS connection state, the first window being read, read errors and the
+// connection being closed, including the time it has been open. Use for debug
+// and audit logging.
+//
+// The callback is called synchronously by the goroutine serving the
+// connection, such that events of a connection are reported in order. A slow
+// callback slows down reading from the connection; hand events off to another
+// goroutine if the callback may block. For TLS connections the handshake is
+// completed before reporting the connection as accepted, bounded by the
+// read/write timeout.
+func ConnectionListener(l func(lj.ConnEvent)) Option {
+	return func(opt *options) error {
+		opt.connListener = l
+		return nil
+	}
+}
+
+// RateLimit limits the number of events accepted per client IP address, using
+// a token bucket accepting eventsPerSecond events on average, with bursts of up
+// to burst events. Clients exceeding the rate are not read from until the rate
+// limit permits, such that clients are slowed down by TCP flow control instead
+// of losing events. The limit is shared by all connections from the same IP
+// address.
+func RateLimit(eventsPerSecond float64, burst int) Option {
+	return func(opt *options) error {
+		if eventsPerSecond <= 0 {
+			return errors.New("rate limit must be positive")
+		}
+		if burst <= 0 {
+			return errors.New("rate limit burst must be positive")
+		}
+		opt.rateLimiter = lj.NewRateLimiter(eventsPerSecond, burst)
+		return nil
+	}
+}
+
+// RateLimiter installs a custom lj.RateLimiter, e.g. for sharing limits
+// between multiple servers. See RateLimit.
+func RateLimiter(l lj.RateLimiter) Option {
+	return func(opt *options) error {
+		opt.rateLimiter = l
+		return nil
+	}
+}
+
+// MaxInFlightEvents limits the number of events read from all connections and
+// not yet ACKed to n. Once the limit is reached, connections are not read from
+// until batches are ACKed, applying backpressure to all clients via TCP flow
+// control. Events of batches not ACKed are released when the connection is
+// closed. A batch larger than n is accepted once no other events are in
+// flight.
+func MaxInFlightEvents(n int) Option {
+	return func(opt *options) error {
+		if n <= 0 {
+			return errors.New("max in-flight events must be positive")
+		}
+		opt.eventLimiter = lj.NewEventLimiter(n)
+		return nil
+	}
+}
+
+// EventLimiter installs a custom lj.EventLimiter, e.g. for sharing the limit
+// of events in flight between multiple servers. See MaxInFlightEvents.
+func EventLimiter(l lj.EventLimiter) Option {
+	return func(opt *options) error {
+		opt.eventLimiter = l
+		return nil
+	}
+}
+
+// ACKCoalesce buffers ACKs for up to d, merging all ACKs buffered into a single
+// ACK frame. This reduces the number of ACK frames if many small batches are
+// ACKed in quick succession by clients pipelining batches, at the cost of
+// delaying ACKs by up to d. Buffered ACKs are written right away if no more
+// batches are waiting for ACK, so clients waiting for the ACK before sending
+// the next batch are not delayed. Like with ACKEvery, the merged ACK counts
+// the events of all merged windows, so only enable ACKCoalesce for go-lumber
+// clients configured with client option CumulativeACK. ACKLatency does not
+// include the time ACKs are buffered. The default of 0 writes ACKs right away.
+func ACKCoalesce(d time.Duration) Option {
+	return func(opt *options) error {
+		if d < 0 {
+			return errors.New("ack coalesce interval must not be negative")
+		}
+		opt.ackCoalesce = d
+		return nil
+	}
+}
+
+// ACKEvery merges the ACKs of up to n consecutive windows into a single ACK
+// frame, reducing the ACK overhead for clients pipelining many small windows.
+// The merged ACK counts the events of all merged windows, relying on the
+// client interpreting ACKs cumulatively across windows. Lumberjack clients
+// expect an ACK per window, so only enable ACKEvery for go-lumber clients
+// configured with client option CumulativeACK. Merged ACKs are written early
+// if no more batches are waiting for ACK, such that clients waiting for an ACK
+// are not blocked. Combine with ACKCoalesce for bounding the delay of merged
+// ACKs. Windows not yet ACKed to the client if the connection fails are
+// resent by the client. The default of 0 ACKs every window.
+func ACKEvery(n int) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("ack cadence must not be negative")
+		}
+		opt.ackEvery = n
+		return nil
+	}
+}
+
+// ResendRequested registers a callback being called if a connection is closed
+// due to the consumer calling (*lj.Batch).RequestResend, with the number of
+// events in the batch. Unlike batches rejected by FullChannelPolicy, the
+// client is expected to reconnect and resend the batch, so the callback allows
+// counting resends separately. The callback must not block.
+func ResendRequested(cb func(addr net.Addr, events int)) Option {
+	return func(opt *options) error {
+		opt.resendRequested = cb
+		return nil
+	}
+}
+
+// FrameHandler registers fn for handling custom frames with the given code,
+// instead of closing the connection with ErrProtocolError. Custom frames are
+// accepted in place of a window frame, e.g. for prefixing a batch with agent
+// metadata, and between the data frames of a window. Custom frames do not
+// count as events of the window. Custom frames must have the layout:
+//
+//	version: uint8 = '2'
+//	code: uint8
+//	payloadLen: uint32
+//	payload: payloadLen bytes
+//
+// Senders are responsible for prefixing the payload with its length, which is
+// consumed by the server before calling fn with the payload. Payloads must not
+// exceed 1MiB, and at most 1024 custom frames may precede a window. The
+// payload is only valid until fn returns. If fn returns an error, the
+// connection is closed. Codes of built-in frames can not be registered.
+// Frames with unregistered codes still fail with ErrProtocolError.
+func FrameHandler(code byte, fn func(payload []byte) error) Option {
+	return func(opt *options) error {
+		switch code {
+		case protocol.CodeWindowSize, protocol.CodeJSONDataFrame, protocol.CodeDataFrame,
+			protocol.CodeCompressed, protocol.CodeACK, protocol.CodeCompressStream:
+			return fmt.Errorf("frame code %q is reserved", code)
+		}
+		if fn == nil {
+			return errors.New("frame handler must not be nil")
+		}
+		if opt.frameHandlers == nil {
+			opt.frameHandlers = map[byte]func([]byte) error{}
+		}
+		opt.frameHandlers[code] = fn
+		return nil
+	}
+}
+
 func applyOptions(opts []Option) (options, error) {
 	o := options{
-		decoder:   json.Unmarshal,
 		timeout:   30 * time.Second,
 		keepalive: 3 * time.Second,
 		tls:       nil,
+
+		maxCompressedDepth: 1,
+		maxFieldSize:       1 << 20,
+		maxFieldPairs:      1024,
+		clock:              time.Now,
 	}
 
 	for _, opt := range opts {
@@ -99,5 +862,11 @@ func applyOptions(opts []Option) (options, error) {
 			return o, err
 		}
 	}
+
+	tlsConfig, err := internal.ConfigureTLS(o.tls, o.tlsSettings)
+	if err != nil {
+		return o, err
+	}
+	o.tls = tlsConfig
 	return o, nil
 }
@@ -20,161 +20,899 @@ package v2
 import (
 	"bufio"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/klauspost/compress/zlib"
 
 	"github.com/elastic/go-lumber/lj"
-	"github.com/elastic/go-lumber/log"
 	protocol "github.com/elastic/go-lumber/protocol/v2"
+	"github.com/elastic/go-lumber/server/internal"
 )
 
 type reader struct {
-	in      *bufio.Reader
-	conn    net.Conn
+	readerConfig
+	in   *bufio.Reader
+	base *bufio.Reader // buffered connection, below stream decompression
+	conn net.Conn
+	buf  []byte
+
+	// events of the current batch, read from a window of size window. Raw
+	// payloads are collected into raw instead of being decoded if keepRaw is
+	// set.
+	events  []interface{}
+	raw     [][]byte
+	seqs    []uint32
+	window  int
+	keepRaw bool
+
+	// buffer holding the raw events of the current batch if keepRaw is set
+	arena []byte
+
+	// arena bytes used by the current and the previous window, for sizing
+	// the first arena of the next window
+	arenaUsed int
+	arenaHint int
+
+	// scratch buffer for frame headers
+	hdr [8]byte
+
+	// compressed frames being inflated by the inflate pool, in frame order
+	pending []*inflateJob
+
+	// batch index of the first event, if the reader inflates a single
+	// compressed frame of a window on behalf of the connection reader
+	offset int
+
+	// number of events dropped from current batch
+	dropped int
+
+	// sequence numbers of the events of the current batch, including dropped
+	// events
+	seq internal.SeqRange
+
+	// first event of the current batch failing validation
+	invalid *internal.InvalidBatchError
+
+	// byte counters of current batch
+	wire    internal.CountingReader
+	decoded int
+
+	// event payload bytes of the current batch, shared with the readers of
+	// the inflate pool for enforcing maxBatchBytes. Nil if unlimited or if
+	// frames are not inflated concurrently.
+	batchBytes *int64
+
+	// reads key-value data frames
+	fields internal.FieldReader
+
+	// set if stream compression has been negotiated
+	streaming bool
+
+	// compressed bytes read from base if streaming
+	stream byteCounter
+
+	// pool to return the reader to on Release
+	pool *readerPool
+}
+
+// readerPool pools readers of closed connections, for reuse by new
+// connections.
+type readerPool struct {
+	cfg  readerConfig
+	pool sync.Pool
+}
+
+type readerConfig struct {
 	timeout time.Duration
 	decoder jsonDecoder
-	buf     []byte
+
+	// maximum time to wait for the next window. Unlimited if 0.
+	idleTimeout time.Duration
+
+	// maximum nesting level of compressed frames
+	maxCompressedDepth int
+
+	// maximum number of events per compressed frame. Unlimited if 0.
+	maxCompressedEvents int
+
+	// maximum number of bytes trailing the compressed data of a frame
+	compressedPadding int
+
+	// maximum size of keys and values, and maximum number of pairs of
+	// key-value data frames. Unlimited if 0.
+	maxFieldSize  int
+	maxFieldPairs int
+
+	// maximum number of event payload bytes per window. Unlimited if 0.
+	maxBatchBytes int
+
+	// defer event decoding to first access
+	lazy bool
+
+	// pass raw event payloads to consumers without decoding
+	rawPayloads bool
+
+	// drop events failing to decode instead of failing the batch
+	lenient bool
+
+	// validate raw JSON events if decoding is deferred
+	validate bool
+
+	// validate raw JSON events by decoding them with decoder
+	decodeValidate bool
+
+	// validates every event read, rejecting the complete batch on failure.
+	// Rejected batches are read to the end of the window if dropInvalid is
+	// set.
+	validator   func(json.RawMessage) error
+	dropInvalid bool
+
+	// accept stream compression requested by client
+	streamCompression bool
+
+	// pass events read before a read error to the consumer
+	partialBatches bool
+
+	// collect the sequence numbers of events into seqs
+	sequences bool
+
+	// time source for stamping received batches
+	clock func() time.Time
+
+	// handlers of custom frames by frame code
+	frameHandlers map[byte]func([]byte) error
+
+	// workers inflating large compressed frames concurrently, if set
+	inflater *inflatePool
 }
 
 type jsonDecoder func([]byte, interface{}) error
 
-func newReader(c net.Conn, to time.Duration, jsonDecoder jsonDecoder) *reader {
+// maxFramePayload is the maximum payload size of custom frames.
+const maxFramePayload = 1 << 20
+
+// maxCustomFrames is the maximum number of custom frames accepted in place of
+// a window frame before the next window must start.
+const maxCustomFrames = 1024
+
+// maxArena is the maximum capacity of an arena of raw payloads. Windows
+// exceeding it are read into multiple arenas.
+const maxArena = 4 << 20
+
+// errDropEvent is returned by readJSONEvent if the event must not be added to
+// the batch.
+var errDropEvent = errors.New("drop event")
+
+func newReader(c net.Conn, cfg readerConfig) *reader {
+	in := bufio.NewReader(c)
 	r := &reader{
-		in:      bufio.NewReader(c),
-		conn:    c,
-		timeout: to,
-		decoder: jsonDecoder,
-		buf:     make([]byte, 0, 64),
+		readerConfig: cfg,
+		in:           in,
+		base:         in,
+		conn:         c,
+		buf:          make([]byte, 0, 64),
+	}
+	return r
+}
+
+// Reader reads batches from a single lumberjack connection, for consumers
+// running their own read loop. Reader does not send ACKs; batches read are not
+// ACKed to the client. Only reader related options (e.g. Timeout,
+// JSONDecoder, LazyDecoding) apply.
+type Reader struct {
+	r *reader
+}
+
+// NewReader creates a Reader reading batches from c.
+func NewReader(c net.Conn, opts ...Option) (*Reader, error) {
+	o, err := applyOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{r: newReader(c, o.readerConfig())}, nil
+}
+
+// ReadBatch reads the next batch. ErrKeepAlive is returned for empty windows.
+func (r *Reader) ReadBatch() (*lj.Batch, error) {
+	return r.r.ReadBatch()
+}
+
+// ReadBatchInto reads the next batch into dst, reusing the storage of dst and
+// of the reader, such that a loop reading batches of similar size allocates
+// nothing once buffers have grown. ErrKeepAlive is returned for empty windows.
+//
+// Events are not decoded, but stored as lazy events (see lj.NewLazyBatch),
+// independent of LazyDecoding, or as raw events with RawPayloads. Payloads are
+// read into a buffer shared by all batches read via ReadBatchInto, such that
+// dst, including payloads and events decoded from it, must not be used after
+// the next call to ReadBatchInto. Compressed frames allocate a decompressor per
+// frame.
+func (r *Reader) ReadBatchInto(dst *lj.Batch) error {
+	return r.r.ReadBatchInto(dst)
+}
+
+// Reset rebinds the reader to a new connection, such that readers can be
+// reused across connections. Bytes still buffered from the previous connection
+// are discarded. The scratch buffer is kept.
+func (r *reader) Reset(c net.Conn, to time.Duration) {
+	r.base.Reset(c)
+	r.in = r.base
+	r.conn = c
+	r.timeout = to
+	r.streaming = false
+	r.stream = byteCounter{}
+}
+
+func newReaderPool(cfg readerConfig) *readerPool {
+	return &readerPool{cfg: cfg}
+}
+
+// get returns a pooled reader reset to c, or a new reader if the pool is
+// empty.
+func (p *readerPool) get(c net.Conn) *reader {
+	if r, ok := p.pool.Get().(*reader); ok {
+		r.Reset(c, p.cfg.timeout)
+		return r
 	}
+
+	r := newReader(c, p.cfg)
+	r.pool = p
 	return r
 }
 
+// Release returns the reader to its pool, once the connection handler has
+// stopped reading. The reader must not be used afterwards.
+func (r *reader) Release() {
+	if r.pool == nil {
+		return
+	}
+
+	r.Reset(nil, r.timeout)
+	r.pool.pool.Put(r)
+}
+
 func (r *reader) ReadBatch() (*lj.Batch, error) {
-	// 1. read window size
-	var win [6]byte
-	_ = r.conn.SetReadDeadline(time.Time{}) // wait for next batch without timeout
-	if err := readFull(r.in, win[:]); err != nil {
+	streamStart := r.stream.n
+	if err := r.readWindow(false); err != nil {
+		err = internal.WithContext(err, r.wire.N, r.conn)
+		if r.partialBatches && len(r.events)+len(r.raw) > 0 && isTransportError(err) {
+			batch := r.newBatch()
+			batch.Partial = true
+			r.stamp(batch, streamStart)
+			return nil, &internal.PartialBatchError{Batch: batch, Err: err}
+		}
 		return nil, err
 	}
 
-	if win[0] != protocol.CodeVersion && win[1] != protocol.CodeWindowSize {
-		log.Printf("Expected window from. Received %v", win[0:1])
-		return nil, ErrProtocolError
+	batch := r.newBatch()
+	r.stamp(batch, streamStart)
+	return batch, nil
+}
+
+// newBatch creates a batch of the events read last.
+func (r *reader) newBatch() *lj.Batch {
+	var batch *lj.Batch
+	switch {
+	case r.rawPayloads:
+		batch = lj.NewRawBatch(r.raw)
+	case r.lazy:
+		batch = lj.NewLazyBatch(r.raw, r.decoder)
+	default:
+		batch = lj.NewBatch(r.events)
+	}
+	// storage is owned by the batch now
+	batch.Sequences = r.seqs
+	r.events, r.raw, r.arena, r.seqs = nil, nil, nil, nil
+	return batch
+}
+
+// SeqRange returns the range of sequence numbers of the window read last.
+func (r *reader) SeqRange() internal.SeqRange {
+	return r.seq
+}
+
+// isTransportError reports whether err has been caused by the connection, not
+// by the client violating the protocol.
+func isTransportError(err error) bool {
+	if err == io.ErrUnexpectedEOF {
+		return true
+	}
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// ReadBatchInto reads the next batch into dst, reusing buffers of the previous
+// call. See Reader.ReadBatchInto.
+func (r *reader) ReadBatchInto(dst *lj.Batch) error {
+	streamStart := r.stream.n
+	if err := r.readWindow(true); err != nil {
+		return internal.WithContext(err, r.wire.N, r.conn)
+	}
+
+	if r.rawPayloads {
+		dst.ResetRaw(r.raw)
+	} else {
+		dst.ResetLazy(r.raw, r.decoder)
+	}
+	dst.Sequences = r.seqs
+	r.stamp(dst, streamStart)
+	return nil
+}
+
+// readWindow reads the next window into r.events, or into r.raw if lazy
+// decoding is configured. Buffers of the previous window are reused if reuse
+// is set.
+func (r *reader) readWindow(reuse bool) error {
+	r.events, r.raw = r.events[:0], r.raw[:0]
+
+	// 1. read window size, skipping custom frames preceding the window
+	win := r.hdr[:6]
+	for frames := 0; ; {
+		r.wire = internal.CountingReader{R: injectFault(faultWindow, r.in)}
+		r.decoded = 0
+		if err := internal.ReadWindowHeader(r.conn, &r.wire, win, r.idleTimeout, r.timeout); err != nil {
+			if r.streaming && err == io.ErrUnexpectedEOF && r.wire.N == 0 {
+				err = io.EOF // compressed stream closed between windows
+			}
+			return err
+		}
+
+		if win[0] == protocol.CodeVersion && win[1] == protocol.CodeCompressStream {
+			if err := r.startStreamCompression(); err != nil {
+				return err
+			}
+			continue // read first batch from compressed stream
+		}
+
+		fn := r.frameHandler(win[:2])
+		if fn == nil {
+			break
+		}
+		if frames++; frames > maxCustomFrames {
+			return internal.NewProtocolError(win[1],
+				"too many custom frames before window (> %v)", maxCustomFrames)
+		}
+		if err := r.conn.SetReadDeadline(time.Now().Add(r.timeout)); err != nil {
+			return err
+		}
+		if err := r.readCustomFrame(&r.wire, win[1], binary.BigEndian.Uint32(win[2:]), fn); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+
+	if win[0] != protocol.CodeVersion || win[1] != protocol.CodeWindowSize {
+		return internal.NewProtocolError(win[1], "expected window frame, got version %q frame", win[0])
 	}
 
 	count := int(binary.BigEndian.Uint32(win[2:]))
 	if count == 0 {
-		return nil, nil
+		return ErrKeepAlive
 	}
 
 	if err := r.conn.SetReadDeadline(time.Now().Add(r.timeout)); err != nil {
-		return nil, err
+		return err
 	}
 
-	events, err := r.readEvents(r.in, make([]interface{}, 0, count))
-	if events == nil || err != nil {
-		log.Printf("readEvents failed with: %v", err)
-		return nil, err
+	r.dropped = 0
+	r.seq = internal.SeqRange{}
+	r.invalid = nil
+	r.window = count
+	r.batchBytes = nil
+	if r.maxBatchBytes > 0 && r.inflater != nil {
+		r.batchBytes = new(int64)
+	}
+	r.arenaHint, r.arenaUsed = r.arenaUsed, 0
+	r.pending = r.pending[:0]
+	r.keepRaw = reuse || r.lazy || r.rawPayloads
+	prealloc := internal.PreallocEvents(count)
+	switch {
+	case reuse:
+		r.events = nil
+		r.raw = r.raw[:0]
+		r.arena = r.arena[:0]
+	case r.keepRaw:
+		r.events = nil
+		r.raw = make([][]byte, 0, prealloc)
+		r.arena = nil
+	default:
+		r.events = make([]interface{}, 0, prealloc)
+		r.raw = nil
+	}
+	switch {
+	case !r.sequences:
+		r.seqs = nil
+	case reuse:
+		r.seqs = r.seqs[:0]
+	default:
+		r.seqs = make([]uint32, 0, prealloc)
 	}
 
-	return lj.NewBatch(events), nil
+	err := r.readEvents(&r.wire, 0, count)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF // connection closed mid window
+	}
+	if err != nil {
+		return err
+	}
+	if r.invalid != nil {
+		r.invalid.Window = count
+		return r.invalid
+	}
+	return nil
+}
+
+// stamp sets the batch metadata of the window read last.
+func (r *reader) stamp(batch *lj.Batch, streamStart int) {
+	batch.Dropped = r.dropped
+	batch.ProtocolVersion = protocol.CodeVersion
+	batch.WireBytes = r.wire.N
+	if r.streaming {
+		batch.WireBytes = r.stream.n - streamStart
+	}
+	batch.DecodedBytes = r.decoded
+	batch.ReceivedAt = r.clock()
 }
 
-func (r *reader) readEvents(in io.Reader, events []interface{}) ([]interface{}, error) {
-	for len(events) < cap(events) {
-		var hdr [2]byte
-		if err := readFull(in, hdr[:]); err != nil {
-			return nil, err
+// received returns the number of events read from the current window,
+// including dropped events.
+func (r *reader) received() int {
+	return r.offset + len(r.events) + len(r.raw) + r.dropped
+}
+
+// readEvents reads frames from in until limit events have been received. Within
+// compressed frames (depth > 0) reading stops early at the end of the frame.
+func (r *reader) readEvents(in io.Reader, depth, limit int) error {
+	for {
+		if depth == 0 && len(r.pending) > 0 && !r.nextCompressed() {
+			if err := r.awaitPending(); err != nil {
+				return err
+			}
+		}
+		if len(r.pending) == 0 && r.received() >= limit {
+			return nil
+		}
+
+		// header buffer is reused by readers of the frame, copy header
+		hdr := r.hdr[:2]
+		if err := internal.ReadFull(in, hdr); err != nil {
+			if depth > 0 && err == io.EOF {
+				return nil // compressed frame ends at frame boundary
+			}
+			return err
 		}
+		version, code := hdr[0], hdr[1]
 
-		if hdr[0] != protocol.CodeVersion {
-			log.Println("Event protocol version error")
-			return nil, ErrProtocolError
+		if version != protocol.CodeVersion {
+			return internal.NewProtocolError(code, "unsupported protocol version %q", version)
 		}
 
-		switch hdr[1] {
+		switch code {
 		case protocol.CodeJSONDataFrame:
-			event, err := r.readJSONEvent(in)
+			idx := r.received()
+			err := r.readJSONEvent(in, idx)
+			if err == errDropEvent {
+				r.dropped++
+				continue
+			}
 			if err != nil {
-				log.Printf("failed to read json event with: %v\n", err)
-				return nil, err
+				return err
+			}
+		case protocol.CodeDataFrame:
+			if err := r.readKVEvent(in); err != nil {
+				return err
 			}
-			events = append(events, event)
 		case protocol.CodeCompressed:
-			readEvents, err := r.readCompressed(in, events)
-			if err != nil {
-				return nil, err
+			if depth >= r.maxCompressedDepth {
+				return internal.NewProtocolError(code,
+					"compressed frames nested too deep (max depth %v)", r.maxCompressedDepth)
+			}
+
+			if err := r.readCompressed(in, depth+1); err != nil {
+				return err
 			}
-			events = readEvents
 		default:
-			log.Printf("Unknown frame type: %v", hdr[1])
-			return nil, ErrProtocolError
+			fn := r.frameHandlers[code]
+			if fn == nil {
+				return internal.NewProtocolError(code, "unknown frame type")
+			}
+
+			sz := r.hdr[:4]
+			if err := internal.ReadFull(in, sz); err != nil {
+				return err
+			}
+			if err := r.readCustomFrame(in, code, binary.BigEndian.Uint32(sz), fn); err != nil {
+				return err
+			}
 		}
 	}
-	return events, nil
 }
 
-func (r *reader) readJSONEvent(in io.Reader) (interface{}, error) {
-	var hdr [8]byte
-	if err := readFull(in, hdr[:]); err != nil {
-		return nil, err
+// readJSONEvent reads the event with index idx, appending it to r.events, or
+// its raw payload to r.raw if keepRaw is set.
+func (r *reader) readJSONEvent(in io.Reader, idx int) error {
+	hdr := r.hdr[:8]
+	if err := internal.ReadFull(in, hdr); err != nil {
+		return err
 	}
 
+	seq := binary.BigEndian.Uint32(hdr[:4])
+	r.seq.Add(seq)
 	payloadSz := int(binary.BigEndian.Uint32(hdr[4:]))
-	if payloadSz > len(r.buf) {
+	if err := r.addDecoded(payloadSz); err != nil {
+		return err
+	}
+	if r.keepRaw {
+		// Read raw payload into arena, decoding is deferred to the consumer.
+		// If the arena is full, a new one is started. Events already read keep
+		// referencing the old arena. Large payloads get a buffer of their own.
+		// Payloads are capped to their length, such that appending to an event
+		// never overwrites the next one.
+		var raw []byte
+		if payloadSz > internal.MaxPreallocPayload {
+			buf, err := internal.ReadSized(in, payloadSz)
+			if err != nil {
+				return err
+			}
+			raw = buf
+		} else {
+			if len(r.arena)+payloadSz > cap(r.arena) {
+				r.arena = make([]byte, 0, r.arenaCap(payloadSz))
+			}
+			off := len(r.arena)
+			end := off + payloadSz
+			r.arena = r.arena[:end]
+			if err := internal.ReadFull(in, r.arena[off:end]); err != nil {
+				return err
+			}
+			raw = r.arena[off:end:end]
+			r.arenaUsed += payloadSz
+		}
+
+		if r.validate && !r.rawPayloads && !r.validJSON(raw) {
+			if r.lenient {
+				return errDropEvent
+			}
+			return fmt.Errorf("%w (event %v in batch)", ErrInvalidJSON, idx)
+		}
+		if err := r.validateEvent(idx, raw); err != nil {
+			return err
+		}
+		r.raw = append(r.raw, raw)
+		r.addSeq(seq)
+		return nil
+	}
+
+	var buf []byte
+	switch {
+	case payloadSz <= len(r.buf):
+		buf = r.buf[:payloadSz]
+		if err := internal.ReadFull(in, buf); err != nil {
+			return err
+		}
+	case payloadSz <= internal.MaxPreallocPayload:
 		r.buf = make([]byte, payloadSz)
+		buf = r.buf
+		if err := internal.ReadFull(in, buf); err != nil {
+			return err
+		}
+	default:
+		var err error
+		if buf, err = internal.ReadSized(in, payloadSz); err != nil {
+			return err
+		}
+		r.buf = buf
 	}
 
-	buf := r.buf[:payloadSz]
-	if err := readFull(in, buf); err != nil {
-		return nil, err
+	var event interface{}
+	if err := r.decoder(buf, &event); err != nil {
+		if r.lenient {
+			return errDropEvent
+		}
+		return err
+	}
+	if err := r.validateEvent(idx, buf); err != nil {
+		return err
+	}
+	r.events = append(r.events, event)
+	r.addSeq(seq)
+	return nil
+}
+
+// validateEvent passes the payload of the event with index idx to the
+// validator. Only the first failure of a window is recorded. The failure is
+// returned right away, unless dropInvalid is set, in which case the window is
+// read to its end before returning the failure.
+func (r *reader) validateEvent(idx int, payload []byte) error {
+	if r.validator == nil || r.invalid != nil {
+		return nil
+	}
+	if err := r.validator(payload); err != nil {
+		r.invalid = &internal.InvalidBatchError{Index: idx, Err: err}
+		if !r.dropInvalid {
+			return r.invalid
+		}
+	}
+	return nil
+}
+
+// addDecoded counts n event payload bytes of the current window, failing with
+// ErrBatchTooLarge once the window exceeds maxBatchBytes. JSON payloads are
+// counted before being read, such that oversized windows are rejected before
+// buffering the payload.
+func (r *reader) addDecoded(n int) error {
+	r.decoded += n
+	if r.maxBatchBytes == 0 {
+		return nil
+	}
+
+	total := int64(r.decoded)
+	if r.batchBytes != nil {
+		total = atomic.AddInt64(r.batchBytes, int64(n))
+	}
+	if total > int64(r.maxBatchBytes) {
+		return ErrBatchTooLarge
+	}
+	return nil
+}
+
+// addSeq records the sequence number of the event appended last, if sequences
+// are collected.
+func (r *reader) addSeq(seq uint32) {
+	if r.sequences {
+		r.seqs = append(r.seqs, seq)
+	}
+}
+
+// arenaCap returns the capacity of a new arena for a payload of n bytes. The
+// sizes of the payloads of a window are not known before reading them, so the
+// first arena of a window is sized by the arena bytes of the previous window,
+// reading windows of similar size into a single arena. Arenas grow by doubling
+// up to maxArena.
+func (r *reader) arenaCap(n int) int {
+	c := 2 * cap(r.arena)
+	if r.arenaUsed == 0 && r.arenaHint > c {
+		c = r.arenaHint
+	}
+	if c > maxArena {
+		c = maxArena
+	}
+	if c < n {
+		c = n
+	}
+	return c
+}
+
+// readKVEvent reads a key-value data frame, appending the event to r.events,
+// or its JSON encoding to r.raw if keepRaw is set. Events are decoded into the
+// same map type JSON objects are decoded into.
+func (r *reader) readKVEvent(in io.Reader) error {
+	seq, pairs, err := r.fields.ReadHeader(in, r.maxFieldPairs)
+	if err != nil {
+		return err
+	}
+
+	event := map[string]interface{}{}
+	for i := 0; i < pairs; i++ {
+		k, err := r.fields.ReadString(in, r.maxFieldSize)
+		if err != nil {
+			return err
+		}
+
+		v, err := r.fields.ReadString(in, r.maxFieldSize)
+		if err != nil {
+			return err
+		}
+
+		if err := r.addDecoded(len(k) + len(v)); err != nil {
+			return err
+		}
+		event[k] = v
+	}
+	r.seq.Add(seq)
+
+	if !r.keepRaw {
+		if r.validator != nil {
+			raw, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			if err := r.validateEvent(r.received(), raw); err != nil {
+				return err
+			}
+		}
+		r.events = append(r.events, event)
+		r.addSeq(seq)
+		return nil
 	}
 
+	raw, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if err := r.validateEvent(r.received(), raw); err != nil {
+		return err
+	}
+	r.raw = append(r.raw, raw)
+	r.addSeq(seq)
+	return nil
+}
+
+// validJSON reports whether raw is a valid JSON document.
+func (r *reader) validJSON(raw []byte) bool {
+	if !r.decodeValidate {
+		return json.Valid(raw)
+	}
 	var event interface{}
-	err := r.decoder(buf, &event)
-	return event, err
+	return r.decoder(raw, &event) == nil
 }
 
-func (r *reader) readCompressed(in io.Reader, events []interface{}) ([]interface{}, error) {
-	var hdr [4]byte
-	if err := readFull(in, hdr[:]); err != nil {
-		return nil, err
+// frameHandler returns the handler registered for the frame with header hdr,
+// or nil if no handler is registered.
+func (r *reader) frameHandler(hdr []byte) func([]byte) error {
+	if hdr[0] != protocol.CodeVersion {
+		return nil
+	}
+	return r.frameHandlers[hdr[1]]
+}
+
+// readCustomFrame reads the payload of a custom frame with code, passing it to
+// fn.
+func (r *reader) readCustomFrame(in io.Reader, code byte, payloadSz uint32, fn func([]byte) error) error {
+	if payloadSz > maxFramePayload {
+		return internal.NewProtocolError(code,
+			"custom frame payload too large (%v > %v)", payloadSz, maxFramePayload)
+	}
+
+	if int(payloadSz) > len(r.buf) {
+		r.buf = make([]byte, payloadSz)
+	}
+	payload := r.buf[:payloadSz]
+	if err := internal.ReadFull(in, payload); err != nil {
+		return err
+	}
+	return fn(payload)
+}
+
+func (r *reader) readCompressed(in io.Reader, depth int) error {
+	hdr := r.hdr[:4]
+	if err := internal.ReadFull(in, hdr); err != nil {
+		return err
 	}
 
-	payloadSz := binary.BigEndian.Uint32(hdr[:])
-	limit := io.LimitReader(in, int64(payloadSz))
-	reader, err := zlib.NewReader(limit)
+	payloadSz := binary.BigEndian.Uint32(hdr)
+	if depth == 1 && r.inflater != nil {
+		// keep frames ordered once a frame is inflated asynchronously
+		if len(r.pending) > 0 || payloadSz >= r.inflater.minSize {
+			return r.readCompressedAsync(in, payloadSz)
+		}
+	}
+
+	// buf implements io.ByteReader, such that the decompressor does not read
+	// ahead. Bytes trailing the compressed data are left in buf and limit. The
+	// codec is selected by peeking at the leading bytes of the payload.
+	limit := &io.LimitedReader{R: in, N: int64(payloadSz)}
+	buf := bufio.NewReader(injectFault(faultCompressed, limit))
+	magic, err := buf.Peek(maxCodecMagic)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if err == io.EOF && limit.N > 0 {
+		return io.ErrUnexpectedEOF
+	}
+	newReader, err := lookupCodec(magic)
 	if err != nil {
-		log.Printf("Failed to initialized zlib reader %v\n", err)
-		return nil, err
+		return err
 	}
+	err = r.inflate(buf, depth, newReader)
+	trailing := int64(buf.Buffered()) + limit.N
+	if err := r.compressedFrameEnd(err, payloadSz, trailing); err != nil {
+		return err
+	}
+
+	// consume padding from limit reader, bounded by compressedPadding
+	return internal.DiscardRemaining(limit)
+}
 
-	events, err = r.readEvents(reader, events)
+// compressedFrameEnd checks the result err of inflating a compressed frame of
+// payloadSz bytes, with trailing bytes of the payload not being consumed by the
+// decompressor.
+func (r *reader) compressedFrameEnd(err error, payloadSz uint32, trailing int64) error {
 	if err != nil {
-		_ = reader.Close()
-		return nil, err
+		if trailing == 0 && errors.Is(err, io.ErrUnexpectedEOF) {
+			return internal.NewProtocolError(protocol.CodeCompressed,
+				"compressed data exceeds frame size of %v bytes", payloadSz)
+		}
+		return err
 	}
-	if err := reader.Close(); err != nil {
-		return nil, err
+
+	if trailing > int64(r.compressedPadding) {
+		return internal.NewProtocolError(protocol.CodeCompressed,
+			"%v of %v compressed frame bytes trail the compressed data", trailing, payloadSz)
 	}
+	return nil
+}
 
-	// consume final bytes from limit reader
-	for {
-		var tmp [16]byte
-		if _, err := limit.Read(tmp[:]); err != nil {
-			if err != io.EOF {
-				return nil, err
-			}
-			break
+// inflate reads the events of the compressed frame payload in, decompressed
+// by the reader created by newReader.
+func (r *reader) inflate(in io.Reader, depth int, newReader codecFactory) error {
+	reader, err := newReader(in)
+	if err != nil {
+		return internal.DecompressorError(protocol.CodeCompressed, err)
+	}
+
+	limit := r.window
+	if r.maxCompressedEvents > 0 && r.received()+r.maxCompressedEvents < limit {
+		limit = r.received() + r.maxCompressedEvents
+	}
+	if err := r.readEvents(injectFault(faultInflated, reader), depth, limit); err != nil {
+		_ = reader.Close()
+		return err
+	}
+	if limit < r.window {
+		// the frame must end after maxCompressedEvents events
+		if n, _ := reader.Read(r.hdr[:1]); n > 0 {
+			_ = reader.Close()
+			return internal.NewProtocolError(protocol.CodeCompressed,
+				"too many events in compressed frame (> %v)", r.maxCompressedEvents)
 		}
 	}
-	return events, nil
+	return reader.Close()
 }
 
-func readFull(in io.Reader, buf []byte) error {
-	_, err := io.ReadFull(in, buf)
-	return err
+// startStreamCompression confirms the stream compression request and wraps
+// the connection input with a zlib reader.
+func (r *reader) startStreamCompression() error {
+	if !r.streamCompression || r.streaming {
+		return internal.NewProtocolError(protocol.CodeCompressStream,
+			"unexpected stream compression request")
+	}
+
+	msg := [6]byte{protocol.CodeVersion, protocol.CodeCompressStream}
+	if err := r.conn.SetWriteDeadline(time.Now().Add(r.timeout)); err != nil {
+		return err
+	}
+	if _, err := r.conn.Write(msg[:]); err != nil {
+		return err
+	}
+
+	r.stream = byteCounter{in: r.base}
+	zr, err := zlib.NewReader(&r.stream)
+	if err != nil {
+		return internal.DecompressorError(protocol.CodeCompressStream, err)
+	}
+	r.in = bufio.NewReader(zr)
+	r.streaming = true
+	return nil
+}
+
+// byteCounter counts the number of bytes read from in. It implements
+// io.ByteReader, such that decompressors do not buffer ahead, consuming bytes
+// from in only as needed.
+type byteCounter struct {
+	in *bufio.Reader
+	n  int
+}
+
+func (c *byteCounter) Read(buf []byte) (int, error) {
+	n, err := c.in.Read(buf)
+	c.n += n
+	return n, err
+}
+
+func (c *byteCounter) ReadByte() (byte, error) {
+	b, err := c.in.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
 }
@@ -0,0 +1,1270 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v2
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zlib"
+
+	"github.com/elastic/go-lumber/lj"
+	protocol "github.com/elastic/go-lumber/protocol/v2"
+)
+
+var testReaderConfig = readerConfig{
+	timeout:            time.Second,
+	decoder:            json.Unmarshal,
+	maxCompressedDepth: 1,
+	clock:              time.Now,
+}
+
+func windowFrame(count uint32) []byte {
+	b := []byte{'2', 'W', 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[2:], count)
+	return b
+}
+
+func jsonFrame(seq uint32, payload string) []byte {
+	b := make([]byte, 10, 10+len(payload))
+	b[0], b[1] = '2', 'J'
+	binary.BigEndian.PutUint32(b[2:], seq)
+	binary.BigEndian.PutUint32(b[6:], uint32(len(payload)))
+	return append(b, payload...)
+}
+
+func compressedFrame(frames ...[]byte) []byte {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	for _, f := range frames {
+		w.Write(f)
+	}
+	w.Close()
+
+	b := []byte{'2', 'C', 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[2:], uint32(buf.Len()))
+	return append(b, buf.Bytes()...)
+}
+
+// pipeConn returns a connection frames are read from. The peer connection is
+// closed after writing all frames.
+func pipeConn(t *testing.T, frames ...[]byte) net.Conn {
+	server, client := net.Pipe()
+	go func() {
+		defer client.Close()
+		for _, f := range frames {
+			if _, err := client.Write(f); err != nil {
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+func testReader(t *testing.T, cfg readerConfig, frames ...[]byte) *reader {
+	return newReader(pipeConn(t, frames...), cfg)
+}
+
+func TestReaderPoolReset(t *testing.T) {
+	pool := newReaderPool(testReaderConfig)
+
+	// leave the second window buffered in the reader
+	r := pool.get(pipeConn(t,
+		append(append(windowFrame(1), jsonFrame(1, `1`)...), windowFrame(5)...)))
+	if b, err := r.ReadBatch(); err != nil || len(b.Events) != 1 {
+		t.Fatalf("failed to read batch: %v", err)
+	}
+	r.Release()
+
+	reused := pool.get(pipeConn(t, windowFrame(1), jsonFrame(1, `"next"`)))
+	b, err := reused.ReadBatch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Events) != 1 || b.Events[0] != "next" {
+		t.Errorf("unexpected events: %v", b.Events)
+	}
+}
+
+func TestReadNestedCompressedRejected(t *testing.T) {
+	frame := jsonFrame(1, `{"message":"nested"}`)
+	for i := 0; i < 64; i++ {
+		frame = compressedFrame(frame)
+	}
+
+	r := testReader(t, testReaderConfig, windowFrame(1), frame)
+	if _, err := r.ReadBatch(); !errors.Is(err, ErrProtocolError) {
+		t.Errorf("expected ErrProtocolError for nested compressed frames, got %v", err)
+	}
+}
+
+func TestReadCompressedDepth(t *testing.T) {
+	nested := compressedFrame(compressedFrame(jsonFrame(1, `1`)))
+
+	cfg := testReaderConfig
+	cfg.maxCompressedDepth = 2
+	r := testReader(t, cfg, windowFrame(1), nested)
+	if b, err := r.ReadBatch(); err != nil || len(b.Events) != 1 {
+		t.Errorf("expected nested frame within depth to be accepted, got %v", err)
+	}
+
+	cfg.maxCompressedDepth = 0
+	r = testReader(t, cfg, windowFrame(1), compressedFrame(jsonFrame(1, `1`)))
+	if _, err := r.ReadBatch(); !errors.Is(err, ErrProtocolError) {
+		t.Errorf("expected compressed frame to be rejected with depth 0, got %v", err)
+	}
+}
+
+func TestReadCompressedMaxEvents(t *testing.T) {
+	cfg := testReaderConfig
+	cfg.maxCompressedEvents = 2
+
+	frames := compressedFrame(jsonFrame(1, `1`), jsonFrame(2, `2`), jsonFrame(3, `3`))
+	r := testReader(t, cfg, windowFrame(3), frames)
+	if _, err := r.ReadBatch(); !errors.Is(err, ErrProtocolError) {
+		t.Errorf("expected ErrProtocolError for too many events, got %v", err)
+	}
+
+	// compressed frames provide all remaining events of a window
+	frames = compressedFrame(jsonFrame(2, `2`), jsonFrame(3, `3`))
+	r = testReader(t, cfg, windowFrame(3), jsonFrame(1, `1`), frames)
+	if b, err := r.ReadBatch(); err != nil || len(b.Events) != 3 {
+		t.Errorf("expected batch to be accepted, got %v", err)
+	}
+}
+
+func TestReadBatchAfterStreamNegotiation(t *testing.T) {
+	server, client := net.Pipe()
+	t.Cleanup(func() { server.Close(); client.Close() })
+	go func() {
+		client.Write([]byte{'2', 'S', 0, 0, 0, 0})
+		var ack [6]byte
+		if _, err := io.ReadFull(client, ack[:]); err != nil {
+			return
+		}
+		w := zlib.NewWriter(client)
+		w.Write(windowFrame(1))
+		w.Write(jsonFrame(1, `"streamed"`))
+		w.Flush()
+	}()
+
+	cfg := testReaderConfig
+	cfg.streamCompression = true
+	b, err := newReader(server, cfg).ReadBatch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b == nil || len(b.Events) != 1 || b.Events[0] != "streamed" {
+		t.Errorf("expected first batch from compressed stream, got %v", b)
+	}
+}
+
+func TestEncoderRoundTrip(t *testing.T) {
+	events := [][]byte{
+		[]byte(`{"message":"first"}`),
+		[]byte(`"second"`),
+		[]byte(`[1,2,3]`),
+	}
+
+	var enc protocol.Encoder
+	var buf bytes.Buffer
+	enc.WriteWindow(&buf, uint32(len(events)))
+	for i, e := range events {
+		enc.WriteJSONEvent(&buf, uint32(i)+1, e)
+	}
+	enc.WriteWindow(&buf, uint32(len(events)))
+	enc.WriteCompressed(&buf, events, zlib.BestSpeed)
+
+	r := testReader(t, testReaderConfig, buf.Bytes())
+	for _, name := range []string{"json", "compressed"} {
+		b, err := r.ReadBatch()
+		if err != nil {
+			t.Fatalf("%v: failed to read batch: %v", name, err)
+		}
+		if b.ProtocolVersion != protocol.CodeVersion {
+			t.Errorf("%v: unexpected protocol version %q", name, b.ProtocolVersion)
+		}
+		if len(b.Events) != len(events) {
+			t.Fatalf("%v: expected %v events, got %v", name, len(events), len(b.Events))
+		}
+		for i, e := range events {
+			got, err := json.Marshal(b.Events[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, e) {
+				t.Errorf("%v: event %v: expected %s, got %s", name, i, e, got)
+			}
+		}
+	}
+}
+
+func customFrame(code byte, payload string) []byte {
+	b := []byte{'2', code, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[2:], uint32(len(payload)))
+	return append(b, payload...)
+}
+
+// stalledConn returns a connection data is read from, without the client ever
+// closing the connection.
+func stalledConn(t *testing.T, data []byte) net.Conn {
+	server, client := net.Pipe()
+	if len(data) > 0 {
+		go client.Write(data)
+	}
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return server
+}
+
+func TestReadWindowHeaderStalled(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		idle time.Duration
+	}{
+		{"partial header", windowFrame(1)[:1], 0},
+		{"partial header with idle timeout", windowFrame(1)[:3], time.Hour},
+		{"idle", nil, 50 * time.Millisecond},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testReaderConfig
+			cfg.timeout = 50 * time.Millisecond
+			cfg.idleTimeout = test.idle
+			r := newReader(stalledConn(t, test.data), cfg)
+
+			start := time.Now()
+			_, err := r.ReadBatch()
+			var ne net.Error
+			if !errors.As(err, &ne) || !ne.Timeout() {
+				t.Fatalf("expected timeout, got %v", err)
+			}
+			if d := time.Since(start); d > 5*time.Second {
+				t.Errorf("stalled client disconnected after %v", d)
+			}
+		})
+	}
+}
+
+func TestReadCustomFrames(t *testing.T) {
+	var payloads []string
+	cfg := testReaderConfig
+	cfg.frameHandlers = map[byte]func([]byte) error{
+		'M': func(p []byte) error {
+			payloads = append(payloads, string(p))
+			return nil
+		},
+	}
+
+	r := testReader(t, cfg,
+		customFrame('M', "agent-1"),
+		windowFrame(2),
+		jsonFrame(1, `1`),
+		customFrame('M', "schema-2"),
+		compressedFrame(customFrame('M', "compressed"), jsonFrame(2, `2`)))
+	b, err := r.ReadBatch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Events) != 2 {
+		t.Errorf("expected 2 events, got %v", b.Events)
+	}
+	expected := []string{"agent-1", "schema-2", "compressed"}
+	if fmt.Sprint(payloads) != fmt.Sprint(expected) {
+		t.Errorf("expected payloads %v, got %v", expected, payloads)
+	}
+}
+
+func TestReadCustomFrameErrors(t *testing.T) {
+	errHandler := errors.New("handler failed")
+	cfg := testReaderConfig
+	cfg.frameHandlers = map[byte]func([]byte) error{
+		'M': func([]byte) error { return nil },
+		'E': func([]byte) error { return errHandler },
+	}
+
+	var tooMany [][]byte
+	for i := 0; i <= maxCustomFrames; i++ {
+		tooMany = append(tooMany, customFrame('M', ""))
+	}
+	tooMany = append(tooMany, windowFrame(1), jsonFrame(1, `1`))
+
+	tests := []struct {
+		name   string
+		frames [][]byte
+		err    error
+	}{
+		{"unregistered before window", [][]byte{customFrame('X', "")}, ErrProtocolError},
+		{"too many before window", tooMany, ErrProtocolError},
+		{"unregistered in window", [][]byte{windowFrame(1), customFrame('X', "")}, ErrProtocolError},
+		{"handler error", [][]byte{customFrame('E', "fail")}, errHandler},
+		{"payload too large", [][]byte{customFrame('M', string(make([]byte, maxFramePayload+1)))}, ErrProtocolError},
+	}
+	for _, test := range tests {
+		r := testReader(t, cfg, test.frames...)
+		if _, err := r.ReadBatch(); !errors.Is(err, test.err) {
+			t.Errorf("%v: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestReadProtocolError(t *testing.T) {
+	badHeader := compressedFrame(jsonFrame(1, `1`))
+	badHeader[7] ^= 0xff // zlib header checksum mismatch
+
+	tests := []struct {
+		name   string
+		frames [][]byte
+		code   byte
+		offset int // not checked if < 0
+	}{
+		{"no window", [][]byte{jsonFrame(1, `1`)}, 'J', 6},
+		{"unknown frame", [][]byte{windowFrame(1), {'2', 'X'}}, 'X', 8},
+		{"version", [][]byte{windowFrame(1), {'1', 'J'}}, 'J', 8},
+		{"field pairs", [][]byte{windowFrame(1), kvFrame(1, "a", "1", "b", "2")}, 'D', 16},
+		{"compressed", [][]byte{windowFrame(1), compressedFrame(jsonFrame(1, `1`), jsonFrame(2, `2`))}, 'C', -1},
+		{"compressed header", [][]byte{windowFrame(1), badHeader}, 'C', -1},
+	}
+	for _, test := range tests {
+		for _, workers := range []int{0, 2} {
+			cfg := testReaderConfig
+			cfg.maxFieldPairs = 1
+			cfg.inflater = newInflatePool(workers, 0)
+
+			_, err := testReader(t, cfg, test.frames...).ReadBatch()
+			var pe *ProtocolError
+			if !errors.Is(err, ErrProtocolError) || !errors.As(err, &pe) {
+				t.Errorf("%v/workers=%v: expected ProtocolError, got %v", test.name, workers, err)
+				continue
+			}
+			if pe.Code != test.code || (test.offset >= 0 && pe.Offset != test.offset) || pe.RemoteAddr == nil {
+				t.Errorf("%v/workers=%v: expected frame %q at offset %v, got %+v",
+					test.name, workers, test.code, test.offset, pe)
+			}
+		}
+	}
+
+	_, err := testReader(t, testReaderConfig, windowFrame(1), []byte{'2', 'X'}).ReadBatch()
+	expected := "lumberjack protocol error: unknown frame type (frame 'X' at offset 8 from pipe)"
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected error %q, got %v", expected, err)
+	}
+}
+
+func TestFrameHandlerReservedCode(t *testing.T) {
+	if _, err := applyOptions([]Option{FrameHandler('W', func([]byte) error { return nil })}); err == nil {
+		t.Error("expected registering built-in frame code to fail")
+	}
+}
+
+func TestReadEOF(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames [][]byte
+		err    error
+	}{
+		{"clean close", nil, io.EOF},
+		{"clean close after window", [][]byte{windowFrame(1), jsonFrame(1, `1`)}, io.EOF},
+		{"truncated window frame", [][]byte{windowFrame(1)[:3]}, io.ErrUnexpectedEOF},
+		{"missing events", [][]byte{windowFrame(2), jsonFrame(1, `1`)}, io.ErrUnexpectedEOF},
+		{"truncated event", [][]byte{windowFrame(1), jsonFrame(1, `"abc"`)[:12]}, io.ErrUnexpectedEOF},
+	}
+	for _, test := range tests {
+		r := testReader(t, testReaderConfig, test.frames...)
+		var err error
+		for err == nil {
+			_, err = r.ReadBatch()
+		}
+		if err != test.err {
+			t.Errorf("%v: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+// BenchmarkReadBatchPartialAccess reads batches accessing every 10th event
+// only, comparing eager and lazy decoding.
+func BenchmarkReadBatchPartialAccess(b *testing.B) {
+	const events = 1000
+
+	var window bytes.Buffer
+	window.Write(windowFrame(events))
+	for i := 0; i < events; i++ {
+		event := fmt.Sprintf(`{"message":"event %v","fields":{"host":"localhost","seq":%v}}`, i, i)
+		window.Write(jsonFrame(uint32(i+1), event))
+	}
+
+	for _, lazy := range []bool{false, true} {
+		b.Run(fmt.Sprintf("lazy=%v", lazy), func(b *testing.B) {
+			server, client := net.Pipe()
+			defer server.Close()
+			go func() {
+				defer client.Close()
+				for i := 0; i < b.N; i++ {
+					if _, err := client.Write(window.Bytes()); err != nil {
+						return
+					}
+				}
+			}()
+
+			cfg := testReaderConfig
+			cfg.lazy = lazy
+			r := newReader(server, cfg)
+
+			b.SetBytes(int64(window.Len()))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				batch, err := r.ReadBatch()
+				if err != nil {
+					b.Fatal(err)
+				}
+				for j := 0; j < len(batch.Events); j += 10 {
+					if _, err := batch.Event(j); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// loopConn replays data endlessly, for reading batches without a peer.
+type loopConn struct {
+	net.Conn
+	data []byte
+	off  int
+}
+
+func (c *loopConn) Read(p []byte) (int, error) {
+	n := copy(p, c.data[c.off:])
+	c.off = (c.off + n) % len(c.data)
+	return n, nil
+}
+
+func (c *loopConn) SetReadDeadline(time.Time) error { return nil }
+
+func TestReadBatchInto(t *testing.T) {
+	conn := pipeConn(t,
+		windowFrame(2), jsonFrame(1, `{"a":1}`), jsonFrame(2, `"b"`),
+		windowFrame(1), compressedFrame(jsonFrame(1, `3`)),
+	)
+	r, err := NewReader(conn, Timeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dst lj.Batch
+	if err := r.ReadBatchInto(&dst); err != nil {
+		t.Fatal(err)
+	}
+	if len(dst.Events) != 2 || dst.Events[0] != nil {
+		t.Fatalf("expected 2 lazy events, got %v", dst.Events)
+	}
+	if e, err := dst.Event(1); err != nil || e != "b" {
+		t.Errorf("unexpected event: %v, %v", e, err)
+	}
+	dst.ACK()
+
+	if err := r.ReadBatchInto(&dst); err != nil {
+		t.Fatal(err)
+	}
+	if len(dst.Events) != 1 || cap(dst.Events) != 2 {
+		t.Errorf("expected event storage to be reused, got len=%v cap=%v",
+			len(dst.Events), cap(dst.Events))
+	}
+	if e, err := dst.Event(0); err != nil || e != 3.0 {
+		t.Errorf("unexpected event: %v, %v", e, err)
+	}
+	select {
+	case <-dst.Await():
+		t.Error("expected reset batch to be pending")
+	default:
+	}
+}
+
+func TestReadBatchIntoAllocs(t *testing.T) {
+	var window bytes.Buffer
+	window.Write(windowFrame(100))
+	for i := 0; i < 100; i++ {
+		window.Write(jsonFrame(uint32(i+1), fmt.Sprintf(`{"seq":%v}`, i)))
+	}
+
+	r := newReader(&loopConn{data: window.Bytes()}, testReaderConfig)
+	var dst lj.Batch
+	allocs := testing.AllocsPerRun(100, func() {
+		if err := r.ReadBatchInto(&dst); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("expected no allocations in steady state, got %v", allocs)
+	}
+}
+
+// BenchmarkReadBatchInto compares reading batches into reused storage with
+// ReadBatch. Run with -benchmem, ReadBatchInto reports 0 allocs/op.
+func BenchmarkReadBatchInto(b *testing.B) {
+	const events = 1000
+
+	var window bytes.Buffer
+	window.Write(windowFrame(events))
+	for i := 0; i < events; i++ {
+		event := fmt.Sprintf(`{"message":"event %v","fields":{"host":"localhost","seq":%v}}`, i, i)
+		window.Write(jsonFrame(uint32(i+1), event))
+	}
+
+	b.Run("ReadBatch", func(b *testing.B) {
+		cfg := testReaderConfig
+		cfg.lazy = true
+		r := newReader(&loopConn{data: window.Bytes()}, cfg)
+
+		b.SetBytes(int64(window.Len()))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := r.ReadBatch(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("ReadBatchInto", func(b *testing.B) {
+		r := newReader(&loopConn{data: window.Bytes()}, testReaderConfig)
+		var dst lj.Batch
+
+		b.SetBytes(int64(window.Len()))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := r.ReadBatchInto(&dst); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestReadMultipleCompressedFrames(t *testing.T) {
+	var window bytes.Buffer
+	window.Write(windowFrame(6))
+	window.Write(compressedFrame(jsonFrame(1, `1`), jsonFrame(2, `2`)))
+	window.Write(compressedFrame(jsonFrame(3, `3`), jsonFrame(4, `4`)))
+	window.Write(jsonFrame(5, `5`))
+	window.Write(compressedFrame(jsonFrame(6, `6`)))
+
+	for _, workers := range []int{0, 2} {
+		cfg := testReaderConfig
+		cfg.inflater = newInflatePool(workers, 0)
+
+		// single write, such that frames following a compressed frame are
+		// buffered already
+		r := testReader(t, cfg, window.Bytes())
+		b, err := r.ReadBatch()
+		if err != nil {
+			t.Fatalf("workers=%v: %v", workers, err)
+		}
+		if fmt.Sprint(b.Events) != "[1 2 3 4 5 6]" {
+			t.Errorf("workers=%v: unexpected events %v", workers, b.Events)
+		}
+	}
+}
+
+// rawCodecMagic identifies compressed payloads holding plain data frames,
+// following the magic bytes.
+var rawCodecMagic = []byte("RAW1")
+
+func init() {
+	RegisterCompressionCodec(rawCodecMagic, func(in io.Reader) (io.ReadCloser, error) {
+		magic := make([]byte, len(rawCodecMagic))
+		if _, err := io.ReadFull(in, magic); err != nil {
+			return nil, err
+		}
+		return io.NopCloser(in), nil
+	})
+}
+
+func rawCompressedFrame(magic []byte, frames ...[]byte) []byte {
+	payload := append([]byte(nil), magic...)
+	for _, f := range frames {
+		payload = append(payload, f...)
+	}
+	b := []byte{'2', 'C', 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[2:], uint32(len(payload)))
+	return append(b, payload...)
+}
+
+func TestReadCompressionCodec(t *testing.T) {
+	var window bytes.Buffer
+	window.Write(windowFrame(4))
+	window.Write(rawCompressedFrame(rawCodecMagic, jsonFrame(1, `1`), jsonFrame(2, `2`)))
+	window.Write(compressedFrame(jsonFrame(3, `3`)))
+	window.Write(rawCompressedFrame(rawCodecMagic, jsonFrame(4, `4`)))
+
+	for _, workers := range []int{0, 2} {
+		cfg := testReaderConfig
+		cfg.inflater = newInflatePool(workers, 0)
+
+		b, err := testReader(t, cfg, window.Bytes()).ReadBatch()
+		if err != nil {
+			t.Fatalf("workers=%v: %v", workers, err)
+		}
+		if fmt.Sprint(b.Events) != "[1 2 3 4]" {
+			t.Errorf("workers=%v: unexpected events %v", workers, b.Events)
+		}
+
+		unknown := append(windowFrame(1), rawCompressedFrame([]byte("RAW2"), jsonFrame(1, `1`))...)
+		_, err = testReader(t, cfg, unknown).ReadBatch()
+		if !errors.Is(err, ErrProtocolError) {
+			t.Errorf("workers=%v: expected ErrProtocolError for unknown codec, got %v", workers, err)
+		}
+	}
+}
+
+func TestReadEventSequences(t *testing.T) {
+	var window bytes.Buffer
+	window.Write(windowFrame(6))
+	window.Write(jsonFrame(11, `1`))
+	window.Write(compressedFrame(jsonFrame(12, `{bad`), jsonFrame(13, `3`)))
+	window.Write(kvFrame(14, "k", "v"))
+	window.Write(compressedFrame(jsonFrame(15, `5`), kvFrame(16, "k", "v")))
+
+	for _, workers := range []int{0, 2} {
+		for _, raw := range []bool{false, true} {
+			cfg := testReaderConfig
+			cfg.inflater = newInflatePool(workers, 0)
+			cfg.rawPayloads = raw
+			cfg.lenient = true
+			cfg.sequences = true
+
+			r := testReader(t, cfg, window.Bytes())
+			b, err := r.ReadBatch()
+			if err != nil {
+				t.Fatalf("workers=%v raw=%v: %v", workers, raw, err)
+			}
+			// the invalid event is only dropped if decoded
+			expected := []uint32{11, 13, 14, 15, 16}
+			if raw {
+				expected = []uint32{11, 12, 13, 14, 15, 16}
+			}
+			if !reflect.DeepEqual(b.Sequences, expected) || len(b.Sequences) != b.Len() {
+				t.Errorf("workers=%v raw=%v: expected sequences %v, got %v (%v events)",
+					workers, raw, expected, b.Sequences, b.Len())
+			}
+		}
+	}
+
+	cfg := testReaderConfig
+	cfg.lenient = true
+	b, err := testReader(t, cfg, window.Bytes()).ReadBatch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Sequences != nil {
+		t.Errorf("expected no sequences by default, got %v", b.Sequences)
+	}
+}
+
+// requireMessage is an event validator requiring the message field.
+func requireMessage(raw json.RawMessage) error {
+	var event struct {
+		Message *string `json:"message"`
+	}
+	if err := json.Unmarshal(raw, &event); err != nil {
+		return err
+	}
+	if event.Message == nil {
+		return errors.New("missing message field")
+	}
+	return nil
+}
+
+func TestReadEventValidator(t *testing.T) {
+	var window bytes.Buffer
+	window.Write(windowFrame(5))
+	window.Write(jsonFrame(1, `{"message":"a"}`))
+	window.Write(compressedFrame(jsonFrame(2, `{"message":"b"}`), kvFrame(3, "message", "c")))
+	window.Write(compressedFrame(jsonFrame(4, `{"msg":"d"}`), kvFrame(5, "msg", "e")))
+	window.Write(windowFrame(1))
+	window.Write(jsonFrame(1, `{"message":"f"}`))
+
+	for _, workers := range []int{0, 2} {
+		for _, drop := range []bool{false, true} {
+			cfg := testReaderConfig
+			cfg.inflater = newInflatePool(workers, 0)
+			cfg.validator = requireMessage
+			cfg.dropInvalid = drop
+
+			r := newReader(&fuzzConn{in: bytes.NewReader(window.Bytes())}, cfg)
+			_, err := r.ReadBatch()
+			var ie *InvalidBatchError
+			if !errors.As(err, &ie) {
+				t.Fatalf("workers=%v drop=%v: expected InvalidBatchError, got %v", workers, drop, err)
+			}
+			if ie.Index != 3 || ie.Err.Error() != "missing message field" {
+				t.Errorf("workers=%v drop=%v: expected event 3 to fail, got %v", workers, drop, ie)
+			}
+			if !drop {
+				if ie.Window != 0 {
+					t.Errorf("workers=%v: expected no window for connection being closed, got %v", workers, ie.Window)
+				}
+				continue
+			}
+
+			// the rejected window has been read completely
+			if ie.Window != 5 {
+				t.Errorf("workers=%v: expected window of 5 events, got %v", workers, ie.Window)
+			}
+			b, err := r.ReadBatch()
+			if err != nil {
+				t.Fatalf("workers=%v: %v", workers, err)
+			}
+			if b.Len() != 1 {
+				t.Errorf("workers=%v: expected next window, got %v", workers, b.Events)
+			}
+		}
+	}
+}
+
+func TestReadParallelDecompressionErrors(t *testing.T) {
+	cfg := testReaderConfig
+	cfg.inflater = newInflatePool(2, 0)
+	tests := []struct {
+		name   string
+		frames []byte
+	}{
+		{"exceeds window", bytes.Join([][]byte{
+			windowFrame(2),
+			compressedFrame(jsonFrame(1, `1`), jsonFrame(2, `2`)),
+			compressedFrame(jsonFrame(3, `3`)),
+		}, nil)},
+		{"invalid event", bytes.Join([][]byte{
+			windowFrame(2),
+			compressedFrame(jsonFrame(1, `1`)),
+			compressedFrame(jsonFrame(2, `{invalid`)),
+		}, nil)},
+		{"too many events per frame", bytes.Join([][]byte{
+			windowFrame(3),
+			compressedFrame(jsonFrame(1, `1`), jsonFrame(2, `2`), jsonFrame(3, `3`)),
+		}, nil)},
+	}
+
+	cfg.maxCompressedEvents = 2
+	for _, test := range tests {
+		r := testReader(t, cfg, test.frames)
+		if _, err := r.ReadBatch(); err == nil {
+			t.Errorf("%v: expected error", test.name)
+		}
+	}
+}
+
+// BenchmarkReadCompressedFrames reads windows of 4 compressed frames of about
+// 1.7MB each, inflating frames on the connection goroutine or in parallel.
+func BenchmarkReadCompressedFrames(b *testing.B) {
+	const frames, eventsPerFrame = 4, 40000
+
+	var window bytes.Buffer
+	window.Write(windowFrame(frames * eventsPerFrame))
+	seq := uint32(1)
+	for i := 0; i < frames; i++ {
+		var events [][]byte
+		for j := 0; j < eventsPerFrame; j++ {
+			event := fmt.Sprintf(`{"message":"%x","seq":%v}`, sha256.Sum256([]byte{byte(i), byte(j), byte(j >> 8)}), seq)
+			events = append(events, jsonFrame(seq, event))
+			seq++
+		}
+		window.Write(compressedFrame(events...))
+	}
+
+	for _, workers := range []int{0, 4} {
+		b.Run(fmt.Sprintf("workers=%v", workers), func(b *testing.B) {
+			cfg := testReaderConfig
+			cfg.lazy = true
+			cfg.inflater = newInflatePool(workers, 0)
+			r := newReader(&loopConn{data: window.Bytes()}, cfg)
+
+			b.SetBytes(int64(window.Len()))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := r.ReadBatch(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkReadCompressedPadding reads compressed frames followed by padding
+// within the declared payload size, which is discarded after inflating.
+func BenchmarkReadCompressedPadding(b *testing.B) {
+	for _, padding := range []int{0, 1 << 10, 4 << 10, 16 << 10} {
+		b.Run(fmt.Sprintf("padding=%v", padding), func(b *testing.B) {
+			var window bytes.Buffer
+			window.Write(windowFrame(1))
+			window.Write(resizeCompressed(compressedFrame(jsonFrame(1, `{"message":"padded"}`)), padding))
+			window.Write(make([]byte, padding))
+
+			cfg := testReaderConfig
+			cfg.compressedPadding = padding
+			r := newReader(&loopConn{data: window.Bytes()}, cfg)
+
+			b.SetBytes(int64(window.Len()))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := r.ReadBatch(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestReadArena(t *testing.T) {
+	const events = 1000
+
+	var window bytes.Buffer
+	window.Write(windowFrame(events))
+	for i := 0; i < events; i++ {
+		window.Write(jsonFrame(uint32(i+1), fmt.Sprintf(`{"message":"event %04d"}`, i)))
+	}
+
+	cfg := testReaderConfig
+	cfg.rawPayloads = true
+	r := newReader(&loopConn{data: window.Bytes()}, cfg)
+	first, err := r.ReadBatch()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// windows of similar size are read into a single arena
+	allocs := testing.AllocsPerRun(10, func() {
+		if _, err := r.ReadBatch(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs > 6 {
+		t.Errorf("expected batch to be read into a single arena, got %v allocations", allocs)
+	}
+
+	// events do not alias each other, nor events of later batches
+	for i := range first.RawEvents {
+		if cap(first.RawEvents[i]) != len(first.RawEvents[i]) {
+			t.Fatalf("event %v not capped to its length", i)
+		}
+	}
+	_ = append(first.RawEvents[0], "overwritten"...)
+	for i, raw := range first.RawEvents {
+		if expected := fmt.Sprintf(`{"message":"event %04d"}`, i); string(raw) != expected {
+			t.Fatalf("event %v: expected %s, got %s", i, expected, raw)
+		}
+	}
+}
+
+// BenchmarkReadLazyBatchGC reads large lazy batches, retaining recent batches
+// like a consumer queue, and reports the GC pause time per batch.
+func BenchmarkReadLazyBatchGC(b *testing.B) {
+	const events, retained = 5000, 64
+
+	var window bytes.Buffer
+	window.Write(windowFrame(events))
+	for i := 0; i < events; i++ {
+		event := fmt.Sprintf(`{"message":"event %v","fields":{"host":"localhost","seq":%v}}`, i, i)
+		window.Write(jsonFrame(uint32(i+1), event))
+	}
+
+	cfg := testReaderConfig
+	cfg.lazy = true
+	r := newReader(&loopConn{data: window.Bytes()}, cfg)
+	queue := make([]*lj.Batch, retained)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	b.SetBytes(int64(window.Len()))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		batch, err := r.ReadBatch()
+		if err != nil {
+			b.Fatal(err)
+		}
+		queue[i%retained] = batch
+	}
+	b.StopTimer()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.PauseTotalNs-before.PauseTotalNs)/float64(b.N), "gc-pause-ns/op")
+	b.ReportMetric(float64(after.NumGC-before.NumGC)/float64(b.N), "gcs/op")
+}
+
+func TestReadRawPayloads(t *testing.T) {
+	cfg := testReaderConfig
+	cfg.rawPayloads = true
+	cfg.validate = true
+
+	r := testReader(t, cfg, windowFrame(3),
+		jsonFrame(1, `{"a":1}`),
+		compressedFrame(jsonFrame(2, `not json`), jsonFrame(3, `"c"`)))
+	b, err := r.ReadBatch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Events != nil || b.Len() != 3 {
+		t.Fatalf("expected 3 raw events only, got %v events, %v raw", len(b.Events), len(b.RawEvents))
+	}
+	for i, expected := range []string{`{"a":1}`, `not json`, `"c"`} {
+		if string(b.RawEvents[i]) != expected {
+			t.Errorf("event %v: expected %s, got %s", i, expected, b.RawEvents[i])
+		}
+	}
+}
+
+func TestJSONDecoderValidation(t *testing.T) {
+	// schema aware decoder requiring events to have an id
+	decoder := func(b []byte, v interface{}) error {
+		var event map[string]interface{}
+		if err := json.Unmarshal(b, &event); err != nil {
+			return err
+		}
+		if _, ok := event["id"]; !ok {
+			return errors.New("missing id")
+		}
+		*(v.(*interface{})) = event
+		return nil
+	}
+
+	frames := [][]byte{windowFrame(2), jsonFrame(1, `{"id":1}`), jsonFrame(2, `{"name":"x"}`)}
+	for _, lazy := range []bool{false, true} {
+		r, err := NewReader(pipeConn(t, frames...),
+			JSONDecoder(decoder), LazyDecoding(lazy), ValidateJSON(true), LenientDecoding(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := r.ReadBatch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.Len() != 1 || b.Dropped != 1 {
+			t.Errorf("lazy=%v: expected event without id to be dropped, got %v events", lazy, b.Len())
+		}
+	}
+}
+
+// resizeCompressed returns compressed frame f declaring a payload size of
+// delta bytes more than its compressed data.
+func resizeCompressed(f []byte, delta int) []byte {
+	f = append([]byte(nil), f...)
+	sz := int(binary.BigEndian.Uint32(f[2:])) + delta
+	binary.BigEndian.PutUint32(f[2:], uint32(sz))
+	return f
+}
+
+func TestReadCompressedPayloadSize(t *testing.T) {
+	frame := compressedFrame(jsonFrame(1, `1`))
+	next := append(windowFrame(1), jsonFrame(1, `2`)...)
+
+	tests := []struct {
+		name    string
+		padding int
+		async   bool // payload is sent completely, can be inflated by the pool
+		frames  [][]byte
+		ok      bool
+	}{
+		{"over-declared", 0, false, [][]byte{windowFrame(1), resizeCompressed(frame, 4)}, false},
+		{"padding", 4, true, [][]byte{windowFrame(1), resizeCompressed(frame, 4), make([]byte, 4), next}, true},
+		{"padding exceeded", 4, true, [][]byte{windowFrame(1), resizeCompressed(frame, 5), make([]byte, 5), next}, false},
+		{"under-declared", 0, true, [][]byte{windowFrame(1), resizeCompressed(frame, -3), next}, false},
+	}
+	for _, test := range tests {
+		for _, workers := range []int{0, 1} {
+			if workers > 0 && !test.async {
+				continue
+			}
+
+			t.Run(fmt.Sprintf("%v/workers=%v", test.name, workers), func(t *testing.T) {
+				// the connection stays open, reads block on bytes never sent
+				server, client := net.Pipe()
+				t.Cleanup(func() { server.Close(); client.Close() })
+				go func() {
+					for _, f := range test.frames {
+						if _, err := client.Write(f); err != nil {
+							return
+						}
+					}
+				}()
+
+				cfg := testReaderConfig
+				cfg.timeout = time.Minute
+				cfg.compressedPadding = test.padding
+				cfg.inflater = newInflatePool(workers, 0)
+				r := newReader(server, cfg)
+
+				b, err := r.ReadBatch()
+				if !test.ok {
+					if !errors.Is(err, ErrProtocolError) {
+						t.Fatalf("expected ErrProtocolError, got %v", err)
+					}
+					return
+				}
+				if err != nil || len(b.Events) != 1 {
+					t.Fatalf("failed to read batch: %v", err)
+				}
+				if b, err = r.ReadBatch(); err != nil || len(b.Events) != 1 || b.Events[0] != 2.0 {
+					t.Fatalf("failed to read batch following padded frame: %v", err)
+				}
+			})
+		}
+	}
+}
+
+// kvFrame encodes a key-value data frame, declaring len(fields)/2 pairs.
+func kvFrame(seq uint32, fields ...string) []byte {
+	b := []byte{'2', 'D', 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[2:], seq)
+	binary.BigEndian.PutUint32(b[6:], uint32(len(fields)/2))
+	for _, f := range fields {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(f)))
+		b = append(b, f...)
+	}
+	return b
+}
+
+func TestReadKVFieldLimits(t *testing.T) {
+	cfg := testReaderConfig
+	cfg.maxFieldSize = 4
+	cfg.maxFieldPairs = 2
+
+	tests := []struct {
+		name  string
+		frame []byte
+		ok    bool
+	}{
+		{"within limits", kvFrame(1, "key", "val", "k2", "1234"), true},
+		{"key too large", kvFrame(1, "large", "val"), false},
+		{"value too large", kvFrame(1, "key", "large"), false},
+		{"too many pairs", kvFrame(1, "a", "1", "b", "2", "c", "3"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := testReader(t, cfg, windowFrame(1), test.frame)
+			b, err := r.ReadBatch()
+			if !test.ok {
+				if !errors.Is(err, ErrProtocolError) {
+					t.Fatalf("expected ErrProtocolError, got %v", err)
+				}
+				return
+			}
+			if err != nil || len(b.Events) != 1 {
+				t.Fatalf("failed to read batch: %v", err)
+			}
+		})
+	}
+}
+
+func TestReadMaxBatchBytes(t *testing.T) {
+	const payload = `"01234567"` // 10 bytes each, JSON and key-value events
+
+	tests := []struct {
+		name   string
+		limit  int
+		frames [][]byte
+		ok     bool
+	}{
+		{"at limit", 20, [][]byte{windowFrame(2), jsonFrame(1, payload), jsonFrame(2, payload)}, true},
+		{
+			// the window is truncated after the header of the event exceeding
+			// the limit, such that reading its payload fails
+			"mid window", 25,
+			[][]byte{windowFrame(4), jsonFrame(1, payload), jsonFrame(2, payload), jsonFrame(3, payload)[:10]},
+			false,
+		},
+		{"compressed", 25, [][]byte{windowFrame(3), compressedFrame(
+			jsonFrame(1, payload), jsonFrame(2, payload), jsonFrame(3, payload))}, false},
+		{"compressed frames", 50, [][]byte{windowFrame(6), // every frame within limit
+			compressedFrame(jsonFrame(1, payload), jsonFrame(2, payload)),
+			compressedFrame(jsonFrame(3, payload), jsonFrame(4, payload)),
+			compressedFrame(jsonFrame(5, payload), jsonFrame(6, payload))}, false},
+		{"key-value", 20, [][]byte{windowFrame(3), kvFrame(1, "key", "value"), kvFrame(2, "key", "value"),
+			kvFrame(3, "key", "value")}, false},
+	}
+	for _, test := range tests {
+		for _, workers := range []int{0, 2} {
+			t.Run(fmt.Sprintf("%v/workers=%v", test.name, workers), func(t *testing.T) {
+				cfg := testReaderConfig
+				cfg.maxBatchBytes = test.limit
+				cfg.inflater = newInflatePool(workers, 0)
+
+				b, err := testReader(t, cfg, test.frames...).ReadBatch()
+				if !test.ok {
+					if err != ErrBatchTooLarge {
+						t.Fatalf("expected ErrBatchTooLarge, got %v", err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if b.DecodedBytes != 20 {
+					t.Errorf("expected 20 decoded bytes, got %v", b.DecodedBytes)
+				}
+			})
+		}
+	}
+}
+
+func TestReadKVHostileLengths(t *testing.T) {
+	o, err := applyOptions(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := o.readerConfig()
+
+	// Frames declare lengths never sent. The connection is closed after the
+	// frames have been written, such that readers trusting the declared length
+	// fail with io.ErrUnexpectedEOF instead, after allocating the field.
+	rng := rand.New(rand.NewSource(1))
+	lengths := []uint32{math.MaxUint32, math.MaxInt32, 1<<20 + 1}
+	for i := 0; i < 20; i++ {
+		lengths = append(lengths, 1<<20+1+uint32(rng.Int63n(math.MaxUint32-1<<20-1)))
+	}
+
+	for _, n := range lengths {
+		key := kvFrame(1)
+		binary.BigEndian.PutUint32(key[6:], 1)
+		key = binary.BigEndian.AppendUint32(key, n)
+
+		value := kvFrame(1, "key", "")
+		binary.BigEndian.PutUint32(value[len(value)-4:], n)
+
+		pairs := kvFrame(1)
+		binary.BigEndian.PutUint32(pairs[6:], n)
+
+		for name, frame := range map[string][]byte{"key": key, "value": value, "pairs": pairs} {
+			r := testReader(t, cfg, windowFrame(1), frame)
+			if _, err := r.ReadBatch(); !errors.Is(err, ErrProtocolError) {
+				t.Errorf("%v length %v: expected ErrProtocolError, got %v", name, n, err)
+			}
+		}
+	}
+}
+
+// fuzzConn serves data as connection input, discarding writes.
+type fuzzConn struct {
+	net.Conn
+	in *bytes.Reader
+}
+
+func (c *fuzzConn) Read(p []byte) (int, error)       { return c.in.Read(p) }
+func (c *fuzzConn) Write(p []byte) (int, error)      { return len(p), nil }
+func (c *fuzzConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *fuzzConn) SetWriteDeadline(time.Time) error { return nil }
+func (c *fuzzConn) RemoteAddr() net.Addr             { return nil }
+
+// FuzzReadBatch reads batches from arbitrary input, with mode selecting reader
+// options. The seed corpus runs as part of go test. Run the fuzzer with:
+//
+//	go test -run '^$' -fuzz FuzzReadBatch -fuzztime 10m ./server/v2
+func FuzzReadBatch(f *testing.F) {
+	window := append(windowFrame(2), jsonFrame(1, `{"a":1}`)...)
+	window = append(window, jsonFrame(2, `"b"`)...)
+	compressed := append(windowFrame(2), compressedFrame(jsonFrame(1, `1`), kvFrame(2, "k", "v"))...)
+	stream := compressedFrame(window)[6:]
+	hostile := append(windowFrame(math.MaxUint32), jsonFrame(1, ``)...)
+	binary.BigEndian.PutUint32(hostile[len(hostile)-4:], math.MaxUint32)
+
+	seeds := [][]byte{
+		window,
+		compressed,
+		append(windowFrame(0), window...),
+		append(windowFrame(1), kvFrame(1, "line", "message", "host", "localhost")...),
+		append(windowFrame(1), compressedFrame(compressedFrame(jsonFrame(1, `[1,2]`)))...),
+		append(windowFrame(3), jsonFrame(1, `{"partial":`)...),
+		append([]byte{protocol.CodeVersion, protocol.CodeCompressStream, 0, 0, 0, 0}, stream...),
+		append(append([]byte(nil), window...), compressed...),
+		hostile,
+	}
+	for _, seed := range seeds {
+		for _, mode := range []byte{0, 0x01, 0x02, 0x0c, 0x10, 0x20, 0x40, 0x80} {
+			f.Add(mode, seed)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, mode byte, data []byte) {
+		depth := 1
+		if mode&0x80 != 0 {
+			depth = 2
+		}
+		workers := int(mode>>6) & 1
+		o, err := applyOptions([]Option{
+			LazyDecoding(mode&0x01 != 0),
+			RawPayloads(mode&0x02 != 0),
+			LenientDecoding(mode&0x04 != 0),
+			ValidateJSON(mode&0x08 != 0),
+			StreamCompression(mode&0x10 != 0),
+			PartialBatches(mode&0x20 != 0),
+			ParallelDecompression(workers, 0),
+			MaxCompressedDepth(depth),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+
+		// every batch consumes a window header at least, reading must fail
+		// once all input has been consumed
+		r := newReader(&fuzzConn{in: bytes.NewReader(data)}, o.readerConfig())
+		for steps := 0; ; steps++ {
+			if steps > len(data)/6 {
+				t.Fatalf("reader did not fail after %v batches", steps)
+			}
+
+			b, err := r.ReadBatch()
+			if err == ErrKeepAlive {
+				continue
+			}
+			if err != nil {
+				break
+			}
+			for i := range b.Events {
+				_, _ = b.Event(i)
+			}
+		}
+
+		// Allocations are bounded by the input size. Compressed frames allow
+		// for a high ratio of decoded to input bytes.
+		runtime.ReadMemStats(&after)
+		limit := uint64(64<<20 + 16<<10*len(data))
+		if alloc := after.TotalAlloc - before.TotalAlloc; alloc > limit {
+			t.Fatalf("reading %v bytes allocated %v bytes", len(data), alloc)
+		}
+	})
+}
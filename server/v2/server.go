@@ -18,10 +18,14 @@
 package v2
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"net"
+	"time"
 
 	"github.com/elastic/go-lumber/lj"
+	protocol "github.com/elastic/go-lumber/protocol/v2"
 	"github.com/elastic/go-lumber/server/internal"
 )
 
@@ -32,10 +36,51 @@ type Server struct {
 
 var (
 	// ErrProtocolError is returned if an protocol error was detected in the
-	// conversation with lumberjack server.
-	ErrProtocolError = errors.New("lumberjack protocol error")
+	// conversation with lumberjack server. The error is shared by all protocol
+	// versions.
+	ErrProtocolError = internal.ErrProtocolError
+
+	// ErrKeepAlive is returned when reading a batch if the client did send an
+	// empty window, keeping the connection alive. Keepalive windows are never
+	// forwarded to consumers.
+	ErrKeepAlive = internal.ErrKeepAlive
+
+	// ErrWriteTimeout is returned if writing an ACK to the client did not
+	// complete within the configured write timeout. The connection is closed.
+	ErrWriteTimeout = internal.ErrWriteTimeout
+
+	// ErrNoClientCert is returned if RequireClientCert is set and a client did
+	// not present a verified certificate.
+	ErrNoClientCert = internal.ErrNoClientCert
+
+	// ErrBatchTooLarge is returned when reading a batch whose event payloads
+	// exceed the size configured by MaxBatchBytes. The connection is closed.
+	// The error is shared by all protocol versions.
+	ErrBatchTooLarge = internal.ErrBatchTooLarge
+
+	// ErrInvalidJSON is returned if JSON validation is enabled and an event
+	// payload is no valid JSON document.
+	ErrInvalidJSON = errors.New("invalid JSON event")
 )
 
+// ProtocolError describes a protocol violation of a client, returned when
+// reading a batch. It carries the offending frame code, the offset in the
+// window and the client address. ProtocolError wraps ErrProtocolError, such
+// that errors.Is(err, ErrProtocolError) holds for all protocol errors. Use
+// errors.As to access the details.
+type ProtocolError = internal.ProtocolError
+
+// PartialBatchError is returned by Reader.ReadBatch with PartialBatches
+// enabled, if the connection failed after some events of a window have been
+// read. Batch holds the events read so far.
+type PartialBatchError = internal.PartialBatchError
+
+// InvalidBatchError is returned by Reader.ReadBatch if an event failed the
+// validation installed by EventValidator. Index is the index of the failing
+// event in the window. With DropInvalidBatches set, the complete window of
+// Window events has been read, and reading can continue with the next window.
+type InvalidBatchError = internal.InvalidBatchError
+
 // NewWithListener creates a new Server using an existing net.Listener.
 func NewWithListener(l net.Listener, opts ...Option) (*Server, error) {
 	return newServer(opts, func(cfg internal.Config) (*internal.Server, error) {
@@ -75,33 +120,149 @@ func (s *Server) Receive() *lj.Batch {
 	return s.s.Receive()
 }
 
+// Stats returns a snapshot of the server statistics. Stats is cheap and safe
+// to call while serving clients.
+func (s *Server) Stats() lj.Stats {
+	return s.s.Stats()
+}
+
 // Close stops the listener, closes all active connections and closes the
-// receiver channel returned from ReceiveChan().
+// receiver channel returned from ReceiveChan(). Connections are given 5
+// seconds to drain, see CloseWithTimeout.
 func (s *Server) Close() error {
 	return s.s.Close()
 }
 
+// CloseWithTimeout stops the listener and waits up to d for active connections
+// to drain, before closing the remaining connections forcibly and closing the
+// receiver channel returned from ReceiveChan(). Draining connections stop
+// reading new batches, but keep ACKing batches already received, such that
+// batches must still be consumed. Connections are closed right away if d is 0.
+// Repeated and concurrent calls are safe and return the result of the first
+// call.
+func (s *Server) CloseWithTimeout(d time.Duration) (lj.CloseResult, error) {
+	return s.s.CloseWithTimeout(d)
+}
+
+// HandleConn serves a single, already established connection, e.g. a socket
+// inherited from inetd or a sidecar. The connection is read using the same
+// handler a Server would use, and received batches are forwarded to the
+// returned channel. The channel is closed once the connection has been closed.
+// Cancelling ctx stops the handler and closes conn.
+//
+// Options configuring the listener or batch channel (TLS, IPStack,
+// AllowedCIDRs, DeniedCIDRs, Channel, PerConnectionChannels,
+// FullChannelPolicy, SNIRouter) are ignored. Pass a *tls.Conn to serve TLS
+// clients; the client certificate is still reported via Batch.ClientX509Cert.
+func HandleConn(ctx context.Context, conn net.Conn, opts ...Option) (<-chan *lj.Batch, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	return internal.ServeConn(ctx, conn, cfg)
+}
+
 func newServer(
 	opts []Option,
 	mk func(cfg internal.Config) (*internal.Server, error),
 ) (*Server, error) {
-	o, err := applyOptions(opts)
+	cfg, err := newConfig(opts)
 	if err != nil {
 		return nil, err
 	}
 
+	s, err := mk(cfg)
+	return &Server{s}, err
+}
+
+func newConfig(opts []Option) (internal.Config, error) {
+	o, err := applyOptions(opts)
+	if err != nil {
+		return internal.Config{}, err
+	}
+
+	readers := newReaderPool(o.readerConfig())
 	mkRW := func(client net.Conn) (internal.BatchReader, internal.ACKWriter, error) {
-		r := newReader(client, o.timeout, o.decoder)
-		w := newWriter(client, o.timeout)
+		r := readers.get(client)
+		wto := o.timeout
+		if o.writeTimeout > 0 {
+			wto = o.writeTimeout
+		}
+		w := internal.NewFrameWriter(client, protocol.CodeVersion, true, wto, o.ackCoalesce > 0)
+		if o.onACK != nil {
+			addr := client.RemoteAddr()
+			w.OnACK = func(seq uint32, events int) { o.onACK(addr, seq, events) }
+		}
 		return r, w, nil
 	}
 
+	stats := internal.NewStats()
+	handler := internal.DefaultHandler(internal.HandlerConfig{
+		Keepalive:       o.keepalive,
+		ACKLatency:      o.ackLatency,
+		ConflictPolicy:  o.conflictPolicy,
+		ResendRequested: o.resendRequested,
+		Trace:           o.trace,
+		Middleware:      o.middleware,
+		RateLimiter:     o.rateLimiter,
+		EventLimiter:    o.eventLimiter,
+		ACKCoalesce:     o.ackCoalesce,
+		ACKEvery:        o.ackEvery,
+		ConnListener:    o.connListener,
+		Stats:           stats,
+		Resends:         internal.NewResendTracker(),
+
+		HandshakeTimeout:  o.timeout,
+		RequireClientCert: o.requireClientCert,
+		TLSState:          o.tlsState,
+	}, mkRW)
+
 	cfg := internal.Config{
-		TLS:     o.tls,
-		Handler: internal.DefaultHandler(o.keepalive, mkRW),
-		Channel: o.ch,
+		TLS:       o.tls,
+		Handler:   handler,
+		Channel:   o.ch,
+		IPStack:   o.ipStack,
+		Backlog:   o.backlog,
+		IPFilter:  o.ipFilter,
+		GCPercent: o.gcPercent,
+
+		FullChannelPolicy: o.fullChannelPolicy,
+		Backpressure:      o.backpressure,
+		PerConnection:     o.perConnection,
+		Router:            o.tlsSettings.Router,
+		AcceptError:       o.acceptError,
+		Stats:             stats,
 	}
+	return cfg, nil
+}
 
-	s, err := mk(cfg)
-	return &Server{s}, err
+func (o options) readerConfig() readerConfig {
+	custom := o.decoder != nil
+	if !custom {
+		o.decoder = json.Unmarshal
+	}
+	return readerConfig{
+		timeout:             o.timeout,
+		idleTimeout:         o.idleTimeout,
+		decoder:             o.decoder,
+		decodeValidate:      custom,
+		maxCompressedDepth:  o.maxCompressedDepth,
+		maxCompressedEvents: o.maxCompressedEvents,
+		compressedPadding:   o.compressedPadding,
+		maxFieldSize:        o.maxFieldSize,
+		maxFieldPairs:       o.maxFieldPairs,
+		maxBatchBytes:       o.maxBatchBytes,
+		lazy:                o.lazy,
+		rawPayloads:         o.rawPayloads,
+		lenient:             o.lenient,
+		validate:            o.validate,
+		validator:           o.validator,
+		dropInvalid:         o.dropInvalid,
+		streamCompression:   o.streamCompression,
+		partialBatches:      o.partialBatches,
+		sequences:           o.sequences,
+		clock:               o.clock,
+		frameHandlers:       o.frameHandlers,
+		inflater:            newInflatePool(o.inflateWorkers, o.inflateMinSize),
+	}
 }
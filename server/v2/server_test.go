@@ -0,0 +1,1668 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v2
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	client "github.com/elastic/go-lumber/client/v2"
+	"github.com/elastic/go-lumber/lj"
+	protocol "github.com/elastic/go-lumber/protocol/v2"
+)
+
+// countingListener counts write calls and bytes read on accepted connections.
+type countingListener struct {
+	net.Listener
+	writes       int32
+	readBytes    int64
+	writtenBytes int64
+}
+
+type countingConn struct {
+	net.Conn
+	l *countingListener
+}
+
+func (c countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.l.readBytes, int64(n))
+	return n, err
+}
+
+func (c countingConn) Write(b []byte) (int, error) {
+	atomic.AddInt32(&c.l.writes, 1)
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.l.writtenBytes, int64(n))
+	return n, err
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return countingConn{c, l}, nil
+}
+
+// pipeListener serves in-memory connections. Writes to the connections block
+// until the peer reads.
+type pipeListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func (l *pipeListener) Dial() net.Conn {
+	server, client := net.Pipe()
+	l.conns <- server
+	return client
+}
+
+func startServer(t *testing.T, opts ...Option) (*Server, string) {
+	s, l := startCountingServer(t, opts...)
+	return s, l.Addr().String()
+}
+
+func startCountingServer(t *testing.T, opts ...Option) (*Server, *countingListener) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cl := &countingListener{Listener: l}
+	s, err := NewWithListener(cl, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, cl
+}
+
+// sendACKBurst pipelines single event batches, returning the number of ACK
+// frames written by the server.
+func sendACKBurst(t *testing.T, opts ...Option) int64 {
+	const batches = 50
+
+	opts = append(opts, Channel(make(chan *lj.Batch, batches)))
+	s, l := startCountingServer(t, opts...)
+
+	c, err := client.AsyncDial(l.Addr().String(), batches,
+		client.Timeout(5*time.Second), client.CumulativeACK(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(batches)
+	for i := 0; i < batches; i++ {
+		err := c.Send(func(seq uint32, err error) {
+			defer wg.Done()
+			if err != nil || seq != 1 {
+				t.Errorf("unexpected ACK: seq=%v, err=%v", seq, err)
+			}
+		}, []interface{}{i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < batches; i++ {
+		s.Receive().ACK()
+	}
+	wg.Wait()
+	return atomic.LoadInt64(&l.writtenBytes) / 6
+}
+
+func TestACKCoalesce(t *testing.T) {
+	plain := sendACKBurst(t)
+	coalesced := sendACKBurst(t, ACKCoalesce(50*time.Millisecond))
+	t.Logf("ACK frames: plain=%v, coalesced=%v", plain, coalesced)
+
+	if plain != 50 {
+		t.Errorf("expected one ACK frame per batch, got %v", plain)
+	}
+	if coalesced >= plain {
+		t.Errorf("expected less ACK frames with coalescing (%v >= %v)", coalesced, plain)
+	}
+}
+
+func TestACKCoalesceSyncClient(t *testing.T) {
+	// sync clients wait for the ACK, so it must not be delayed by the interval
+	s, addr := startServer(t, ACKCoalesce(time.Minute))
+	go func() {
+		for b := range s.ReceiveChan() {
+			b.ACK()
+		}
+	}()
+
+	c, err := client.SyncDial(addr, client.Timeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if n, err := c.Send([]interface{}{i}); err != nil || n != 1 {
+			t.Fatalf("send failed: n=%v, err=%v", n, err)
+		}
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("ACKs delayed by %v", d)
+	}
+}
+
+func TestACKEvery(t *testing.T) {
+	s, addr := startServer(t, ACKEvery(3))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sendWindow := func(events int) {
+		var buf bytes.Buffer
+		var enc protocol.Encoder
+		enc.WriteWindow(&buf, uint32(events))
+		for i := 1; i <= events; i++ {
+			enc.WriteJSONEvent(&buf, uint32(i), []byte(`1`))
+		}
+		if _, err := conn.Write(buf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readACK := func() uint32 {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var ack [6]byte
+		if _, err := io.ReadFull(conn, ack[:]); err != nil {
+			t.Fatal(err)
+		}
+		if ack[1] != protocol.CodeACK {
+			t.Fatalf("unexpected ACK %v", ack)
+		}
+		return binary.BigEndian.Uint32(ack[2:])
+	}
+
+	// ACKs of pipelined windows are merged
+	for i := 0; i < 3; i++ {
+		sendWindow(2)
+	}
+	for i := 0; i < 3; i++ {
+		b := s.Receive()
+		time.Sleep(20 * time.Millisecond) // let the next window queue up for ACK
+		b.ACK()
+	}
+	if seq := readACK(); seq != 6 {
+		t.Errorf("expected merged ACK of 6 events, got %v", seq)
+	}
+
+	// merged ACK is written early if no more batches are waiting
+	sendWindow(1)
+	s.Receive().ACK()
+	if seq := readACK(); seq != 1 {
+		t.Errorf("expected ACK of 1 event, got %v", seq)
+	}
+}
+
+func TestACKEveryCumulativeClient(t *testing.T) {
+	const batches = 50
+
+	s, l := startCountingServer(t, ACKEvery(10), Channel(make(chan *lj.Batch, batches)))
+	c, err := client.AsyncDial(l.Addr().String(), batches,
+		client.Timeout(5*time.Second), client.CumulativeACK(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(batches)
+	for i := 0; i < batches; i++ {
+		err := c.Send(func(seq uint32, err error) {
+			defer wg.Done()
+			if err != nil || seq != 2 {
+				t.Errorf("unexpected ACK: seq=%v, err=%v", seq, err)
+			}
+		}, []interface{}{i, i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < batches; i++ {
+		s.Receive().ACK()
+	}
+	wg.Wait()
+	if writes := atomic.LoadInt32(&l.writes); writes >= batches {
+		t.Errorf("expected less ACK writes than batches, got %v", writes)
+	}
+}
+
+func TestRequestResendClientResends(t *testing.T) {
+	var resends int32
+	s, addr := startServer(t, ResendRequested(func(_ net.Addr, events int) {
+		if events != 2 {
+			t.Errorf("expected 2 events in resend request, got %v", events)
+		}
+		atomic.AddInt32(&resends, 1)
+	}))
+
+	received := make(chan []interface{}, 2)
+	go func() {
+		first := true
+		for b := range s.ReceiveChan() {
+			received <- b.Events
+			if first {
+				first = false
+				b.RequestResend()
+			} else {
+				b.ACK()
+			}
+		}
+	}()
+
+	c, err := client.PoolDial([]string{addr},
+		client.PoolBackoff(time.Millisecond, 10*time.Millisecond),
+		client.PoolClientOptions(client.Timeout(5*time.Second)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	n, err := c.Send([]interface{}{"a", "b"})
+	if err != nil || n != 2 {
+		t.Fatalf("send failed: n=%v, err=%v", n, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		events := <-received
+		if len(events) != 2 || events[0] != "a" || events[1] != "b" {
+			t.Errorf("unexpected events in batch %v: %v", i, events)
+		}
+	}
+	if n := atomic.LoadInt32(&resends); n != 1 {
+		t.Errorf("expected 1 resend request, got %v", n)
+	}
+}
+
+// BenchmarkGCPercent publishes bursts of batches, reporting the number of GC
+// cycles and GC pause time per burst with and without GCPercent.
+func BenchmarkGCPercent(b *testing.B) {
+	batch := make([]interface{}, 1024)
+	for i := range batch {
+		batch[i] = map[string]interface{}{
+			"message": fmt.Sprintf("event %v", i),
+			"fields":  map[string]interface{}{"host": "localhost", "seq": i},
+		}
+	}
+
+	for _, p := range []int{0, 400} {
+		b.Run(fmt.Sprintf("gc=%v", p), func(b *testing.B) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			s, err := NewWithListener(l, GCPercent(p))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer s.Close()
+			go func() {
+				for b := range s.ReceiveChan() {
+					b.ACK()
+				}
+			}()
+
+			c, err := client.SyncDial(l.Addr().String())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer c.Close()
+
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				for burst := 0; burst < 10; burst++ {
+					if _, err := c.Send(batch); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+
+			b.StopTimer()
+			runtime.ReadMemStats(&after)
+			b.ReportMetric(float64(after.NumGC-before.NumGC)/float64(b.N), "gcs/op")
+			b.ReportMetric(float64(after.PauseTotalNs-before.PauseTotalNs)/float64(b.N), "gc-pause-ns/op")
+		})
+	}
+}
+
+func TestACKLatencySlowReader(t *testing.T) {
+	const delay = 100 * time.Millisecond
+
+	latencies := make(chan time.Duration, 1)
+	l := newPipeListener()
+	s, err := NewWithListener(l, ACKLatency(func(_ net.Addr, d time.Duration) {
+		latencies <- d
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go func() {
+		for b := range s.ReceiveChan() {
+			b.ACK()
+		}
+	}()
+
+	conn := l.Dial()
+	defer conn.Close()
+
+	var enc protocol.Encoder
+	if err := enc.WriteWindow(conn, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.WriteJSONEvent(conn, 1, []byte(`{"message":"hello"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	// ACK write blocks until the client reads
+	time.Sleep(delay)
+	var ack [6]byte
+	if _, err := io.ReadFull(conn, ack[:]); err != nil {
+		t.Fatal(err)
+	}
+	if ack[1] != protocol.CodeACK || binary.BigEndian.Uint32(ack[2:]) != 1 {
+		t.Fatalf("unexpected ACK: %v", ack)
+	}
+
+	if d := <-latencies; d < delay/2 {
+		t.Errorf("ACK latency %v does not reflect client read delay of %v", d, delay)
+	}
+}
+
+// sendSmallWindows publishes many small windows, returning the number of
+// bytes read by the server and the batches received.
+func sendSmallWindows(t *testing.T, serverOpts []Option, clientOpts ...client.Option) (int64, []*lj.Batch) {
+	const windows = 200
+
+	s, l := startCountingServer(t, serverOpts...)
+	received := make(chan *lj.Batch, windows)
+	go func() {
+		for b := range s.ReceiveChan() {
+			b.ACK()
+			received <- b
+		}
+	}()
+
+	clientOpts = append(clientOpts, client.Timeout(5*time.Second))
+	c, err := client.SyncDial(l.Addr().String(), clientOpts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var batches []*lj.Batch
+	for i := 0; i < windows; i++ {
+		events := make([]interface{}, 5)
+		for j := range events {
+			events[j] = map[string]interface{}{
+				"message": fmt.Sprintf("GET /index.html HTTP/1.1 200 %v-%v", i, j),
+				"host":    "web-01.example.com",
+				"service": "frontend",
+			}
+		}
+		if _, err := c.Send(events); err != nil {
+			t.Fatal(err)
+		}
+
+		b := <-received
+		for j, event := range b.Events {
+			msg := event.(map[string]interface{})["message"]
+			if msg != events[j].(map[string]interface{})["message"] {
+				t.Fatalf("unexpected event %v in window %v: %v", j, i, event)
+			}
+		}
+		batches = append(batches, b)
+	}
+	return atomic.LoadInt64(&l.readBytes), batches
+}
+
+func TestStreamCompressionRoundTrip(t *testing.T) {
+	plain, _ := sendSmallWindows(t, nil)
+	framed, _ := sendSmallWindows(t, nil, client.CompressionLevel(6))
+	streamed, _ := sendSmallWindows(t, []Option{StreamCompression(true)},
+		client.StreamCompression(6))
+	t.Logf("bytes read: plain=%v, compressed frames=%v, stream=%v", plain, framed, streamed)
+
+	if streamed*2 > plain {
+		t.Errorf("expected stream compression to at least halve the bytes read (%v vs %v)", streamed, plain)
+	}
+	if streamed >= framed {
+		t.Errorf("expected stream compression to beat per frame compression (%v >= %v)", streamed, framed)
+	}
+}
+
+func TestStreamCompressionDisabled(t *testing.T) {
+	_, addr := startServer(t)
+	_, err := client.SyncDial(addr, client.Timeout(5*time.Second), client.StreamCompression(6))
+	if err == nil {
+		t.Error("expected stream compression negotiation to fail")
+	}
+}
+
+func TestStreamCompressionWireBytes(t *testing.T) {
+	wireBytes := func(batches []*lj.Batch) (n int64) {
+		for _, b := range batches {
+			n += int64(b.WireBytes)
+		}
+		return n
+	}
+
+	read, batches := sendSmallWindows(t, nil)
+	if wire := wireBytes(batches); wire != read {
+		t.Errorf("expected WireBytes to match bytes read (%v != %v)", wire, read)
+	}
+
+	read, batches = sendSmallWindows(t, []Option{StreamCompression(true)},
+		client.StreamCompression(6))
+	wire := wireBytes(batches)
+	t.Logf("stream compression: read=%v, wire=%v", read, wire)
+
+	// bytes read include the negotiation and zlib header
+	if wire > read || wire < read-16 {
+		t.Errorf("expected WireBytes to count compressed bytes (read=%v, wire=%v)", read, wire)
+	}
+}
+
+func TestStats(t *testing.T) {
+	s, addr := startServer(t)
+
+	c, err := client.SyncDial(addr, client.Timeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for b := range s.ReceiveChan() {
+			b.ACK()
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		if _, err := c.Send([]interface{}{"a", "b", "c"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := s.Stats()
+	if stats.ActiveConnections != 1 || stats.Connections != 1 {
+		t.Errorf("unexpected connections: %+v", stats)
+	}
+	if stats.Batches != 2 || stats.Events != 6 || stats.Bytes == 0 {
+		t.Errorf("unexpected batch counters: %+v", stats)
+	}
+
+	// clean disconnect between batches is no read error
+	c.Close()
+
+	// invalid frame
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte{'2', 'X', 0, 0, 0, 0})
+	defer conn.Close()
+
+	waitFor(t, func() bool {
+		stats = s.Stats()
+		return stats.ActiveConnections == 0 && stats.Connections == 2
+	})
+	if stats.ReadErrors != 1 {
+		t.Errorf("expected 1 read error, got %+v", stats)
+	}
+	if stats.Uptime <= 0 {
+		t.Errorf("expected positive uptime, got %v", stats.Uptime)
+	}
+}
+
+// waitFor polls cond until it returns true, failing the test after a timeout.
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHalfCloseACK(t *testing.T) {
+	s, addr := startServer(t)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var buf bytes.Buffer
+	var enc protocol.Encoder
+	enc.WriteWindow(&buf, 1)
+	enc.WriteJSONEvent(&buf, 1, []byte(`"last"`))
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	// ACK after the server did read EOF
+	b := s.Receive()
+	time.Sleep(20 * time.Millisecond)
+	b.ACK()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var ack [6]byte
+	if _, err := io.ReadFull(conn, ack[:]); err != nil {
+		t.Fatalf("expected ACK after half-close: %v", err)
+	}
+	if ack[1] != protocol.CodeACK || binary.BigEndian.Uint32(ack[2:]) != 1 {
+		t.Errorf("unexpected ACK %v", ack)
+	}
+
+	// server closes the connection after the last ACK
+	if _, err := conn.Read(ack[:]); err != io.EOF {
+		t.Errorf("expected connection to be closed, got %v", err)
+	}
+}
+
+func TestKeyValueFrames(t *testing.T) {
+	events := []interface{}{
+		map[string]string{"message": "hello", "host": "web-01"},
+		map[string]string{},
+		map[string]string{"line": "2", "empty": ""},
+	}
+	expected := []interface{}{
+		map[string]interface{}{"message": "hello", "host": "web-01"},
+		map[string]interface{}{},
+		map[string]interface{}{"line": "2", "empty": ""},
+	}
+
+	tests := []struct {
+		name    string
+		server  []Option
+		clients []client.Option
+	}{
+		{"plain", nil, nil},
+		{"compressed", nil, []client.Option{client.CompressionLevel(3)}},
+		{"lazy", []Option{LazyDecoding(true)}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, addr := startServer(t, test.server...)
+			opts := append([]client.Option{
+				client.Timeout(5 * time.Second),
+				client.DataFrameEncoding(client.KeyValue),
+			}, test.clients...)
+			c, err := client.SyncDial(addr, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			received := make(chan []interface{}, 1)
+			go func() {
+				b := s.Receive()
+				var got []interface{}
+				for i := 0; i < b.Len(); i++ {
+					evt, err := b.Event(i)
+					if err != nil {
+						t.Error(err)
+					}
+					got = append(got, evt)
+				}
+				b.ACK()
+				received <- got
+			}()
+
+			if n, err := c.Send(events); err != nil || n != len(events) {
+				t.Fatalf("send failed: n=%v, err=%v", n, err)
+			}
+			if got := <-received; !reflect.DeepEqual(got, expected) {
+				t.Errorf("expected events %v, got %v", expected, got)
+			}
+		})
+	}
+}
+
+func TestMaxInFlightEvents(t *testing.T) {
+	s, addr := startServer(t, MaxInFlightEvents(3), Channel(make(chan *lj.Batch, 10)))
+
+	dial := func(events int) net.Conn {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+
+		var buf bytes.Buffer
+		var enc protocol.Encoder
+		enc.WriteWindow(&buf, uint32(events))
+		for i := 1; i <= events; i++ {
+			enc.WriteJSONEvent(&buf, uint32(i), []byte(`1`))
+		}
+		if _, err := conn.Write(buf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	receive := func() *lj.Batch {
+		select {
+		case b := <-s.ReceiveChan():
+			return b
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for batch")
+			return nil
+		}
+	}
+	expectBlocked := func() {
+		select {
+		case b := <-s.ReceiveChan():
+			t.Fatalf("expected in-flight limit to block batch of %v events", b.Len())
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	dial(2)
+	first := receive()
+	conn := dial(2)
+	expectBlocked()
+
+	first.ACK()
+	second := receive()
+	if second.Len() != 2 {
+		t.Fatalf("unexpected batch of %v events", second.Len())
+	}
+
+	// events of batches not ACKed are released when the connection fails
+	dial(3)
+	expectBlocked()
+	if _, err := conn.Write([]byte("2X\x00\x00\x00\x00")); err != nil { // invalid frame
+		t.Fatal(err)
+	}
+	b := receive()
+	if b.Len() != 3 {
+		t.Fatalf("unexpected batch of %v events", b.Len())
+	}
+	b.ACK()
+}
+
+func TestConnCounters(t *testing.T) {
+	s, addr := startServer(t)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var sent uint64
+	send := func(event string) *lj.Batch {
+		var buf bytes.Buffer
+		var enc protocol.Encoder
+		enc.WriteWindow(&buf, 1)
+		enc.WriteJSONEvent(&buf, 1, []byte(event))
+		if _, err := conn.Write(buf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		sent += uint64(buf.Len())
+
+		b := s.Receive()
+		b.ACK()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var ack [6]byte
+		if _, err := io.ReadFull(conn, ack[:]); err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	first := send(`"first"`)
+	if n := first.Conn.BytesRead(); n != sent {
+		t.Errorf("expected %v bytes read, got %v", sent, n)
+	}
+	second := send(`{"message":"second"}`)
+	if second.Conn != first.Conn {
+		t.Fatal("expected batches of a connection to share counters")
+	}
+	if n := second.Conn.BytesRead(); n != sent {
+		t.Errorf("expected %v bytes read, got %v", sent, n)
+	}
+	if n := second.Conn.BytesWritten(); n != 12 {
+		t.Errorf("expected 2 ACKs of 6 bytes written, got %v bytes", n)
+	}
+}
+
+func TestConnectionListener(t *testing.T) {
+	events := make(chan lj.ConnEvent, 10)
+	s, addr := startServer(t, ConnectionListener(func(evt lj.ConnEvent) {
+		events <- evt
+	}))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var buf bytes.Buffer
+	var enc protocol.Encoder
+	enc.WriteWindow(&buf, 2)
+	enc.WriteJSONEvent(&buf, 1, []byte(`1`))
+	enc.WriteJSONEvent(&buf, 2, []byte(`2`))
+	enc.WriteWindow(&buf, 2)
+	buf.WriteString("2X") // invalid frame
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	s.Receive().ACK()
+
+	next := func(kind lj.ConnEventKind) lj.ConnEvent {
+		select {
+		case evt := <-events:
+			if evt.Kind != kind {
+				t.Fatalf("expected %v event, got %v", kind, evt.Kind)
+			}
+			if evt.RemoteAddr.String() != conn.LocalAddr().String() {
+				t.Errorf("unexpected remote address %v", evt.RemoteAddr)
+			}
+			return evt
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %v event", kind)
+			return lj.ConnEvent{}
+		}
+	}
+
+	if evt := next(lj.ConnAccepted); evt.TLS != nil {
+		t.Errorf("unexpected TLS state for plain connection")
+	}
+	if evt := next(lj.ConnFirstWindow); evt.Events != 2 {
+		t.Errorf("expected first window of 2 events, got %v", evt.Events)
+	}
+	if evt := next(lj.ConnReadError); !errors.Is(evt.Err, ErrProtocolError) {
+		t.Errorf("expected protocol error, got %v", evt.Err)
+	}
+	if evt := next(lj.ConnClosed); !errors.Is(evt.Err, ErrProtocolError) || evt.Duration <= 0 {
+		t.Errorf("unexpected close event: err=%v, duration=%v", evt.Err, evt.Duration)
+	}
+}
+
+func TestTruncatedBatchClosesConnection(t *testing.T) {
+	s, addr := startServer(t)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var buf bytes.Buffer
+	var enc protocol.Encoder
+	enc.WriteWindow(&buf, 2)
+	enc.WriteJSONEvent(&buf, 1, []byte(`1`))
+	conn.Write(buf.Bytes())
+	conn.(*net.TCPConn).CloseWrite()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var tmp [6]byte
+	if _, err := conn.Read(tmp[:]); err != io.EOF {
+		t.Errorf("expected connection to be closed, got %v", err)
+	}
+	waitFor(t, func() bool { return s.Stats().ReadErrors == 1 })
+}
+
+func TestRawPayloadsACK(t *testing.T) {
+	s, addr := startServer(t, RawPayloads(true))
+
+	c, err := client.SyncDial(addr, client.Timeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	go func() {
+		b := s.Receive()
+		if string(b.RawEvents[1]) != `{"b":2}` {
+			t.Errorf("unexpected raw event %s", b.RawEvents[1])
+		}
+		b.ACK()
+	}()
+	n, err := c.Send([]interface{}{map[string]int{"a": 1}, map[string]int{"b": 2}})
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 events to be ACKed, got %v: %v", n, err)
+	}
+}
+
+func TestPartialBatches(t *testing.T) {
+	s, addr := startServer(t, PartialBatches(true), Timeout(100*time.Millisecond))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// client stalls after 2 of 3 events
+	var buf bytes.Buffer
+	var enc protocol.Encoder
+	enc.WriteWindow(&buf, 3)
+	enc.WriteJSONEvent(&buf, 1, []byte(`1`))
+	enc.WriteJSONEvent(&buf, 2, []byte(`2`))
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	b := s.Receive()
+	if !b.Partial || b.Len() != 2 {
+		t.Fatalf("expected partial batch of 2 events, got %v events (partial=%v)", b.Len(), b.Partial)
+	}
+	b.ACK()
+
+	// connection is closed without ACK
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 6)); err != io.EOF {
+		t.Errorf("expected connection to be closed without ACK, got %v bytes: %v", n, err)
+	}
+	waitFor(t, func() bool { return s.Stats().PartialBatches == 1 })
+}
+
+func TestDroppedEventsStats(t *testing.T) {
+	s, addr := startServer(t, LenientDecoding(true))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var buf bytes.Buffer
+	var enc protocol.Encoder
+	enc.WriteWindow(&buf, 2)
+	enc.WriteJSONEvent(&buf, 1, []byte(`1`))
+	enc.WriteJSONEvent(&buf, 2, []byte(`{`))
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	b := s.Receive()
+	if b.Len() != 1 || b.Dropped != 1 {
+		t.Fatalf("expected batch of 1 event with 1 event dropped, got %v (dropped %v)", b.Len(), b.Dropped)
+	}
+	b.ACK()
+	if st := s.Stats(); st.DroppedEvents != 1 || st.Events != 1 {
+		t.Errorf("expected 1 event and 1 dropped event, got %+v", st)
+	}
+}
+
+func TestDeniedCIDRs(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	s, addr := startServer(t, DeniedCIDRs([]net.IPNet{*loopback}))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected connection to be closed, got %v", err)
+	}
+	if stats := s.Stats(); stats.Rejected != 1 || stats.Connections != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestHandleConn(t *testing.T) {
+	server, conn := net.Pipe()
+	defer conn.Close()
+
+	batches, err := HandleConn(context.Background(), server, Timeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := client.NewSyncClientWithConn(conn, client.Timeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for b := range batches {
+			b.ACK()
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		n, err := c.Send([]interface{}{i, i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 2 {
+			t.Fatalf("expected 2 events to be ACKed, got %v", n)
+		}
+	}
+}
+
+func TestHandleConnClosed(t *testing.T) {
+	server, conn := net.Pipe()
+
+	batches, err := HandleConn(context.Background(), server, Timeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.Close()
+	select {
+	case b, ok := <-batches:
+		if ok {
+			t.Fatalf("unexpected batch: %v", b)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("batch channel not closed after connection was closed")
+	}
+}
+
+func TestHandleConnCancel(t *testing.T) {
+	server, conn := net.Pipe()
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	batches, err := HandleConn(ctx, server, Timeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// batch is never consumed, cancel must unblock the handler
+	var enc protocol.Encoder
+	go func() {
+		enc.WriteWindow(conn, 1)
+		enc.WriteJSONEvent(conn, 1, []byte(`{}`))
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-batches:
+			if !ok {
+				conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				if _, err := conn.Read(make([]byte, 6)); err != io.EOF {
+					t.Errorf("expected connection to be closed, got %v", err)
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatal("batch channel not closed after cancel")
+		}
+	}
+}
+
+func TestCloseWithTimeoutDrains(t *testing.T) {
+	s, addr := startServer(t)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var buf bytes.Buffer
+	var enc protocol.Encoder
+	enc.WriteWindow(&buf, 1)
+	enc.WriteJSONEvent(&buf, 1, []byte(`"event"`))
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	b := s.Receive()
+
+	type closeResult struct {
+		res lj.CloseResult
+		err error
+	}
+	closed := make(chan closeResult, 1)
+	go func() {
+		res, err := s.CloseWithTimeout(5 * time.Second)
+		closed <- closeResult{res, err}
+	}()
+
+	select {
+	case <-closed:
+		t.Fatal("expected CloseWithTimeout to wait for the batch to be ACKed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	b.ACK()
+
+	// ACK is written before the connection is closed
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var ack [6]byte
+	if _, err := io.ReadFull(conn, ack[:]); err != nil {
+		t.Fatalf("expected ACK before close: %v", err)
+	}
+	if ack[1] != protocol.CodeACK || binary.BigEndian.Uint32(ack[2:]) != 1 {
+		t.Errorf("unexpected ACK %v", ack)
+	}
+	if _, err := conn.Read(ack[:]); err != io.EOF {
+		t.Errorf("expected connection to be closed, got %v", err)
+	}
+
+	select {
+	case c := <-closed:
+		if c.err != nil || c.res != (lj.CloseResult{}) {
+			t.Errorf("unexpected close result %+v: %v", c.res, c.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for CloseWithTimeout")
+	}
+}
+
+func TestCloseWithTimeoutIdle(t *testing.T) {
+	s, addr := startServer(t)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	waitFor(t, func() bool { return s.Stats().ActiveConnections == 1 })
+
+	start := time.Now()
+	res, err := s.CloseWithTimeout(5 * time.Second)
+	if err != nil || res != (lj.CloseResult{}) {
+		t.Errorf("unexpected close result %+v: %v", res, err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("expected idle connection to be closed right away, took %v", d)
+	}
+}
+
+func TestCloseWithTimeoutForced(t *testing.T) {
+	s, addr := startServer(t)
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		var buf bytes.Buffer
+		var enc protocol.Encoder
+		enc.WriteWindow(&buf, 1)
+		enc.WriteJSONEvent(&buf, 1, []byte(`"event"`))
+		if _, err := conn.Write(buf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		s.Receive() // never ACKed
+	}
+
+	// concurrent and repeated calls return the same result
+	var wg sync.WaitGroup
+	results := make([]lj.CloseResult, 3)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = s.CloseWithTimeout(50 * time.Millisecond)
+		}(i)
+	}
+	wg.Wait()
+
+	expected := lj.CloseResult{ForcedConns: 2, Dropped: true}
+	for _, res := range results {
+		if res != expected {
+			t.Errorf("expected close result %+v, got %+v", expected, res)
+		}
+	}
+	if res, _ := s.CloseWithTimeout(0); res != expected {
+		t.Errorf("expected close result %+v, got %+v", expected, res)
+	}
+	if b := s.Receive(); b != nil {
+		t.Errorf("unexpected batch after close: %v", b)
+	}
+}
+
+// ackRecorder records the ACKs reported to OnACK.
+type ackRecorder struct {
+	mu   sync.Mutex
+	acks [][2]int
+}
+
+func (r *ackRecorder) onACK(addr net.Addr, seq uint32, events int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if addr == nil {
+		panic("missing client address")
+	}
+	r.acks = append(r.acks, [2]int{int(seq), events})
+}
+
+func (r *ackRecorder) get() [][2]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([][2]int(nil), r.acks...)
+}
+
+func TestOnACKCoalesced(t *testing.T) {
+	var acks ackRecorder
+	s, addr := startServer(t, ACKCoalesce(time.Minute), OnACK(acks.onACK))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var buf bytes.Buffer
+	var enc protocol.Encoder
+	enc.WriteWindow(&buf, 1)
+	enc.WriteJSONEvent(&buf, 1, []byte(`1`))
+	enc.WriteWindow(&buf, 2)
+	enc.WriteJSONEvent(&buf, 1, []byte(`1`))
+	enc.WriteJSONEvent(&buf, 2, []byte(`2`))
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	// ACK is buffered, as the second window is waiting for ACK
+	first := s.Receive()
+	time.Sleep(20 * time.Millisecond)
+	first.ACK()
+	time.Sleep(20 * time.Millisecond)
+	if reported := acks.get(); len(reported) != 0 {
+		t.Fatalf("buffered ACKs reported before written: %v", reported)
+	}
+
+	// both ACKs are merged into a single frame, written and reported once no
+	// more batches are waiting
+	s.Receive().ACK()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var frame [6]byte
+	if _, err := io.ReadFull(conn, frame[:]); err != nil {
+		t.Fatal(err)
+	}
+	if seq := binary.BigEndian.Uint32(frame[2:]); seq != 3 {
+		t.Errorf("expected merged ACK for 3 events, got %v", seq)
+	}
+	waitFor(t, func() bool { return len(acks.get()) == 1 })
+	expected := [][2]int{{3, 3}}
+	if reported := acks.get(); !reflect.DeepEqual(reported, expected) {
+		t.Errorf("expected ACKs %v, got %v", expected, reported)
+	}
+}
+
+func TestOnACKMerged(t *testing.T) {
+	var acks ackRecorder
+	s, addr := startServer(t, ACKEvery(2), OnACK(acks.onACK))
+	go func() {
+		for b := range s.ReceiveChan() {
+			time.Sleep(20 * time.Millisecond) // let the next window queue up for ACK
+			b.ACK()
+		}
+	}()
+
+	c, err := client.AsyncDial(addr, 2, client.Timeout(5*time.Second), client.CumulativeACK(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	for i := 0; i < 2; i++ {
+		err := c.Send(func(seq uint32, err error) {
+			defer wg.Done()
+			if err != nil {
+				t.Error(err)
+			}
+		}, []interface{}{1, 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	expected := [][2]int{{4, 4}}
+	if reported := acks.get(); !reflect.DeepEqual(reported, expected) {
+		t.Errorf("expected merged ACK %v, got %v", expected, reported)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	record := func(name string) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, name)
+	}
+
+	filter := func(b *lj.Batch) (*lj.Batch, error) {
+		record("filter")
+		switch b.Events[0] {
+		case "health":
+			return nil, nil
+		case "bad":
+			return nil, fmt.Errorf("invalid event")
+		}
+		return b, nil
+	}
+	enrich := func(b *lj.Batch) (*lj.Batch, error) {
+		record("enrich")
+		out := lj.NewBatch(append(b.Events, "extra"))
+		out.SetMeta("tenant", "a")
+		return out, nil
+	}
+	s, addr := startServer(t, Middleware(filter), Middleware(enrich))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var buf bytes.Buffer
+	var enc protocol.Encoder
+	enc.WriteWindow(&buf, 1)
+	enc.WriteJSONEvent(&buf, 1, []byte(`"health"`))
+	enc.WriteWindow(&buf, 2)
+	enc.WriteJSONEvent(&buf, 1, []byte(`"ok"`))
+	enc.WriteJSONEvent(&buf, 2, []byte(`"ok"`))
+	enc.WriteWindow(&buf, 1)
+	enc.WriteJSONEvent(&buf, 1, []byte(`"bad"`))
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	b := s.Receive()
+	if !reflect.DeepEqual(b.Events, []interface{}{"ok", "ok", "extra"}) {
+		t.Errorf("unexpected events %v", b.Events)
+	}
+	if tenant, _ := b.Meta("tenant"); tenant != "a" {
+		t.Errorf("expected metadata set by middleware, got %v", tenant)
+	}
+	b.ACK()
+
+	// the dropped window is ACKed, followed by the complete enriched window.
+	// The rejected window is not ACKed.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	acks, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{'2', 'A', 0, 0, 0, 1, '2', 'A', 0, 0, 0, 2}
+	if !bytes.Equal(acks, expected) {
+		t.Errorf("expected ACKs %v, got %v", expected, acks)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if order := []string{"filter", "filter", "enrich", "filter"}; !reflect.DeepEqual(calls, order) {
+		t.Errorf("expected middleware calls %v, got %v", order, calls)
+	}
+}
+
+func TestPossibleDuplicate(t *testing.T) {
+	s, addr := startServer(t)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	send := func(first uint32, compressed bool) *lj.Batch {
+		events := append(jsonFrame(first, `"a"`), jsonFrame(first+1, `"b"`)...)
+		if compressed {
+			events = compressedFrame(events)
+		}
+		if _, err := conn.Write(append(windowFrame(2), events...)); err != nil {
+			t.Fatal(err)
+		}
+
+		b := s.Receive()
+		b.ACK()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		ack := make([]byte, 6)
+		if _, err := io.ReadFull(conn, ack); err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	for i, test := range []struct {
+		first      uint32
+		compressed bool
+		duplicate  bool
+	}{
+		{first: 1},
+		{first: 3},
+		{first: 5, compressed: true},
+		{first: 5, compressed: true, duplicate: true}, // resent
+		{first: 4, duplicate: true},                   // overlapping
+		{first: 7},
+		{first: 1}, // new numbering
+		{first: 3},
+	} {
+		if b := send(test.first, test.compressed); b.PossibleDuplicate != test.duplicate {
+			t.Errorf("window %v (seq %v): expected PossibleDuplicate=%v", i, test.first, test.duplicate)
+		}
+	}
+}
+
+func TestPossibleDuplicateResend(t *testing.T) {
+	// keepalives fail fast once the client closed the connection
+	closed := make(chan struct{}, 1)
+	s, addr := startServer(t, Keepalive(10*time.Millisecond), ConnectionListener(func(evt lj.ConnEvent) {
+		if evt.Kind == lj.ConnClosed {
+			closed <- struct{}{}
+		}
+	}))
+
+	// windows are numbered starting at 1, like lumberjack clients do
+	window := append(windowFrame(2), append(jsonFrame(1, `"a"`), jsonFrame(2, `"b"`)...)...)
+	send := func(conn net.Conn) *lj.Batch {
+		if _, err := conn.Write(window); err != nil {
+			t.Fatal(err)
+		}
+		return s.Receive()
+	}
+
+	// connection is closed before the window has been ACKed
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := send(conn); b.PossibleDuplicate {
+		t.Error("first window flagged as duplicate")
+	}
+	conn.Close()
+	<-closed
+
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i, duplicate := range []bool{true, false} {
+		b := send(conn)
+		if b.PossibleDuplicate != duplicate {
+			t.Errorf("window %v: expected PossibleDuplicate=%v", i, duplicate)
+		}
+		b.ACK()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for ack := make([]byte, 6); binary.BigEndian.Uint32(ack[2:]) == 0; {
+			if _, err := io.ReadFull(conn, ack); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestEventValidator(t *testing.T) {
+	for _, drop := range []bool{false, true} {
+		t.Run(fmt.Sprintf("drop=%v", drop), func(t *testing.T) {
+			closed := make(chan error, 1)
+			listener := func(evt lj.ConnEvent) {
+				if evt.Kind == lj.ConnClosed {
+					closed <- evt.Err
+				}
+			}
+			s, addr := startServer(t, EventValidator(requireMessage), DropInvalidBatches(drop),
+				ConnectionListener(listener))
+
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			var window []byte
+			window = append(window, windowFrame(1)...)
+			window = append(window, jsonFrame(1, `{"message":"ok"}`)...)
+			window = append(window, windowFrame(2)...)
+			window = append(window, jsonFrame(1, `{"message":"ok"}`)...)
+			window = append(window, jsonFrame(2, `{"level":"info"}`)...)
+			window = append(window, windowFrame(1)...)
+			window = append(window, jsonFrame(1, `{"message":"next"}`)...)
+			if _, err := conn.Write(window); err != nil {
+				t.Fatal(err)
+			}
+
+			b := s.Receive()
+			b.ACK()
+			acks := []byte{'2', 'A', 0, 0, 0, 1}
+			if drop {
+				// invalid window is ACKed without being forwarded
+				b = s.Receive()
+				if !reflect.DeepEqual(b.Events, []interface{}{map[string]interface{}{"message": "next"}}) {
+					t.Errorf("expected window following the invalid one, got %v", b.Events)
+				}
+				b.ACK()
+				acks = append(acks, '2', 'A', 0, 0, 0, 2, '2', 'A', 0, 0, 0, 1)
+			}
+
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			got := make([]byte, len(acks))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, acks) {
+				t.Errorf("expected ACKs %v, got %v", acks, got)
+			}
+			if drop {
+				return
+			}
+
+			// the connection is closed on the invalid window
+			if _, err := conn.Read(got); err != io.EOF {
+				t.Errorf("expected connection to be closed, got %v", err)
+			}
+			var ie *InvalidBatchError
+			if err := <-closed; !errors.As(err, &ie) || ie.Index != 1 {
+				t.Errorf("expected event 1 to fail validation, got %v", err)
+			}
+		})
+	}
+}
+
+// sendSequence sends batches numbered 0 to n-1 over a new connection, each
+// batch holding the events [id, i], and waits for all batches to be ACKed.
+func sendSequence(t *testing.T, addr string, id, n int) {
+	c, err := client.AsyncDial(addr, 16, client.Timeout(5*time.Second), client.CompressionLevel(3))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		err := c.Send(func(_ uint32, err error) {
+			defer wg.Done()
+			if err != nil {
+				t.Errorf("connection %v: batch %v not ACKed: %v", id, i, err)
+			}
+		}, []interface{}{id, i})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	wg.Wait()
+}
+
+// sequenceID returns the connection id and batch number of a batch sent by
+// sendSequence.
+func sequenceID(t *testing.T, b *lj.Batch) (int, int) {
+	if len(b.Events) != 2 {
+		t.Fatalf("unexpected batch: %v", b.Events)
+	}
+	return int(b.Events[0].(float64)), int(b.Events[1].(float64))
+}
+
+func TestConnectionOrdering(t *testing.T) {
+	const conns, batches = 8, 100
+
+	s, addr := startServer(t, ParallelDecompression(4, 0), Channel(make(chan *lj.Batch, conns)))
+
+	var wg sync.WaitGroup
+	for c := 0; c < conns; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			sendSequence(t, addr, c, batches)
+		}(c)
+	}
+
+	next := make([]int, conns)
+	for i := 0; i < conns*batches; i++ {
+		b := s.Receive()
+		id, seq := sequenceID(t, b)
+		if seq != next[id] {
+			t.Fatalf("connection %v: expected batch %v, got %v", id, next[id], seq)
+		}
+		next[id]++
+		b.ACK()
+	}
+	wg.Wait()
+}
+
+func TestPerConnectionChannels(t *testing.T) {
+	const conns, batches = 8, 100
+
+	release := make(chan struct{})
+	var mu sync.Mutex
+	stalled := -1
+	var consumers sync.WaitGroup
+	open := func(_ net.Addr, ch <-chan *lj.Batch) {
+		consumers.Add(1)
+		go func() {
+			defer consumers.Done()
+
+			id, next := -1, 0
+			for b := range ch {
+				c, seq := sequenceID(t, b)
+				if id < 0 {
+					id = c
+					mu.Lock()
+					if stalled < 0 {
+						// stall the first connection seen, until all others completed
+						stalled = c
+						mu.Unlock()
+						<-release
+					} else {
+						mu.Unlock()
+					}
+				}
+				if c != id || seq != next {
+					t.Errorf("connection %v: expected batch %v of connection %v, got %v of %v",
+						id, next, id, seq, c)
+				}
+				next++
+				b.ACK()
+			}
+			if next != batches {
+				t.Errorf("connection %v: expected %v batches, got %v", id, batches, next)
+			}
+		}()
+	}
+
+	s, addr := startServer(t, ParallelDecompression(4, 0), PerConnectionChannels(open))
+
+	done := make(chan int, conns)
+	for c := 0; c < conns; c++ {
+		go func(c int) {
+			sendSequence(t, addr, c, batches)
+			done <- c
+		}(c)
+	}
+
+	// all connections besides the stalled one complete
+	for i := 0; i < conns-1; i++ {
+		c := <-done
+		mu.Lock()
+		if c == stalled {
+			t.Errorf("connection %v completed while its consumer was stalled", c)
+		}
+		mu.Unlock()
+	}
+	close(release)
+	<-done
+
+	// per connection channels are closed once the clients disconnect
+	consumers.Wait()
+
+	if st := s.Stats(); st.Batches != conns*batches {
+		t.Errorf("expected %v batches read, got %v", conns*batches, st.Batches)
+	}
+	select {
+	case b := <-s.ReceiveChan():
+		t.Errorf("unexpected batch on server channel: %v", b.Events)
+	default:
+	}
+}